@@ -4,7 +4,7 @@
 //  3. URL structure: /stream/{username}/live.m3u8 for viewing
 //  4. RTMP publish with authorization: rtmp://localhost/live/{app}/{username}
 //  5. Path-based pattern matching for flexible authorization
-//  6. Play connections are blocked (publish-only server)
+//  6. RTMP play of live streams, e.g. by another instance pulling them
 //
 // Build & run:
 //
@@ -15,6 +15,20 @@
 //	rtmp://localhost/live/test/johndoe
 //	rtmp://localhost/live/myapp/alice
 //
+// Or over SRT, with MPEG-TS (e.g. ffmpeg -f mpegts):
+//
+//	srt://localhost:9000?streamid=#!::r=live/test/johndoe,m=publish
+//
+// Or with an HTTP PUT or POST of FLV or MPEG-TS, the stream key as a Bearer
+// token:
+//
+//	http://localhost:8080/ingest/test/johndoe
+//
+// Or pull a remote RTMP stream or HLS playlist, configured in PullStreams or
+// added through the API:
+//
+//	curl -d '{"name":"bob","url":"rtmp://origin/live/test/johndoe/johndoe"}' http://localhost:8080/api/v1/pulls
+//
 // Watch streams at:
 //
 //	http://localhost:8080/stream/{username}/live.m3u8
@@ -23,24 +37,53 @@
 //
 //	/live/{app}/{username} - matches rtmp://anyhost/live/anyapp/anyuser
 //
+// Convert a recorded FLV file to MP4 without FFmpeg:
+//
+//	go run ./cmd/main.go flv2mp4 recording.flv recording.mp4
+//
+// Serve HLS viewers from one or more origins (EdgeOrigins unless given),
+// caching and coalescing their requests, on EdgePort:
+//
+//	go run ./cmd/main.go edge http://origin1:8080 http://origin2:8080
+//
 // -----------------------------------------------------------------------------
 package main
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 
 	"github.com/yutopp/go-rtmp"
 
 	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/edge"
 	httpserver "rtmp-server-poc/internal/http"
+	"rtmp-server-poc/internal/mp4"
+	"rtmp-server-poc/internal/pull"
 	rtmphandler "rtmp-server-poc/internal/rtmp"
+	"rtmp-server-poc/internal/srt"
 	"rtmp-server-poc/internal/stream"
+	"rtmp-server-poc/internal/udp"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "flv2mp4" {
+		if err := convertFLV(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "edge" {
+		if err := runEdge(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Load configuration
 	cfg := config.DefaultConfig()
 
@@ -51,9 +94,20 @@ func main() {
 
 	// Create stream manager
 	streamManager := stream.NewManager()
+	streamManager.StartVODRetention(cfg)
+	streamManager.StartClipRetention(cfg)
+
+	// Start pulling remote streams
+	pulls := pull.NewManager(streamManager, cfg)
+	for name, ps := range cfg.PullStreams {
+		if _, err := pulls.Add(name, ps.URL, ps.OnDemand); err != nil {
+			log.Fatalf("Invalid pull %s: %v", name, err)
+		}
+	}
 
 	// Start HTTP server
 	httpSrv := httpserver.NewServer(cfg, streamManager)
+	httpSrv.SetPullManager(pulls)
 	httpServer := httpSrv.SetupServer()
 	go func() {
 		log.Printf("HTTP server listening on %s", cfg.HTTPPort)
@@ -63,11 +117,41 @@ func main() {
 		}
 	}()
 
+	// Start SRT server
+	if cfg.SRTPort != "" {
+		srtListener, err := srt.Listen(cfg.SRTPort)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("SRT server listening on %s", cfg.SRTPort)
+			if err := srt.NewServer(streamManager, cfg).Serve(srtListener); err != nil {
+				log.Printf("SRT server error: %v", err)
+			}
+		}()
+	}
+
+	// Start UDP ingest
+	udpServer := udp.NewServer(streamManager, cfg)
+	for address, ingest := range cfg.UDPIngests {
+		conn, err := udp.Listen(address)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("UDP ingest listening on %s for stream %s", address, ingest.Username)
+			if err := udpServer.Serve(conn, ingest); err != nil {
+				log.Printf("UDP ingest error on %s: %v", address, err)
+			}
+		}()
+	}
+
 	// Start RTMP server
 	srv := rtmp.NewServer(&rtmp.ServerConfig{
 		OnConnect: func(conn net.Conn) (io.ReadWriteCloser, *rtmp.ConnConfig) {
 			return conn, &rtmp.ConnConfig{
 				Handler: rtmphandler.NewHandler(streamManager, cfg),
+				RPreset: rtmphandler.NewResponsePreset(),
 			}
 		},
 	})
@@ -85,3 +169,37 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// runEdge implements the edge subcommand: edge [origin URL...]
+func runEdge(origins []string) error {
+	cfg := config.DefaultConfig()
+	if len(origins) > 0 {
+		cfg.EdgeOrigins = origins
+	}
+	e, err := edge.New(cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("Edge listening on %s for origins %v", cfg.EdgePort, cfg.EdgeOrigins)
+	log.Printf("Watch streams at: http://localhost%s/stream/{username}/live.m3u8", cfg.EdgePort)
+	return http.ListenAndServe(cfg.EdgePort, e.Handler())
+}
+
+// convertFLV implements the flv2mp4 subcommand: flv2mp4 <input.flv> <output.mp4>
+func convertFLV(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s flv2mp4 <input.flv> <output.mp4>", os.Args[0])
+	}
+	in, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := mp4.ConvertFLV(in, args[1])
+	if err != nil {
+		return fmt.Errorf("converting %s: %w", args[0], err)
+	}
+	log.Printf("Wrote %s (%.1fs, %d bytes, %d keyframes)", info.Path, info.Duration, info.Size, info.Keyframes)
+	return nil
+}
@@ -49,6 +49,21 @@ func (a *Authorizer) ExtractVariables(tcurl string) (map[string]string, bool) {
 	return nil, false
 }
 
+// ExtractVariablesFromPath extracts variables from a path without the
+// leading literal segments of the patterns, e.g. "/test/johndoe" for the
+// pattern "/live/{app}/{username}". Protocols other than RTMP, such as WHIP,
+// use it with their own endpoint prefix in place of the RTMP application.
+func (a *Authorizer) ExtractVariablesFromPath(path string) (map[string]string, bool) {
+	for _, pattern := range a.authorizedPatterns {
+		regexStr, varNames := patternToRegex(trimLiteralPrefix(pattern))
+		vars, ok := extractVariables(regexStr, varNames, path)
+		if ok {
+			return vars, true
+		}
+	}
+	return nil, false
+}
+
 // ValidateAuthentication validates authentication rules based on extracted variables and publishingName
 func (a *Authorizer) ValidateAuthentication(vars map[string]string, publishingName string) error {
 	if publishingName == "" {
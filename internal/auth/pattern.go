@@ -3,6 +3,7 @@ package auth
 import (
 	"net/url"
 	"regexp"
+	"strings"
 )
 
 // patternToRegex converts a pattern with {var} to a regex and returns the regex and the variable names
@@ -40,6 +41,16 @@ func extractVariables(regexStr string, varNames []string, tcurl string) (map[str
 	return result, true
 }
 
+// trimLiteralPrefix removes the leading segments of a pattern that hold no
+// variable, so "/live/{app}/{username}" yields "/{app}/{username}"
+func trimLiteralPrefix(pattern string) string {
+	segments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	for len(segments) > 1 && !strings.Contains(segments[0], "{") {
+		segments = segments[1:]
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
 // extractPathFromTCURL extracts the path component from a TCURL
 func extractPathFromTCURL(tcurl string) string {
 	parsedURL, err := url.Parse(tcurl)
@@ -47,4 +58,27 @@ func extractPathFromTCURL(tcurl string) string {
 		return tcurl
 	}
 	return parsedURL.Path
-} 
\ No newline at end of file
+}
+
+// SplitPublishingName separates a publishing name from its query string, so
+// "johndoe?role=backup" yields "johndoe" and role=backup
+func SplitPublishingName(publishingName string) (string, url.Values) {
+	name, rawQuery, found := strings.Cut(publishingName, "?")
+	if !found {
+		return publishingName, url.Values{}
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return name, url.Values{}
+	}
+	return name, query
+}
+
+// QueryFromTCURL returns the query parameters of a TCURL
+func QueryFromTCURL(tcurl string) url.Values {
+	parsedURL, err := url.Parse(tcurl)
+	if err != nil {
+		return url.Values{}
+	}
+	return parsedURL.Query()
+}
@@ -0,0 +1,172 @@
+package codec
+
+import (
+	"fmt"
+)
+
+// Audio object types (ISO/IEC 14496-3)
+const (
+	AACObjectTypeMain = 1
+	AACObjectTypeLC   = 2
+	AACObjectTypeSSR  = 3
+	AACObjectTypeLTP  = 4
+	AACObjectTypeSBR  = 5  // HE-AAC
+	AACObjectTypePS   = 29 // HE-AAC v2
+)
+
+// aacProfiles names audio object types
+var aacProfiles = map[int]string{
+	AACObjectTypeMain: "Main",
+	AACObjectTypeLC:   "LC",
+	AACObjectTypeSSR:  "SSR",
+	AACObjectTypeLTP:  "LTP",
+	AACObjectTypeSBR:  "HE-AAC",
+	AACObjectTypePS:   "HE-AAC v2",
+}
+
+// aacSampleRates are indexed by samplingFrequencyIndex
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// aacChannelLayouts are indexed by channelConfiguration; 0 means the layout
+// is given by a program config element
+var aacChannelLayouts = []struct {
+	channels int
+	layout   string
+}{
+	{0, ""}, {1, "mono"}, {2, "stereo"}, {3, "3.0"}, {4, "4.0"}, {5, "5.0"}, {6, "5.1"}, {8, "7.1"},
+}
+
+// ParseAudioSpecificConfig parses an AAC AudioSpecificConfig, the payload of
+// an AAC sequence header. For HE-AAC the sample rate and channel count are
+// those of the decoded output.
+func ParseAudioSpecificConfig(data []byte) (*AudioConfig, error) {
+	r := &bitReader{data: data}
+
+	objectType, err := audioObjectType(r)
+	if err != nil {
+		return nil, err
+	}
+	sampleRate, err := samplingFrequency(r)
+	if err != nil {
+		return nil, err
+	}
+	channelConfig, err := r.bits(4)
+	if err != nil {
+		return nil, err
+	}
+	if int(channelConfig) >= len(aacChannelLayouts) {
+		return nil, fmt.Errorf("codec: invalid AAC channel configuration %d", channelConfig)
+	}
+	layout := aacChannelLayouts[channelConfig]
+
+	// Explicit SBR/PS signalling carries the output sample rate, then the
+	// underlying object type
+	if objectType == AACObjectTypeSBR || objectType == AACObjectTypePS {
+		if sampleRate, err = samplingFrequency(r); err != nil {
+			return nil, err
+		}
+		if objectType == AACObjectTypePS && channelConfig == 1 {
+			layout = aacChannelLayouts[2] // parametric stereo decodes to stereo
+		}
+	}
+
+	return &AudioConfig{
+		Codec:         "aac",
+		Profile:       aacProfiles[objectType],
+		ObjectType:    objectType,
+		SampleRate:    sampleRate,
+		Channels:      layout.channels,
+		ChannelLayout: layout.layout,
+		Codecs:        fmt.Sprintf("mp4a.40.%d", objectType),
+	}, nil
+}
+
+// audioObjectType reads a GetAudioObjectType() field
+func audioObjectType(r *bitReader) (int, error) {
+	objectType, err := r.bits(5)
+	if err != nil {
+		return 0, err
+	}
+	if objectType == 31 {
+		ext, err := r.bits(6)
+		if err != nil {
+			return 0, err
+		}
+		objectType = 32 + ext
+	}
+	return int(objectType), nil
+}
+
+// samplingFrequency reads a samplingFrequencyIndex, with its explicit
+// 24-bit frequency if escaped
+func samplingFrequency(r *bitReader) (int, error) {
+	index, err := r.bits(4)
+	if err != nil {
+		return 0, err
+	}
+	if index == 15 {
+		frequency, err := r.bits(24)
+		if err != nil {
+			return 0, err
+		}
+		if frequency == 0 {
+			return 0, fmt.Errorf("codec: invalid AAC sampling frequency of 0 Hz")
+		}
+		return int(frequency), nil
+	}
+	if int(index) >= len(aacSampleRates) {
+		return 0, fmt.Errorf("codec: invalid AAC sampling frequency index %d", index)
+	}
+	return aacSampleRates[index], nil
+}
+
+// ADTSHeader is the header of an AAC frame in an ADTS stream, as MPEG-TS
+// carries AAC
+type ADTSHeader struct {
+	ObjectType      int
+	SampleRateIndex int
+	ChannelConfig   int
+	HeaderSize      int // 7, or 9 with a CRC
+	FrameSize       int // including the header
+}
+
+// ParseADTSHeader parses the ADTS header at the start of data
+func ParseADTSHeader(data []byte) (*ADTSHeader, error) {
+	if len(data) < 7 {
+		return nil, fmt.Errorf("codec: ADTS header too short: %d bytes", len(data))
+	}
+	if data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+		return nil, fmt.Errorf("codec: invalid ADTS sync word")
+	}
+	h := &ADTSHeader{
+		ObjectType:      int(data[2]>>6) + 1,
+		SampleRateIndex: int(data[2] >> 2 & 0x0f),
+		ChannelConfig:   int(data[2]&0x01)<<2 | int(data[3]>>6),
+		HeaderSize:      7,
+		FrameSize:       int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5),
+	}
+	if data[1]&0x01 == 0 { // protection_absent unset
+		h.HeaderSize = 9
+	}
+	if h.SampleRateIndex >= len(aacSampleRates) {
+		return nil, fmt.Errorf("codec: invalid AAC sampling frequency index %d", h.SampleRateIndex)
+	}
+	if h.FrameSize < h.HeaderSize {
+		return nil, fmt.Errorf("codec: invalid ADTS frame size %d", h.FrameSize)
+	}
+	return h, nil
+}
+
+// SampleRate returns the sample rate of the frame
+func (h *ADTSHeader) SampleRate() int {
+	return aacSampleRates[h.SampleRateIndex]
+}
+
+// AudioSpecificConfig returns the AudioSpecificConfig of the stream, the
+// payload of its AAC sequence header
+func (h *ADTSHeader) AudioSpecificConfig() []byte {
+	return []byte{
+		byte(h.ObjectType<<3 | h.SampleRateIndex>>1),
+		byte(h.SampleRateIndex&0x01<<7 | h.ChannelConfig<<3),
+	}
+}
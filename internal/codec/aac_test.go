@@ -0,0 +1,127 @@
+package codec
+
+import (
+	"testing"
+)
+
+func TestParseAudioSpecificConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		expected    AudioConfig
+		expectError bool
+	}{
+		{
+			name:     "LC 44.1 kHz stereo",
+			data:     []byte{0x12, 0x10},
+			expected: AudioConfig{Codec: "aac", Profile: "LC", ObjectType: 2, SampleRate: 44100, Channels: 2, ChannelLayout: "stereo", Codecs: "mp4a.40.2"},
+		},
+		{
+			name:     "LC 48 kHz 5.1",
+			data:     []byte{0x11, 0xb0},
+			expected: AudioConfig{Codec: "aac", Profile: "LC", ObjectType: 2, SampleRate: 48000, Channels: 6, ChannelLayout: "5.1", Codecs: "mp4a.40.2"},
+		},
+		{
+			name:     "Explicit HE-AAC",
+			data:     []byte{0x2b, 0x11, 0x88},
+			expected: AudioConfig{Codec: "aac", Profile: "HE-AAC", ObjectType: 5, SampleRate: 48000, Channels: 2, ChannelLayout: "stereo", Codecs: "mp4a.40.5"},
+		},
+		{
+			name:     "Explicit HE-AAC v2",
+			data:     []byte{0xeb, 0x8a, 0x08},
+			expected: AudioConfig{Codec: "aac", Profile: "HE-AAC v2", ObjectType: 29, SampleRate: 44100, Channels: 2, ChannelLayout: "stereo", Codecs: "mp4a.40.29"},
+		},
+		{
+			name:     "Explicit sampling frequency",
+			data:     []byte{0x17, 0x80, 0x3e, 0x80, 0x08},
+			expected: AudioConfig{Codec: "aac", Profile: "LC", ObjectType: 2, SampleRate: 32000, Channels: 1, ChannelLayout: "mono", Codecs: "mp4a.40.2"},
+		},
+		{
+			name:        "Truncated",
+			data:        []byte{0x12},
+			expectError: true,
+		},
+		{
+			name:        "Explicit sampling frequency of 0",
+			data:        []byte{0x17, 0x80, 0x00, 0x00, 0x08},
+			expectError: true,
+		},
+		{
+			name:        "Reserved sampling frequency index",
+			data:        []byte{0x16, 0x90},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ParseAudioSpecificConfig(tt.data)
+			if tt.expectError {
+				if err == nil {
+					t.Fatalf("ParseAudioSpecificConfig() = %+v, expected an error", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseAudioSpecificConfig() error = %v", err)
+			}
+			if *cfg != tt.expected {
+				t.Errorf("ParseAudioSpecificConfig() = %+v, expected %+v", *cfg, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseADTSHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		expected    ADTSHeader
+		config      []byte
+		expectError bool
+	}{
+		{
+			name:     "LC 44.1 kHz stereo",
+			data:     []byte{0xff, 0xf1, 0x50, 0x80, 0x2e, 0x7f, 0xfc},
+			expected: ADTSHeader{ObjectType: 2, SampleRateIndex: 4, ChannelConfig: 2, HeaderSize: 7, FrameSize: 371},
+			config:   []byte{0x12, 0x10},
+		},
+		{
+			name:     "LC 48 kHz 5.1 with CRC",
+			data:     []byte{0xff, 0xf0, 0x4d, 0x80, 0x02, 0x00, 0x00, 0x00, 0x00},
+			expected: ADTSHeader{ObjectType: 2, SampleRateIndex: 3, ChannelConfig: 6, HeaderSize: 9, FrameSize: 16},
+			config:   []byte{0x11, 0xb0},
+		},
+		{
+			name:        "No sync word",
+			data:        []byte{0x00, 0xf1, 0x50, 0x80, 0x2e, 0x7f, 0xfc},
+			expectError: true,
+		},
+		{
+			name:        "Truncated",
+			data:        []byte{0xff, 0xf1, 0x50},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := ParseADTSHeader(tt.data)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("ParseADTSHeader() expected error, got %+v", header)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseADTSHeader() error = %v", err)
+			}
+			if *header != tt.expected {
+				t.Errorf("ParseADTSHeader() = %+v, expected %+v", *header, tt.expected)
+			}
+			if config := header.AudioSpecificConfig(); string(config) != string(tt.config) {
+				t.Errorf("AudioSpecificConfig() = %x, expected %x", config, tt.config)
+			}
+		})
+	}
+}
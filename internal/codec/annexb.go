@@ -0,0 +1,36 @@
+package codec
+
+import "bytes"
+
+// SplitAnnexB returns the NAL units of an Annex B byte stream, where each
+// is preceded by a 3 or 4 byte start code. Data before the first start code
+// is ignored.
+func SplitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			i++
+			continue
+		}
+		if start >= 0 {
+			nalus = appendNALU(nalus, data[start:i])
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 {
+		nalus = appendNALU(nalus, data[start:])
+	}
+	return nalus
+}
+
+// appendNALU appends a NAL unit without the zero bytes that follow it,
+// which belong to the next start code or are padding: a NAL unit never ends
+// with a zero byte
+func appendNALU(nalus [][]byte, nalu []byte) [][]byte {
+	if nalu = bytes.TrimRight(nalu, "\x00"); len(nalu) > 0 {
+		nalus = append(nalus, nalu)
+	}
+	return nalus
+}
@@ -0,0 +1,42 @@
+package codec
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitAnnexB(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected [][]byte
+	}{
+		{
+			name:     "4 byte start codes",
+			data:     []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x68, 0xce},
+			expected: [][]byte{{0x67, 0x42}, {0x68, 0xce}},
+		},
+		{
+			name:     "3 byte start codes and trailing zeros",
+			data:     []byte{0, 0, 1, 0x09, 0xf0, 0, 0, 1, 0x65, 0x88, 0x00, 0x00},
+			expected: [][]byte{{0x09, 0xf0}, {0x65, 0x88}},
+		},
+		{
+			name:     "Escaped zeros inside a NAL unit",
+			data:     []byte{0, 0, 0, 1, 0x65, 0x00, 0x00, 0x03, 0x01},
+			expected: [][]byte{{0x65, 0x00, 0x00, 0x03, 0x01}},
+		},
+		{
+			name: "No start code",
+			data: []byte{0x65, 0x88},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SplitAnnexB(tt.data); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("SplitAnnexB() = %x, expected %x", got, tt.expected)
+			}
+		})
+	}
+}
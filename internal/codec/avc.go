@@ -0,0 +1,321 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// avcProfiles names H.264 profile_idc values
+var avcProfiles = map[uint8]string{
+	66:  "Baseline",
+	77:  "Main",
+	88:  "Extended",
+	100: "High",
+	110: "High 10",
+	122: "High 4:2:2",
+	244: "High 4:4:4 Predictive",
+	44:  "CAVLC 4:4:4 Intra",
+}
+
+// avcHighProfiles carry chroma format and bit depth in their SPS
+var avcHighProfiles = map[uint32]bool{
+	100: true, 110: true, 122: true, 244: true, 44: true, 83: true,
+	86: true, 118: true, 128: true, 138: true, 139: true, 134: true, 135: true,
+}
+
+// ParseAVCDecoderConfigurationRecord parses an AVCDecoderConfigurationRecord
+// (ISO/IEC 14496-15), the payload of an AVC sequence header, and the first
+// SPS it carries
+func ParseAVCDecoderConfigurationRecord(data []byte) (*VideoConfig, error) {
+	if len(data) < 6 {
+		return nil, ErrShortConfig
+	}
+	if data[0] != 1 {
+		return nil, fmt.Errorf("codec: unsupported AVC configuration version %d", data[0])
+	}
+	if data[5]&0x1f == 0 {
+		return nil, errors.New("codec: AVC configuration has no SPS")
+	}
+	if len(data) < 8 {
+		return nil, ErrShortConfig
+	}
+	size := int(binary.BigEndian.Uint16(data[6:]))
+	if len(data) < 8+size {
+		return nil, ErrShortConfig
+	}
+
+	return ParseAVCSPS(data[8 : 8+size])
+}
+
+// AVCParameterSets are the NAL units an AVCDecoderConfigurationRecord
+// carries, which H.264 frames in FLV and MP4 leave out, and the size of the
+// length prefixing each NAL unit of those frames
+type AVCParameterSets struct {
+	SPS        [][]byte
+	PPS        [][]byte
+	LengthSize int
+}
+
+// ParseAVCParameterSets extracts the SPS and PPS NAL units of an
+// AVCDecoderConfigurationRecord
+func ParseAVCParameterSets(data []byte) (*AVCParameterSets, error) {
+	if len(data) < 6 {
+		return nil, ErrShortConfig
+	}
+	if data[0] != 1 {
+		return nil, fmt.Errorf("codec: unsupported AVC configuration version %d", data[0])
+	}
+	sets := &AVCParameterSets{LengthSize: int(data[4]&0x03) + 1}
+
+	// The SPS count shares its byte with reserved bits, the PPS count does not
+	offset := 5
+	for _, list := range []*[][]byte{&sets.SPS, &sets.PPS} {
+		if offset >= len(data) {
+			return nil, ErrShortConfig
+		}
+		count := int(data[offset])
+		if list == &sets.SPS {
+			count &= 0x1f
+		}
+		offset++
+		for range count {
+			if offset+2 > len(data) {
+				return nil, ErrShortConfig
+			}
+			size := int(binary.BigEndian.Uint16(data[offset:]))
+			offset += 2
+			if offset+size > len(data) {
+				return nil, ErrShortConfig
+			}
+			*list = append(*list, data[offset:offset+size])
+			offset += size
+		}
+	}
+	if len(sets.SPS) == 0 {
+		return nil, errors.New("codec: AVC configuration has no SPS")
+	}
+	if len(sets.SPS[0]) < 4 {
+		return nil, ErrShortConfig
+	}
+	return sets, nil
+}
+
+// Record encodes the parameter sets as an AVCDecoderConfigurationRecord,
+// the payload of an AVC sequence header, with the profile and level of the
+// first SPS. It fails when there is no SPS or the first is too short to
+// hold them.
+func (p *AVCParameterSets) Record() ([]byte, error) {
+	if len(p.SPS) == 0 || len(p.SPS[0]) < 4 {
+		return nil, ErrShortConfig
+	}
+	sps := p.SPS[0]
+	record := []byte{0x01, sps[1], sps[2], sps[3], 0xfc | byte(p.LengthSize-1), 0xe0 | byte(len(p.SPS))}
+	for _, nalu := range p.SPS {
+		record = binary.BigEndian.AppendUint16(record, uint16(len(nalu)))
+		record = append(record, nalu...)
+	}
+	record = append(record, byte(len(p.PPS)))
+	for _, nalu := range p.PPS {
+		record = binary.BigEndian.AppendUint16(record, uint16(len(nalu)))
+		record = append(record, nalu...)
+	}
+	return record, nil
+}
+
+// ParseAVCSPS parses an H.264 sequence parameter set NAL unit
+func ParseAVCSPS(nal []byte) (*VideoConfig, error) {
+	if len(nal) < 4 {
+		return nil, ErrShortConfig
+	}
+	if nal[0]&0x1f != 7 {
+		return nil, fmt.Errorf("codec: NAL unit type %d is not an SPS", nal[0]&0x1f)
+	}
+	r := &bitReader{data: unescapeRBSP(nal[1:])}
+	profileIDC, _ := r.bits(8)
+	constraints, _ := r.bits(8)
+	levelIDC, _ := r.bits(8)
+
+	cfg := &VideoConfig{
+		Codec:    "avc",
+		Profile:  avcProfiles[uint8(profileIDC)],
+		Level:    fmt.Sprintf("%d.%d", levelIDC/10, levelIDC%10),
+		BitDepth: 8,
+		Codecs:   fmt.Sprintf("avc1.%02x%02x%02x", profileIDC, constraints, levelIDC),
+	}
+	if profileIDC == 66 && constraints&0x40 != 0 {
+		cfg.Profile = "Constrained Baseline"
+	}
+
+	if err := parseAVCSPS(r, profileIDC, cfg); err != nil {
+		return nil, fmt.Errorf("codec: parsing SPS: %w", err)
+	}
+	return cfg, nil
+}
+
+// parseAVCSPS reads the SPS fields following the level, filling in the
+// chroma format, bit depth and cropped frame size
+func parseAVCSPS(r *bitReader, profileIDC uint32, cfg *VideoConfig) error {
+	if _, err := r.ue(); err != nil { // seq_parameter_set_id
+		return err
+	}
+
+	chromaFormatIDC := uint32(1)
+	separateColourPlane := false
+	if avcHighProfiles[profileIDC] {
+		var err error
+		if chromaFormatIDC, err = r.ue(); err != nil {
+			return err
+		}
+		if chromaFormatIDC == 3 {
+			flag, err := r.bit()
+			if err != nil {
+				return err
+			}
+			separateColourPlane = flag == 1
+		}
+		bitDepthLuma, err := r.ue()
+		if err != nil {
+			return err
+		}
+		cfg.BitDepth = int(bitDepthLuma) + 8
+		if _, err := r.ue(); err != nil { // bit_depth_chroma_minus8
+			return err
+		}
+		if err := r.skip(1); err != nil { // qpprime_y_zero_transform_bypass_flag
+			return err
+		}
+		scalingMatrix, err := r.bit()
+		if err != nil {
+			return err
+		}
+		if scalingMatrix == 1 {
+			lists := 8
+			if chromaFormatIDC == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, err := r.bit()
+				if err != nil {
+					return err
+				}
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				if err := skipScalingList(r, size); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	cfg.ChromaFormat = chromaFormat(chromaFormatIDC)
+
+	if _, err := r.ue(); err != nil { // log2_max_frame_num_minus4
+		return err
+	}
+	pocType, err := r.ue()
+	if err != nil {
+		return err
+	}
+	switch pocType {
+	case 0:
+		if _, err := r.ue(); err != nil { // log2_max_pic_order_cnt_lsb_minus4
+			return err
+		}
+	case 1:
+		if err := r.skip(1); err != nil { // delta_pic_order_always_zero_flag
+			return err
+		}
+		if _, err := r.se(); err != nil { // offset_for_non_ref_pic
+			return err
+		}
+		if _, err := r.se(); err != nil { // offset_for_top_to_bottom_field
+			return err
+		}
+		cycle, err := r.ue()
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i < cycle; i++ {
+			if _, err := r.se(); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := r.ue(); err != nil { // max_num_ref_frames
+		return err
+	}
+	if err := r.skip(1); err != nil { // gaps_in_frame_num_value_allowed_flag
+		return err
+	}
+	widthInMbs, err := r.ue()
+	if err != nil {
+		return err
+	}
+	heightInMapUnits, err := r.ue()
+	if err != nil {
+		return err
+	}
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return err
+	}
+	if frameMbsOnly == 0 {
+		if err := r.skip(1); err != nil { // mb_adaptive_frame_field_flag
+			return err
+		}
+	}
+	if err := r.skip(1); err != nil { // direct_8x8_inference_flag
+		return err
+	}
+
+	width := int(widthInMbs+1) * 16
+	height := int(2-frameMbsOnly) * int(heightInMapUnits+1) * 16
+
+	cropping, err := r.bit()
+	if err != nil {
+		return err
+	}
+	if cropping == 1 {
+		var crop [4]uint32 // left, right, top, bottom
+		for i := range crop {
+			if crop[i], err = r.ue(); err != nil {
+				return err
+			}
+		}
+		unitX, unitY := 1, 1
+		if !separateColourPlane {
+			unitX, unitY = cropUnits(chromaFormatIDC)
+		}
+		unitY *= int(2 - frameMbsOnly)
+		width -= unitX * int(crop[0]+crop[1])
+		height -= unitY * int(crop[2]+crop[3])
+	}
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("invalid frame size %dx%d", width, height)
+	}
+	cfg.Width, cfg.Height = width, height
+	return nil
+}
+
+// skipScalingList skips a scaling_list() of the given size
+func skipScalingList(r *bitReader, size int) error {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// x264 1080p High profile SPS, coded as 1920x1088 and cropped to 1080
+var avc1080pSPS = []byte{
+	0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00,
+	0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58,
+}
+
+// avcRecord wraps an SPS in an AVCDecoderConfigurationRecord without PPS
+func avcRecord(sps []byte) []byte {
+	record := []byte{0x01, sps[1], sps[2], sps[3], 0xff, 0xe1, byte(len(sps) >> 8), byte(len(sps))}
+	return append(append(record, sps...), 0x00)
+}
+
+func TestParseAVCDecoderConfigurationRecord(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		expected    VideoConfig
+		expectError bool
+	}{
+		{
+			name: "1080p High",
+			data: avcRecord(avc1080pSPS),
+			expected: VideoConfig{
+				Codec: "avc", Width: 1920, Height: 1080, Profile: "High", Level: "4.0",
+				ChromaFormat: "4:2:0", BitDepth: 8, Codecs: "avc1.640028",
+			},
+		},
+		{
+			name:        "Truncated SPS",
+			data:        avcRecord(avc1080pSPS)[:20],
+			expectError: true,
+		},
+		{
+			name:        "SPS ending before the frame size",
+			data:        avcRecord(avc1080pSPS[:8]),
+			expectError: true,
+		},
+		{
+			name:        "No SPS",
+			data:        []byte{0x01, 0x64, 0x00, 0x28, 0xff, 0xe0, 0x00},
+			expectError: true,
+		},
+		{
+			name:        "Not an SPS",
+			data:        avcRecord([]byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}),
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ParseAVCDecoderConfigurationRecord(tt.data)
+			if tt.expectError {
+				if err == nil {
+					t.Fatalf("ParseAVCDecoderConfigurationRecord() = %+v, expected an error", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseAVCDecoderConfigurationRecord() error = %v", err)
+			}
+			if *cfg != tt.expected {
+				t.Errorf("ParseAVCDecoderConfigurationRecord() = %+v, expected %+v", *cfg, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseAVCParameterSets(t *testing.T) {
+	pps := []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	withPPS := append(avcRecord(avc1080pSPS)[:len(avcRecord(avc1080pSPS))-1], 0x01, 0x00, byte(len(pps)))
+	withPPS = append(withPPS, pps...)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		expected    AVCParameterSets
+		expectError bool
+	}{
+		{
+			name:     "SPS and PPS",
+			data:     withPPS,
+			expected: AVCParameterSets{SPS: [][]byte{avc1080pSPS}, PPS: [][]byte{pps}, LengthSize: 4},
+		},
+		{
+			name:     "No PPS",
+			data:     avcRecord(avc1080pSPS),
+			expected: AVCParameterSets{SPS: [][]byte{avc1080pSPS}, LengthSize: 4},
+		},
+		{
+			name:        "Truncated PPS",
+			data:        withPPS[:len(withPPS)-1],
+			expectError: true,
+		},
+		{
+			name:        "No SPS",
+			data:        []byte{0x01, 0x64, 0x00, 0x28, 0xff, 0xe0, 0x00},
+			expectError: true,
+		},
+		{
+			name:        "Short SPS",
+			data:        []byte{0x01, 0x64, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x01, 0x67, 0x00},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sets, err := ParseAVCParameterSets(tt.data)
+			if tt.expectError {
+				if err == nil {
+					t.Fatalf("ParseAVCParameterSets() = %+v, expected an error", sets)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseAVCParameterSets() error = %v", err)
+			}
+			if !reflect.DeepEqual(*sets, tt.expected) {
+				t.Errorf("ParseAVCParameterSets() = %x, expected %x", *sets, tt.expected)
+			}
+			if record, err := sets.Record(); err != nil || !bytes.Equal(record, tt.data) {
+				t.Errorf("Record() = %x, %v, expected %x", record, err, tt.data)
+			}
+		})
+	}
+
+	short := AVCParameterSets{SPS: [][]byte{{0x67}}, PPS: [][]byte{pps}, LengthSize: 4}
+	if record, err := short.Record(); err == nil {
+		t.Errorf("Record() of a 1 byte SPS = %x, expected an error", record)
+	}
+}
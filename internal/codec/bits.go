@@ -0,0 +1,122 @@
+package codec
+
+import (
+	"errors"
+)
+
+// ErrShortConfig is returned when a decoder configuration ends early
+var ErrShortConfig = errors.New("codec: decoder configuration too short")
+
+// bitReader reads big-endian bit fields, including the Exp-Golomb codes
+// used by H.264 and HEVC parameter sets
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (r *bitReader) bit() (uint32, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, ErrShortConfig
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint32(b), nil
+}
+
+func (r *bitReader) bits(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (r *bitReader) skip(n int) error {
+	if r.pos+n > len(r.data)*8 {
+		return ErrShortConfig
+	}
+	r.pos += n
+	return nil
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("codec: invalid Exp-Golomb code")
+		}
+	}
+	v, err := r.bits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return 1<<zeros - 1 + v, nil
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 1 {
+		return int32(v/2 + 1), nil
+	}
+	return -int32(v / 2), nil
+}
+
+// unescapeRBSP strips the emulation prevention bytes (00 00 03) from a NAL
+// unit payload
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// chromaFormats names chroma_format_idc values
+var chromaFormats = []string{"4:0:0", "4:2:0", "4:2:2", "4:4:4"}
+
+// chromaFormat names a chroma_format_idc
+func chromaFormat(idc uint32) string {
+	if int(idc) < len(chromaFormats) {
+		return chromaFormats[idc]
+	}
+	return ""
+}
+
+// cropUnits returns the horizontal and vertical size of one cropping unit
+// for a chroma format, before field coding is accounted for
+func cropUnits(chromaFormatIDC uint32) (int, int) {
+	switch chromaFormatIDC {
+	case 1:
+		return 2, 2
+	case 2:
+		return 2, 1
+	}
+	return 1, 1
+}
@@ -0,0 +1,71 @@
+// Package codec inspects decoder configurations (the payload of sequence
+// header tags) to find the actual parameters of a stream, which encoders do
+// not always declare correctly in onMetaData.
+package codec
+
+import (
+	"errors"
+	"fmt"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// VideoConfig describes a video track as coded
+type VideoConfig struct {
+	Codec        string `json:"codec"` // "avc" or "hevc"
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Profile      string `json:"profile,omitempty"` // e.g. "High", "Main 10"
+	Level        string `json:"level,omitempty"`   // e.g. "4.1"
+	Tier         string `json:"tier,omitempty"`    // HEVC only, "Main" or "High"
+	ChromaFormat string `json:"chroma_format,omitempty"`
+	BitDepth     int    `json:"bit_depth,omitempty"`
+	// Codecs is the RFC 6381 codecs parameter, e.g. "avc1.64001f"
+	Codecs string `json:"codecs"`
+}
+
+// AudioConfig describes an audio track as coded
+type AudioConfig struct {
+	Codec         string `json:"codec"`             // "aac"
+	Profile       string `json:"profile,omitempty"` // e.g. "LC", "HE-AAC"
+	ObjectType    int    `json:"object_type,omitempty"`
+	SampleRate    int    `json:"sample_rate"`
+	Channels      int    `json:"channels"`
+	ChannelLayout string `json:"channel_layout,omitempty"` // e.g. "stereo", "5.1"
+	// Codecs is the RFC 6381 codecs parameter, e.g. "mp4a.40.2"
+	Codecs string `json:"codecs"`
+}
+
+// ErrUnsupportedCodec is returned for sequence headers of codecs whose
+// decoder configuration is not inspected
+var ErrUnsupportedCodec = errors.New("codec: decoder configuration not supported")
+
+// ParseVideoSequenceHeader parses the decoder configuration carried by a
+// video sequence header tag
+func ParseVideoSequenceHeader(tag flv.Tag) (*VideoConfig, error) {
+	if tag.Video == nil || !tag.Video.IsSequenceHeader() {
+		return nil, errors.New("codec: not a video sequence header")
+	}
+	payload := tag.Data[tag.Video.PayloadOffset:]
+	switch tag.Video.Codec() {
+	case "avc":
+		return ParseAVCDecoderConfigurationRecord(payload)
+	case "hevc":
+		return ParseHEVCDecoderConfigurationRecord(payload)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedCodec, tag.Video.Codec())
+}
+
+// ParseAudioSequenceHeader parses the decoder configuration carried by an
+// audio sequence header tag
+func ParseAudioSequenceHeader(tag flv.Tag) (*AudioConfig, error) {
+	if tag.Audio == nil || !tag.Audio.IsSequenceHeader() {
+		return nil, errors.New("codec: not an audio sequence header")
+	}
+	payload := tag.Data[tag.Audio.PayloadOffset:]
+	switch tag.Audio.Codec() {
+	case "aac":
+		return ParseAudioSpecificConfig(payload)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedCodec, tag.Audio.Codec())
+}
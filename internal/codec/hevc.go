@@ -0,0 +1,228 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// hevcNALUnitSPS is the NAL unit type of an HEVC sequence parameter set
+const hevcNALUnitSPS = 33
+
+// hevcProfiles names HEVC general_profile_idc values
+var hevcProfiles = map[uint8]string{
+	1: "Main",
+	2: "Main 10",
+	3: "Main Still Picture",
+	4: "Range Extensions",
+	9: "Screen Content Coding",
+}
+
+// ParseHEVCDecoderConfigurationRecord parses an HEVCDecoderConfigurationRecord
+// (ISO/IEC 14496-15), the payload of an HEVC sequence header. Profile, tier
+// and level come from the record; the frame size, chroma format and bit
+// depth from its first SPS.
+func ParseHEVCDecoderConfigurationRecord(data []byte) (*VideoConfig, error) {
+	if len(data) < 23 {
+		return nil, ErrShortConfig
+	}
+	if data[0] != 1 {
+		return nil, fmt.Errorf("codec: unsupported HEVC configuration version %d", data[0])
+	}
+
+	profileSpace := data[1] >> 6
+	tierFlag := data[1] >> 5 & 1
+	profileIDC := data[1] & 0x1f
+	compatibility := binary.BigEndian.Uint32(data[2:6])
+	constraints := data[6:12]
+	levelIDC := data[12]
+
+	cfg := &VideoConfig{
+		Codec:   "hevc",
+		Profile: hevcProfiles[profileIDC],
+		Level:   fmt.Sprintf("%d.%d", levelIDC/30, levelIDC%30/3),
+		Tier:    "Main",
+		Codecs:  hevcCodecs(profileSpace, tierFlag, profileIDC, compatibility, constraints, levelIDC),
+	}
+	if tierFlag == 1 {
+		cfg.Tier = "High"
+	}
+
+	sps, err := findHEVCSPS(data[22:])
+	if err != nil {
+		return nil, err
+	}
+	if err := parseHEVCSPS(sps, cfg); err != nil {
+		return nil, fmt.Errorf("codec: parsing SPS: %w", err)
+	}
+	return cfg, nil
+}
+
+// hevcCodecs builds the RFC 6381 codecs parameter for HEVC as specified by
+// ISO/IEC 14496-15 Annex E, e.g. "hvc1.1.6.L93.B0"
+func hevcCodecs(profileSpace, tierFlag, profileIDC uint8, compatibility uint32, constraints []byte, levelIDC uint8) string {
+	var b strings.Builder
+	b.WriteString("hvc1.")
+	if profileSpace > 0 {
+		b.WriteByte("ABC"[profileSpace-1])
+	}
+	fmt.Fprintf(&b, "%d.%x.", profileIDC, bits.Reverse32(compatibility))
+	if tierFlag == 1 {
+		b.WriteByte('H')
+	} else {
+		b.WriteByte('L')
+	}
+	fmt.Fprintf(&b, "%d", levelIDC)
+
+	// Trailing zero constraint bytes are omitted
+	last := len(constraints)
+	for last > 0 && constraints[last-1] == 0 {
+		last--
+	}
+	for _, c := range constraints[:last] {
+		fmt.Fprintf(&b, ".%X", c)
+	}
+	return b.String()
+}
+
+// findHEVCSPS returns the first SPS NAL unit in the record's arrays
+func findHEVCSPS(data []byte) ([]byte, error) {
+	numArrays := int(data[0])
+	data = data[1:]
+	for i := 0; i < numArrays; i++ {
+		if len(data) < 3 {
+			return nil, ErrShortConfig
+		}
+		nalType := data[0] & 0x3f
+		numNalus := int(binary.BigEndian.Uint16(data[1:3]))
+		data = data[3:]
+		for j := 0; j < numNalus; j++ {
+			if len(data) < 2 {
+				return nil, ErrShortConfig
+			}
+			size := int(binary.BigEndian.Uint16(data))
+			if len(data) < 2+size {
+				return nil, ErrShortConfig
+			}
+			if nalType == hevcNALUnitSPS {
+				return data[2 : 2+size], nil
+			}
+			data = data[2+size:]
+		}
+	}
+	return nil, errors.New("codec: HEVC configuration has no SPS")
+}
+
+// parseHEVCSPS reads the frame size, chroma format and bit depth from an
+// HEVC SPS NAL unit
+func parseHEVCSPS(nal []byte, cfg *VideoConfig) error {
+	if len(nal) < 3 {
+		return ErrShortConfig
+	}
+	r := &bitReader{data: unescapeRBSP(nal[2:])} // after the 2-byte NAL header
+
+	if err := r.skip(4); err != nil { // sps_video_parameter_set_id
+		return err
+	}
+	maxSubLayersMinus1, err := r.bits(3)
+	if err != nil {
+		return err
+	}
+	if err := r.skip(1); err != nil { // sps_temporal_id_nesting_flag
+		return err
+	}
+	if err := skipProfileTierLevel(r, int(maxSubLayersMinus1)); err != nil {
+		return err
+	}
+	if _, err := r.ue(); err != nil { // sps_seq_parameter_set_id
+		return err
+	}
+	chromaFormatIDC, err := r.ue()
+	if err != nil {
+		return err
+	}
+	separateColourPlane := uint32(0)
+	if chromaFormatIDC == 3 {
+		if separateColourPlane, err = r.bit(); err != nil {
+			return err
+		}
+	}
+	width, err := r.ue()
+	if err != nil {
+		return err
+	}
+	height, err := r.ue()
+	if err != nil {
+		return err
+	}
+	conformanceWindow, err := r.bit()
+	if err != nil {
+		return err
+	}
+	w, h := int(width), int(height)
+	if conformanceWindow == 1 {
+		var window [4]uint32 // left, right, top, bottom
+		for i := range window {
+			if window[i], err = r.ue(); err != nil {
+				return err
+			}
+		}
+		unitX, unitY := 1, 1
+		if separateColourPlane == 0 {
+			unitX, unitY = cropUnits(chromaFormatIDC)
+		}
+		w -= unitX * int(window[0]+window[1])
+		h -= unitY * int(window[2]+window[3])
+	}
+	bitDepthLuma, err := r.ue()
+	if err != nil {
+		return err
+	}
+	if w <= 0 || h <= 0 {
+		return fmt.Errorf("invalid frame size %dx%d", w, h)
+	}
+
+	cfg.Width, cfg.Height = w, h
+	cfg.ChromaFormat = chromaFormat(chromaFormatIDC)
+	cfg.BitDepth = int(bitDepthLuma) + 8
+	return nil
+}
+
+// skipProfileTierLevel skips a profile_tier_level() with profilePresentFlag set
+func skipProfileTierLevel(r *bitReader, maxSubLayersMinus1 int) error {
+	// general profile (88 bits) and general_level_idc (8 bits)
+	if err := r.skip(96); err != nil {
+		return err
+	}
+	profilePresent := make([]uint32, maxSubLayersMinus1)
+	levelPresent := make([]uint32, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		var err error
+		if profilePresent[i], err = r.bit(); err != nil {
+			return err
+		}
+		if levelPresent[i], err = r.bit(); err != nil {
+			return err
+		}
+	}
+	if maxSubLayersMinus1 > 0 {
+		if err := r.skip(2 * (8 - maxSubLayersMinus1)); err != nil { // reserved_zero_2bits
+			return err
+		}
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] == 1 {
+			if err := r.skip(88); err != nil {
+				return err
+			}
+		}
+		if levelPresent[i] == 1 {
+			if err := r.skip(8); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
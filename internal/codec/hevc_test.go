@@ -0,0 +1,61 @@
+package codec
+
+import (
+	"testing"
+)
+
+// HEVC Main 1080p configuration record: general_level_idc 123 (4.1), a
+// 1920x1088 SPS with a 8 line conformance window
+var hevc1080pRecord = []byte{
+	0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0xb0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x7b, 0xf0,
+	0x00, 0xfc, 0xfd, 0xf8, 0xf8, 0x00, 0x00, 0x0f, 0x01, 0xa1, 0x00, 0x01, 0x00, 0x1a,
+	0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0xb0, 0x00, 0x00, 0x03, 0x00,
+	0x00, 0x03, 0x00, 0x7b, 0xa0, 0x03, 0xc0, 0x80, 0x11, 0x07, 0xcb, 0xc0,
+}
+
+func TestParseHEVCDecoderConfigurationRecord(t *testing.T) {
+	cfg, err := ParseHEVCDecoderConfigurationRecord(hevc1080pRecord)
+	if err != nil {
+		t.Fatalf("ParseHEVCDecoderConfigurationRecord() error = %v", err)
+	}
+	expected := VideoConfig{
+		Codec: "hevc", Width: 1920, Height: 1080, Profile: "Main", Level: "4.1", Tier: "Main",
+		ChromaFormat: "4:2:0", BitDepth: 8, Codecs: "hvc1.1.6.L123.B0",
+	}
+	if *cfg != expected {
+		t.Errorf("ParseHEVCDecoderConfigurationRecord() = %+v, expected %+v", *cfg, expected)
+	}
+
+	for _, n := range []int{0, 22, 27, len(hevc1080pRecord) - 4} {
+		if _, err := ParseHEVCDecoderConfigurationRecord(hevc1080pRecord[:n]); err == nil {
+			t.Errorf("ParseHEVCDecoderConfigurationRecord() of %d bytes succeeded", n)
+		}
+	}
+}
+
+func TestHEVCCodecs(t *testing.T) {
+	tests := []struct {
+		name          string
+		profileSpace  uint8
+		tierFlag      uint8
+		profileIDC    uint8
+		compatibility uint32
+		constraints   []byte
+		levelIDC      uint8
+		expected      string
+	}{
+		{"Main", 0, 0, 1, 0x60000000, []byte{0xb0, 0, 0, 0, 0, 0}, 93, "hvc1.1.6.L93.B0"},
+		{"Main 10 High tier", 0, 1, 2, 0x20000000, []byte{0xb0, 0, 0, 0, 0, 0}, 120, "hvc1.2.4.H120.B0"},
+		{"Profile space and constraints", 1, 0, 4, 0x08000000, []byte{0x90, 0x08, 0, 0, 0, 0}, 153, "hvc1.A4.10.L153.90.8"},
+		{"No constraints", 0, 0, 1, 0x60000000, []byte{0, 0, 0, 0, 0, 0}, 90, "hvc1.1.6.L90"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codecs := hevcCodecs(tt.profileSpace, tt.tierFlag, tt.profileIDC, tt.compatibility, tt.constraints, tt.levelIDC)
+			if codecs != tt.expected {
+				t.Errorf("hevcCodecs() = %q, expected %q", codecs, tt.expected)
+			}
+		})
+	}
+}
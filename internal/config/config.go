@@ -1,20 +1,218 @@
 package config
 
-import "time"
+import (
+	"slices"
+	"time"
+)
+
+// Duplicate publisher policies, applied when a publisher arrives for a
+// stream name that already has a live publisher
+const (
+	// DuplicatePublisherReject refuses the newcomer with NetStream.Publish.BadName
+	DuplicatePublisherReject = "reject"
+	// DuplicatePublisherTakeover accepts the newcomer and disconnects the old publisher
+	DuplicatePublisherTakeover = "takeover"
+	// DuplicatePublisherStandby keeps the newcomer as a hot standby that is
+	// promoted when the current publisher leaves
+	DuplicatePublisherStandby = "standby"
+)
+
+// Queue overflow policies, applied when a stream's frame queue is full
+// because FFmpeg is not keeping up
+const (
+	// QueueOverflowDropFrames drops non-key video frames first, then whole GOPs
+	QueueOverflowDropFrames = "drop-frames"
+	// QueueOverflowDropGOP drops the oldest whole GOP
+	QueueOverflowDropGOP = "drop-gop"
+	// QueueOverflowBlock blocks the publisher until FFmpeg catches up
+	QueueOverflowBlock = "block"
+)
+
+// Video policies, applied to published video that is not H.264. H.264 is
+// always copied, and audio other than AAC is always transcoded to AAC.
+const (
+	// VideoPolicyFMP4 copies HEVC, AV1 and VP9 into fMP4 segments and
+	// transcodes older codecs to H.264
+	VideoPolicyFMP4 = "fmp4"
+	// VideoPolicyTranscode transcodes all video that is not H.264 to H.264
+	VideoPolicyTranscode = "transcode"
+	// VideoPolicyReject refuses publishers sending video that is not H.264
+	VideoPolicyReject = "reject"
+)
+
+// Recording formats
+const (
+	// RecordFormatFLV keeps the incoming FLV, with a keyframes index
+	RecordFormatFLV = "flv"
+	// RecordFormatMP4 muxes H.264/HEVC and AAC into a faststart MP4
+	RecordFormatMP4 = "mp4"
+)
+
+// MetadataPolicy limits what a publisher may declare in its onMetaData.
+// Zero fields are not checked.
+type MetadataPolicy struct {
+	MaxWidth        int
+	MaxHeight       int
+	MaxFrameRate    float64
+	MaxVideoBitrate float64 // kbit/s, as videodatarate
+	MaxAudioBitrate float64 // kbit/s, as audiodatarate
+}
+
+// UDPIngest is the stream a UDP port publishes to, as if its encoder had
+// published rtmp://host/live/{App}/{Username}
+type UDPIngest struct {
+	App      string
+	Username string
+	Role     string // "primary" when empty
+}
+
+// RelayTarget is an upstream RTMP or RTMPS server a stream is forwarded to
+type RelayTarget struct {
+	Name string // identifies the target among the stream's, e.g. "youtube"
+	URL  string // ending with the stream key, rtmp://a.rtmp.youtube.com/live2/{key}
+}
+
+// PullStream is a remote stream played and published under a local name
+type PullStream struct {
+	URL      string // rtmp://, rtmps:// or an http(s):// HLS playlist
+	OnDemand bool   // pulled only while the stream is watched
+}
+
+// DefaultMetadataPolicy is the MetadataPolicies key applying to apps
+// without a policy of their own
+const DefaultMetadataPolicy = "*"
 
 // Config holds all configuration for the application
 type Config struct {
-	// Server configuration
+	// Server configuration. SRTPort is a UDP port for SRT ingest, empty to
+	// disable it. With RTMPPlay set, RTMP clients can also play live
+	// streams, such as the pulls of another instance, authorized as
+	// publishers are.
 	RTMPPort string
 	HTTPPort string
-	
+	SRTPort  string
+	RTMPPlay bool
+
+	// AdminToken is the Bearer token the API requires to add or remove
+	// relays and pulls, and to cut clips. Those routes are refused while it
+	// is empty.
+	AdminToken string
+
 	// Output configuration
 	OutputDir string
-	
+
 	// Stream configuration
-	ReconnectDelay time.Duration
-	CleanupDelay   time.Duration
-	
+	ReconnectDelay           time.Duration
+	CleanupDelay             time.Duration
+	DuplicatePublisherPolicy string
+
+	// Failover configuration: a backup publisher takes over when the primary
+	// sends nothing for FailoverStallTimeout, and hands back once the primary
+	// has been sending steadily for FailoverRecoveryDelay
+	FailoverStallTimeout  time.Duration
+	FailoverRecoveryDelay time.Duration
+
+	// Queue configuration: tags are buffered per stream between the
+	// publishers and FFmpeg, QueueSize tags at most
+	QueueSize           int
+	QueueOverflowPolicy string
+
+	// Metadata policies by app name (the {app} pattern variable), with
+	// DefaultMetadataPolicy as the fallback. A publisher whose onMetaData
+	// exceeds its app's policy is rejected.
+	MetadataPolicies map[string]MetadataPolicy
+
+	// VideoPolicy decides what happens to video that is not H.264
+	VideoPolicy string
+
+	// Recording configuration: the incoming FLV of streams whose app is
+	// listed in RecordApps or whose username is listed in RecordUsers ("*"
+	// matches any) is archived under RecordDir in each of RecordFormats.
+	// RecordPath is the file name template without extension, expanding
+	// {app}, {username} and {timestamp}. A file is split at the next
+	// keyframe once it exceeds RecordMaxSize bytes or RecordMaxDuration;
+	// zero means no limit.
+	RecordDir         string
+	RecordPath        string
+	RecordFormats     []string
+	RecordApps        []string
+	RecordUsers       []string
+	RecordMaxSize     int64
+	RecordMaxDuration time.Duration
+
+	// Clip configuration: the last ClipBuffer of every stream is kept in
+	// memory so clips can be cut from it as MP4 files into ClipDir. Zero, the
+	// default, disables clipping. No clip is cut once ClipDir holds ClipMaxSize
+	// bytes, and clips are deleted after ClipRetention; zero means no limit.
+	ClipBuffer    time.Duration
+	ClipDir       string
+	ClipMaxSize   int64
+	ClipRetention time.Duration
+
+	// HLS DVR configuration: the live playlist keeps the last DVRWindow of
+	// segments so viewers can rewind, or only the last few when zero. With
+	// DVREvent it is an EVENT playlist keeping every segment instead.
+	DVRWindow time.Duration
+	DVREvent  bool
+
+	// VOD configuration: when VODDir is set, the HLS output of a stream that
+	// ends is moved under VODDir with a playlist closed by EXT-X-ENDLIST
+	// instead of being deleted. Archives are deleted after VODRetention;
+	// zero keeps them.
+	VODDir       string
+	VODRetention time.Duration
+
+	// WebRTC configuration: with WHEP set, players can watch streams over
+	// WebRTC, and FFmpeg also encodes each stream's audio to Opus for them
+	// if it has libopus.
+	// With WHIP set, encoders can publish over WebRTC, authorized by the
+	// same patterns as RTMP. ICEServers are the STUN and TURN URLs the
+	// server gathers candidates with, e.g. "stun:stun.l.google.com:19302"
+	// behind NAT.
+	WHEP       bool
+	WHIP       bool
+	ICEServers []string
+
+	// MPEG-TS ingest configuration: with HTTPIngest set, encoders can PUT or
+	// POST a transport stream to /ingest/{app}/{username}, authorized by the
+	// same patterns as RTMP. UDPIngests maps UDP addresses, such as ":5000"
+	// or the multicast group "239.0.0.1:5000", to the streams their
+	// transport streams publish, without authorization.
+	HTTPIngest bool
+	UDPIngests map[string]UDPIngest
+
+	// Relay configuration: streams are forwarded to the RelayApps targets of
+	// their app and the RelayUsers targets of their username ("*" matches
+	// any), a user's target replacing an app's of the same name. More can be
+	// added to live streams through the API. A failing target reconnects
+	// after RelayBackoffMin, doubling up to RelayBackoffMax.
+	RelayApps       map[string][]RelayTarget
+	RelayUsers      map[string][]RelayTarget
+	RelayBackoffMin time.Duration
+	RelayBackoffMax time.Duration
+
+	// Pull configuration: PullStreams maps stream names to remote RTMP or
+	// HLS URLs played and published under those names. More can be added
+	// through the API. On-demand pulls start with the first viewer and stop
+	// once the stream has been unwatched for PullIdleTimeout. A failing pull
+	// reconnects after PullBackoffMin, doubling up to PullBackoffMax.
+	PullStreams     map[string]PullStream
+	PullIdleTimeout time.Duration
+	PullBackoffMin  time.Duration
+	PullBackoffMax  time.Duration
+
+	// Edge configuration, for the edge subcommand: an edge serves the
+	// /stream/ requests of viewers on EdgePort from EdgeOrigins, the base
+	// URLs of origin servers, each stream from the origin its name hashes
+	// to. Playlists are cached for EdgePlaylistTTL, and segments until they
+	// leave their playlist but EdgeSegmentTTL at most, in at most
+	// EdgeCacheSize bytes.
+	EdgePort        string
+	EdgeOrigins     []string
+	EdgePlaylistTTL time.Duration
+	EdgeSegmentTTL  time.Duration
+	EdgeCacheSize   int64
+
 	// Authorization configuration
 	AuthorizedPatterns []string
 }
@@ -22,13 +220,80 @@ type Config struct {
 // DefaultConfig returns a default configuration
 func DefaultConfig() Config {
 	return Config{
-		RTMPPort: ":1935",
-		HTTPPort: ":8080",
-		OutputDir: "./streams",
-		ReconnectDelay: 5 * time.Second,
-		CleanupDelay: 2 * time.Second,
+		RTMPPort:                 ":1935",
+		HTTPPort:                 ":8080",
+		SRTPort:                  ":9000",
+		OutputDir:                "./streams",
+		ReconnectDelay:           5 * time.Second,
+		CleanupDelay:             2 * time.Second,
+		DuplicatePublisherPolicy: DuplicatePublisherReject,
+		FailoverStallTimeout:     2 * time.Second,
+		FailoverRecoveryDelay:    5 * time.Second,
+		QueueSize:                512,
+		QueueOverflowPolicy:      QueueOverflowDropFrames,
+		VideoPolicy:              VideoPolicyFMP4,
+		RecordDir:                "./recordings",
+		RecordPath:               "{app}/{username}/{timestamp}",
+		RecordFormats:            []string{RecordFormatFLV},
+		ClipDir:                  "./clips",
+		ClipMaxSize:              1 << 30,
+		ClipRetention:            24 * time.Hour,
+		VODRetention:             7 * 24 * time.Hour,
+		WHIP:                     true,
+		HTTPIngest:               true,
+		RelayBackoffMin:          time.Second,
+		RelayBackoffMax:          30 * time.Second,
+		PullIdleTimeout:          30 * time.Second,
+		PullBackoffMin:           time.Second,
+		PullBackoffMax:           30 * time.Second,
+		EdgePort:                 ":8081",
+		EdgeOrigins:              []string{"http://localhost:8080"},
+		EdgePlaylistTTL:          time.Second,
+		EdgeSegmentTTL:           30 * time.Second,
+		EdgeCacheSize:            256 << 20,
 		AuthorizedPatterns: []string{
 			"/live/{app}/{username}",
 		},
 	}
-} 
\ No newline at end of file
+}
+
+// MetadataPolicyFor returns the metadata policy applying to an app
+func (c Config) MetadataPolicyFor(app string) MetadataPolicy {
+	if policy, ok := c.MetadataPolicies[app]; ok {
+		return policy
+	}
+	return c.MetadataPolicies[DefaultMetadataPolicy]
+}
+
+// ShouldRecord reports whether a stream published by username to app is
+// recorded
+func (c Config) ShouldRecord(app, username string) bool {
+	return matchesAny(c.RecordApps, app) || matchesAny(c.RecordUsers, username)
+}
+
+// RelayTargetsFor returns the targets a stream published by username to app
+// is forwarded to
+func (c Config) RelayTargetsFor(app, username string) []RelayTarget {
+	var targets []RelayTarget
+	for _, candidates := range [][]RelayTarget{c.RelayApps["*"], c.RelayApps[app], c.RelayUsers["*"], c.RelayUsers[username]} {
+		for _, target := range candidates {
+			i := slices.IndexFunc(targets, func(t RelayTarget) bool { return t.Name == target.Name })
+			if i >= 0 {
+				targets[i] = target
+			} else {
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
+}
+
+// matchesAny reports whether value is listed in values, or values holds "*"
+func matchesAny(values []string, value string) bool {
+	for _, v := range values {
+		if v == "*" || v == value {
+			return true
+		}
+	}
+	return false
+}
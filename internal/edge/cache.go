@@ -0,0 +1,156 @@
+package edge
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// object is a response of an origin, as cached and served
+type object struct {
+	status  int
+	header  http.Header // the headers passed on to viewers
+	body    []byte
+	expires time.Time // zero when not cached
+}
+
+// size is roughly the memory an object takes
+func (o *object) size() int64 {
+	return int64(len(o.body)) + 512
+}
+
+// result tells how a request was served
+type result string
+
+// Request results, reported in the X-Cache header
+const (
+	resultHit       result = "HIT"       // from the cache
+	resultMiss      result = "MISS"      // fetched from the origin
+	resultCoalesced result = "COALESCED" // from the fetch of another request
+)
+
+// fetch is an origin fetch in flight, which requests for the same object
+// wait for rather than fetching it again
+type fetch struct {
+	done   chan struct{}
+	object *object
+	err    error
+}
+
+// cache holds the objects fetched from the origins until they expire, up to
+// a total size, and coalesces concurrent fetches of the same object
+type cache struct {
+	maxSize int64
+
+	mutex    sync.Mutex
+	objects  map[string]*object
+	size     int64
+	inflight map[string]*fetch
+	stats    Stats
+}
+
+func newCache(maxSize int64) *cache {
+	return &cache{
+		maxSize:  maxSize,
+		objects:  make(map[string]*object),
+		inflight: make(map[string]*fetch),
+	}
+}
+
+// get returns the object cached under key, or else loads it once however
+// many requests ask for it meanwhile. load sets the expiry of what it
+// returns; objects without one are not cached.
+func (c *cache) get(key string, load func() (*object, error)) (*object, result, error) {
+	c.mutex.Lock()
+	if o, ok := c.objects[key]; ok {
+		if time.Now().Before(o.expires) {
+			c.stats.Hits++
+			c.mutex.Unlock()
+			return o, resultHit, nil
+		}
+		c.removeLocked(key)
+	}
+	if f, ok := c.inflight[key]; ok {
+		c.stats.Coalesced++
+		c.mutex.Unlock()
+		<-f.done
+		return f.object, resultCoalesced, f.err
+	}
+	f := &fetch{done: make(chan struct{})}
+	c.inflight[key] = f
+	c.stats.Misses++
+	c.mutex.Unlock()
+
+	f.object, f.err = load()
+
+	c.mutex.Lock()
+	delete(c.inflight, key)
+	if f.err != nil {
+		c.stats.OriginErrors++
+	} else if !f.object.expires.IsZero() {
+		c.storeLocked(key, f.object)
+	}
+	c.mutex.Unlock()
+	close(f.done)
+	return f.object, resultMiss, f.err
+}
+
+// storeLocked caches an object, evicting expired objects and then those
+// expiring soonest to stay within the maximum size
+func (c *cache) storeLocked(key string, o *object) {
+	if o.size() > c.maxSize {
+		return
+	}
+	c.removeLocked(key)
+	c.objects[key] = o
+	c.size += o.size()
+	if c.size <= c.maxSize {
+		return
+	}
+	now := time.Now()
+	for k, cached := range c.objects {
+		if !now.Before(cached.expires) {
+			c.removeLocked(k)
+		}
+	}
+	for c.size > c.maxSize {
+		var oldest string
+		for k, cached := range c.objects {
+			if oldest == "" || cached.expires.Before(c.objects[oldest].expires) {
+				oldest = k
+			}
+		}
+		c.removeLocked(oldest)
+	}
+}
+
+// removeLocked drops an object
+func (c *cache) removeLocked(key string) {
+	if o, ok := c.objects[key]; ok {
+		c.size -= o.size()
+		delete(c.objects, key)
+	}
+}
+
+// expire drops the objects under the directory dir for which keep returns
+// false
+func (c *cache) expire(dir string, keep func(key string) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.objects {
+		if strings.HasPrefix(key, dir) && !keep(key) {
+			c.removeLocked(key)
+		}
+	}
+}
+
+// snapshot returns the counters and the size of the cache
+func (c *cache) snapshot() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Objects = len(c.objects)
+	stats.Bytes = c.size
+	return stats
+}
@@ -0,0 +1,308 @@
+// Package edge serves HLS viewers from origin servers, so that delivery
+// scales out across many edges in front of few origins. An edge proxies
+// /stream/{username}/ requests to the origin the username hashes to on a
+// consistent hashing ring, caches playlists for a short time and segments
+// until they leave their playlist, and coalesces concurrent requests for
+// an object into a single origin fetch.
+package edge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+)
+
+// fetchTimeout bounds each origin fetch, body included
+const fetchTimeout = 10 * time.Second
+
+// maxObjectSize bounds the objects fetched from origins
+const maxObjectSize = 64 << 20
+
+// contentTypes are those of the HLS objects proxied, as the origin serves
+// them
+var contentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+}
+
+// forwardedHeaders are the origin response headers passed on to viewers
+var forwardedHeaders = []string{"Content-Type", "Cache-Control", "Pragma", "Expires", "Last-Modified"}
+
+// Stats counts the requests an edge served, for the API
+type Stats struct {
+	// Hits were served from the cache, Misses fetched from an origin and
+	// Coalesced served by the fetch of another request
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Coalesced uint64 `json:"coalesced"`
+	// OriginErrors counts the fetches no origin answered
+	OriginErrors uint64 `json:"origin_errors"`
+	// Objects and Bytes are in the cache
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Edge proxies HLS requests to origin servers through a cache
+type Edge struct {
+	origins     []*url.URL
+	ring        *Ring
+	client      *http.Client
+	playlistTTL time.Duration
+	segmentTTL  time.Duration
+	cache       *cache
+}
+
+// New creates an edge for the configured origins, base URLs such as
+// http://origin:8080
+func New(cfg config.Config) (*Edge, error) {
+	if len(cfg.EdgeOrigins) == 0 {
+		return nil, errors.New("no origin configured")
+	}
+	e := &Edge{
+		client:      &http.Client{Timeout: fetchTimeout},
+		playlistTTL: cfg.EdgePlaylistTTL,
+		segmentTTL:  cfg.EdgeSegmentTTL,
+		cache:       newCache(cfg.EdgeCacheSize),
+	}
+	var names []string
+	for _, origin := range cfg.EdgeOrigins {
+		u, err := url.Parse(strings.TrimSuffix(origin, "/"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid origin %q", origin)
+		}
+		e.origins = append(e.origins, u)
+		names = append(names, u.String())
+	}
+	e.ring = NewRing(names, DefaultReplicas)
+	return e, nil
+}
+
+// Handler returns the edge's HTTP handler: the HLS files of
+// /stream/{username}/, and its state on /api/v1/edge
+func (e *Edge) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream/", e.handleStreamRequest)
+	mux.HandleFunc("GET /api/v1/edge", e.handleAPIState)
+	return mux
+}
+
+// Stats returns the edge's counters and cache size
+func (e *Edge) Stats() Stats {
+	return e.cache.snapshot()
+}
+
+// Origin returns the base URL of the origin serving a stream
+func (e *Edge) Origin(username string) string {
+	return e.ring.Lookup(username)[0]
+}
+
+// stateResponse is the body returned by GET /api/v1/edge
+type stateResponse struct {
+	Origins []string `json:"origins"`
+	Stats   Stats    `json:"stats"`
+}
+
+func (e *Edge) handleAPIState(w http.ResponseWriter, r *http.Request) {
+	state := stateResponse{Stats: e.Stats()}
+	for _, origin := range e.origins {
+		state.Origins = append(state.Origins, origin.String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// handleStreamRequest serves an HLS file of a stream from the cache or its
+// origin, with the headers the origin serves it with. X-Cache tells whether
+// it came from the cache.
+func (e *Edge) handleStreamRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Range")
+	switch r.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodGet, http.MethodHead:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, key, ok := objectKey(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	o, result, err := e.cache.get(key, func() (*object, error) {
+		return e.load(username, key)
+	})
+	if err != nil {
+		log.Printf("Edge cannot fetch %s: %v", key, err)
+		http.Error(w, "origin unavailable", http.StatusBadGateway)
+		return
+	}
+
+	for name, values := range o.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("X-Cache", string(result))
+	if o.status != http.StatusOK {
+		w.WriteHeader(o.status)
+		w.Write(o.body)
+		return
+	}
+	modified, _ := http.ParseTime(o.header.Get("Last-Modified"))
+	http.ServeContent(w, r, path.Base(key), modified, bytes.NewReader(o.body))
+}
+
+// objectKey returns the stream and the cleaned path of an HLS request,
+// /stream/{username}/{file}, the file being the live playlist when omitted
+// as on the origin
+func objectKey(requestPath string) (username, key string, ok bool) {
+	rest, ok := strings.CutPrefix(requestPath, "/stream/")
+	if !ok {
+		return "", "", false
+	}
+	for _, element := range strings.Split(rest, "/") {
+		if element == "." || element == ".." {
+			return "", "", false
+		}
+	}
+	username, file, _ := strings.Cut(rest, "/")
+	if username == "" {
+		return "", "", false
+	}
+	if file == "" {
+		file = "live.m3u8"
+	}
+	if _, ok := contentTypes[path.Ext(file)]; !ok {
+		return "", "", false
+	}
+	return username, path.Clean("/stream/" + username + "/" + file), true
+}
+
+// load fetches an object from the stream's origin, or the next ones on the
+// ring while they cannot be reached, and sets how long it is cached:
+// playlists and what is not found for the playlist TTL, segments for the
+// segment TTL. Other responses are not cached. A media playlist expires the
+// segments it no longer lists.
+func (e *Edge) load(username, key string) (*object, error) {
+	var o *object
+	var err error
+	for _, origin := range e.ring.Lookup(username) {
+		if o, err = e.fetch(origin + key); err == nil {
+			break
+		}
+		log.Printf("Edge fetch of %s from %s failed: %v", key, origin, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	playlist := path.Ext(key) == ".m3u8"
+	switch {
+	case o.status == http.StatusOK && !playlist:
+		o.expires = time.Now().Add(e.segmentTTL)
+	case o.status == http.StatusOK || o.status == http.StatusNotFound:
+		o.expires = time.Now().Add(e.playlistTTL)
+	}
+
+	if !playlist {
+		return o, nil
+	}
+	// Segments expire once their media playlist no longer lists them, or
+	// is gone with the stream
+	listed, media := map[string]bool{}, o.status == http.StatusNotFound
+	if o.status == http.StatusOK {
+		listed, media = mediaSegments(o.body, key)
+	}
+	if media {
+		e.cache.expire(path.Dir(key)+"/", func(cached string) bool {
+			return path.Ext(cached) == ".m3u8" || listed[cached]
+		})
+	}
+	return o, nil
+}
+
+// fetch gets an object from an origin. It fails when the origin cannot be
+// reached or answers with a server error.
+func (e *Edge) fetch(rawURL string) (*object, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("origin answered %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxObjectSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxObjectSize {
+		return nil, fmt.Errorf("object larger than %d bytes", maxObjectSize)
+	}
+
+	o := &object{status: resp.StatusCode, header: make(http.Header), body: body}
+	for _, name := range forwardedHeaders {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			o.header[name] = values
+		}
+	}
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		o.header.Del("Last-Modified")
+	case o.header.Get("Content-Type") == "":
+		o.header.Set("Content-Type", contentTypes[path.Ext(req.URL.Path)])
+	}
+	return o, nil
+}
+
+// mediaSegments returns the keys of the segments a media playlist lists,
+// its init segment included, or false for a master playlist
+func mediaSegments(playlist []byte, key string) (map[string]bool, bool) {
+	base := &url.URL{Path: key}
+	listed := make(map[string]bool)
+	media := false
+	add := func(uri string) {
+		if u, err := base.Parse(uri); err == nil && u.Host == "" {
+			listed[path.Clean(u.Path)] = true
+		}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF"):
+			media = true
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			if _, rest, ok := strings.Cut(line, `URI="`); ok {
+				uri, _, _ := strings.Cut(rest, `"`)
+				add(uri)
+			}
+		case line != "" && !strings.HasPrefix(line, "#"):
+			add(line)
+		}
+	}
+	return listed, media
+}
@@ -0,0 +1,351 @@
+package edge
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	httpserver "rtmp-server-poc/internal/http"
+	"rtmp-server-poc/internal/stream"
+)
+
+// origin is a local instance of the server's HTTP side, serving the HLS
+// files the test writes and counting the requests it gets
+type origin struct {
+	dir    string
+	server *httptest.Server
+
+	mutex    sync.Mutex
+	requests map[string]int
+	gate     chan struct{} // when set, requests wait for it to close
+}
+
+// startOrigin serves HLS from a temporary directory
+func startOrigin(t *testing.T) *origin {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.OutputDir = t.TempDir()
+	cfg.WHEP, cfg.WHIP = false, false
+	handler := httpserver.NewServer(cfg, stream.NewManager()).SetupServer().Handler
+
+	o := &origin{dir: cfg.OutputDir, requests: make(map[string]int)}
+	o.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.mutex.Lock()
+		o.requests[r.URL.Path]++
+		gate := o.gate
+		o.mutex.Unlock()
+		if gate != nil {
+			<-gate
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(o.server.Close)
+	return o
+}
+
+// write writes a file of a stream's HLS output
+func (o *origin) write(t *testing.T, username, file, content string) {
+	t.Helper()
+	dir := filepath.Join(o.dir, username)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// count returns how many times the origin was asked for a path
+func (o *origin) count(path string) int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.requests[path]
+}
+
+// startEdge serves an edge in front of origins
+func startEdge(t *testing.T, cfg config.Config, origins ...*origin) (*Edge, string) {
+	t.Helper()
+	cfg.EdgeOrigins = nil
+	for _, o := range origins {
+		cfg.EdgeOrigins = append(cfg.EdgeOrigins, o.server.URL)
+	}
+	e, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(e.Handler())
+	t.Cleanup(server.Close)
+	return e, server.URL
+}
+
+// get requests a URL, returning the status, the body and the X-Cache header
+func get(t *testing.T, url string) (int, string, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body), resp.Header.Get("X-Cache")
+}
+
+// mediaPlaylist lists segments
+func mediaPlaylist(sequence int, segments ...string) string {
+	playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+	for _, segment := range segments {
+		playlist += "#EXTINF:1.0,\n" + segment + "\n"
+	}
+	return playlist
+}
+
+func TestEdgeCachesPlaylists(t *testing.T) {
+	o := startOrigin(t)
+	o.write(t, "alice", "live.m3u8", mediaPlaylist(0, "live_000.ts"))
+	cfg := config.DefaultConfig()
+	cfg.EdgePlaylistTTL = 200 * time.Millisecond
+	_, edge := startEdge(t, cfg, o)
+
+	status, body, cache := get(t, edge+"/stream/alice/live.m3u8")
+	if status != http.StatusOK || body != mediaPlaylist(0, "live_000.ts") || cache != "MISS" {
+		t.Fatalf("GET = %d %q %s, expected the playlist from the origin", status, body, cache)
+	}
+	o.write(t, "alice", "live.m3u8", mediaPlaylist(1, "live_001.ts"))
+	if _, body, cache = get(t, edge+"/stream/alice/"); body != mediaPlaylist(0, "live_000.ts") || cache != "HIT" {
+		t.Errorf("GET of the stream = %q %s, expected the cached live playlist", body, cache)
+	}
+	if n := o.count("/stream/alice/live.m3u8"); n != 1 {
+		t.Errorf("origin got %d playlist requests, expected 1", n)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if _, body, cache = get(t, edge+"/stream/alice/live.m3u8"); body != mediaPlaylist(1, "live_001.ts") || cache != "MISS" {
+		t.Errorf("GET after the TTL = %q %s, expected the new playlist", body, cache)
+	}
+
+	// Streams that do not exist are cached for the playlist TTL too
+	for range 2 {
+		if status, _, _ := get(t, edge+"/stream/bob/live.m3u8"); status != http.StatusNotFound {
+			t.Errorf("GET of an unknown stream = %d, expected 404", status)
+		}
+	}
+	if n := o.count("/stream/bob/live.m3u8"); n != 1 {
+		t.Errorf("origin got %d requests for an unknown stream, expected 1", n)
+	}
+}
+
+func TestEdgeCachesSegmentsUntilExpired(t *testing.T) {
+	o := startOrigin(t)
+	o.write(t, "alice", "live.m3u8", mediaPlaylist(0, "live_000.ts", "live_001.ts"))
+	o.write(t, "alice", "live_000.ts", "segment 0")
+	o.write(t, "alice", "live_001.ts", "segment 1")
+	cfg := config.DefaultConfig()
+	cfg.EdgePlaylistTTL = 50 * time.Millisecond
+	e, edge := startEdge(t, cfg, o)
+
+	get(t, edge+"/stream/alice/live.m3u8")
+	for _, segment := range []string{"live_000.ts", "live_001.ts"} {
+		get(t, edge+"/stream/alice/"+segment)
+		if status, body, cache := get(t, edge+"/stream/alice/"+segment); status != http.StatusOK || cache != "HIT" {
+			t.Errorf("GET %s again = %d %q %s, expected a hit", segment, status, body, cache)
+		}
+	}
+
+	// Once the playlist slides, the segment it dropped expires
+	o.write(t, "alice", "live.m3u8", mediaPlaylist(1, "live_001.ts", "live_002.ts"))
+	time.Sleep(60 * time.Millisecond)
+	get(t, edge+"/stream/alice/live.m3u8")
+	if _, _, cache := get(t, edge+"/stream/alice/live_001.ts"); cache != "HIT" {
+		t.Errorf("GET of a listed segment = %s, expected a hit", cache)
+	}
+	if _, _, cache := get(t, edge+"/stream/alice/live_000.ts"); cache != "MISS" {
+		t.Errorf("GET of a dropped segment = %s, expected a miss", cache)
+	}
+
+	// And once the stream ends, all of it does
+	if err := os.RemoveAll(filepath.Join(o.dir, "alice")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	get(t, edge+"/stream/alice/live.m3u8")
+	if status, _, _ := get(t, edge+"/stream/alice/live_001.ts"); status != http.StatusNotFound {
+		t.Errorf("GET of a segment of an ended stream = %d, expected 404", status)
+	}
+	if stats := e.Stats(); stats.Objects != 2 {
+		t.Errorf("cache holds %d objects, expected the two 404s", stats.Objects)
+	}
+}
+
+func TestEdgeCoalescesRequests(t *testing.T) {
+	o := startOrigin(t)
+	o.write(t, "alice", "live_000.ts", "segment 0")
+	gate := make(chan struct{})
+	o.gate = gate
+	e, edge := startEdge(t, config.DefaultConfig(), o)
+
+	const viewers = 10
+	var wg sync.WaitGroup
+	bodies := make([]string, viewers)
+	for i := range viewers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, bodies[i], _ = get(t, edge+"/stream/alice/live_000.ts")
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().Coalesced < viewers-1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v, expected %d requests waiting for the first", e.Stats(), viewers-1)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(gate)
+	wg.Wait()
+
+	for i, body := range bodies {
+		if body != "segment 0" {
+			t.Errorf("viewer %d got %q", i, body)
+		}
+	}
+	if n := o.count("/stream/alice/live_000.ts"); n != 1 {
+		t.Errorf("origin got %d requests, expected 1", n)
+	}
+	if stats := e.Stats(); stats.Misses != 1 || stats.Coalesced != viewers-1 || stats.Objects != 1 {
+		t.Errorf("stats = %+v, expected one miss and the rest coalesced", stats)
+	}
+}
+
+func TestEdgeSelectsOrigins(t *testing.T) {
+	origins := []*origin{startOrigin(t), startOrigin(t), startOrigin(t)}
+	e, edge := startEdge(t, config.DefaultConfig(), origins...)
+
+	// Each stream is published to the origin it hashes to
+	byURL := make(map[string]*origin)
+	for _, o := range origins {
+		byURL[o.server.URL] = o
+	}
+	used := make(map[*origin]bool)
+	for i := range 20 {
+		name := fmt.Sprintf("user%d", i)
+		o := byURL[e.Origin(name)]
+		used[o] = true
+		o.write(t, name, "live.m3u8", mediaPlaylist(0, "live_000.ts"))
+		if status, _, _ := get(t, edge+"/stream/"+name+"/live.m3u8"); status != http.StatusOK {
+			t.Errorf("GET of %s = %d, expected it from its origin", name, status)
+		}
+		for _, other := range origins {
+			if n := other.count("/stream/" + name + "/live.m3u8"); (other == o) != (n == 1) {
+				t.Errorf("%s got %d requests for %s", other.server.URL, n, name)
+			}
+		}
+	}
+	if len(used) != len(origins) {
+		t.Errorf("%d of %d origins used for 20 streams", len(used), len(origins))
+	}
+
+	// Streams of an origin that is down are asked of the next on the ring
+	down := byURL[e.Origin("user0")]
+	down.server.Close()
+	next := byURL[e.ring.Lookup("user0")[1]]
+	next.write(t, "user0", "live_000.ts", "segment 0")
+	if status, body, _ := get(t, edge+"/stream/user0/live_000.ts"); status != http.StatusOK || body != "segment 0" {
+		t.Errorf("GET with the origin down = %d %q, expected it from the next origin", status, body)
+	}
+}
+
+func TestEdgeRejectsRequests(t *testing.T) {
+	o := startOrigin(t)
+	_, edge := startEdge(t, config.DefaultConfig(), o)
+	for _, path := range []string{"/stream/", "/stream/alice/notes.txt", "/other"} {
+		if status, _, _ := get(t, edge+path); status != http.StatusNotFound {
+			t.Errorf("GET %s = %d, expected 404", path, status)
+		}
+	}
+	req, _ := http.NewRequest(http.MethodPost, edge+"/stream/alice/live.m3u8", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, expected 405", resp.StatusCode)
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if len(o.requests) != 0 {
+		t.Errorf("origin got %v, expected nothing", o.requests)
+	}
+}
+
+func TestNewRejectsOrigins(t *testing.T) {
+	for _, origins := range [][]string{nil, {"localhost:8080"}, {"ftp://origin"}, {"http://"}} {
+		cfg := config.DefaultConfig()
+		cfg.EdgeOrigins = origins
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New() with origins %q succeeded", origins)
+		}
+	}
+}
+
+func TestObjectKey(t *testing.T) {
+	tests := []struct {
+		path     string
+		username string
+		key      string
+		ok       bool
+	}{
+		{"/stream/alice/live.m3u8", "alice", "/stream/alice/live.m3u8", true},
+		{"/stream/alice/", "alice", "/stream/alice/live.m3u8", true},
+		{"/stream/alice", "alice", "/stream/alice/live.m3u8", true},
+		{"/stream/alice/720p/live_003.ts", "alice", "/stream/alice/720p/live_003.ts", true},
+		{"/stream/alice//init.mp4", "alice", "/stream/alice/init.mp4", true},
+		{"/stream/alice/../bob/live.m3u8", "", "", false},
+		{"/stream/alice/./live.m3u8", "", "", false},
+		{"/stream//live.m3u8", "", "", false},
+		{"/stream/alice/notes.txt", "", "", false},
+		{"/api/v1/edge", "", "", false},
+	}
+	for _, tt := range tests {
+		username, key, ok := objectKey(tt.path)
+		if username != tt.username || key != tt.key || ok != tt.ok {
+			t.Errorf("objectKey(%q) = %q, %q, %v, expected %q, %q, %v", tt.path, username, key, ok, tt.username, tt.key, tt.ok)
+		}
+	}
+}
+
+func TestMediaSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist string
+		listed   []string
+		media    bool
+	}{
+		{"media", mediaPlaylist(3, "live_003.ts", "live_004.ts"), []string{"/stream/alice/live_003.ts", "/stream/alice/live_004.ts"}, true},
+		{"fmp4", "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:1.0,\nlive_000.m4s\n", []string{"/stream/alice/init.mp4", "/stream/alice/live_000.m4s"}, true},
+		{"master", "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\n480p/live.m3u8\n", []string{"/stream/alice/480p/live.m3u8"}, false},
+		{"absolute", "#EXTM3U\n#EXTINF:1.0,\nhttp://cdn/live_000.ts\n#EXTINF:1.0,\n/stream/alice/live_001.ts\n", []string{"/stream/alice/live_001.ts"}, true},
+	}
+	for _, tt := range tests {
+		listed, media := mediaSegments([]byte(tt.playlist), "/stream/alice/live.m3u8")
+		if media != tt.media || len(listed) != len(tt.listed) {
+			t.Errorf("%s: mediaSegments() = %v, %v, expected %v, %v", tt.name, listed, media, tt.listed, tt.media)
+			continue
+		}
+		for _, key := range tt.listed {
+			if !listed[key] {
+				t.Errorf("%s: mediaSegments() = %v, expected %s listed", tt.name, listed, key)
+			}
+		}
+	}
+}
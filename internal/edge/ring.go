@@ -0,0 +1,78 @@
+package edge
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of points each node has on a ring
+const DefaultReplicas = 128
+
+// Ring maps keys to nodes by consistent hashing: each node is placed at
+// many points on a circle of hashes, and a key belongs to the first node
+// clockwise of its own hash. Adding or removing a node only moves the keys
+// of that node.
+type Ring struct {
+	points []point // sorted by hash
+	nodes  int
+}
+
+// point is one of a node's places on the ring
+type point struct {
+	hash uint64
+	node string
+}
+
+// NewRing places the nodes on a ring, replicas times each. Duplicate nodes
+// are placed once.
+func NewRing(nodes []string, replicas int) *Ring {
+	r := &Ring{}
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		r.nodes++
+		for i := range replicas {
+			r.points = append(r.points, point{hash: hash(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+// Lookup returns every node in the order a key prefers them: its own first,
+// then those to try when it fails
+func (r *Ring) Lookup(key string) []string {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	nodes := make([]string, 0, r.nodes)
+	seen := make(map[string]bool, r.nodes)
+	for i := 0; i < len(r.points) && len(nodes) < r.nodes; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !seen[p.node] {
+			seen[p.node] = true
+			nodes = append(nodes, p.node)
+		}
+	}
+	return nodes
+}
+
+// hash is FNV-1a, whose bits are then mixed as by MurmurHash3's finalizer:
+// the keys and points differ by a few trailing characters only
+func hash(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
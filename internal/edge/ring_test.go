@@ -0,0 +1,59 @@
+package edge
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRingLookup(t *testing.T) {
+	origins := []string{"http://origin1:8080", "http://origin2:8080", "http://origin3:8080"}
+	ring := NewRing(origins, DefaultReplicas)
+
+	counts := make(map[string]int)
+	for i := range 3000 {
+		nodes := ring.Lookup(fmt.Sprintf("user%d", i))
+		if len(nodes) != len(origins) {
+			t.Fatalf("Lookup() = %v, expected every origin once", nodes)
+		}
+		counts[nodes[0]]++
+	}
+	// Each origin gets its share of the streams, give or take
+	for _, origin := range origins {
+		if counts[origin] < 700 || counts[origin] > 1300 {
+			t.Errorf("%s got %d of 3000 streams, expected about 1000", origin, counts[origin])
+		}
+	}
+
+	if a, b := ring.Lookup("alice"), NewRing(origins, DefaultReplicas).Lookup("alice"); !reflect.DeepEqual(a, b) {
+		t.Errorf("Lookup() = %v then %v, expected the same order on every ring", a, b)
+	}
+	if nodes := NewRing(append(origins, origins[0]), DefaultReplicas).Lookup("alice"); len(nodes) != 3 {
+		t.Errorf("Lookup() = %v, expected a duplicate origin once", nodes)
+	}
+	if nodes := NewRing(nil, DefaultReplicas).Lookup("alice"); nodes != nil {
+		t.Errorf("Lookup() on an empty ring = %v", nodes)
+	}
+}
+
+func TestRingAddNode(t *testing.T) {
+	origins := []string{"http://origin1:8080", "http://origin2:8080", "http://origin3:8080"}
+	before := NewRing(origins, DefaultReplicas)
+	after := NewRing(append(origins, "http://origin4:8080"), DefaultReplicas)
+
+	moved := 0
+	for i := range 3000 {
+		key := fmt.Sprintf("user%d", i)
+		from, to := before.Lookup(key)[0], after.Lookup(key)[0]
+		if from != to {
+			if to != "http://origin4:8080" {
+				t.Fatalf("%s moved from %s to %s, expected only moves to the new origin", key, from, to)
+			}
+			moved++
+		}
+	}
+	// About a quarter of the streams move to the new origin
+	if moved < 450 || moved > 1050 {
+		t.Errorf("%d of 3000 streams moved, expected about 750", moved)
+	}
+}
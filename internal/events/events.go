@@ -0,0 +1,129 @@
+// Package events provides a small in-process event bus used to report what
+// happens to streams (publisher decisions, recordings, clips, ...) to logs,
+// the HTTP API and any other interested component.
+package events
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Type identifies the kind of event
+type Type string
+
+// Publisher events
+const (
+	PublisherAccepted Type = "publisher.accepted"
+	PublisherRejected Type = "publisher.rejected"
+	PublisherTakeover Type = "publisher.takeover"
+	PublisherStandby  Type = "publisher.standby"
+	PublisherPromoted Type = "publisher.promoted"
+	PublisherLeft     Type = "publisher.left"
+)
+
+// Recording events
+const (
+	RecordingFinished Type = "recording.finished"
+)
+
+// Clip events
+const (
+	ClipCreated Type = "clip.created"
+	ClipExpired Type = "clip.expired"
+)
+
+// VOD events
+const (
+	VODArchived Type = "vod.archived"
+	VODExpired  Type = "vod.expired"
+)
+
+// Relay events
+const (
+	RelayConnected Type = "relay.connected"
+	RelayFailed    Type = "relay.failed"
+	RelayStopped   Type = "relay.stopped"
+)
+
+// Pull events
+const (
+	PullConnected Type = "pull.connected"
+	PullFailed    Type = "pull.failed"
+	PullStopped   Type = "pull.stopped"
+)
+
+// Event is a single notification published on the bus
+type Event struct {
+	Type    Type                   `json:"type"`
+	Stream  string                 `json:"stream"`
+	Time    time.Time              `json:"time"`
+	Message string                 `json:"message,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// Bus fans events out to subscribers and keeps a short history
+type Bus struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]struct{}
+	history     []Event
+	historySize int
+}
+
+// NewBus creates a bus remembering the last historySize events
+func NewBus(historySize int) *Bus {
+	return &Bus{
+		subscribers: make(map[chan Event]struct{}),
+		historySize: historySize,
+	}
+}
+
+// Publish logs the event and delivers it to every subscriber. Subscribers
+// that are not keeping up miss events rather than blocking the publisher.
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	log.Printf("Event %s for stream %s: %s", e.Type, e.Stream, e.Message)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.history = append(b.history, e)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving future events and a function to
+// unsubscribe, which closes the channel
+func (b *Bus) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	b.mutex.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mutex.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mutex.Lock()
+			delete(b.subscribers, ch)
+			b.mutex.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Recent returns the remembered events, oldest first
+func (b *Bus) Recent() []Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]Event(nil), b.history...)
+}
@@ -0,0 +1,394 @@
+package flv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrShortPayload is returned when a tag payload is too short for its header
+var ErrShortPayload = errors.New("flv: tag payload shorter than its header")
+
+// SoundFormat is the audio codec of an audio tag
+type SoundFormat byte
+
+// Sound formats defined by the FLV specification
+const (
+	SoundFormatLinearPCM      SoundFormat = 0
+	SoundFormatADPCM          SoundFormat = 1
+	SoundFormatMP3            SoundFormat = 2
+	SoundFormatLinearPCMLE    SoundFormat = 3
+	SoundFormatNellymoser16k  SoundFormat = 4
+	SoundFormatNellymoser8k   SoundFormat = 5
+	SoundFormatNellymoser     SoundFormat = 6
+	SoundFormatG711ALaw       SoundFormat = 7
+	SoundFormatG711MuLaw      SoundFormat = 8
+	SoundFormatExHeader       SoundFormat = 9 // Enhanced RTMP, the codec is a FourCC
+	SoundFormatAAC            SoundFormat = 10
+	SoundFormatSpeex          SoundFormat = 11
+	SoundFormatMP38k          SoundFormat = 14
+	SoundFormatDeviceSpecific SoundFormat = 15
+)
+
+var soundFormatNames = map[SoundFormat]string{
+	SoundFormatLinearPCM:      "pcm",
+	SoundFormatADPCM:          "adpcm",
+	SoundFormatMP3:            "mp3",
+	SoundFormatLinearPCMLE:    "pcm_le",
+	SoundFormatNellymoser16k:  "nellymoser",
+	SoundFormatNellymoser8k:   "nellymoser",
+	SoundFormatNellymoser:     "nellymoser",
+	SoundFormatG711ALaw:       "g711a",
+	SoundFormatG711MuLaw:      "g711u",
+	SoundFormatExHeader:       "exheader",
+	SoundFormatAAC:            "aac",
+	SoundFormatSpeex:          "speex",
+	SoundFormatMP38k:          "mp3",
+	SoundFormatDeviceSpecific: "device",
+}
+
+// String returns a short codec name
+func (f SoundFormat) String() string {
+	if name, ok := soundFormatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("sound_format_%d", byte(f))
+}
+
+// AACPacketType tells an AAC AudioSpecificConfig from raw AAC frames
+type AACPacketType byte
+
+// AAC packet types
+const (
+	AACPacketTypeSequenceHeader AACPacketType = 0
+	AACPacketTypeRaw            AACPacketType = 1
+)
+
+// AudioPacketType is the Enhanced RTMP audio packet type
+type AudioPacketType byte
+
+// Enhanced RTMP audio packet types
+const (
+	AudioPacketTypeSequenceStart AudioPacketType = 0
+	AudioPacketTypeCodedFrames   AudioPacketType = 1
+	AudioPacketTypeSequenceEnd   AudioPacketType = 2
+	AudioPacketTypeMultichannel  AudioPacketType = 4
+	AudioPacketTypeMultitrack    AudioPacketType = 5
+)
+
+// AudioHeader is the parsed header of an audio tag payload
+type AudioHeader struct {
+	SoundFormat SoundFormat
+	SoundRate   byte // 0: 5.5 kHz, 1: 11 kHz, 2: 22 kHz, 3: 44 kHz
+	SoundSize   byte // 0: 8-bit, 1: 16-bit
+	SoundType   byte // 0: mono, 1: stereo
+
+	// AACPacketType is set for SoundFormatAAC
+	AACPacketType AACPacketType
+
+	// Enhanced RTMP fields, set for SoundFormatExHeader
+	PacketType AudioPacketType
+	FourCC     FourCC
+
+	// PayloadOffset is where the codec data starts in the tag payload
+	PayloadOffset int
+}
+
+// ParseAudioHeader parses the header of an audio tag payload
+func ParseAudioHeader(data []byte) (AudioHeader, error) {
+	if len(data) < 1 {
+		return AudioHeader{}, fmt.Errorf("%w: empty audio tag", ErrShortPayload)
+	}
+
+	h := AudioHeader{
+		SoundFormat:   SoundFormat(data[0] >> 4),
+		SoundRate:     (data[0] >> 2) & 0x03,
+		SoundSize:     (data[0] >> 1) & 0x01,
+		SoundType:     data[0] & 0x01,
+		PayloadOffset: 1,
+	}
+	switch h.SoundFormat {
+	case SoundFormatAAC:
+		if len(data) < 2 {
+			return AudioHeader{}, fmt.Errorf("%w: AAC tag without packet type", ErrShortPayload)
+		}
+		h.AACPacketType = AACPacketType(data[1])
+		h.PayloadOffset = 2
+	case SoundFormatExHeader:
+		if len(data) < 5 {
+			return AudioHeader{}, fmt.Errorf("%w: enhanced audio tag without FourCC", ErrShortPayload)
+		}
+		h.PacketType = AudioPacketType(data[0] & 0x0f)
+		h.FourCC = FourCC(data[1:5])
+		h.SoundRate, h.SoundSize, h.SoundType = 0, 0, 0 // reused as the packet type
+		h.PayloadOffset = 5
+	}
+	return h, nil
+}
+
+// IsSequenceHeader reports whether the payload is a decoder configuration
+func (h AudioHeader) IsSequenceHeader() bool {
+	switch h.SoundFormat {
+	case SoundFormatAAC:
+		return h.AACPacketType == AACPacketTypeSequenceHeader
+	case SoundFormatExHeader:
+		return h.PacketType == AudioPacketTypeSequenceStart
+	}
+	return false
+}
+
+// Codec returns a short codec name, e.g. "aac" or "opus"
+func (h AudioHeader) Codec() string {
+	if h.SoundFormat == SoundFormatExHeader {
+		return h.FourCC.Codec()
+	}
+	return h.SoundFormat.String()
+}
+
+// SampleRate returns the sample rate signalled in the tag header. AAC always
+// signals 44 kHz; the real rate is in the AudioSpecificConfig.
+func (h AudioHeader) SampleRate() int {
+	switch h.SoundFormat {
+	case SoundFormatNellymoser8k, SoundFormatMP38k, SoundFormatG711ALaw, SoundFormatG711MuLaw:
+		return 8000
+	case SoundFormatNellymoser16k, SoundFormatSpeex:
+		return 16000
+	}
+	return [...]int{5512, 11025, 22050, 44100}[h.SoundRate]
+}
+
+// Channels returns the channel count signalled in the tag header
+func (h AudioHeader) Channels() int {
+	return int(h.SoundType) + 1
+}
+
+// FrameType is the frame type of a video tag
+type FrameType byte
+
+// Video frame types
+const (
+	FrameTypeKeyframe           FrameType = 1
+	FrameTypeInterframe         FrameType = 2
+	FrameTypeDisposableInter    FrameType = 3
+	FrameTypeGeneratedKeyframe  FrameType = 4
+	FrameTypeVideoInfoOrCommand FrameType = 5
+)
+
+// CodecID is the legacy (non Enhanced RTMP) video codec of a video tag
+type CodecID byte
+
+// Video codec IDs. HEVC (12) is not part of the specification but is used by
+// the Chinese CDN extension that predates Enhanced RTMP.
+const (
+	CodecIDSorensonH263 CodecID = 2
+	CodecIDScreenVideo  CodecID = 3
+	CodecIDVP6          CodecID = 4
+	CodecIDVP6Alpha     CodecID = 5
+	CodecIDScreenVideo2 CodecID = 6
+	CodecIDAVC          CodecID = 7
+	CodecIDHEVC         CodecID = 12
+)
+
+var codecIDNames = map[CodecID]string{
+	CodecIDSorensonH263: "h263",
+	CodecIDScreenVideo:  "screen",
+	CodecIDVP6:          "vp6",
+	CodecIDVP6Alpha:     "vp6a",
+	CodecIDScreenVideo2: "screen2",
+	CodecIDAVC:          "avc",
+	CodecIDHEVC:         "hevc",
+}
+
+// String returns a short codec name
+func (c CodecID) String() string {
+	if name, ok := codecIDNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("codec_%d", byte(c))
+}
+
+// FourCC identifies an Enhanced RTMP codec
+type FourCC string
+
+// Enhanced RTMP FourCCs
+const (
+	FourCCAVC  FourCC = "avc1"
+	FourCCHEVC FourCC = "hvc1"
+	FourCCAV1  FourCC = "av01"
+	FourCCVP9  FourCC = "vp09"
+
+	FourCCOpus FourCC = "Opus"
+	FourCCFLAC FourCC = "fLaC"
+	FourCCAC3  FourCC = "ac-3"
+	FourCCEAC3 FourCC = "ec-3"
+	FourCCAAC  FourCC = "mp4a"
+	FourCCMP3  FourCC = ".mp3"
+)
+
+var fourCCNames = map[FourCC]string{
+	FourCCAVC:  "avc",
+	FourCCHEVC: "hevc",
+	FourCCAV1:  "av1",
+	FourCCVP9:  "vp9",
+	FourCCOpus: "opus",
+	FourCCFLAC: "flac",
+	FourCCAC3:  "ac3",
+	FourCCEAC3: "eac3",
+	FourCCAAC:  "aac",
+	FourCCMP3:  "mp3",
+}
+
+// Codec returns the short codec name used for legacy codecs, or the FourCC
+// itself when it is unknown
+func (f FourCC) Codec() string {
+	if name, ok := fourCCNames[f]; ok {
+		return name
+	}
+	return string(f)
+}
+
+// VideoPacketType says what a video tag carries. Legacy AVC/HEVC packet
+// types map onto the first three values.
+type VideoPacketType byte
+
+// Video packet types, as defined by Enhanced RTMP
+const (
+	VideoPacketTypeSequenceStart        VideoPacketType = 0
+	VideoPacketTypeCodedFrames          VideoPacketType = 1
+	VideoPacketTypeSequenceEnd          VideoPacketType = 2
+	VideoPacketTypeCodedFramesX         VideoPacketType = 3 // coded frames, composition time 0
+	VideoPacketTypeMetadata             VideoPacketType = 4
+	VideoPacketTypeMPEG2TSSequenceStart VideoPacketType = 5
+	VideoPacketTypeMultitrack           VideoPacketType = 6
+	VideoPacketTypeModEx                VideoPacketType = 7
+)
+
+// VideoHeader is the parsed header of a video tag payload
+type VideoHeader struct {
+	FrameType FrameType
+
+	// CodecID is set for legacy tags, FourCC for Enhanced RTMP tags
+	Enhanced bool
+	CodecID  CodecID
+	FourCC   FourCC
+
+	// PacketType is set for AVC/HEVC and Enhanced RTMP tags
+	PacketType VideoPacketType
+
+	// CompositionTime is the PTS - DTS offset in milliseconds
+	CompositionTime int32
+
+	// PayloadOffset is where the codec data starts in the tag payload
+	PayloadOffset int
+}
+
+// ParseVideoHeader parses the header of a video tag payload
+func ParseVideoHeader(data []byte) (VideoHeader, error) {
+	if len(data) < 1 {
+		return VideoHeader{}, fmt.Errorf("%w: empty video tag", ErrShortPayload)
+	}
+
+	if data[0]&0x80 != 0 {
+		return parseExVideoHeader(data)
+	}
+
+	h := VideoHeader{
+		FrameType:     FrameType(data[0] >> 4),
+		CodecID:       CodecID(data[0] & 0x0f),
+		PayloadOffset: 1,
+	}
+	if h.FrameType == FrameTypeVideoInfoOrCommand {
+		return h, nil
+	}
+	if h.CodecID == CodecIDAVC || h.CodecID == CodecIDHEVC {
+		if len(data) < 5 {
+			return VideoHeader{}, fmt.Errorf("%w: %s tag without packet type", ErrShortPayload, h.CodecID)
+		}
+		h.PacketType = VideoPacketType(data[1])
+		h.CompositionTime = compositionTime(data[2:5])
+		h.PayloadOffset = 5
+	}
+	return h, nil
+}
+
+// parseExVideoHeader parses an Enhanced RTMP ExVideoTagHeader
+func parseExVideoHeader(data []byte) (VideoHeader, error) {
+	h := VideoHeader{
+		Enhanced:   true,
+		FrameType:  FrameType((data[0] >> 4) & 0x07),
+		PacketType: VideoPacketType(data[0] & 0x0f),
+	}
+	switch h.PacketType {
+	case VideoPacketTypeMultitrack, VideoPacketTypeModEx:
+		return VideoHeader{}, fmt.Errorf("flv: unsupported enhanced video packet type %d", h.PacketType)
+	}
+
+	if h.FrameType == FrameTypeVideoInfoOrCommand && h.PacketType != VideoPacketTypeMetadata {
+		// The payload is a single VideoCommand byte, no FourCC
+		h.PayloadOffset = 1
+		return h, nil
+	}
+	if len(data) < 5 {
+		return VideoHeader{}, fmt.Errorf("%w: enhanced video tag without FourCC", ErrShortPayload)
+	}
+	h.FourCC = FourCC(data[1:5])
+	h.PayloadOffset = 5
+
+	// Only AVC and HEVC coded frames carry a composition time
+	if h.PacketType == VideoPacketTypeCodedFrames && (h.FourCC == FourCCAVC || h.FourCC == FourCCHEVC) {
+		if len(data) < 8 {
+			return VideoHeader{}, fmt.Errorf("%w: %s coded frames without composition time", ErrShortPayload, h.FourCC)
+		}
+		h.CompositionTime = compositionTime(data[5:8])
+		h.PayloadOffset = 8
+	}
+	return h, nil
+}
+
+// compositionTime decodes a signed 24-bit big endian integer
+func compositionTime(b []byte) int32 {
+	return int32(uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8) >> 8
+}
+
+// IsSequenceHeader reports whether the payload is a decoder configuration
+func (h VideoHeader) IsSequenceHeader() bool {
+	if h.FrameType == FrameTypeVideoInfoOrCommand {
+		return false
+	}
+	if h.Enhanced {
+		return h.PacketType == VideoPacketTypeSequenceStart
+	}
+	return (h.CodecID == CodecIDAVC || h.CodecID == CodecIDHEVC) && h.PacketType == VideoPacketTypeSequenceStart
+}
+
+// IsSequenceEnd reports whether the payload signals the end of a sequence
+func (h VideoHeader) IsSequenceEnd() bool {
+	if h.Enhanced || h.CodecID == CodecIDAVC || h.CodecID == CodecIDHEVC {
+		return h.PacketType == VideoPacketTypeSequenceEnd
+	}
+	return false
+}
+
+// IsCodedFrame reports whether the payload carries coded video
+func (h VideoHeader) IsCodedFrame() bool {
+	if h.FrameType == FrameTypeVideoInfoOrCommand {
+		return false
+	}
+	if h.Enhanced || h.CodecID == CodecIDAVC || h.CodecID == CodecIDHEVC {
+		return h.PacketType == VideoPacketTypeCodedFrames || h.PacketType == VideoPacketTypeCodedFramesX
+	}
+	return true
+}
+
+// IsKeyframe reports whether the payload is a coded keyframe
+func (h VideoHeader) IsKeyframe() bool {
+	return (h.FrameType == FrameTypeKeyframe || h.FrameType == FrameTypeGeneratedKeyframe) && h.IsCodedFrame()
+}
+
+// Codec returns a short codec name, e.g. "avc" or "av1", whether the tag
+// uses a legacy codec ID or an Enhanced RTMP FourCC
+func (h VideoHeader) Codec() string {
+	if h.Enhanced {
+		return h.FourCC.Codec()
+	}
+	return h.CodecID.String()
+}
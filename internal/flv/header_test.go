@@ -0,0 +1,274 @@
+package flv
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseAudioHeader(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           []byte
+		expected       AudioHeader
+		expectedCodec  string
+		sequenceHeader bool
+		sampleRate     int
+		channels       int
+		expectError    bool
+	}{
+		{
+			name:           "AAC sequence header",
+			data:           []byte{0xaf, 0x00, 0x12, 0x10},
+			expected:       AudioHeader{SoundFormat: SoundFormatAAC, SoundRate: 3, SoundSize: 1, SoundType: 1, AACPacketType: AACPacketTypeSequenceHeader, PayloadOffset: 2},
+			expectedCodec:  "aac",
+			sequenceHeader: true,
+			sampleRate:     44100,
+			channels:       2,
+		},
+		{
+			name:          "AAC raw frame",
+			data:          []byte{0xaf, 0x01, 0x21},
+			expected:      AudioHeader{SoundFormat: SoundFormatAAC, SoundRate: 3, SoundSize: 1, SoundType: 1, AACPacketType: AACPacketTypeRaw, PayloadOffset: 2},
+			expectedCodec: "aac",
+			sampleRate:    44100,
+			channels:      2,
+		},
+		{
+			name:          "MP3 mono 22 kHz",
+			data:          []byte{0x2a, 0xff},
+			expected:      AudioHeader{SoundFormat: SoundFormatMP3, SoundRate: 2, SoundSize: 1, PayloadOffset: 1},
+			expectedCodec: "mp3",
+			sampleRate:    22050,
+			channels:      1,
+		},
+		{
+			name:          "G.711 A-law",
+			data:          []byte{0x72, 0xd5},
+			expected:      AudioHeader{SoundFormat: SoundFormatG711ALaw, SoundSize: 1, PayloadOffset: 1},
+			expectedCodec: "g711a",
+			sampleRate:    8000,
+			channels:      1,
+		},
+		{
+			name:           "Enhanced Opus sequence start",
+			data:           []byte{0x90, 'O', 'p', 'u', 's', 0x01},
+			expected:       AudioHeader{SoundFormat: SoundFormatExHeader, PacketType: AudioPacketTypeSequenceStart, FourCC: FourCCOpus, PayloadOffset: 5},
+			expectedCodec:  "opus",
+			sequenceHeader: true,
+			sampleRate:     5512,
+			channels:       1,
+		},
+		{
+			name:        "Empty payload",
+			data:        []byte{},
+			expectError: true,
+		},
+		{
+			name:        "AAC without packet type",
+			data:        []byte{0xaf},
+			expectError: true,
+		},
+		{
+			name:        "Enhanced audio without FourCC",
+			data:        []byte{0x91, 'O', 'p'},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ParseAudioHeader(tt.data)
+			if tt.expectError {
+				if !errors.Is(err, ErrShortPayload) {
+					t.Fatalf("ParseAudioHeader() error = %v, expected ErrShortPayload", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseAudioHeader() error = %v", err)
+			}
+			if h != tt.expected {
+				t.Errorf("ParseAudioHeader() = %+v, expected %+v", h, tt.expected)
+			}
+			if h.Codec() != tt.expectedCodec {
+				t.Errorf("Codec() = %q, expected %q", h.Codec(), tt.expectedCodec)
+			}
+			if h.IsSequenceHeader() != tt.sequenceHeader {
+				t.Errorf("IsSequenceHeader() = %v, expected %v", h.IsSequenceHeader(), tt.sequenceHeader)
+			}
+			if h.SampleRate() != tt.sampleRate || h.Channels() != tt.channels {
+				t.Errorf("SampleRate(), Channels() = %d, %d, expected %d, %d", h.SampleRate(), h.Channels(), tt.sampleRate, tt.channels)
+			}
+		})
+	}
+}
+
+func TestParseVideoHeader(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           []byte
+		expected       VideoHeader
+		expectedCodec  string
+		sequenceHeader bool
+		keyframe       bool
+		sequenceEnd    bool
+		expectError    bool
+	}{
+		{
+			name:           "AVC sequence header",
+			data:           []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x64},
+			expected:       VideoHeader{FrameType: FrameTypeKeyframe, CodecID: CodecIDAVC, PacketType: VideoPacketTypeSequenceStart, PayloadOffset: 5},
+			expectedCodec:  "avc",
+			sequenceHeader: true,
+		},
+		{
+			name:          "AVC keyframe with composition time",
+			data:          []byte{0x17, 0x01, 0x00, 0x00, 0x42, 0x65},
+			expected:      VideoHeader{FrameType: FrameTypeKeyframe, CodecID: CodecIDAVC, PacketType: VideoPacketTypeCodedFrames, CompositionTime: 66, PayloadOffset: 5},
+			expectedCodec: "avc",
+			keyframe:      true,
+		},
+		{
+			name:          "AVC inter frame with negative composition time",
+			data:          []byte{0x27, 0x01, 0xff, 0xff, 0xdf, 0x41},
+			expected:      VideoHeader{FrameType: FrameTypeInterframe, CodecID: CodecIDAVC, PacketType: VideoPacketTypeCodedFrames, CompositionTime: -33, PayloadOffset: 5},
+			expectedCodec: "avc",
+		},
+		{
+			name:          "AVC end of sequence",
+			data:          []byte{0x17, 0x02, 0x00, 0x00, 0x00},
+			expected:      VideoHeader{FrameType: FrameTypeKeyframe, CodecID: CodecIDAVC, PacketType: VideoPacketTypeSequenceEnd, PayloadOffset: 5},
+			expectedCodec: "avc",
+			sequenceEnd:   true,
+		},
+		{
+			name:           "Legacy HEVC sequence header",
+			data:           []byte{0x1c, 0x00, 0x00, 0x00, 0x00, 0x01},
+			expected:       VideoHeader{FrameType: FrameTypeKeyframe, CodecID: CodecIDHEVC, PacketType: VideoPacketTypeSequenceStart, PayloadOffset: 5},
+			expectedCodec:  "hevc",
+			sequenceHeader: true,
+		},
+		{
+			name:          "VP6 keyframe",
+			data:          []byte{0x14, 0x00, 0x01},
+			expected:      VideoHeader{FrameType: FrameTypeKeyframe, CodecID: CodecIDVP6, PayloadOffset: 1},
+			expectedCodec: "vp6",
+			keyframe:      true,
+		},
+		{
+			name:          "Video command frame",
+			data:          []byte{0x57, 0x00},
+			expected:      VideoHeader{FrameType: FrameTypeVideoInfoOrCommand, CodecID: CodecIDAVC, PayloadOffset: 1},
+			expectedCodec: "avc",
+		},
+		{
+			name:           "Enhanced HEVC sequence start",
+			data:           []byte{0x90, 'h', 'v', 'c', '1', 0x01},
+			expected:       VideoHeader{Enhanced: true, FrameType: FrameTypeKeyframe, FourCC: FourCCHEVC, PacketType: VideoPacketTypeSequenceStart, PayloadOffset: 5},
+			expectedCodec:  "hevc",
+			sequenceHeader: true,
+		},
+		{
+			name:          "Enhanced HEVC coded frames with composition time",
+			data:          []byte{0x91, 'h', 'v', 'c', '1', 0x00, 0x00, 0x21, 0x26},
+			expected:      VideoHeader{Enhanced: true, FrameType: FrameTypeKeyframe, FourCC: FourCCHEVC, PacketType: VideoPacketTypeCodedFrames, CompositionTime: 33, PayloadOffset: 8},
+			expectedCodec: "hevc",
+			keyframe:      true,
+		},
+		{
+			name:          "Enhanced HEVC coded frames without composition time",
+			data:          []byte{0xa3, 'h', 'v', 'c', '1', 0x02},
+			expected:      VideoHeader{Enhanced: true, FrameType: FrameTypeInterframe, FourCC: FourCCHEVC, PacketType: VideoPacketTypeCodedFramesX, PayloadOffset: 5},
+			expectedCodec: "hevc",
+		},
+		{
+			name:          "Enhanced AV1 keyframe",
+			data:          []byte{0x91, 'a', 'v', '0', '1', 0x12, 0x00},
+			expected:      VideoHeader{Enhanced: true, FrameType: FrameTypeKeyframe, FourCC: FourCCAV1, PacketType: VideoPacketTypeCodedFrames, PayloadOffset: 5},
+			expectedCodec: "av1",
+			keyframe:      true,
+		},
+		{
+			name:          "Enhanced VP9 sequence end",
+			data:          []byte{0x92, 'v', 'p', '0', '9'},
+			expected:      VideoHeader{Enhanced: true, FrameType: FrameTypeKeyframe, FourCC: FourCCVP9, PacketType: VideoPacketTypeSequenceEnd, PayloadOffset: 5},
+			expectedCodec: "vp9",
+			sequenceEnd:   true,
+		},
+		{
+			name:          "Enhanced metadata",
+			data:          []byte{0x94, 'a', 'v', '0', '1', 0x02},
+			expected:      VideoHeader{Enhanced: true, FrameType: FrameTypeKeyframe, FourCC: FourCCAV1, PacketType: VideoPacketTypeMetadata, PayloadOffset: 5},
+			expectedCodec: "av1",
+		},
+		{
+			name:        "Empty payload",
+			data:        []byte{},
+			expectError: true,
+		},
+		{
+			name:        "AVC without composition time",
+			data:        []byte{0x17, 0x01, 0x00},
+			expectError: true,
+		},
+		{
+			name:        "Enhanced HEVC coded frames without composition time bytes",
+			data:        []byte{0x91, 'h', 'v', 'c', '1', 0x00},
+			expectError: true,
+		},
+		{
+			name:        "Enhanced without FourCC",
+			data:        []byte{0x90, 'a', 'v'},
+			expectError: true,
+		},
+		{
+			name:        "Enhanced multitrack",
+			data:        []byte{0x96, 0x00, 'a', 'v', '0', '1'},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ParseVideoHeader(tt.data)
+			if tt.expectError {
+				if err == nil {
+					t.Fatalf("ParseVideoHeader() = %+v, expected an error", h)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseVideoHeader() error = %v", err)
+			}
+			if h != tt.expected {
+				t.Errorf("ParseVideoHeader() = %+v, expected %+v", h, tt.expected)
+			}
+			if h.Codec() != tt.expectedCodec {
+				t.Errorf("Codec() = %q, expected %q", h.Codec(), tt.expectedCodec)
+			}
+			if h.IsSequenceHeader() != tt.sequenceHeader || h.IsKeyframe() != tt.keyframe || h.IsSequenceEnd() != tt.sequenceEnd {
+				t.Errorf("IsSequenceHeader(), IsKeyframe(), IsSequenceEnd() = %v, %v, %v, expected %v, %v, %v",
+					h.IsSequenceHeader(), h.IsKeyframe(), h.IsSequenceEnd(), tt.sequenceHeader, tt.keyframe, tt.sequenceEnd)
+			}
+		})
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	tag, err := ParseTag(TagTypeVideo, 40, []byte{0x90, 'h', 'v', 'c', '1', 0x01})
+	if err != nil {
+		t.Fatalf("ParseTag() error = %v", err)
+	}
+	if tag.Video == nil || tag.Audio != nil || !tag.IsSequenceHeader() || tag.IsKeyframe() {
+		t.Errorf("ParseTag() = %+v, expected a parsed HEVC sequence start", tag)
+	}
+
+	tag, err = ParseTag(TagTypeScript, 0, []byte{0x02})
+	if err != nil || tag.Audio != nil || tag.Video != nil || tag.Metadata != nil {
+		t.Errorf("ParseTag() = %+v, %v, expected an unparsed script tag", tag, err)
+	}
+
+	if _, err := ParseTag(TagTypeAudio, 0, nil); !errors.Is(err, ErrShortPayload) {
+		t.Errorf("ParseTag() error = %v, expected ErrShortPayload", err)
+	}
+}
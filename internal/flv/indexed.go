@@ -0,0 +1,246 @@
+package flv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/yutopp/go-amf0"
+)
+
+// tagOverhead is the tag header plus the trailing PreviousTagSize
+const tagOverhead = 11 + 4
+
+// IndexedFile writes a seekable FLV file. Tags are written to a ".part" file
+// next to the destination; Close writes the destination with an onMetaData
+// carrying the duration, file size and a keyframes index (times and file
+// positions, as read by players and flvmeta), followed by the tags.
+type IndexedFile struct {
+	path     string
+	part     *os.File
+	buffered *bufio.Writer
+	writer   *Writer
+	metadata amf0.ECMAArray
+
+	size         int64 // bytes of tags written to the part file
+	firstTS      uint32
+	lastTS       uint32
+	hasTimestamp bool
+	hasVideo     bool
+	hasAudio     bool
+	keyTimes     []float64 // seconds
+	keyPositions []int64   // offsets into the part file
+}
+
+// FileInfo describes a finished indexed file
+type FileInfo struct {
+	Path      string  `json:"path"`
+	Size      int64   `json:"size"`
+	Duration  float64 `json:"duration"` // seconds
+	Keyframes int     `json:"keyframes"`
+}
+
+// CreateIndexedFile starts writing an indexed FLV file at path
+func CreateIndexedFile(path string) (*IndexedFile, error) {
+	part, err := os.Create(path + ".part")
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewWriter(part)
+	return &IndexedFile{
+		path:     path,
+		part:     part,
+		buffered: buffered,
+		writer:   NewWriter(buffered),
+	}, nil
+}
+
+// SetMetadata sets the onMetaData object written ahead of the tags, from the
+// body of an onMetaData script tag. Its duration, filesize and keyframes
+// fields are replaced on Close.
+func (f *IndexedFile) SetMetadata(data []byte) error {
+	metadata, err := decodeMetadata(data)
+	if err != nil {
+		return err
+	}
+	f.metadata = metadata
+	return nil
+}
+
+// WriteTag appends a tag. Script tags are not written; onMetaData belongs in
+// SetMetadata.
+func (f *IndexedFile) WriteTag(tag Tag) error {
+	if tag.Type == TagTypeScript {
+		return nil
+	}
+	if !f.hasTimestamp {
+		f.firstTS, f.hasTimestamp = tag.Timestamp, true
+	}
+	if tag.Timestamp > f.lastTS {
+		f.lastTS = tag.Timestamp
+	}
+	switch tag.Type {
+	case TagTypeVideo:
+		f.hasVideo = true
+		if tag.IsKeyframe() {
+			f.keyTimes = append(f.keyTimes, float64(tag.Timestamp)/1000)
+			f.keyPositions = append(f.keyPositions, f.size)
+		}
+	case TagTypeAudio:
+		f.hasAudio = true
+	}
+
+	if err := f.writer.WriteTag(tag.Type, tag.Timestamp, tag.Data); err != nil {
+		return err
+	}
+	f.size += int64(len(tag.Data)) + tagOverhead
+	return nil
+}
+
+// Size returns the number of bytes of tags written so far
+func (f *IndexedFile) Size() int64 {
+	return f.size
+}
+
+// Duration returns the time spanned by the tags written so far, in milliseconds
+func (f *IndexedFile) Duration() uint32 {
+	return f.lastTS - f.firstTS
+}
+
+// Close writes the final file and removes the part file
+func (f *IndexedFile) Close() (FileInfo, error) {
+	err := f.buffered.Flush()
+	if closeErr := f.part.Close(); err == nil {
+		err = closeErr
+	}
+	defer os.Remove(f.part.Name())
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	script, err := f.script()
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	out, err := os.Create(f.path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	part, err := os.Open(f.part.Name())
+	if err != nil {
+		out.Close()
+		return FileInfo{}, err
+	}
+	defer part.Close()
+
+	buffered := bufio.NewWriter(out)
+	w := NewWriter(buffered)
+	w.WriteHeaderFlags(f.hasAudio, f.hasVideo)
+	err = w.WriteTag(TagTypeScript, 0, script)
+	if err == nil {
+		_, err = io.Copy(buffered, part)
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.path)
+		return FileInfo{}, err
+	}
+
+	return FileInfo{
+		Path:      f.path,
+		Size:      f.fileSize(len(script)),
+		Duration:  float64(f.Duration()) / 1000,
+		Keyframes: len(f.keyTimes),
+	}, nil
+}
+
+// fileSize is the size of the final file given the size of its script tag
+func (f *IndexedFile) fileSize(scriptSize int) int64 {
+	return f.bodyOffset(scriptSize) + f.size
+}
+
+// bodyOffset is where the tags start in the final file: after the file
+// header, PreviousTagSize0 and the script tag
+func (f *IndexedFile) bodyOffset(scriptSize int) int64 {
+	return headerSize + 4 + int64(scriptSize) + tagOverhead
+}
+
+// script encodes the final onMetaData. AMF0 numbers have a fixed size, so
+// the tag's size, and with it every file position, is known before the
+// values are filled in.
+func (f *IndexedFile) script() ([]byte, error) {
+	metadata := amf0.ECMAArray{}
+	for key, value := range f.metadata {
+		metadata[key] = value
+	}
+	positions := make([]interface{}, len(f.keyPositions))
+	times := make([]interface{}, len(f.keyTimes))
+	for i := range times {
+		times[i] = f.keyTimes[i]
+	}
+	metadata["duration"] = float64(f.Duration()) / 1000
+	metadata["filesize"] = 0.0
+	metadata["hasKeyframes"] = len(times) > 0
+	metadata["canSeekToEnd"] = true
+	metadata["keyframes"] = map[string]interface{}{
+		"times":         times,
+		"filepositions": positions,
+	}
+	for i := range positions {
+		positions[i] = 0.0
+	}
+
+	placeholder, err := encodeMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+	offset := f.bodyOffset(len(placeholder))
+	for i, position := range f.keyPositions {
+		positions[i] = float64(offset + position)
+	}
+	metadata["filesize"] = float64(f.fileSize(len(placeholder)))
+	return encodeMetadata(metadata)
+}
+
+// encodeMetadata encodes an onMetaData script tag body. Properties are
+// written in a fixed order with keyframes first: go-amf0, and with it
+// ParseMetadata, cannot decode an object nested in an ECMA array after
+// other properties.
+func encodeMetadata(metadata amf0.ECMAArray) ([]byte, error) {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if (keys[i] == "keyframes") != (keys[j] == "keyframes") {
+			return keys[i] == "keyframes"
+		}
+		return keys[i] < keys[j]
+	})
+
+	buf := &bytes.Buffer{}
+	encoder := amf0.NewEncoder(buf)
+	if err := encoder.Encode("onMetaData"); err != nil {
+		return nil, err
+	}
+	buf.WriteByte(byte(amf0.MarkerEcmaArray))
+	binary.Write(buf, binary.BigEndian, uint32(len(keys)))
+	for _, key := range keys {
+		binary.Write(buf, binary.BigEndian, uint16(len(key)))
+		buf.WriteString(key)
+		if err := encoder.Encode(metadata[key]); err != nil {
+			return nil, err
+		}
+	}
+	buf.Write([]byte{0x00, 0x00, byte(amf0.MarkerObjectEnd)})
+	return buf.Bytes(), nil
+}
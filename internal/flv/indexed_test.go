@@ -0,0 +1,118 @@
+package flv
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yutopp/go-amf0"
+)
+
+func TestIndexedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.flv")
+	f, err := CreateIndexedFile(path)
+	if err != nil {
+		t.Fatalf("CreateIndexedFile() error = %v", err)
+	}
+	if err := f.SetMetadata(encodeScript(t, "@setDataFrame", "onMetaData", amf0.ECMAArray{
+		"width":    1280.0,
+		"duration": 0.0,
+	})); err != nil {
+		t.Fatalf("SetMetadata() error = %v", err)
+	}
+
+	writes := []struct {
+		tagType   byte
+		timestamp uint32
+		data      []byte
+	}{
+		{TagTypeVideo, 1000, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}},
+		{TagTypeScript, 1000, []byte{0x02, 0x00, 0x0a}}, // not written
+		{TagTypeVideo, 1000, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65}},
+		{TagTypeAudio, 1020, []byte{0xaf, 0x01, 0x21}},
+		{TagTypeVideo, 1033, []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x41}},
+		{TagTypeVideo, 3000, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65}},
+		{TagTypeAudio, 3500, []byte{0xaf, 0x01, 0x21}},
+	}
+	for _, w := range writes {
+		tag, _ := ParseTag(w.tagType, w.timestamp, w.data)
+		if err := f.WriteTag(tag); err != nil {
+			t.Fatalf("WriteTag() error = %v", err)
+		}
+	}
+
+	info, err := f.Close()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+		t.Errorf("part file left behind: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	expectedInfo := FileInfo{Path: path, Size: int64(len(data)), Duration: 2.5, Keyframes: 2}
+	if info != expectedInfo {
+		t.Errorf("Close() = %+v, expected %+v", info, expectedInfo)
+	}
+
+	reader := NewReader(bytes.NewReader(data))
+	header, err := reader.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error = %v", err)
+	}
+	if !header.HasAudio || !header.HasVideo {
+		t.Errorf("header = %+v, expected audio and video", header)
+	}
+
+	script, err := reader.ReadTag()
+	if err != nil || script.Type != TagTypeScript {
+		t.Fatalf("first tag = %v, %v, expected onMetaData", script.Type, err)
+	}
+	metadata, err := decodeMetadata(script.Data)
+	if err != nil {
+		t.Fatalf("decodeMetadata() error = %v", err)
+	}
+	if metadata["width"] != 1280.0 || metadata["duration"] != 2.5 || metadata["filesize"] != float64(len(data)) {
+		t.Errorf("onMetaData = %v, expected width 1280, duration 2.5 and filesize %d", metadata, len(data))
+	}
+
+	// Every tag offset, to check the keyframe positions against
+	offsets := map[float64]Tag{}
+	var count int
+	for {
+		offset := reader.Offset()
+		tag, err := reader.ReadTag()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadTag() error = %v", err)
+		}
+		offsets[float64(offset)] = tag
+		count++
+	}
+	if count != 6 {
+		t.Errorf("read %d tags after onMetaData, expected 6", count)
+	}
+
+	keyframes, _ := metadata["keyframes"].(map[string]interface{})
+	times, _ := keyframes["times"].([]interface{})
+	if expected := []interface{}{1.0, 3.0}; !reflect.DeepEqual(times, expected) {
+		t.Errorf("keyframes.times = %v, expected %v", times, expected)
+	}
+	positions, _ := keyframes["filepositions"].([]interface{})
+	if len(positions) != 2 {
+		t.Fatalf("keyframes.filepositions = %v, expected 2 positions", positions)
+	}
+	for i, position := range positions {
+		tag, ok := offsets[position.(float64)]
+		if !ok || !IsKeyframe(tag.Type, tag.Data) || tag.Timestamp != uint32(times[i].(float64)*1000) {
+			t.Errorf("filepositions[%d] = %v does not point at the keyframe at %vs", i, position, times[i])
+		}
+	}
+}
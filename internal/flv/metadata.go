@@ -0,0 +1,140 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/yutopp/go-amf0"
+)
+
+// ErrNotMetadata is returned by ParseMetadata for script data other than
+// onMetaData, such as onCuePoint or onTextData
+var ErrNotMetadata = errors.New("flv: script data is not onMetaData")
+
+// StreamMetadata is the onMetaData object sent by encoders ahead of the media.
+// Values are as declared by the encoder, which is not always accurate.
+type StreamMetadata struct {
+	Width           int     `json:"width,omitempty"`
+	Height          int     `json:"height,omitempty"`
+	FrameRate       float64 `json:"framerate,omitempty"`
+	VideoDataRate   float64 `json:"videodatarate,omitempty"` // kbit/s
+	AudioDataRate   float64 `json:"audiodatarate,omitempty"` // kbit/s
+	VideoCodec      string  `json:"videocodec,omitempty"`    // e.g. "avc", "hevc"
+	AudioCodec      string  `json:"audiocodec,omitempty"`    // e.g. "aac"
+	AudioSampleRate float64 `json:"audiosamplerate,omitempty"`
+	AudioChannels   int     `json:"audiochannels,omitempty"`
+	Encoder         string  `json:"encoder,omitempty"`
+
+	// Custom holds every other field of the object
+	Custom map[string]interface{} `json:"custom,omitempty"`
+}
+
+// ParseMetadata decodes the AMF0 body of an onMetaData script tag, with or
+// without the leading @setDataFrame of the RTMP data message
+func ParseMetadata(data []byte) (*StreamMetadata, error) {
+	object, err := decodeMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+
+	md := &StreamMetadata{}
+	for key, value := range object {
+		switch key {
+		case "width":
+			md.Width = int(number(value))
+		case "height":
+			md.Height = int(number(value))
+		case "framerate", "fps":
+			md.FrameRate = number(value)
+		case "videodatarate":
+			md.VideoDataRate = number(value)
+		case "audiodatarate":
+			md.AudioDataRate = number(value)
+		case "videocodecid":
+			md.VideoCodec = codecName(value, func(id byte) string { return CodecID(id).String() })
+		case "audiocodecid":
+			md.AudioCodec = codecName(value, func(id byte) string { return SoundFormat(id).String() })
+		case "audiosamplerate":
+			md.AudioSampleRate = number(value)
+		case "audiochannels":
+			md.AudioChannels = int(number(value))
+		case "stereo":
+			if stereo, ok := value.(bool); ok && md.AudioChannels == 0 {
+				md.AudioChannels = 1
+				if stereo {
+					md.AudioChannels = 2
+				}
+			}
+		case "encoder":
+			md.Encoder, _ = value.(string)
+		case "duration", "filesize":
+			// Always 0 for live streams
+		default:
+			if md.Custom == nil {
+				md.Custom = make(map[string]interface{})
+			}
+			md.Custom[key] = value
+		}
+	}
+	return md, nil
+}
+
+// decodeMetadata decodes the object of an onMetaData script tag body
+func decodeMetadata(data []byte) (amf0.ECMAArray, error) {
+	decoder := amf0.NewDecoder(bytes.NewReader(data))
+
+	var name string
+	if err := decoder.Decode(&name); err != nil {
+		return nil, fmt.Errorf("flv: decoding script data name: %w", err)
+	}
+	if name == "@setDataFrame" {
+		if err := decoder.Decode(&name); err != nil {
+			return nil, fmt.Errorf("flv: decoding script data name: %w", err)
+		}
+	}
+	if name != "onMetaData" {
+		return nil, fmt.Errorf("%w: %q", ErrNotMetadata, name)
+	}
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("flv: decoding onMetaData object: %w", err)
+	}
+	switch v := value.(type) {
+	case amf0.ECMAArray:
+		return v, nil
+	case map[string]interface{}:
+		return v, nil
+	}
+	return nil, fmt.Errorf("flv: onMetaData carries %T, expected an object", value)
+}
+
+// number converts an AMF0 number, ignoring other types
+func number(value interface{}) float64 {
+	if n, ok := value.(float64); ok && !math.IsNaN(n) && !math.IsInf(n, 0) {
+		return n
+	}
+	return 0
+}
+
+// codecName turns a codec id into a codec name. Ids are legacy FLV codec
+// numbers, FourCCs packed into a number (Enhanced RTMP), or strings.
+func codecName(value interface{}, legacy func(id byte) string) string {
+	switch v := value.(type) {
+	case float64:
+		if v >= 0 && v < 256 {
+			return legacy(byte(v))
+		}
+		if v < math.MaxUint32 {
+			var fourCC [4]byte
+			binary.BigEndian.PutUint32(fourCC[:], uint32(v))
+			return FourCC(fourCC[:]).Codec()
+		}
+	case string:
+		return FourCC(v).Codec()
+	}
+	return ""
+}
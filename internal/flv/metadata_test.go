@@ -0,0 +1,96 @@
+package flv
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/yutopp/go-amf0"
+)
+
+// encodeScript encodes AMF0 values as a script tag body
+func encodeScript(t *testing.T, values ...interface{}) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	encoder := amf0.NewEncoder(buf)
+	for _, v := range values {
+		if err := encoder.Encode(v); err != nil {
+			t.Fatalf("Encode(%v) error = %v", v, err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestParseMetadata(t *testing.T) {
+	tests := []struct {
+		name        string
+		values      []interface{}
+		expected    *StreamMetadata
+		expectError error
+	}{
+		{
+			name: "OBS onMetaData",
+			values: []interface{}{"@setDataFrame", "onMetaData", amf0.ECMAArray{
+				"duration":        0.0,
+				"width":           1920.0,
+				"height":          1080.0,
+				"videodatarate":   6000.0,
+				"framerate":       30.0,
+				"videocodecid":    7.0,
+				"audiodatarate":   160.0,
+				"audiosamplerate": 48000.0,
+				"audiosamplesize": 16.0,
+				"audiochannels":   2.0,
+				"stereo":          true,
+				"audiocodecid":    10.0,
+				"encoder":         "obs-output module (libobs version 30.0.0)",
+				"filesize":        0.0,
+			}},
+			expected: &StreamMetadata{
+				Width: 1920, Height: 1080, FrameRate: 30,
+				VideoDataRate: 6000, AudioDataRate: 160,
+				VideoCodec: "avc", AudioCodec: "aac",
+				AudioSampleRate: 48000, AudioChannels: 2,
+				Encoder: "obs-output module (libobs version 30.0.0)",
+				Custom:  map[string]interface{}{"audiosamplesize": 16.0},
+			},
+		},
+		{
+			name: "Enhanced RTMP FourCC codec ids",
+			values: []interface{}{"onMetaData", map[string]interface{}{
+				"videocodecid": float64('h'<<24 | 'v'<<16 | 'c'<<8 | '1'),
+				"audiocodecid": "Opus",
+				"stereo":       false,
+			}},
+			expected: &StreamMetadata{VideoCodec: "hevc", AudioCodec: "opus", AudioChannels: 1},
+		},
+		{
+			name:        "Cue point",
+			values:      []interface{}{"onCuePoint", amf0.ECMAArray{"name": "ad"}},
+			expectError: ErrNotMetadata,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, err := ParseMetadata(encodeScript(t, tt.values...))
+			if tt.expectError != nil {
+				if !errors.Is(err, tt.expectError) {
+					t.Fatalf("ParseMetadata() error = %v, expected %v", err, tt.expectError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMetadata() error = %v", err)
+			}
+			if !reflect.DeepEqual(md, tt.expected) {
+				t.Errorf("ParseMetadata() = %+v, expected %+v", md, tt.expected)
+			}
+		})
+	}
+
+	if _, err := ParseMetadata([]byte{0x02, 0x00, 0x0a}); err == nil {
+		t.Errorf("ParseMetadata() of a truncated name succeeded")
+	}
+}
@@ -0,0 +1,152 @@
+package flv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Errors returned by Reader, wrapped with the offset at which they occurred
+var (
+	ErrInvalidHeader   = errors.New("flv: invalid file header")
+	ErrInvalidTagType  = errors.New("flv: invalid tag type")
+	ErrInvalidStreamID = errors.New("flv: non-zero stream id")
+	ErrTagSizeMismatch = errors.New("flv: PreviousTagSize does not match the previous tag")
+)
+
+// headerSize is the size of the FLV file header, PreviousTagSize0 excluded
+const headerSize = 9
+
+// Header is the FLV file header
+type Header struct {
+	Version  byte
+	HasAudio bool
+	HasVideo bool
+}
+
+// Reader reads FLV tags from a stream, validating the framing as it goes.
+// The file header is read on the first call to ReadHeader or ReadTag.
+type Reader struct {
+	reader *bufio.Reader
+	offset int64 // bytes consumed so far
+	header *Header
+}
+
+// NewReader creates a new FLV reader
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{reader: bufio.NewReader(reader)}
+}
+
+// ReadHeader reads the FLV file header and PreviousTagSize0. Calling it again
+// returns the header read the first time.
+func (r *Reader) ReadHeader() (Header, error) {
+	if r.header != nil {
+		return *r.header, nil
+	}
+
+	var buf [headerSize]byte
+	if err := r.readFull(buf[:]); err != nil {
+		return Header{}, r.errorf(err, "reading file header")
+	}
+	if buf[0] != 'F' || buf[1] != 'L' || buf[2] != 'V' {
+		return Header{}, r.errorf(ErrInvalidHeader, "bad signature %q", buf[:3])
+	}
+	dataOffset := binary.BigEndian.Uint32(buf[5:9])
+	if dataOffset < headerSize {
+		return Header{}, r.errorf(ErrInvalidHeader, "data offset %d", dataOffset)
+	}
+	if extra := int(dataOffset - headerSize); extra > 0 {
+		// Header extensions are allowed by the spec and ignored
+		n, err := r.reader.Discard(extra)
+		r.offset += int64(n)
+		if err != nil {
+			return Header{}, r.errorf(io.ErrUnexpectedEOF, "skipping header extension")
+		}
+	}
+
+	var prev [4]byte
+	if err := r.readFull(prev[:]); err != nil {
+		return Header{}, r.errorf(err, "reading PreviousTagSize0")
+	}
+	if got := binary.BigEndian.Uint32(prev[:]); got != 0 {
+		return Header{}, r.errorf(ErrTagSizeMismatch, "PreviousTagSize0 is %d", got)
+	}
+
+	r.header = &Header{
+		Version:  buf[3],
+		HasAudio: buf[4]&0x04 != 0,
+		HasVideo: buf[4]&0x01 != 0,
+	}
+	return *r.header, nil
+}
+
+// ReadTag reads the next tag. It returns io.EOF at the end of a well formed
+// stream and io.ErrUnexpectedEOF, wrapped, when a tag is truncated.
+func (r *Reader) ReadTag() (Tag, error) {
+	if _, err := r.ReadHeader(); err != nil {
+		return Tag{}, err
+	}
+
+	var hdr [11]byte
+	start := r.offset
+	if _, err := io.ReadFull(r.reader, hdr[:1]); err == io.EOF {
+		return Tag{}, io.EOF
+	} else if err != nil {
+		return Tag{}, r.errorf(err, "reading tag header")
+	}
+	r.offset++
+	if err := r.readFull(hdr[1:]); err != nil {
+		return Tag{}, r.errorf(err, "reading tag header")
+	}
+
+	tagType := hdr[0] & 0x1f
+	if hdr[0]&0x20 != 0 {
+		return Tag{}, fmt.Errorf("tag at offset %d: %w: encrypted tags are not supported", start, ErrInvalidTagType)
+	}
+	if tagType != TagTypeAudio && tagType != TagTypeVideo && tagType != TagTypeScript {
+		return Tag{}, fmt.Errorf("tag at offset %d: %w: %d", start, ErrInvalidTagType, hdr[0])
+	}
+	if streamID := uint32(hdr[8])<<16 | uint32(hdr[9])<<8 | uint32(hdr[10]); streamID != 0 {
+		return Tag{}, fmt.Errorf("tag at offset %d: %w: %d", start, ErrInvalidStreamID, streamID)
+	}
+
+	size := uint32(hdr[1])<<16 | uint32(hdr[2])<<8 | uint32(hdr[3])
+	timestamp := uint32(hdr[7])<<24 | uint32(hdr[4])<<16 | uint32(hdr[5])<<8 | uint32(hdr[6])
+
+	data := make([]byte, size)
+	if err := r.readFull(data); err != nil {
+		return Tag{}, r.errorf(err, "reading %d bytes of tag data", size)
+	}
+
+	var prev [4]byte
+	if err := r.readFull(prev[:]); err != nil {
+		return Tag{}, r.errorf(err, "reading PreviousTagSize")
+	}
+	if got := binary.BigEndian.Uint32(prev[:]); got != size+11 {
+		return Tag{}, fmt.Errorf("tag at offset %d: %w: got %d, expected %d", start, ErrTagSizeMismatch, got, size+11)
+	}
+	return Tag{Type: tagType, Timestamp: timestamp, Data: data}, nil
+}
+
+// Offset returns the number of bytes consumed so far
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// readFull fills buf, turning a clean EOF into io.ErrUnexpectedEOF since
+// the caller is always in the middle of a structure
+func (r *Reader) readFull(buf []byte) error {
+	n, err := io.ReadFull(r.reader, buf)
+	r.offset += int64(n)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// errorf wraps err with the current offset
+func (r *Reader) errorf(err error, format string, args ...interface{}) error {
+	return fmt.Errorf("offset %d: %s: %w", r.offset, fmt.Sprintf(format, args...), err)
+}
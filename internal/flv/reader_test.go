@@ -0,0 +1,181 @@
+package flv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReaderRoundTrip(t *testing.T) {
+	tags := []Tag{
+		{Type: TagTypeScript, Timestamp: 0, Data: []byte{0x02, 0x00, 0x0a, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a'}},
+		{Type: TagTypeVideo, Timestamp: 0, Data: []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x64}},
+		{Type: TagTypeAudio, Timestamp: 0, Data: []byte{0xaf, 0x00, 0x12, 0x10}},
+		{Type: TagTypeVideo, Timestamp: 33, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xaa}},
+		{Type: TagTypeAudio, Timestamp: 0x00fffffe, Data: []byte{0xaf, 0x01, 0xbb}},
+		{Type: TagTypeVideo, Timestamp: 0x01000021, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0xcc}}, // extended timestamp
+		{Type: TagTypeVideo, Timestamp: 0x01000042, Data: []byte{}},
+	}
+
+	buf := &bytes.Buffer{}
+	writer := NewWriter(buf)
+	for _, tag := range tags {
+		var err error
+		switch tag.Type {
+		case TagTypeAudio:
+			err = writer.WriteAudio(tag.Timestamp, tag.Data)
+		case TagTypeVideo:
+			err = writer.WriteVideo(tag.Timestamp, tag.Data)
+		default:
+			err = writer.WriteScript(tag.Timestamp, tag.Data)
+		}
+		if err != nil {
+			t.Fatalf("Write error = %v", err)
+		}
+	}
+
+	size := buf.Len()
+	reader := NewReader(buf)
+	header, err := reader.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error = %v", err)
+	}
+	if header.Version != 1 || !header.HasAudio || !header.HasVideo {
+		t.Errorf("ReadHeader() = %+v, expected version 1 with audio and video", header)
+	}
+
+	for i, expected := range tags {
+		tag, err := reader.ReadTag()
+		if err != nil {
+			t.Fatalf("ReadTag() #%d error = %v", i, err)
+		}
+		if tag.Type != expected.Type || tag.Timestamp != expected.Timestamp || !bytes.Equal(tag.Data, expected.Data) {
+			t.Errorf("ReadTag() #%d = %+v, expected %+v", i, tag, expected)
+		}
+	}
+	if _, err := reader.ReadTag(); err != io.EOF {
+		t.Errorf("ReadTag() at end error = %v, expected io.EOF", err)
+	}
+	if reader.Offset() != int64(size) {
+		t.Errorf("Offset() = %d, expected %d", reader.Offset(), size)
+	}
+}
+
+func TestReaderReadsStandaloneWriteTag(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{'F', 'L', 'V', 0x01, 0x01, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00})
+	if err := WriteTag(TagTypeVideo, 0x12345678, bytes.NewReader([]byte{0x17, 0x01}), buf); err != nil {
+		t.Fatalf("WriteTag() error = %v", err)
+	}
+
+	reader := NewReader(buf)
+	tag, err := reader.ReadTag()
+	if err != nil {
+		t.Fatalf("ReadTag() error = %v", err)
+	}
+	if tag.Type != TagTypeVideo || tag.Timestamp != 0x12345678 || !bytes.Equal(tag.Data, []byte{0x17, 0x01}) {
+		t.Errorf("ReadTag() = %+v", tag)
+	}
+	if header, _ := reader.ReadHeader(); header.HasAudio || !header.HasVideo {
+		t.Errorf("ReadHeader() = %+v, expected video only", header)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	fileHeader := []byte{'F', 'L', 'V', 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
+	validTag := []byte{
+		0x09, 0x00, 0x00, 0x02, 0x00, 0x00, 0x21, 0x00, 0x00, 0x00, 0x00, // header, 2 bytes at 33ms
+		0x17, 0x01,
+		0x00, 0x00, 0x00, 0x0d,
+	}
+	withTag := func(mutate func(tag []byte)) []byte {
+		tag := append([]byte(nil), validTag...)
+		mutate(tag)
+		return append(append([]byte(nil), fileHeader...), tag...)
+	}
+
+	tests := []struct {
+		name        string
+		input       []byte
+		expectedErr error
+	}{
+		{
+			name:        "Bad signature",
+			input:       append([]byte("FLX"), fileHeader[3:]...),
+			expectedErr: ErrInvalidHeader,
+		},
+		{
+			name:        "Data offset inside the header",
+			input:       append(append([]byte(nil), fileHeader[:8]...), 0x05, 0, 0, 0, 0),
+			expectedErr: ErrInvalidHeader,
+		},
+		{
+			name:        "Non-zero PreviousTagSize0",
+			input:       append(append([]byte(nil), fileHeader[:12]...), 0x01),
+			expectedErr: ErrTagSizeMismatch,
+		},
+		{
+			name:        "Truncated file header",
+			input:       fileHeader[:7],
+			expectedErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:        "Unknown tag type",
+			input:       withTag(func(tag []byte) { tag[0] = 0x07 }),
+			expectedErr: ErrInvalidTagType,
+		},
+		{
+			name:        "Encrypted tag",
+			input:       withTag(func(tag []byte) { tag[0] = 0x29 }),
+			expectedErr: ErrInvalidTagType,
+		},
+		{
+			name:        "Non-zero stream id",
+			input:       withTag(func(tag []byte) { tag[10] = 0x01 }),
+			expectedErr: ErrInvalidStreamID,
+		},
+		{
+			name:        "PreviousTagSize mismatch",
+			input:       withTag(func(tag []byte) { tag[len(tag)-1] = 0x0c }),
+			expectedErr: ErrTagSizeMismatch,
+		},
+		{
+			name:        "Data size larger than the file",
+			input:       withTag(func(tag []byte) { tag[3] = 0x40 }),
+			expectedErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:        "Truncated tag header",
+			input:       append(append([]byte(nil), fileHeader...), validTag[:5]...),
+			expectedErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:        "Missing PreviousTagSize",
+			input:       append(append([]byte(nil), fileHeader...), validTag[:13]...),
+			expectedErr: io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewReader(bytes.NewReader(tt.input)).ReadTag()
+			if !errors.Is(err, tt.expectedErr) {
+				t.Errorf("ReadTag() error = %v, expected %v", err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestReaderSkipsHeaderExtension(t *testing.T) {
+	input := []byte{'F', 'L', 'V', 0x01, 0x04, 0x00, 0x00, 0x00, 0x0b, 0xee, 0xee, 0x00, 0x00, 0x00, 0x00}
+	input = append(input, 0x08, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xaf, 0x00, 0x00, 0x00, 0x0c)
+
+	reader := NewReader(bytes.NewReader(input))
+	tag, err := reader.ReadTag()
+	if err != nil {
+		t.Fatalf("ReadTag() error = %v", err)
+	}
+	if tag.Type != TagTypeAudio || !bytes.Equal(tag.Data, []byte{0xaf}) {
+		t.Errorf("ReadTag() = %+v", tag)
+	}
+}
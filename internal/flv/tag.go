@@ -0,0 +1,98 @@
+package flv
+
+// FLV tag types
+const (
+	TagTypeAudio  byte = 8
+	TagTypeVideo  byte = 9
+	TagTypeScript byte = 18
+)
+
+// IsSequenceHeader reports whether an audio or video tag payload carries a
+// decoder configuration (AAC AudioSpecificConfig, AVC/HEVC configuration
+// record, Enhanced RTMP sequence start) rather than coded media.
+func IsSequenceHeader(tagType byte, data []byte) bool {
+	switch tagType {
+	case TagTypeAudio:
+		h, err := ParseAudioHeader(data)
+		return err == nil && h.IsSequenceHeader()
+	case TagTypeVideo:
+		h, err := ParseVideoHeader(data)
+		return err == nil && h.IsSequenceHeader()
+	}
+	return false
+}
+
+// IsKeyframe reports whether a video tag payload is a keyframe. Sequence
+// headers share the keyframe flag and count as keyframes here.
+func IsKeyframe(tagType byte, data []byte) bool {
+	if tagType != TagTypeVideo {
+		return false
+	}
+	h, err := ParseVideoHeader(data)
+	return err == nil && (h.FrameType == FrameTypeKeyframe || h.FrameType == FrameTypeGeneratedKeyframe)
+}
+
+// Tag is a single FLV tag as it flows from a publisher to the stream outputs.
+// Tags built by ParseTag carry their parsed audio or video header, or the
+// decoded onMetaData object.
+type Tag struct {
+	Type      byte
+	Timestamp uint32
+	Data      []byte
+
+	Audio    *AudioHeader    // set for parsed audio tags
+	Video    *VideoHeader    // set for parsed video tags
+	Metadata *StreamMetadata // set for parsed onMetaData script tags
+}
+
+// ParseTag builds a tag and parses its audio or video header. Script tags
+// are decoded when they carry onMetaData; other or undecodable script data
+// is passed through as is.
+func ParseTag(tagType byte, timestamp uint32, data []byte) (Tag, error) {
+	tag := Tag{Type: tagType, Timestamp: timestamp, Data: data}
+	switch tagType {
+	case TagTypeAudio:
+		h, err := ParseAudioHeader(data)
+		if err != nil {
+			return tag, err
+		}
+		tag.Audio = &h
+	case TagTypeVideo:
+		h, err := ParseVideoHeader(data)
+		if err != nil {
+			return tag, err
+		}
+		tag.Video = &h
+	case TagTypeScript:
+		if md, err := ParseMetadata(data); err == nil {
+			tag.Metadata = md
+		}
+	}
+	return tag, nil
+}
+
+// IsSequenceHeader reports whether the tag carries a decoder configuration
+func (t Tag) IsSequenceHeader() bool {
+	switch {
+	case t.Audio != nil:
+		return t.Audio.IsSequenceHeader()
+	case t.Video != nil:
+		return t.Video.IsSequenceHeader()
+	}
+	return IsSequenceHeader(t.Type, t.Data)
+}
+
+// IsKeyframe reports whether the tag is a coded video keyframe; sequence
+// headers, which share the keyframe flag, are not
+func (t Tag) IsKeyframe() bool {
+	if t.Video != nil {
+		return t.Video.IsKeyframe()
+	}
+	return IsKeyframe(t.Type, t.Data) && !t.IsSequenceHeader()
+}
+
+// Clone returns a copy of the tag that does not share its payload
+func (t Tag) Clone() Tag {
+	t.Data = append([]byte(nil), t.Data...)
+	return t
+}
@@ -8,7 +8,7 @@ import (
 
 // Writer handles FLV tag writing with thread safety
 type Writer struct {
-	writer    io.Writer
+	writer     io.Writer
 	writeMutex sync.Mutex
 	headerOnce sync.Once
 }
@@ -22,8 +22,21 @@ func NewWriter(writer io.Writer) *Writer {
 
 // WriteHeader writes the FLV header (only once)
 func (w *Writer) WriteHeader() {
+	w.WriteHeaderFlags(true, true)
+}
+
+// WriteHeaderFlags writes the FLV header announcing only the given tracks
+// (only once)
+func (w *Writer) WriteHeaderFlags(hasAudio, hasVideo bool) {
 	w.headerOnce.Do(func() {
-		header := []byte{'F', 'L', 'V', 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
+		var flags byte
+		if hasAudio {
+			flags |= 0x04
+		}
+		if hasVideo {
+			flags |= 0x01
+		}
+		header := []byte{'F', 'L', 'V', 0x01, flags, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
 		_, _ = w.writer.Write(header)
 	})
 }
@@ -59,19 +72,19 @@ func (w *Writer) WriteTag(tagType byte, timestamp uint32, data []byte) error {
 // WriteAudio writes an audio tag
 func (w *Writer) WriteAudio(timestamp uint32, data []byte) error {
 	w.WriteHeader()
-	return w.WriteTag(8, timestamp, data) // FLV audio tag type = 8
+	return w.WriteTag(TagTypeAudio, timestamp, data)
 }
 
 // WriteVideo writes a video tag
 func (w *Writer) WriteVideo(timestamp uint32, data []byte) error {
 	w.WriteHeader()
-	return w.WriteTag(9, timestamp, data) // FLV video tag type = 9
+	return w.WriteTag(TagTypeVideo, timestamp, data)
 }
 
 // WriteScript writes a script tag (metadata)
 func (w *Writer) WriteScript(timestamp uint32, data []byte) error {
 	w.WriteHeader()
-	return w.WriteTag(18, timestamp, data) // FLV script tag type = 18
+	return w.WriteTag(TagTypeScript, timestamp, data)
 }
 
 // makeFLVTagHeader creates an FLV tag header
@@ -89,4 +102,4 @@ func makeFLVTagHeader(tagType byte, dataSize uint32, timestamp uint32) []byte {
 	header[9] = 0
 	header[10] = 0
 	return header
-} 
\ No newline at end of file
+}
@@ -0,0 +1,279 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"rtmp-server-poc/internal/events"
+	"rtmp-server-poc/internal/pull"
+	"rtmp-server-poc/internal/relay"
+	"rtmp-server-poc/internal/stream"
+)
+
+// streamListResponse is the body returned by GET /api/v1/streams
+type streamListResponse struct {
+	Streams []stream.StreamInfo `json:"streams"`
+}
+
+// handleAPIListStreams returns the state of every active stream as JSON
+func (s *Server) handleAPIListStreams(w http.ResponseWriter, r *http.Request) {
+	streams := s.streamManager.ListStreams()
+	if streams == nil {
+		streams = []stream.StreamInfo{}
+	}
+	writeJSON(w, http.StatusOK, streamListResponse{Streams: streams})
+}
+
+// eventListResponse is the body returned by GET /api/v1/events
+type eventListResponse struct {
+	Events []events.Event `json:"events"`
+}
+
+// handleAPIListEvents returns the most recent stream events as JSON
+func (s *Server) handleAPIListEvents(w http.ResponseWriter, r *http.Request) {
+	recent := s.streamManager.Events().Recent()
+	if recent == nil {
+		recent = []events.Event{}
+	}
+	writeJSON(w, http.StatusOK, eventListResponse{Events: recent})
+}
+
+// clipRequest is the body of POST /api/v1/streams/{name}/clips
+type clipRequest struct {
+	// StartOffset is how many seconds before the live edge the clip starts
+	StartOffset float64 `json:"start_offset"`
+	// Duration is the clip length in seconds
+	Duration float64 `json:"duration"`
+}
+
+// clipResponse is the body returned when a clip is created
+type clipResponse struct {
+	Clip stream.ClipInfo `json:"clip"`
+	URL  string          `json:"url"`
+}
+
+// handleAPICreateClip cuts an MP4 clip from a live stream's buffer
+func (s *Server) handleAPICreateClip(w http.ResponseWriter, r *http.Request) {
+	var req clipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid clip request: %w", err))
+		return
+	}
+
+	sp, ok := s.streamManager.GetStream(r.PathValue("name"))
+	if !ok || !sp.IsActive() {
+		writeError(w, http.StatusNotFound, errors.New("stream not found"))
+		return
+	}
+
+	clip, err := sp.CreateClip(seconds(req.StartOffset), seconds(req.Duration))
+	switch {
+	case errors.Is(err, stream.ErrInvalidClip):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.Is(err, stream.ErrClipOutOfRange):
+		writeError(w, http.StatusUnprocessableEntity, err)
+	case errors.Is(err, stream.ErrClipsDisabled):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, stream.ErrClipQuotaExceeded):
+		writeError(w, http.StatusInsufficientStorage, err)
+	case err != nil:
+		log.Printf("Failed to create clip for stream %s: %v", sp.Username(), err)
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusCreated, clipResponse{Clip: clip, URL: "/clips/" + clip.File})
+	}
+}
+
+// relayRequest is the body of POST /api/v1/streams/{name}/relays
+type relayRequest struct {
+	Name string `json:"name"`
+	// URL is the RTMP or RTMPS URL ending with the stream key, as
+	// rtmp://a.rtmp.youtube.com/live2/xxxx-xxxx
+	URL string `json:"url"`
+}
+
+// relayListResponse is the body returned by GET /api/v1/streams/{name}/relays
+type relayListResponse struct {
+	Relays []relay.Status `json:"relays"`
+}
+
+// handleAPIListRelays returns the status of a live stream's relay targets
+func (s *Server) handleAPIListRelays(w http.ResponseWriter, r *http.Request) {
+	sp, ok := s.streamManager.GetStream(r.PathValue("name"))
+	if !ok || !sp.IsActive() {
+		writeError(w, http.StatusNotFound, errors.New("stream not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, relayListResponse{Relays: sp.Relays()})
+}
+
+// handleAPIAddRelay forwards a live stream to another target until the
+// stream ends or the target is removed
+func (s *Server) handleAPIAddRelay(w http.ResponseWriter, r *http.Request) {
+	var req relayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid relay request: %w", err))
+		return
+	}
+	if req.Name == "" || req.URL == "" {
+		writeError(w, http.StatusBadRequest, errors.New("invalid relay request: name and url are required"))
+		return
+	}
+
+	sp, ok := s.streamManager.GetStream(r.PathValue("name"))
+	if !ok || !sp.IsActive() {
+		writeError(w, http.StatusNotFound, errors.New("stream not found"))
+		return
+	}
+
+	err := sp.AddRelay(req.Name, req.URL)
+	switch {
+	case errors.Is(err, stream.ErrRelayExists):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, stream.ErrStreamEnded):
+		writeError(w, http.StatusNotFound, errors.New("stream not found"))
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		for _, status := range sp.Relays() {
+			if status.Name == req.Name {
+				writeJSON(w, http.StatusCreated, status)
+				return
+			}
+		}
+		// Removed in the meantime
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAPIRemoveRelay stops forwarding a live stream to a target
+func (s *Server) handleAPIRemoveRelay(w http.ResponseWriter, r *http.Request) {
+	sp, ok := s.streamManager.GetStream(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("stream not found"))
+		return
+	}
+	if err := sp.RemoveRelay(r.PathValue("target")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireAdmin guards an API route that changes the server: requests must
+// carry AdminToken as a Bearer token, and are all refused while none is
+// configured
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.AdminToken == "" {
+			writeError(w, http.StatusForbidden, errors.New("no admin token configured"))
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+			log.Printf("Unauthorized API request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// seconds converts a number of seconds from a request body to a duration
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
+}
+
+// errorResponse is the body of failed API requests
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeError writes err as a JSON error response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// writeJSON encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode API response: %v", err)
+	}
+}
+
+// pullRequest is the body of POST /api/v1/pulls
+type pullRequest struct {
+	// Name is the local stream published
+	Name string `json:"name"`
+	// URL is an RTMP or RTMPS URL ending with the stream key, or the URL of
+	// an HLS playlist
+	URL      string `json:"url"`
+	OnDemand bool   `json:"on_demand"`
+}
+
+// pullListResponse is the body returned by GET /api/v1/pulls
+type pullListResponse struct {
+	Pulls []pull.Status `json:"pulls"`
+}
+
+// handleAPIListPulls returns the status of the pulls
+func (s *Server) handleAPIListPulls(w http.ResponseWriter, r *http.Request) {
+	if s.pulls == nil {
+		writeJSON(w, http.StatusOK, pullListResponse{Pulls: []pull.Status{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, pullListResponse{Pulls: s.pulls.List()})
+}
+
+// handleAPIAddPull starts pulling a remote stream
+func (s *Server) handleAPIAddPull(w http.ResponseWriter, r *http.Request) {
+	if s.pulls == nil {
+		writeError(w, http.StatusNotFound, errors.New("pulls are disabled"))
+		return
+	}
+	var req pullRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid pull request: %w", err))
+		return
+	}
+	if req.Name == "" || req.URL == "" {
+		writeError(w, http.StatusBadRequest, errors.New("invalid pull request: name and url are required"))
+		return
+	}
+
+	status, err := s.pulls.Add(req.Name, req.URL, req.OnDemand)
+	switch {
+	case errors.Is(err, pull.ErrPullExists):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, pull.ErrClosed):
+		writeError(w, http.StatusServiceUnavailable, err)
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeJSON(w, http.StatusCreated, status)
+	}
+}
+
+// handleAPIRemovePull stops a pull, which ends its stream as a publisher
+// leaving would
+func (s *Server) handleAPIRemovePull(w http.ResponseWriter, r *http.Request) {
+	if s.pulls == nil {
+		writeError(w, http.StatusNotFound, pull.ErrPullNotFound)
+		return
+	}
+	if err := s.pulls.Remove(r.PathValue("name")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,244 @@
+package http
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/pull"
+	"rtmp-server-poc/internal/stream"
+)
+
+// testConfig is the default configuration without WebRTC, writing under a
+// temporary directory
+func testConfig(t *testing.T) config.Config {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	dir := t.TempDir()
+	cfg.OutputDir = dir + "/streams"
+	cfg.RecordDir = dir + "/recordings"
+	cfg.ClipDir = dir + "/clips"
+	cfg.WHEP, cfg.WHIP = false, false
+	cfg.AdminToken = "secret"
+	return cfg
+}
+
+// stubFFmpeg puts an ffmpeg discarding its input first in PATH, so streams
+// can start without transcoding
+func stubFFmpeg(t *testing.T) {
+	t.Helper()
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte("#!/bin/sh\ncat >/dev/null\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// avcSequenceHeader is the FLV video tag of an x264 1080p High profile SPS
+var avcSequenceHeader = []byte{
+	0x17, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x64, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x1b,
+	0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00,
+	0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58,
+	0x00,
+}
+
+// publishGOPs publishes timestamps 0 to end of AAC audio and H.264 video,
+// with a keyframe every second
+func publishGOPs(t *testing.T, publisher *stream.Publisher, end uint32) {
+	t.Helper()
+	if err := publisher.WriteVideo(0, avcSequenceHeader); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.WriteAudio(0, []byte{0xaf, 0x00, 0x12, 0x10}); err != nil {
+		t.Fatal(err)
+	}
+	for ts := uint32(0); ts <= end; ts += 500 {
+		frame := []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x41}
+		if ts%1000 == 0 {
+			frame = []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65}
+		}
+		if err := publisher.WriteVideo(ts, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// startServer serves the HTTP side of a server
+func startServer(t *testing.T, cfg config.Config, manager *stream.Manager) (*Server, string) {
+	t.Helper()
+	s := NewServer(cfg, manager)
+	server := httptest.NewServer(s.SetupServer().Handler)
+	t.Cleanup(server.Close)
+	return s, server.URL
+}
+
+// request sends a request with an optional Bearer token and returns the
+// response status and body
+func request(t *testing.T, method, url, token, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response strings.Builder
+	if _, err := io.Copy(&response, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, response.String()
+}
+
+func TestAdminRoutesRequireToken(t *testing.T) {
+	routes := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodPost, "/api/v1/streams/alice/relays", `{"name":"youtube","url":"rtmp://a.rtmp.youtube.com/live2/key"}`},
+		{http.MethodDelete, "/api/v1/streams/alice/relays/youtube", ""},
+		{http.MethodDelete, "/api/v1/pulls/alice", ""},
+		{http.MethodPost, "/api/v1/streams/alice/clips", `{"start_offset":1,"duration":1}`},
+	}
+	tests := []struct {
+		name       string
+		adminToken string
+		token      string
+		expected   int
+	}{
+		{"No admin token configured", "", "secret", http.StatusForbidden},
+		{"Missing token", "secret", "", http.StatusUnauthorized},
+		{"Wrong token", "secret", "guess", http.StatusUnauthorized},
+		{"Admin token", "secret", "secret", http.StatusNotFound}, // alice is not live
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.AdminToken = tt.adminToken
+			_, url := startServer(t, cfg, stream.NewManager())
+			for _, route := range routes {
+				if status, body := request(t, route.method, url+route.path, tt.token, route.body); status != tt.expected {
+					t.Errorf("%s %s = %d %s, expected %d", route.method, route.path, status, body, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestAddPull(t *testing.T) {
+	cfg := testConfig(t)
+	manager := stream.NewManager()
+	s, url := startServer(t, cfg, manager)
+	pulls := pull.NewManager(manager, cfg)
+	t.Cleanup(pulls.Close)
+	s.SetPullManager(pulls)
+
+	tests := []struct {
+		name     string
+		token    string
+		body     string
+		expected int
+	}{
+		{"Missing token", "", `{"name":"bob","url":"rtmp://127.0.0.1:1/live/key","on_demand":true}`, http.StatusUnauthorized},
+		{"Invalid name", "secret", `{"name":"<script>alert(1)</script>","url":"rtmp://127.0.0.1:1/live/key"}`, http.StatusBadRequest},
+		{"Added", "secret", `{"name":"bob","url":"rtmp://127.0.0.1:1/live/key","on_demand":true}`, http.StatusCreated},
+		{"Name taken", "secret", `{"name":"bob","url":"rtmp://127.0.0.1:1/live/key","on_demand":true}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if status, body := request(t, http.MethodPost, url+"/api/v1/pulls", tt.token, tt.body); status != tt.expected {
+			t.Errorf("%s: POST = %d %s, expected %d", tt.name, status, body, tt.expected)
+		}
+	}
+	if status, _ := request(t, http.MethodDelete, url+"/api/v1/pulls/bob", "secret", ""); status != http.StatusNoContent {
+		t.Errorf("DELETE = %d, expected 204", status)
+	}
+}
+
+func TestStreamListEscapesNames(t *testing.T) {
+	s := NewServer(testConfig(t), stream.NewManager())
+	var page strings.Builder
+	s.renderStreamList(&page, []stream.StreamInfo{{Username: `<script>alert("x")</script>`, State: stream.StateLive}})
+	if strings.Contains(page.String(), "<script>") {
+		t.Errorf("stream list renders the name unescaped:\n%s", page.String())
+	}
+	if !strings.Contains(page.String(), "&lt;script&gt;") {
+		t.Errorf("stream list does not show the escaped name:\n%s", page.String())
+	}
+}
+
+func TestCreateClip(t *testing.T) {
+	stubFFmpeg(t)
+	cfg := testConfig(t)
+	cfg.ClipBuffer = 5 * time.Minute
+	cfg.ClipMaxSize = 1 // room for a single clip
+	manager := stream.NewManager()
+	_, url := startServer(t, cfg, manager)
+
+	sp, err := manager.GetOrCreateStream("alice", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := sp.Attach(stream.RolePrimary, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close(cfg)
+	publishGOPs(t, publisher, 3500)
+
+	clips := url + "/api/v1/streams/alice/clips"
+	tests := []struct {
+		name     string
+		url      string
+		body     string
+		expected int
+	}{
+		{"Invalid body", clips, `{"start_offset":`, http.StatusBadRequest},
+		{"Unknown stream", url + "/api/v1/streams/bob/clips", `{"start_offset":1,"duration":1}`, http.StatusNotFound},
+		{"Invalid range", clips, `{"start_offset":1,"duration":0}`, http.StatusBadRequest},
+		{"Longer than the buffer", clips, `{"start_offset":1,"duration":86400}`, http.StatusBadRequest},
+		{"Out of range", clips, `{"start_offset":60,"duration":1}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		if status, body := request(t, http.MethodPost, tt.url, "secret", tt.body); status != tt.expected {
+			t.Errorf("%s: POST = %d %s, expected %d", tt.name, status, body, tt.expected)
+		}
+	}
+
+	// Tags reach the clip buffer once dispatched
+	var status int
+	var body string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if status, body = request(t, http.MethodPost, clips, "secret", `{"start_offset":1.5,"duration":1}`); status != http.StatusUnprocessableEntity {
+			break
+		}
+	}
+	var created clipResponse
+	if status != http.StatusCreated || json.Unmarshal([]byte(body), &created) != nil {
+		t.Fatalf("POST = %d %s, expected a clip", status, body)
+	}
+	if created.Clip.Stream != "alice" || created.URL != "/clips/"+created.Clip.File || !strings.HasPrefix(created.Clip.File, "alice/") {
+		t.Errorf("response = %+v, expected alice's clip and its download URL", created)
+	}
+	if status, clip := request(t, http.MethodGet, url+created.URL, "", ""); status != http.StatusOK || int64(len(clip)) != created.Clip.Size {
+		t.Errorf("GET %s = %d with %d bytes, expected the %d byte clip", created.URL, status, len(clip), created.Clip.Size)
+	}
+
+	if status, body := request(t, http.MethodPost, clips, "secret", `{"start_offset":1.5,"duration":1}`); status != http.StatusInsufficientStorage {
+		t.Errorf("POST over quota = %d %s, expected 507", status, body)
+	}
+}
@@ -0,0 +1,155 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"rtmp-server-poc/internal/auth"
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/mpegts"
+	"rtmp-server-poc/internal/stream"
+)
+
+// ingestRequest is an authorized HTTP publish
+type ingestRequest struct {
+	name string // the publishing name
+	app  string
+	role stream.Role
+}
+
+// authorizeIngest authorizes an HTTP publish, WHIP or an upload: the {path}
+// stands for the RTMP URL, so "test/johndoe" is authorized like
+// rtmp://host/live/test/johndoe, and the stream key, given as a Bearer token
+// or in a token query parameter, like the publishing name, which may carry a
+// role ("johndoe?role=backup"). It writes the error response when refused.
+func (s *Server) authorizeIngest(w http.ResponseWriter, r *http.Request) (ingestRequest, bool) {
+	vars, ok := s.authorizer.ExtractVariablesFromPath("/" + r.PathValue("path"))
+	if !ok {
+		log.Printf("Unauthorized ingest path %s", r.URL.Path)
+		http.Error(w, "unauthorized path", http.StatusForbidden)
+		return ingestRequest{}, false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing Bearer token", http.StatusUnauthorized)
+		return ingestRequest{}, false
+	}
+	publishingName, query := auth.SplitPublishingName(token)
+	if err := s.authorizer.ValidateAuthentication(vars, publishingName); err != nil {
+		log.Printf("Ingest authentication failed for %s: %v", r.URL.Path, err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid Bearer token", http.StatusUnauthorized)
+		return ingestRequest{}, false
+	}
+
+	// The role comes from, in order, the token query, the request query and
+	// a {role} pattern variable, as for RTMP publishers
+	role := query.Get("role")
+	if role == "" {
+		role = r.URL.Query().Get("role")
+	}
+	if role == "" {
+		role = vars["role"]
+	}
+	parsedRole, err := stream.ParseRole(role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ingestRequest{}, false
+	}
+	return ingestRequest{name: publishingName, app: vars["app"], role: parsedRole}, true
+}
+
+// attachIngest attaches a publisher to an authorized request's stream, as for
+// RTMP publishers. It writes the error response when refused.
+func (s *Server) attachIngest(w http.ResponseWriter, req ingestRequest) (*stream.Publisher, bool) {
+	_, publisher, err := s.streamManager.Publish(req.name, req.app, req.role, nil, s.config)
+	switch {
+	case errors.Is(err, stream.ErrPublisherExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil, false
+	case err != nil:
+		log.Printf("Ingest refused for %s: %v", req.name, err)
+		http.Error(w, "cannot publish the stream", http.StatusInternalServerError)
+		return nil, false
+	}
+	return publisher, true
+}
+
+// handleIngest publishes an upload: PUT or POST /ingest/{app}/{username}
+// with an FLV stream or an MPEG-TS transport stream as the (usually chunked)
+// body, for as long as the encoder keeps sending. FLV is told apart by its
+// signature. The response comes once the upload ends.
+func (s *Server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.authorizeIngest(w, r)
+	if !ok {
+		return
+	}
+	body := bufio.NewReader(r.Body)
+	format := "MPEG-TS"
+	if signature, _ := body.Peek(3); string(signature) == "FLV" {
+		format = "FLV"
+	}
+	publisher, ok := s.attachIngest(w, req)
+	if !ok {
+		return
+	}
+	defer publisher.Close(s.config)
+
+	log.Printf("HTTP %s ingest from %s started stream %s as %s", format, r.RemoteAddr, req.name, req.role)
+	// Writes through an evicted publisher fail, which ends the upload
+	var err error
+	if format == "FLV" {
+		err = copyFLV(publisher, body)
+	} else {
+		err = mpegts.Copy(publisher, body)
+	}
+	switch {
+	case errors.Is(err, stream.ErrPublisherEvicted):
+		log.Printf("HTTP ingest from %s stopped: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, stream.ErrMetadataRejected) || errors.Is(err, stream.ErrCodecRejected):
+		log.Printf("HTTP ingest from %s rejected: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case err != nil:
+		log.Printf("HTTP ingest from %s stopped: %v", r.RemoteAddr, err)
+		http.Error(w, "cannot read the "+format+" upload", http.StatusBadRequest)
+	default:
+		log.Printf("HTTP ingest from %s ended", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// copyFLV writes the tags of an FLV stream through the publisher, as the
+// RTMP handler's OnVideo, OnAudio and OnSetDataFrame do, until it ends. A
+// truncated last tag, left by an encoder killed mid-write, ends it too.
+func copyFLV(publisher *stream.Publisher, r io.Reader) error {
+	reader := flv.NewReader(r)
+	for {
+		tag, err := reader.ReadTag()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch tag.Type {
+		case flv.TagTypeVideo:
+			err = publisher.WriteVideo(tag.Timestamp, tag.Data)
+		case flv.TagTypeAudio:
+			err = publisher.WriteAudio(tag.Timestamp, tag.Data)
+		case flv.TagTypeScript:
+			err = publisher.WriteScript(tag.Timestamp, tag.Data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
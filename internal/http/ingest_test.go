@@ -0,0 +1,218 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/stream"
+)
+
+// flvHeaderSize is the size of the FLV header and PreviousTagSize0
+const flvHeaderSize = 9 + 4
+
+// flvUpload is an FLV stream with an AVC sequence header and a keyframe
+func flvUpload(t *testing.T) []byte {
+	t.Helper()
+	var upload bytes.Buffer
+	writer := flv.NewWriter(&upload)
+	if err := writer.WriteVideo(0, avcSequenceHeader); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteVideo(0, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65}); err != nil {
+		t.Fatal(err)
+	}
+	return upload.Bytes()
+}
+
+// waitForStream waits for a stream to be created
+func waitForStream(t *testing.T, manager *stream.Manager, name string) *stream.StreamProcess {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if sp, ok := manager.GetStream(name); ok {
+			return sp
+		}
+	}
+	t.Fatalf("stream %s was not created", name)
+	return nil
+}
+
+func TestHandleIngestFLV(t *testing.T) {
+	stubFFmpeg(t)
+	cfg := testConfig(t)
+	cfg.ReconnectDelay = 10 * time.Millisecond
+	manager := stream.NewManager()
+	_, url := startServer(t, cfg, manager)
+
+	// A pipe makes the body chunked, and keeps the upload going until closed
+	body, upload := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, url+"/ingest/test/johndoe", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer johndoe")
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			close(responses)
+			return
+		}
+		resp.Body.Close()
+		responses <- resp
+	}()
+
+	// The FLV header starts the stream, and its tags then reach viewers
+	tags := flvUpload(t)
+	if _, err := upload.Write(tags[:flvHeaderSize]); err != nil {
+		t.Fatal(err)
+	}
+	sp := waitForStream(t, manager, "johndoe")
+	viewer, err := sp.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close()
+	if _, err := upload.Write(tags[flvHeaderSize:]); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, expected := range [][]byte{avcSequenceHeader, {0x17, 0x01, 0x00, 0x00, 0x00, 0x65}} {
+		tag, ok := viewer.Next(ctx)
+		if !ok {
+			t.Fatal("viewer got no tag")
+		}
+		if tag.Type != flv.TagTypeVideo || !bytes.Equal(tag.Data, expected) {
+			t.Errorf("viewer got tag %d %x, expected video %x", tag.Type, tag.Data, expected)
+		}
+	}
+
+	// A half-written tag is dropped, and the upload ends normally
+	if _, err := upload.Write(tags[flvHeaderSize : flvHeaderSize+8]); err != nil {
+		t.Fatal(err)
+	}
+	upload.Close()
+	resp, ok := <-responses
+	if !ok {
+		return
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("POST = %d, expected 204", resp.StatusCode)
+	}
+	for deadline := time.Now().Add(5 * time.Second); sp.IsActive(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream is still %s once the upload ended", sp.State())
+		}
+	}
+}
+
+func TestHandleIngestRefused(t *testing.T) {
+	stubFFmpeg(t)
+	cfg := testConfig(t)
+	manager := stream.NewManager()
+	_, url := startServer(t, cfg, manager)
+
+	sp, err := manager.GetOrCreateStream("alice", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := sp.Attach(stream.RolePrimary, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close(cfg)
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		expected int
+	}{
+		{"Missing token", "/ingest/test/johndoe", "", http.StatusUnauthorized},
+		{"Wrong token", "/ingest/test/johndoe", "alice", http.StatusUnauthorized},
+		{"Unauthorized path", "/ingest/johndoe", "johndoe", http.StatusForbidden},
+		{"Already published", "/ingest/test/alice", "alice", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := request(t, http.MethodPost, url+tt.path, tt.token, string(flvUpload(t))); status != tt.expected {
+				t.Errorf("POST %s = %d %s, expected %d", tt.path, status, body, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAuthorizeIngest(t *testing.T) {
+	stubFFmpeg(t)
+	cfg := testConfig(t)
+	cfg.AuthorizedPatterns = append(cfg.AuthorizedPatterns, "/live/{app}/{username}/{role}")
+	manager := stream.NewManager()
+	s, url := startServer(t, cfg, manager)
+
+	tests := []struct {
+		name     string
+		path     string
+		header   string // the Authorization header
+		expected int
+		role     stream.Role
+	}{
+		{"Bearer token", "test/johndoe", "Bearer johndoe", http.StatusOK, stream.RolePrimary},
+		{"Token query", "test/johndoe?token=johndoe", "", http.StatusOK, stream.RolePrimary},
+		{"Missing token", "test/johndoe", "", http.StatusUnauthorized, ""},
+		{"Not a Bearer token", "test/johndoe", "Basic am9obmRvZQ==", http.StatusUnauthorized, ""},
+		{"Wrong token", "test/johndoe", "Bearer alice", http.StatusUnauthorized, ""},
+		{"Unauthorized path", "johndoe", "Bearer johndoe", http.StatusForbidden, ""},
+		{"Role in the token", "test/johndoe", "Bearer johndoe?role=backup", http.StatusOK, stream.RoleBackup},
+		{"Role in the request", "test/johndoe?role=backup", "Bearer johndoe", http.StatusOK, stream.RoleBackup},
+		{"Role in the path", "test/johndoe/backup", "Bearer johndoe", http.StatusOK, stream.RoleBackup},
+		{"Token role first", "test/johndoe/backup?role=backup", "Bearer johndoe?role=primary", http.StatusOK, stream.RolePrimary},
+		{"Unknown role", "test/johndoe?role=spare", "Bearer johndoe", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/whip/"+tt.path, nil)
+			r.SetPathValue("path", strings.TrimPrefix(r.URL.Path, "/whip/"))
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			req, ok := s.authorizeIngest(w, r)
+			if ok != (tt.expected == http.StatusOK) || w.Code != tt.expected {
+				t.Fatalf("authorizeIngest() = %v with %d %s, expected %d", ok, w.Code, w.Body, tt.expected)
+			}
+			if ok && (req.name != "johndoe" || req.app != "test" || req.role != tt.role) {
+				t.Errorf("authorizeIngest() = %+v, expected johndoe's %s publish to test", req, tt.role)
+			}
+
+			// MPEG-TS uploads are authorized the same way
+			put, err := http.NewRequest(http.MethodPut, url+"/ingest/"+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				put.Header.Set("Authorization", tt.header)
+			}
+			resp, err := http.DefaultClient.Do(put)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			expected := tt.expected
+			if expected == http.StatusOK {
+				expected = http.StatusNoContent // the empty upload ends at once
+			}
+			if resp.StatusCode != expected {
+				t.Errorf("PUT /ingest/%s = %d, expected %d", tt.path, resp.StatusCode, expected)
+			}
+		})
+	}
+}
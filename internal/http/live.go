@@ -0,0 +1,103 @@
+package http
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/stream"
+)
+
+// viewerWriteTimeout bounds each write to a live viewer, so that a stalled
+// connection is dropped rather than kept open
+const viewerWriteTimeout = 10 * time.Second
+
+// pullWait bounds how long a viewer of an idle on-demand pull waits for it
+// to connect
+const pullWait = 10 * time.Second
+
+// liveStream returns the live stream named name. A request for a pulled
+// stream counts as demand for it, and waits for an on-demand pull to start.
+func (s *Server) liveStream(r *http.Request, name string) (*stream.StreamProcess, bool) {
+	if s.pulls != nil && s.pulls.Demand(name) {
+		ctx, cancel := context.WithTimeout(r.Context(), pullWait)
+		defer cancel()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			if sp, ok := s.streamManager.GetStream(name); ok && sp.IsActive() {
+				return sp, true
+			}
+			select {
+			case <-ctx.Done():
+				return nil, false
+			case <-ticker.C:
+			}
+		}
+	}
+	sp, ok := s.streamManager.GetStream(name)
+	return sp, ok && sp.IsActive()
+}
+
+// watchStream starts a viewer of the live stream named name, or reports
+// 404 when there is none
+func (s *Server) watchStream(w http.ResponseWriter, r *http.Request, name string) (*stream.Viewer, bool) {
+	sp, ok := s.liveStream(r, name)
+	if !ok {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	viewer, err := sp.Watch()
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return viewer, true
+}
+
+// handleLiveFLV streams a live stream as HTTP-FLV, for players such as
+// flv.js and mpegts.js: GET /live/{username}.flv. The body starts with the
+// cached metadata, sequence headers and current GOP, and ends when the
+// stream does.
+func (s *Server) handleLiveFLV(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutSuffix(r.PathValue("file"), ".flv")
+	if !ok || name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	viewer, ok := s.watchStream(w, r, name)
+	if !ok {
+		return
+	}
+	defer viewer.Close()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(w)
+	controller.Flush()
+
+	log.Printf("HTTP-FLV viewer %s joined stream %s", r.RemoteAddr, name)
+	writer := flv.NewWriter(w)
+	for first := true; ; first = false {
+		tag, ok := viewer.Next(r.Context())
+		if !ok {
+			break
+		}
+		controller.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+		if first {
+			writer.WriteHeaderFlags(viewer.Tracks())
+		}
+		if err := writer.WriteTag(tag.Type, tag.Timestamp, tag.Data); err != nil {
+			break
+		}
+		if err := controller.Flush(); err != nil {
+			break
+		}
+	}
+	log.Printf("HTTP-FLV viewer %s left stream %s (%d tags dropped)", r.RemoteAddr, name, viewer.Dropped())
+}
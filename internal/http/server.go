@@ -2,28 +2,62 @@ package http
 
 import (
 	"fmt"
+	"html"
 	"io"
+	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"rtmp-server-poc/internal/auth"
 	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/pull"
 	"rtmp-server-poc/internal/stream"
+	"rtmp-server-poc/internal/whep"
+	"rtmp-server-poc/internal/whip"
 )
 
 // Server handles HTTP requests for HLS streaming
 type Server struct {
 	config        config.Config
 	streamManager *stream.Manager
+	whep          *whep.Manager // nil when WHEP is disabled
+	whip          *whip.Manager // nil when WHIP is disabled
+	pulls         *pull.Manager // nil until SetPullManager
+	authorizer    *auth.Authorizer
 }
 
 // NewServer creates a new HTTP server
 func NewServer(cfg config.Config, manager *stream.Manager) *Server {
-	return &Server{
+	s := &Server{
 		config:        cfg,
 		streamManager: manager,
+		authorizer:    auth.NewAuthorizer(cfg.AuthorizedPatterns),
 	}
+	if cfg.WHEP {
+		m, err := whep.NewManager(cfg.ICEServers)
+		if err != nil {
+			log.Printf("WHEP disabled: %v", err)
+		}
+		s.whep = m
+	}
+	if cfg.WHIP {
+		m, err := whip.NewManager(cfg.ICEServers)
+		if err != nil {
+			log.Printf("WHIP disabled: %v", err)
+		}
+		s.whip = m
+	}
+	return s
+}
+
+// SetPullManager lets the API manage pulls, and viewers start on-demand
+// pulls
+func (s *Server) SetPullManager(m *pull.Manager) {
+	s.pulls = m
 }
 
 // SetupServer sets up the HTTP server for HLS streaming
@@ -33,6 +67,47 @@ func (s *Server) SetupServer() *http.Server {
 	// Stream handler
 	mux.HandleFunc("/stream/", s.handleStreamRequest)
 
+	// JSON API
+	mux.HandleFunc("GET /api/v1/streams", s.handleAPIListStreams)
+	mux.HandleFunc("GET /api/v1/events", s.handleAPIListEvents)
+	mux.HandleFunc("POST /api/v1/streams/{name}/clips", s.requireAdmin(s.handleAPICreateClip))
+	mux.HandleFunc("GET /api/v1/streams/{name}/relays", s.handleAPIListRelays)
+	mux.HandleFunc("POST /api/v1/streams/{name}/relays", s.requireAdmin(s.handleAPIAddRelay))
+	mux.HandleFunc("DELETE /api/v1/streams/{name}/relays/{target}", s.requireAdmin(s.handleAPIRemoveRelay))
+	mux.HandleFunc("GET /api/v1/pulls", s.handleAPIListPulls)
+	mux.HandleFunc("POST /api/v1/pulls", s.requireAdmin(s.handleAPIAddPull))
+	mux.HandleFunc("DELETE /api/v1/pulls/{name}", s.requireAdmin(s.handleAPIRemovePull))
+
+	// Clip downloads
+	mux.HandleFunc("GET /clips/{name}/{file}", s.handleClipRequest)
+
+	// Live playback
+	mux.HandleFunc("GET /live/{file}", s.handleLiveFLV)
+	mux.HandleFunc("GET /ws/{file}", s.handleLiveWebSocket)
+	if s.whep != nil {
+		mux.HandleFunc("POST /whep/{name}", s.handleWHEPOffer)
+		mux.HandleFunc("DELETE /whep/{name}/{session}", s.handleWHEPDelete)
+		mux.HandleFunc("PATCH /whep/{name}/{session}", s.handleWebRTCPatch)
+		mux.HandleFunc("OPTIONS /whep/", s.handleWebRTCOptions)
+	}
+
+	// WebRTC ingest
+	if s.whip != nil {
+		mux.HandleFunc("POST /whip/{path...}", s.handleWHIPOffer)
+		mux.HandleFunc("DELETE /whip/{path...}", s.handleWHIPDelete)
+		mux.HandleFunc("PATCH /whip/{path...}", s.handleWebRTCPatch)
+		mux.HandleFunc("OPTIONS /whip/", s.handleWebRTCOptions)
+	}
+
+	// MPEG-TS ingest
+	if s.config.HTTPIngest {
+		mux.HandleFunc("PUT /ingest/{path...}", s.handleIngest)
+		mux.HandleFunc("POST /ingest/{path...}", s.handleIngest)
+	}
+
+	// Archived streams
+	mux.HandleFunc("GET /vod/{name}/{id}/{file}", s.handleVODRequest)
+
 	// Root handler (stream list)
 	mux.HandleFunc("/", s.handleRootRequest)
 
@@ -42,6 +117,15 @@ func (s *Server) SetupServer() *http.Server {
 	}
 }
 
+// hlsContentTypes maps HLS file extensions to their content types. HEVC, AV1
+// and VP9 streams use fMP4 segments and an init.mp4 instead of MPEG-TS.
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+}
+
 // handleStreamRequest handles requests for stream files
 func (s *Server) handleStreamRequest(w http.ResponseWriter, r *http.Request) {
 	// Add CORS headers
@@ -64,6 +148,10 @@ func (s *Server) handleStreamRequest(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	// Players retry until an on-demand pull's first segments are written
+	if s.pulls != nil {
+		s.pulls.Demand(username)
+	}
 
 	streamDir := filepath.Join(s.config.OutputDir, username)
 	if _, err := os.Stat(streamDir); os.IsNotExist(err) {
@@ -78,7 +166,9 @@ func (s *Server) handleStreamRequest(w http.ResponseWriter, r *http.Request) {
 
 	filePath := filepath.Join(streamDir, remainingPath)
 
-	if filepath.Ext(filePath) == ".m3u8" || filepath.Ext(filePath) == ".ts" {
+	ext := filepath.Ext(filePath)
+	if contentType, ok := hlsContentTypes[ext]; ok {
+		w.Header().Set("Content-Type", contentType)
 		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 		w.Header().Set("Pragma", "no-cache")
 		w.Header().Set("Expires", "0")
@@ -87,6 +177,35 @@ func (s *Server) handleStreamRequest(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, filePath)
 }
 
+// handleClipRequest serves a clip created through the API as a download
+func (s *Server) handleClipRequest(w http.ResponseWriter, r *http.Request) {
+	name, file := r.PathValue("name"), r.PathValue("file")
+	if filepath.Ext(file) != ".mp4" || strings.ContainsAny(name+file, `/\`) || strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"-"+file))
+	http.ServeFile(w, r, filepath.Join(s.config.ClipDir, name, file))
+}
+
+// handleVODRequest serves the playlists and segments of a stream archived
+// when it ended. Archives do not change, so they may be cached.
+func (s *Server) handleVODRequest(w http.ResponseWriter, r *http.Request) {
+	name, id, file := r.PathValue("name"), r.PathValue("id"), r.PathValue("file")
+	contentType, ok := hlsContentTypes[filepath.Ext(file)]
+	if !ok || s.config.VODDir == "" || strings.ContainsAny(name+id+file, `/\`) || strings.HasPrefix(name, ".") || strings.HasPrefix(id, ".") {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", contentType)
+	http.ServeFile(w, r, filepath.Join(s.config.VODDir, name, id, file))
+}
+
 // handleRootRequest handles requests to the root path
 func (s *Server) handleRootRequest(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
@@ -95,7 +214,7 @@ func (s *Server) handleRootRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Collect active streams
-	activeStreams := s.streamManager.GetActiveStreams()
+	activeStreams := s.streamManager.ListStreams()
 
 	// Render HTML
 	w.Header().Set("Content-Type", "text/html")
@@ -103,7 +222,7 @@ func (s *Server) handleRootRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 // renderStreamList renders the HTML page with the list of active streams
-func (s *Server) renderStreamList(w io.Writer, activeStreams []string) {
+func (s *Server) renderStreamList(w io.Writer, activeStreams []stream.StreamInfo) {
 	fmt.Fprintf(w, `<!DOCTYPE html>
 <html>
 <head>
@@ -115,6 +234,9 @@ func (s *Server) renderStreamList(w io.Writer, activeStreams []string) {
         .stream-link:hover { background: #e0e0e0; }
         .instructions { background: #f9f9f9; padding: 20px; border-radius: 5px; margin-bottom: 20px; }
         .code { background: #f0f0f0; padding: 5px; border-radius: 3px; font-family: monospace; }
+        .state { float: right; font-size: 0.9em; color: #666; }
+        .state-awaiting_reconnect { color: #b36b00; }
+        .metadata { font-size: 0.9em; color: #666; margin-left: 10px; }
     </style>
 </head>
 <body>
@@ -131,21 +253,65 @@ func (s *Server) renderStreamList(w io.Writer, activeStreams []string) {
         </ul>
         <p><strong>Watch streams:</strong></p>
         <p><span class="code">http://localhost:8080/stream/{username}/live.m3u8</span></p>
-        <p><strong>Note:</strong> Play connections are blocked. This is a publish-only server.</p>
+        <p><span class="code">http://localhost:8080/live/{username}.flv</span> (HTTP-FLV)</p>%s
     </div>
 
     <h2>Active Streams (%d)</h2>
-    <div class="stream-list">`, len(activeStreams))
+    <div class="stream-list">`, rtmpPlayHint(s.config.RTMPPlay), len(activeStreams))
 
 	if len(activeStreams) == 0 {
 		fmt.Fprintf(w, `<p>No active streams currently.</p>`)
 	} else {
-		for _, username := range activeStreams {
-			fmt.Fprintf(w, `<a href="/stream/%s/live.m3u8" class="stream-link">%s - Click to view stream</a>`, username, username)
+		for _, info := range activeStreams {
+			// Usernames come from publishers' URLs
+			fmt.Fprintf(w, `<a href="/stream/%s/live.m3u8" class="stream-link">%s - Click to view stream<span class="metadata">%s</span><span class="state state-%s">%s</span></a>`,
+				html.EscapeString(url.PathEscape(info.Username)), html.EscapeString(info.Username), html.EscapeString(describeFormat(info)), info.State, describeState(info))
 		}
 	}
 
 	fmt.Fprintf(w, `    </div>
 </body>
 </html>`)
-} 
\ No newline at end of file
+}
+
+// rtmpPlayHint tells how to play streams over RTMP, or that it is blocked
+func rtmpPlayHint(enabled bool) string {
+	if !enabled {
+		return `
+        <p><strong>Note:</strong> RTMP play connections are blocked.</p>`
+	}
+	return `
+        <p><span class="code">rtmp://localhost/live/{app}/{username}/{username}</span> (RTMP)</p>`
+}
+
+// describeState returns a short human readable label for the stream state
+func describeState(info stream.StreamInfo) string {
+	if info.State == stream.StateAwaitingReconnect {
+		return fmt.Sprintf("reconnecting… %ds left", int(math.Ceil(info.ReconnectRemaining)))
+	}
+	return info.State.String()
+}
+
+// describeFormat summarizes the stream's resolution, frame rate and bitrate,
+// e.g. "1920x1080 30fps 6160 kbit/s". The resolution read from the sequence
+// header is preferred over the one declared in onMetaData.
+func describeFormat(info stream.StreamInfo) string {
+	var parts []string
+	md := info.Metadata
+	switch {
+	case info.Video != nil:
+		parts = append(parts, fmt.Sprintf("%dx%d", info.Video.Width, info.Video.Height))
+	case md != nil && md.Width > 0 && md.Height > 0:
+		parts = append(parts, fmt.Sprintf("%dx%d", md.Width, md.Height))
+	}
+	if md == nil {
+		return strings.Join(parts, " ")
+	}
+	if md.FrameRate > 0 {
+		parts = append(parts, fmt.Sprintf("%gfps", math.Round(md.FrameRate*100)/100))
+	}
+	if bitrate := md.VideoDataRate + md.AudioDataRate; bitrate > 0 {
+		parts = append(parts, fmt.Sprintf("%.0f kbit/s", bitrate))
+	}
+	return strings.Join(parts, " ")
+}
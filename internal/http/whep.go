@@ -0,0 +1,105 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"rtmp-server-poc/internal/whep"
+)
+
+// maxOfferSize bounds the SDP offers read from WHEP players and WHIP
+// encoders
+const maxOfferSize = 64 * 1024
+
+// offerTimeout bounds answering a WebRTC offer, mostly gathering candidates
+const offerTimeout = 10 * time.Second
+
+// setWebRTCHeaders allows browser players and encoders on other origins to
+// use the WHEP and WHIP endpoints and read the session URL
+func setWebRTCHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+}
+
+// handleWebRTCOptions answers CORS preflight requests for the WHEP and WHIP
+// endpoints
+func (s *Server) handleWebRTCOptions(w http.ResponseWriter, r *http.Request) {
+	setWebRTCHeaders(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWHEPOffer starts WebRTC playback of a live stream: POST
+// /whep/{username} with an SDP offer gets the answer back, and the session
+// URL to DELETE when done in the Location header
+func (s *Server) handleWHEPOffer(w http.ResponseWriter, r *http.Request) {
+	setWebRTCHeaders(w)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/sdp" {
+		http.Error(w, "expected an application/sdp offer", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, "cannot read the offer", http.StatusBadRequest)
+		return
+	}
+
+	name := r.PathValue("name")
+	sp, ok := s.liveStream(r, name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	viewer, err := sp.Watch()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var audio whep.PacketSource
+	if listener := sp.ListenOpus(); listener != nil {
+		audio = listener
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), offerTimeout)
+	defer cancel()
+	session, answer, err := s.whep.Offer(ctx, string(offer), viewer, audio)
+	switch {
+	case errors.Is(err, whep.ErrInvalidOffer):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("WHEP offer for stream %s failed: %v", name, err)
+		http.Error(w, "cannot answer the offer", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("WHEP viewer %s joined stream %s (session %s)", r.RemoteAddr, name, session.ID)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whep/"+name+"/"+session.ID)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// handleWHEPDelete ends a WHEP session: DELETE /whep/{username}/{session}
+func (s *Server) handleWHEPDelete(w http.ResponseWriter, r *http.Request) {
+	setWebRTCHeaders(w)
+	if err := s.whep.Close(r.PathValue("session")); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleWebRTCPatch refuses trickled candidates and ICE restarts, which WHEP
+// and WHIP servers may do: the answer already carries every candidate
+func (s *Server) handleWebRTCPatch(w http.ResponseWriter, r *http.Request) {
+	setWebRTCHeaders(w)
+	w.Header().Set("Allow", "DELETE, OPTIONS")
+	http.Error(w, "trickle ICE is not supported", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+
+	"rtmp-server-poc/internal/whip"
+)
+
+// handleWHIPOffer starts a WebRTC publish: POST /whip/{app}/{username} with
+// an SDP offer and the stream key as a Bearer token gets the answer back,
+// and the session URL to DELETE when done in the Location header. The path
+// stands for the RTMP URL, so "/whip/test/johndoe" is authorized like
+// rtmp://host/live/test/johndoe, and the token like the publishing name,
+// which may carry a role ("johndoe?role=backup").
+func (s *Server) handleWHIPOffer(w http.ResponseWriter, r *http.Request) {
+	setWebRTCHeaders(w)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/sdp" {
+		http.Error(w, "expected an application/sdp offer", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	req, ok := s.authorizeIngest(w, r)
+	if !ok {
+		return
+	}
+	offer, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, "cannot read the offer", http.StatusBadRequest)
+		return
+	}
+
+	// An evicted publisher's writes fail, which ends its session
+	publisher, ok := s.attachIngest(w, req)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), offerTimeout)
+	defer cancel()
+	session, answer, err := s.whip.Offer(ctx, string(offer), publisher.Bind(s.config))
+	switch {
+	case errors.Is(err, whip.ErrInvalidOffer):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("WHIP offer for stream %s failed: %v", req.name, err)
+		http.Error(w, "cannot answer the offer", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("WHIP publisher %s started stream %s as %s (session %s)", r.RemoteAddr, req.name, req.role, session.ID)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", r.URL.Path+"/"+session.ID)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// handleWHIPDelete ends a WHIP session, and with it the publish: DELETE on
+// the session URL, /whip/{app}/{username}/{session}
+func (s *Server) handleWHIPDelete(w http.ResponseWriter, r *http.Request) {
+	setWebRTCHeaders(w)
+	if err := s.whip.Close(path.Base(r.URL.Path)); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
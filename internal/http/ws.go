@@ -0,0 +1,332 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/mp4"
+	"rtmp-server-poc/internal/stream"
+	"rtmp-server-poc/internal/websocket"
+)
+
+// WebSocket playback formats
+const (
+	wsFormatFLV  = "flv"  // an FLV byte stream, as over HTTP-FLV
+	wsFormatFMP4 = "fmp4" // fragmented MP4 for Media Source Extensions
+)
+
+// Playback qualities a WebSocket viewer can switch between
+const (
+	qualitySource = "source" // the stream as published
+	qualityAudio  = "audio"  // audio only
+)
+
+// wsControl is a control message sent by a WebSocket viewer
+type wsControl struct {
+	Type    string `json:"type"` // "pause", "resume" or "quality"
+	Quality string `json:"quality,omitempty"`
+}
+
+// wsState is sent to a WebSocket viewer after each control message
+type wsState struct {
+	Type    string `json:"type"` // "state"
+	Paused  bool   `json:"paused"`
+	Quality string `json:"quality"`
+}
+
+// wsNotice is a text message telling a WebSocket viewer about the binary
+// messages that follow, or about an error
+type wsNotice struct {
+	Type string `json:"type"` // "init" or "error"
+	// MIMEType is the SourceBuffer type of the fMP4 init segment that follows
+	MIMEType string `json:"mime,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// wsSession is a WebSocket viewer's playback, which control messages pause,
+// resume or restart at another quality. Each restart watches the stream
+// anew, so playback resumes from the cached GOP.
+type wsSession struct {
+	conn   *websocket.Conn
+	stream *stream.StreamProcess
+	format string
+
+	mutex     sync.Mutex
+	paused    bool
+	quality   string
+	viewer    *stream.Viewer // nil while paused
+	restarted bool           // viewer was closed by a control message
+	changed   chan struct{}  // signalled when a paused session may restart
+
+	// The FLV byte stream continues across restarts
+	flvBuffer   bytes.Buffer
+	flvWriter   *flv.Writer
+	flvStarted  bool // header written
+	flvTimeline flvTimeline
+}
+
+// flvTimeline keeps the timestamps of an FLV byte stream from going back
+// when playback restarts: the cached GOP it restarts from was partly sent
+// already, so its tags are rebased to continue from the last one written.
+type flvTimeline struct {
+	offset    uint32
+	last      uint32
+	written   bool
+	restarted bool
+}
+
+// timestamp returns a tag's timestamp on the byte stream. After a restart,
+// the metadata and sequence headers the viewer starts with keep the last
+// timestamp written, and the first frame sets the offset of the others.
+func (t *flvTimeline) timestamp(tag flv.Tag) uint32 {
+	if t.restarted && t.written {
+		if tag.Type == flv.TagTypeScript || tag.IsSequenceHeader() {
+			return t.last
+		}
+		t.offset = 0
+		if tag.Timestamp < t.last {
+			t.offset = t.last - tag.Timestamp
+		}
+	}
+	t.restarted = false
+
+	timestamp := tag.Timestamp + t.offset
+	if !t.written || timestamp > t.last {
+		t.last = timestamp
+	}
+	t.written = true
+	return timestamp
+}
+
+// handleLiveWebSocket streams a live stream over a WebSocket, as FLV
+// (GET /ws/{username}.flv) or fragmented MP4 (GET /ws/{username}.mp4) in
+// binary messages. Text messages carry the control protocol: the viewer
+// sends {"type":"pause"}, {"type":"resume"} or {"type":"quality",
+// "quality":"source"|"audio"} and gets the resulting state back; each fMP4
+// init segment is preceded by {"type":"init","mime":...}.
+func (s *Server) handleLiveWebSocket(w http.ResponseWriter, r *http.Request) {
+	file := r.PathValue("file")
+	format := wsFormatFLV
+	name, ok := strings.CutSuffix(file, ".flv")
+	if !ok {
+		format = wsFormatFMP4
+		name, ok = strings.CutSuffix(file, ".mp4")
+	}
+	if !ok || name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	sp, ok := s.liveStream(r, name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	session := &wsSession{
+		conn:    conn,
+		stream:  sp,
+		format:  format,
+		quality: qualitySource,
+		changed: make(chan struct{}, 1),
+	}
+	session.flvWriter = flv.NewWriter(&session.flvBuffer)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		session.readControls()
+		cancel()
+	}()
+
+	log.Printf("WebSocket %s viewer %s joined stream %s", format, conn.RemoteAddr(), name)
+	err = session.play(ctx)
+	switch {
+	case errors.Is(err, stream.ErrStreamEnded):
+		conn.CloseWithReason(websocket.CloseGoingAway, "stream ended")
+	default:
+		conn.Close()
+	}
+	cancel()
+	log.Printf("WebSocket %s viewer %s left stream %s", format, conn.RemoteAddr(), name)
+}
+
+// readControls applies the viewer's control messages until the connection
+// closes
+func (ws *wsSession) readControls() {
+	for {
+		messageType, data, err := ws.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		var control wsControl
+		if err := json.Unmarshal(data, &control); err != nil {
+			ws.sendJSON(wsNotice{Type: "error", Message: "invalid control message"})
+			continue
+		}
+		state, err := ws.apply(control)
+		if err != nil {
+			ws.sendJSON(wsNotice{Type: "error", Message: err.Error()})
+			continue
+		}
+		ws.sendJSON(state)
+	}
+}
+
+// apply changes the playback state. Pausing or switching quality closes the
+// current viewer, so play starts over.
+func (ws *wsSession) apply(control wsControl) (wsState, error) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	switch control.Type {
+	case "pause":
+		ws.paused = true
+		ws.interruptLocked()
+	case "resume":
+		ws.paused = false
+	case "quality":
+		if control.Quality != qualitySource && control.Quality != qualityAudio {
+			return wsState{}, fmt.Errorf("unknown quality %q", control.Quality)
+		}
+		if control.Quality != ws.quality {
+			ws.quality = control.Quality
+			ws.interruptLocked()
+		}
+	default:
+		return wsState{}, fmt.Errorf("unknown control %q", control.Type)
+	}
+
+	select {
+	case ws.changed <- struct{}{}:
+	default:
+	}
+	return wsState{Type: "state", Paused: ws.paused, Quality: ws.quality}, nil
+}
+
+// interruptLocked closes the current viewer. The caller holds mutex.
+func (ws *wsSession) interruptLocked() {
+	if ws.viewer != nil {
+		ws.viewer.Close()
+		ws.viewer = nil
+		ws.restarted = true
+	}
+}
+
+// watch starts a viewer at the current quality, waiting while paused. It
+// returns a nil viewer once ctx is done.
+func (ws *wsSession) watch(ctx context.Context) (*stream.Viewer, string, error) {
+	for {
+		ws.mutex.Lock()
+		if !ws.paused {
+			viewer, err := ws.stream.Watch()
+			ws.viewer, ws.restarted = viewer, false
+			quality := ws.quality
+			ws.mutex.Unlock()
+			return viewer, quality, err
+		}
+		ws.mutex.Unlock()
+
+		select {
+		case <-ws.changed:
+		case <-ctx.Done():
+			return nil, "", nil
+		}
+	}
+}
+
+// play sends the stream until it ends, the viewer goes away or a write
+// fails
+func (ws *wsSession) play(ctx context.Context) error {
+	for {
+		viewer, quality, err := ws.watch(ctx)
+		if err != nil || viewer == nil {
+			return err
+		}
+		err = ws.send(ctx, viewer, quality)
+		viewer.Close()
+		if err != nil {
+			return err
+		}
+
+		ws.mutex.Lock()
+		restarted := ws.restarted
+		ws.mutex.Unlock()
+		if !restarted && ctx.Err() == nil {
+			return stream.ErrStreamEnded
+		}
+	}
+}
+
+// send writes a viewer's tags as binary messages until the viewer is closed.
+// A viewer starts with the metadata and sequence headers, so a restarted FLV
+// byte stream carries them again, for the quality it switched to.
+func (ws *wsSession) send(ctx context.Context, viewer *stream.Viewer, quality string) error {
+	fragmenter := mp4.NewFragmenter()
+	ws.flvTimeline.restarted = true
+	for {
+		tag, ok := viewer.Next(ctx)
+		if !ok {
+			return nil
+		}
+		if quality == qualityAudio && tag.Type == flv.TagTypeVideo {
+			continue
+		}
+
+		if ws.format == wsFormatFMP4 {
+			for _, segment := range fragmenter.WriteTag(tag) {
+				if segment.Init {
+					if err := ws.sendJSON(wsNotice{Type: "init", MIMEType: segment.MIMEType}); err != nil {
+						return err
+					}
+				}
+				if err := ws.sendBinary(segment.Data); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if !ws.flvStarted {
+			ws.flvWriter.WriteHeaderFlags(viewer.Tracks())
+			ws.flvStarted = true
+		}
+		err := ws.flvWriter.WriteTag(tag.Type, ws.flvTimeline.timestamp(tag), tag.Data)
+		if err == nil {
+			err = ws.sendBinary(ws.flvBuffer.Bytes())
+		}
+		ws.flvBuffer.Reset()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendBinary writes a binary message
+func (ws *wsSession) sendBinary(data []byte) error {
+	ws.conn.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+	return ws.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// sendJSON writes a text message
+func (ws *wsSession) sendJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ws.conn.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+	return ws.conn.WriteMessage(websocket.TextMessage, data)
+}
@@ -0,0 +1,42 @@
+package http
+
+import (
+	"testing"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+func TestFLVTimelineRestart(t *testing.T) {
+	header := flv.Tag{Type: flv.TagTypeVideo, Data: []byte{0x17, 0x00, 0x00, 0x00, 0x00}}
+	keyframe := func(timestamp uint32) flv.Tag {
+		return flv.Tag{Type: flv.TagTypeVideo, Timestamp: timestamp, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00}}
+	}
+	frame := func(timestamp uint32) flv.Tag {
+		return flv.Tag{Type: flv.TagTypeVideo, Timestamp: timestamp, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00}}
+	}
+	at := func(tag flv.Tag, timestamp uint32) flv.Tag {
+		tag.Timestamp = timestamp
+		return tag
+	}
+
+	steps := []struct {
+		name     string
+		tags     []flv.Tag
+		expected []uint32
+	}{
+		{"First viewer", []flv.Tag{at(header, 1000), keyframe(1000), frame(1500), keyframe(2000), frame(2500)}, []uint32{1000, 1000, 1500, 2000, 2500}},
+		{"Restart from the cached GOP", []flv.Tag{at(header, 2000), keyframe(2000), frame(2500), frame(3000)}, []uint32{2500, 2500, 3000, 3500}},
+		{"Restart at the next keyframe", []flv.Tag{at(header, 0), keyframe(10000)}, []uint32{3500, 10000}},
+	}
+
+	// Each step is a viewer, as send starts them
+	var timeline flvTimeline
+	for _, step := range steps {
+		timeline.restarted = true
+		for i, tag := range step.tags {
+			if timestamp := timeline.timestamp(tag); timestamp != step.expected[i] {
+				t.Errorf("%s: tag %d at %d written at %d, expected %d", step.name, i, tag.Timestamp, timestamp, step.expected[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Package mp4 writes ISO BMFF (MP4) files from FLV tags without FFmpeg.
+// Files are "faststart": the moov box comes before the media data so
+// playback can begin before the whole file is downloaded. Live streams are
+// fragmented into an initialization segment and moof/mdat fragments for
+// Media Source Extensions players.
+package mp4
+
+import (
+	"encoding/binary"
+)
+
+// box encodes a box of the given four character type around its payload
+func box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, boxType...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// fullBox encodes a box carrying a version and flags ahead of its payload
+func fullBox(boxType string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags&0xffffff)
+	return box(boxType, append([][]byte{header}, payload...)...)
+}
+
+// fields appends big-endian integers; each value is written with the width
+// of its type
+func fields(values ...interface{}) []byte {
+	var b []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case uint8:
+			b = append(b, v)
+		case uint16:
+			b = binary.BigEndian.AppendUint16(b, v)
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case int32:
+			b = binary.BigEndian.AppendUint32(b, uint32(v))
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		case int64:
+			b = binary.BigEndian.AppendUint64(b, uint64(v))
+		case []byte:
+			b = append(b, v...)
+		default:
+			panic("mp4: unsupported field type")
+		}
+	}
+	return b
+}
+
+// unityMatrix is the identity transformation matrix of mvhd and tkhd
+var unityMatrix = fields(
+	uint32(0x00010000), uint32(0), uint32(0),
+	uint32(0), uint32(0x00010000), uint32(0),
+	uint32(0), uint32(0), uint32(0x40000000),
+)
+
+// descriptor encodes an MPEG-4 descriptor (ISO/IEC 14496-1) with a
+// four-byte size field, as most muxers write it
+func descriptor(tag byte, payload ...[]byte) []byte {
+	size := 0
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := []byte{tag, 0x80 | byte(size>>21)&0x7f, 0x80 | byte(size>>14)&0x7f, 0x80 | byte(size>>7)&0x7f, byte(size) & 0x7f}
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
@@ -0,0 +1,37 @@
+package mp4
+
+import (
+	"io"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// ConvertFLV muxes the FLV file read from src into an MP4 file at path.
+// Malformed tags are skipped; a broken FLV framing aborts the conversion.
+func ConvertFLV(src io.Reader, path string) (FileInfo, error) {
+	f, err := Create(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	reader := flv.NewReader(src)
+	for {
+		raw, err := reader.ReadTag()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.discard()
+			return FileInfo{}, err
+		}
+		tag, err := flv.ParseTag(raw.Type, raw.Timestamp, raw.Data)
+		if err != nil {
+			continue
+		}
+		if err := f.WriteTag(tag); err != nil {
+			f.discard()
+			return FileInfo{}, err
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,45 @@
+package mp4
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+func TestConvertFLV(t *testing.T) {
+	src := &bytes.Buffer{}
+	w := flv.NewWriter(src)
+	w.WriteHeader()
+	for _, tag := range []struct {
+		tagType   byte
+		timestamp uint32
+		data      []byte
+	}{
+		{flv.TagTypeScript, 0, []byte{0x02, 0x00, 0x0a}},
+		{flv.TagTypeVideo, 1000, append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, avcConfig...)},
+		{flv.TagTypeVideo, 1000, []byte{}}, // malformed, skipped
+		{flv.TagTypeVideo, 1000, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65}},
+		{flv.TagTypeVideo, 1040, []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x41}},
+	} {
+		if err := w.WriteTag(tag.tagType, tag.timestamp, tag.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "out.mp4")
+	info, err := ConvertFLV(bytes.NewReader(src.Bytes()), path)
+	if err != nil {
+		t.Fatalf("ConvertFLV() error = %v", err)
+	}
+	if info.Duration != 0.08 || info.Keyframes != 1 {
+		t.Errorf("ConvertFLV() = %+v, expected 80ms with 1 keyframe", info)
+	}
+
+	// A truncated file is an error and leaves nothing behind
+	truncated := src.Bytes()[:src.Len()-3]
+	if _, err := ConvertFLV(bytes.NewReader(truncated), filepath.Join(t.TempDir(), "bad.mp4")); err == nil {
+		t.Error("ConvertFLV() of a truncated file succeeded")
+	}
+}
@@ -0,0 +1,282 @@
+package mp4
+
+import (
+	"bytes"
+	"strings"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// Sample flags of trun entries: a sync sample depends on no other; other
+// video samples depend on earlier ones and are not sync samples
+const (
+	syncSampleFlags    = 0x02000000
+	nonSyncSampleFlags = 0x01010000
+)
+
+// trun flags: data offset, then per sample duration, size, flags and
+// composition offset
+const trunFlags = 0x000001 | 0x000100 | 0x000200 | 0x000400 | 0x000800
+
+// Segment is a piece of a fragmented MP4 stream
+type Segment struct {
+	// Init is set on initialization segments (ftyp and moov), which the
+	// fragments following them depend on
+	Init bool
+	// MIMEType is the type to create a Media Source Extensions SourceBuffer
+	// with, e.g. `video/mp4; codecs="avc1.64001f,mp4a.40.2"`; set on
+	// initialization segments
+	MIMEType string
+	Data     []byte
+}
+
+// pendingSample is a sample waiting for the next one of its track, which
+// gives its duration
+type pendingSample struct {
+	sample
+	data []byte
+}
+
+// Fragmenter turns a live stream's FLV tags into fragmented MP4 for Media
+// Source Extensions players. An initialization segment is written at the
+// first video keyframe (the first audio frame without video) with the
+// tracks configured so far, then a moof/mdat fragment per video frame (per
+// audio frame without video). H.264, HEVC and AAC are supported; other
+// codecs are dropped. A decoder configuration that changes starts over with
+// a new initialization segment.
+type Fragmenter struct {
+	video    *track
+	audio    *track
+	tracks   []*track // tracks of the last initialization segment
+	pending  map[*track][]pendingSample
+	sequence uint32
+}
+
+// NewFragmenter creates a fragmenter waiting for sequence headers
+func NewFragmenter() *Fragmenter {
+	return &Fragmenter{pending: make(map[*track][]pendingSample)}
+}
+
+// WriteTag adds a tag parsed by flv.ParseTag, returning the segments it
+// completes
+func (f *Fragmenter) WriteTag(tag flv.Tag) []Segment {
+	switch {
+	case tag.Video != nil:
+		if name := tag.Video.Codec(); name != "avc" && name != "hevc" {
+			return nil
+		}
+		if tag.Video.IsSequenceHeader() {
+			return f.configure(&f.video, tag, newVideoTrack)
+		}
+		if f.video == nil || !tag.Video.IsCodedFrame() {
+			return nil
+		}
+		return f.add(f.video, tag, tag.Data[tag.Video.PayloadOffset:], tag.Video.CompositionTime, tag.IsKeyframe())
+	case tag.Audio != nil:
+		if tag.Audio.Codec() != "aac" {
+			return nil
+		}
+		if tag.Audio.IsSequenceHeader() {
+			return f.configure(&f.audio, tag, newAudioTrack)
+		}
+		if f.audio == nil {
+			return nil
+		}
+		return f.add(f.audio, tag, tag.Data[tag.Audio.PayloadOffset:], 0, true)
+	}
+	return nil
+}
+
+// configure sets up a track from its sequence header. A new configuration
+// ends the current fragments, and the stream starts over with a new
+// initialization segment.
+func (f *Fragmenter) configure(current **track, tag flv.Tag, newTrack func(flv.Tag) (*track, error)) []Segment {
+	t, err := newTrack(tag)
+	if err != nil || *current != nil && bytes.Equal((*current).config, t.config) {
+		return nil
+	}
+	segments := f.flush(true)
+	*current = t
+	f.tracks = nil
+	return segments
+}
+
+// started reports whether an initialization segment covers t
+func (f *Fragmenter) started(t *track) bool {
+	for _, started := range f.tracks {
+		if started == t {
+			return true
+		}
+	}
+	return false
+}
+
+// clock is the track whose samples complete fragments: video when the
+// stream has it
+func (f *Fragmenter) clock() *track {
+	if f.video != nil && (f.started(f.video) || f.tracks == nil) {
+		return f.video
+	}
+	return f.audio
+}
+
+// add queues a sample, writing the initialization segment first when the
+// sample may start the stream, and returns the fragment it completes
+func (f *Fragmenter) add(t *track, tag flv.Tag, data []byte, composition int32, sync bool) []Segment {
+	var segments []Segment
+	if f.tracks == nil {
+		if t != f.clock() || !sync {
+			return nil // waiting for a keyframe
+		}
+		segments = append(segments, f.initSegment())
+	}
+	if !f.started(t) {
+		return segments
+	}
+
+	pending := f.pending[t]
+	if n := len(pending); n > 0 && tag.Timestamp < pending[n-1].timestamp {
+		tag.Timestamp = pending[n-1].timestamp // decoding time never goes back
+	}
+	f.pending[t] = append(pending, pendingSample{
+		sample: sample{
+			size:        uint32(len(data)),
+			timestamp:   tag.Timestamp,
+			composition: composition,
+			sync:        sync,
+		},
+		data: append([]byte(nil), data...),
+	})
+	if t == f.clock() && len(f.pending[t]) > 1 {
+		segments = append(segments, f.flush(false)...)
+	}
+	return segments
+}
+
+// initSegment starts the stream with the configured tracks
+func (f *Fragmenter) initSegment() Segment {
+	f.tracks = nil
+	clear(f.pending)
+	var codecs []string
+	for _, t := range []*track{f.video, f.audio} {
+		if t != nil {
+			t.id = uint32(len(f.tracks) + 1)
+			f.tracks = append(f.tracks, t)
+			codecs = append(codecs, t.codecs)
+		}
+	}
+
+	mimeType := "video/mp4"
+	if f.video == nil {
+		mimeType = "audio/mp4"
+	}
+	brands := [][]byte{[]byte("iso5"), fields(uint32(0x200)), []byte("iso5"), []byte("iso6"), []byte("mp41")}
+	if f.video != nil && f.video.codec == "avc" {
+		brands = append(brands, []byte("avc1"))
+	}
+
+	traks := [][]byte{fullBox("mvhd", 0, 0, fields(
+		uint32(0), uint32(0), uint32(movieTimescale), uint32(0),
+		uint32(0x00010000), uint16(0x0100), make([]byte, 10),
+		unityMatrix, make([]byte, 24), uint32(len(f.tracks)+1),
+	))}
+	var trex [][]byte
+	for _, t := range f.tracks {
+		traks = append(traks, box("trak", t.tkhd(0), box("mdia",
+			t.mdhd(0),
+			t.hdlr(),
+			box("minf", t.mediaHeader(), dinf(), box("stbl",
+				fullBox("stsd", 0, 0, fields(uint32(1)), t.sampleEntry()),
+				fullBox("stts", 0, 0, fields(uint32(0))),
+				fullBox("stsc", 0, 0, fields(uint32(0))),
+				fullBox("stsz", 0, 0, fields(uint32(0), uint32(0))),
+				fullBox("stco", 0, 0, fields(uint32(0))),
+			)),
+		)))
+		trex = append(trex, fullBox("trex", 0, 0, fields(t.id, uint32(1), uint32(0), uint32(0), uint32(0))))
+	}
+	traks = append(traks, box("mvex", trex...))
+
+	return Segment{
+		Init:     true,
+		MIMEType: mimeType + `; codecs="` + strings.Join(codecs, ",") + `"`,
+		Data:     append(box("ftyp", brands...), box("moov", traks...)...),
+	}
+}
+
+// flush writes a fragment with the pending samples of every track, except
+// the last of each, whose duration is not known yet. With all set, the last
+// samples are written too, lasting as long as the ones before them.
+func (f *Fragmenter) flush(all bool) []Segment {
+	type run struct {
+		t         *track
+		samples   []pendingSample
+		durations []int64
+	}
+	var runs []run
+	for _, t := range f.tracks {
+		pending := f.pending[t]
+		n := len(pending)
+		if !all {
+			n--
+		}
+		if n <= 0 {
+			continue
+		}
+		r := run{t: t, samples: pending[:n]}
+		for i := range r.samples {
+			switch {
+			case i+1 < len(pending):
+				next := t.toTimescale(int64(pending[i+1].timestamp))
+				r.durations = append(r.durations, next-t.toTimescale(int64(pending[i].timestamp)))
+			case i > 0:
+				r.durations = append(r.durations, r.durations[i-1])
+			case t.handler == "soun":
+				r.durations = append(r.durations, 1024) // one AAC frame
+			default:
+				r.durations = append(r.durations, int64(t.timescale)/30)
+			}
+		}
+		runs = append(runs, r)
+		f.pending[t] = append([]pendingSample(nil), pending[n:]...)
+	}
+	if len(runs) == 0 {
+		return nil
+	}
+
+	// The trun data offsets depend on the size of the moof box, which does
+	// not depend on their values
+	f.sequence++
+	moof := func(base int) []byte {
+		payload := [][]byte{fullBox("mfhd", 0, 0, fields(f.sequence))}
+		offset := base
+		for _, r := range runs {
+			entries := fields(uint32(len(r.samples)), int32(offset))
+			for i, s := range r.samples {
+				flags := uint32(syncSampleFlags)
+				if !s.sync {
+					flags = nonSyncSampleFlags
+				}
+				entries = append(entries, fields(
+					uint32(r.durations[i]), s.size, flags, int32(r.t.toTimescale(int64(s.composition))),
+				)...)
+				offset += int(s.size)
+			}
+			payload = append(payload, box("traf",
+				fullBox("tfhd", 0, 0x020000, fields(r.t.id)), // default-base-is-moof
+				fullBox("tfdt", 1, 0, fields(uint64(r.t.toTimescale(int64(r.samples[0].timestamp))))),
+				fullBox("trun", 1, trunFlags, entries),
+			))
+		}
+		return box("moof", payload...)
+	}
+	header := moof(len(moof(0)) + 8)
+
+	var media [][]byte
+	for _, r := range runs {
+		for _, s := range r.samples {
+			media = append(media, s.data)
+		}
+	}
+	return []Segment{{Data: append(header, box("mdat", media...)...)}}
+}
@@ -0,0 +1,110 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// trunSamples decodes the data offset and per sample fields of a version
+// 1 trun with every per sample field present
+func trunSamples(t *testing.T, trun []byte) (offset int32, samples [][4]uint32) {
+	t.Helper()
+	if flags := binary.BigEndian.Uint32(trun) & 0xffffff; flags != trunFlags {
+		t.Fatalf("trun flags = %#x", flags)
+	}
+	count := binary.BigEndian.Uint32(trun[4:])
+	offset = int32(binary.BigEndian.Uint32(trun[8:]))
+	for i := range count {
+		entry := trun[12+16*i:]
+		samples = append(samples, [4]uint32{
+			binary.BigEndian.Uint32(entry), binary.BigEndian.Uint32(entry[4:]),
+			binary.BigEndian.Uint32(entry[8:]), binary.BigEndian.Uint32(entry[12:]),
+		})
+	}
+	return offset, samples
+}
+
+func TestFragmenter(t *testing.T) {
+	f := NewFragmenter()
+	sequenceHeader, _ := flv.ParseTag(flv.TagTypeVideo, 0, append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, avcConfig...))
+	var segments []Segment
+	for _, tag := range []flv.Tag{
+		sequenceHeader,
+		audioTag(0, 0x00, 0x12, 0x10), // AAC-LC 44.1 kHz stereo
+		audioTag(0, 0x01, 0xee),       // before the first keyframe, dropped
+		videoTag(0, true, 66, 0x65, 0x01),
+		audioTag(10, 0x01, 0xa1),
+		videoTag(33, false, 0, 0x41, 0x02),
+		audioTag(33, 0x01, 0xa2),
+		videoTag(66, true, 0, 0x65, 0x03),
+	} {
+		segments = append(segments, f.WriteTag(tag)...)
+	}
+	if len(segments) != 3 || !segments[0].Init || segments[1].Init {
+		t.Fatalf("got %d segments, expected an init segment and 2 fragments", len(segments))
+	}
+
+	init := segments[0]
+	if init.MIMEType != `video/mp4; codecs="avc1.640028,mp4a.40.2"` {
+		t.Errorf("MIMEType = %q", init.MIMEType)
+	}
+	if types, _ := children(t, init.Data); !reflect.DeepEqual(types, []string{"ftyp", "moov"}) {
+		t.Errorf("init segment boxes = %v", types)
+	}
+	if trex := find(t, init.Data, "moov", "mvex", "trex"); len(trex) != 2 {
+		t.Errorf("init segment has %d trex, expected one per track", len(trex))
+	}
+	if stsz := find(t, init.Data, "moov", "trak", "mdia", "minf", "stbl", "stsz"); len(stsz) != 2 || !bytes.Equal(stsz[0], make([]byte, 12)) {
+		t.Errorf("init segment sample tables are not empty: %x", stsz)
+	}
+
+	// The second fragment has the inter frame and the first audio frame,
+	// each running until the next sample of its track
+	fragment := segments[2].Data
+	if types, _ := children(t, fragment); !reflect.DeepEqual(types, []string{"moof", "mdat"}) {
+		t.Fatalf("fragment boxes = %v", types)
+	}
+	if mfhd := find(t, fragment, "moof", "mfhd")[0]; binary.BigEndian.Uint32(mfhd[4:]) != 2 {
+		t.Errorf("fragment sequence number = %d, expected 2", binary.BigEndian.Uint32(mfhd[4:]))
+	}
+	trafs := find(t, fragment, "moof", "traf")
+	expected := []struct {
+		tfdt    uint64
+		samples [][4]uint32
+		data    []byte
+	}{
+		{2970, [][4]uint32{{2970, 2, nonSyncSampleFlags, 0}}, []byte{0x41, 0x02}},
+		{441, [][4]uint32{{1014, 1, syncSampleFlags, 0}}, []byte{0xa1}},
+	}
+	if len(trafs) != len(expected) {
+		t.Fatalf("fragment has %d trafs, expected video and audio", len(trafs))
+	}
+	for i, traf := range trafs {
+		if tfdt := binary.BigEndian.Uint64(find(t, traf, "tfdt")[0][4:]); tfdt != expected[i].tfdt {
+			t.Errorf("track %d tfdt = %d, expected %d", i+1, tfdt, expected[i].tfdt)
+		}
+		offset, samples := trunSamples(t, find(t, traf, "trun")[0])
+		if !reflect.DeepEqual(samples, expected[i].samples) {
+			t.Errorf("track %d samples = %v, expected %v", i+1, samples, expected[i].samples)
+		}
+		if got := fragment[offset : offset+int32(len(expected[i].data))]; !bytes.Equal(got, expected[i].data) {
+			t.Errorf("track %d data offset points at %x, expected %x", i+1, got, expected[i].data)
+		}
+	}
+
+	// A new decoder configuration writes out the pending samples and starts
+	// over at the next keyframe
+	changed := append([]byte(nil), sequenceHeader.Data...)
+	changed[len(changed)-1] = 0x01
+	newHeader, _ := flv.ParseTag(flv.TagTypeVideo, 100, changed)
+	if flushed := f.WriteTag(newHeader); len(flushed) != 1 || len(find(t, flushed[0].Data, "moof", "traf")) != 2 {
+		t.Errorf("configuration change flushed %d segments, expected a fragment with both tracks", len(flushed))
+	}
+	if restarted := f.WriteTag(videoTag(100, true, 0, 0x65)); len(restarted) != 1 || !restarted[0].Init {
+		t.Errorf("keyframe after the change gave %d segments, expected an init segment", len(restarted))
+	}
+}
@@ -0,0 +1,288 @@
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// ErrNoMedia is returned when a file is closed without any sample to write
+var ErrNoMedia = errors.New("mp4: no audio or video to write")
+
+// File writes an MP4 file from FLV tags. H.264, HEVC and AAC tracks are
+// muxed; tags of other codecs, or with a decoder configuration that does
+// not parse, are dropped. Samples are written to a ".part" file next to the
+// destination; Close writes the destination with the moov box ahead of the
+// media data.
+type File struct {
+	path     string
+	part     *os.File
+	buffered *bufio.Writer
+
+	size  int64 // bytes of samples written to the part file
+	video *track
+	audio *track
+
+	skipped map[string]bool // codecs already reported as dropped
+}
+
+// FileInfo describes a finished MP4 file
+type FileInfo struct {
+	Path      string  `json:"path"`
+	Size      int64   `json:"size"`
+	Duration  float64 `json:"duration"` // seconds
+	Keyframes int     `json:"keyframes"`
+}
+
+// Create starts writing an MP4 file at path
+func Create(path string) (*File, error) {
+	part, err := os.Create(path + ".part")
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		path:     path,
+		part:     part,
+		buffered: bufio.NewWriter(part),
+		skipped:  make(map[string]bool),
+	}, nil
+}
+
+// WriteTag adds a tag parsed by flv.ParseTag. The first sequence header of
+// each track provides its decoder configuration; frames before it, and
+// video before the first keyframe, are dropped.
+func (f *File) WriteTag(tag flv.Tag) error {
+	switch {
+	case tag.Video != nil:
+		return f.writeVideo(tag)
+	case tag.Audio != nil:
+		return f.writeAudio(tag)
+	}
+	return nil
+}
+
+// writeVideo handles a video tag
+func (f *File) writeVideo(tag flv.Tag) error {
+	name := tag.Video.Codec()
+	if name != "avc" && name != "hevc" {
+		f.skip(name, errors.New("codec not supported"))
+		return nil
+	}
+	if tag.Video.IsSequenceHeader() {
+		if f.video == nil {
+			t, err := newVideoTrack(tag)
+			if err != nil {
+				f.skip(name, err)
+				return nil
+			}
+			f.video = t
+		}
+		return nil
+	}
+	if f.video == nil || !tag.Video.IsCodedFrame() {
+		return nil
+	}
+	keyframe := tag.IsKeyframe()
+	if len(f.video.samples) == 0 && !keyframe {
+		return nil
+	}
+	return f.writeSample(f.video, tag, tag.Data[tag.Video.PayloadOffset:], tag.Video.CompositionTime, keyframe)
+}
+
+// writeAudio handles an audio tag
+func (f *File) writeAudio(tag flv.Tag) error {
+	name := tag.Audio.Codec()
+	if name != "aac" {
+		f.skip(name, errors.New("codec not supported"))
+		return nil
+	}
+	if tag.Audio.IsSequenceHeader() {
+		if f.audio == nil {
+			t, err := newAudioTrack(tag)
+			if err != nil {
+				f.skip(name, err)
+				return nil
+			}
+			f.audio = t
+		}
+		return nil
+	}
+	if f.audio == nil {
+		return nil
+	}
+	return f.writeSample(f.audio, tag, tag.Data[tag.Audio.PayloadOffset:], 0, true)
+}
+
+// writeSample appends a sample to the part file
+func (f *File) writeSample(t *track, tag flv.Tag, data []byte, composition int32, sync bool) error {
+	if n := len(t.samples); n > 0 && tag.Timestamp < t.samples[n-1].timestamp {
+		tag.Timestamp = t.samples[n-1].timestamp // decoding time never goes back
+	}
+	if _, err := f.buffered.Write(data); err != nil {
+		return err
+	}
+	t.samples = append(t.samples, sample{
+		offset:      f.size,
+		size:        uint32(len(data)),
+		timestamp:   tag.Timestamp,
+		composition: composition,
+		sync:        sync,
+	})
+	t.bytes += int64(len(data))
+	f.size += int64(len(data))
+	return nil
+}
+
+// skip reports once that the frames of a codec are dropped
+func (f *File) skip(name string, reason error) {
+	if !f.skipped[name] {
+		f.skipped[name] = true
+		log.Printf("MP4 %s: dropping %s frames: %v", f.path, name, reason)
+	}
+}
+
+// Size returns the number of bytes of samples written so far
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// tracks returns the tracks holding samples, numbered from 1
+func (f *File) tracks() []*track {
+	var tracks []*track
+	for _, t := range []*track{f.video, f.audio} {
+		if t != nil && len(t.samples) > 0 {
+			t.id = uint32(len(tracks) + 1)
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks
+}
+
+// Close writes the final file and removes the part file
+func (f *File) Close() (FileInfo, error) {
+	err := f.buffered.Flush()
+	if closeErr := f.part.Close(); err == nil {
+		err = closeErr
+	}
+	defer os.Remove(f.part.Name())
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	tracks := f.tracks()
+	if len(tracks) == 0 {
+		return FileInfo{}, ErrNoMedia
+	}
+
+	ftyp := f.ftyp()
+	mdatHeader := fields(uint32(8+f.size), []byte("mdat"))
+	if 8+f.size > 0xffffffff {
+		mdatHeader = fields(uint32(1), []byte("mdat"), uint64(16+f.size))
+	}
+	// Sample offsets depend on the size of the moov box, which does not
+	// depend on their values once the offset width is chosen
+	co64 := int64(len(ftyp))+int64(len(mdatHeader))+f.size+int64(len(moov(tracks, 0, true))) > 0xffffffff
+	base := int64(len(ftyp) + len(moov(tracks, 0, co64)) + len(mdatHeader))
+	header := append(append(ftyp, moov(tracks, base, co64)...), mdatHeader...)
+
+	info := FileInfo{Path: f.path, Size: base + f.size}
+	for _, t := range tracks {
+		if d := float64(t.duration(movieStart(tracks))) / movieTimescale; d > info.Duration {
+			info.Duration = d
+		}
+		if t.handler == "vide" {
+			for _, s := range t.samples {
+				if s.sync {
+					info.Keyframes++
+				}
+			}
+		}
+	}
+	if err := f.writeFinal(header); err != nil {
+		return FileInfo{}, err
+	}
+	return info, nil
+}
+
+// writeFinal writes the header boxes followed by the part file
+func (f *File) writeFinal(header []byte) error {
+	out, err := os.Create(f.path)
+	if err != nil {
+		return err
+	}
+	part, err := os.Open(f.part.Name())
+	if err != nil {
+		out.Close()
+		return err
+	}
+	defer part.Close()
+
+	buffered := bufio.NewWriter(out)
+	_, err = buffered.Write(header)
+	if err == nil {
+		_, err = io.Copy(buffered, part)
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.path)
+	}
+	return err
+}
+
+// discard abandons the file, removing the part file
+func (f *File) discard() {
+	f.part.Close()
+	os.Remove(f.part.Name())
+}
+
+// ftyp encodes the file type box
+func (f *File) ftyp() []byte {
+	brands := [][]byte{[]byte("isom"), []byte("iso2"), []byte("mp41")}
+	if f.video != nil && f.video.codec == "avc" {
+		brands = append(brands, []byte("avc1"))
+	}
+	return box("ftyp", append([][]byte{[]byte("isom"), fields(uint32(0x200))}, brands...)...)
+}
+
+// movieStart is the earliest decoding time of any track, in milliseconds
+func movieStart(tracks []*track) uint32 {
+	start := tracks[0].samples[0].timestamp
+	for _, t := range tracks[1:] {
+		if t.samples[0].timestamp < start {
+			start = t.samples[0].timestamp
+		}
+	}
+	return start
+}
+
+// moov encodes the movie box, with media data starting at baseOffset
+func moov(tracks []*track, baseOffset int64, co64 bool) []byte {
+	start := movieStart(tracks)
+	var duration int64
+	for _, t := range tracks {
+		if d := t.duration(start); d > duration {
+			duration = d
+		}
+	}
+
+	mvhd := fullBox("mvhd", 0, 0, fields(
+		uint32(0), uint32(0), uint32(movieTimescale), uint32(duration),
+		uint32(0x00010000), uint16(0x0100), make([]byte, 10), // rate, volume, reserved
+		unityMatrix, make([]byte, 24), uint32(len(tracks)+1),
+	))
+	payload := [][]byte{mvhd}
+	for _, t := range tracks {
+		payload = append(payload, t.trak(start, baseOffset, co64))
+	}
+	return box("moov", bytes.Join(payload, nil))
+}
@@ -0,0 +1,209 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// x264 1080p High profile SPS wrapped in an AVCDecoderConfigurationRecord
+var avcConfig = []byte{
+	0x01, 0x64, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x1b,
+	0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00,
+	0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58,
+	0x00,
+}
+
+// children splits a box payload into its child boxes, keyed by type in order
+func children(t *testing.T, data []byte) (types []string, payloads [][]byte) {
+	t.Helper()
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("truncated box header %x", data)
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		header := 8
+		if size == 1 {
+			size, header = int(binary.BigEndian.Uint64(data[8:])), 16
+		}
+		if size < header || size > len(data) {
+			t.Fatalf("box %q has size %d, %d bytes left", data[4:8], size, len(data))
+		}
+		types = append(types, string(data[4:8]))
+		payloads = append(payloads, data[header:size])
+		data = data[size:]
+	}
+	return types, payloads
+}
+
+// find returns the payloads of the boxes at a path below data, e.g.
+// "moov", "trak" returns every trak
+func find(t *testing.T, data []byte, path ...string) [][]byte {
+	t.Helper()
+	matches := [][]byte{data}
+	for _, boxType := range path {
+		var next [][]byte
+		for _, m := range matches {
+			types, payloads := children(t, m)
+			for i := range types {
+				if types[i] == boxType {
+					next = append(next, payloads[i])
+				}
+			}
+		}
+		matches = next
+	}
+	return matches
+}
+
+// videoTag builds an AVC frame tag with a composition time
+func videoTag(timestamp uint32, keyframe bool, composition uint32, payload ...byte) flv.Tag {
+	frameType := byte(0x27)
+	if keyframe {
+		frameType = 0x17
+	}
+	data := append([]byte{frameType, 0x01, byte(composition >> 16), byte(composition >> 8), byte(composition)}, payload...)
+	tag, _ := flv.ParseTag(flv.TagTypeVideo, timestamp, data)
+	return tag
+}
+
+// audioTag builds an AAC tag
+func audioTag(timestamp uint32, data ...byte) flv.Tag {
+	tag, _ := flv.ParseTag(flv.TagTypeAudio, timestamp, append([]byte{0xaf}, data...))
+	return tag
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.mp4")
+	f, err := Create(path)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	sequenceHeader, _ := flv.ParseTag(flv.TagTypeVideo, 0, append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, avcConfig...))
+	tags := []flv.Tag{
+		videoTag(0, true, 0, 0xee), // before the sequence header, dropped
+		audioTag(0, 0x01, 0xee),    // before the sequence header, dropped
+		sequenceHeader,
+		audioTag(0, 0x00, 0x12, 0x10), // AAC-LC 44.1 kHz stereo
+		videoTag(0, false, 0, 0xee),   // before the first keyframe, dropped
+		videoTag(0, true, 66, 0x65, 0x01),
+		audioTag(10, 0x01, 0xa1),
+		videoTag(33, false, 100, 0x41, 0x02),
+		audioTag(33, 0x01, 0xa2),
+		videoTag(66, true, 33, 0x65, 0x03),
+		audioTag(56, 0x01, 0xa3),
+	}
+	for _, tag := range tags {
+		if err := f.WriteTag(tag); err != nil {
+			t.Fatalf("WriteTag() error = %v", err)
+		}
+	}
+	info, err := f.Close()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+		t.Errorf("part file left behind: %v", err)
+	}
+	if expected := (FileInfo{Path: path, Size: int64(len(data)), Duration: 0.099, Keyframes: 2}); info != expected {
+		t.Errorf("Close() = %+v, expected %+v", info, expected)
+	}
+	if types, _ := children(t, data); !reflect.DeepEqual(types, []string{"ftyp", "moov", "mdat"}) {
+		t.Fatalf("top level boxes = %v, expected moov ahead of mdat", types)
+	}
+
+	traks := find(t, data, "moov", "trak")
+	if len(traks) != 2 {
+		t.Fatalf("got %d tracks, expected video and audio", len(traks))
+	}
+	video, audio := traks[0], traks[1]
+
+	// Every chunk offset points at the sample's payload
+	expectedSamples := [][][]byte{
+		{{0x65, 0x01}, {0x41, 0x02}, {0x65, 0x03}},
+		{{0xa1}, {0xa2}, {0xa3}},
+	}
+	for i, trak := range traks {
+		stbl := find(t, trak, "mdia", "minf", "stbl")[0]
+		offsets := find(t, stbl, "stco")[0][8:]
+		sizes := find(t, stbl, "stsz")[0][12:]
+		for j, expected := range expectedSamples[i] {
+			offset := binary.BigEndian.Uint32(offsets[4*j:])
+			size := binary.BigEndian.Uint32(sizes[4*j:])
+			if got := data[offset : offset+size]; !bytes.Equal(got, expected) {
+				t.Errorf("track %d sample %d = %x, expected %x", i+1, j, got, expected)
+			}
+		}
+	}
+
+	videoStbl := find(t, video, "mdia", "minf", "stbl")[0]
+	if avcC := find(t, videoStbl, "stsd")[0][8+8+78:]; !bytes.Equal(avcC[8:], avcConfig) || string(avcC[4:8]) != "avcC" {
+		t.Errorf("avc1 entry carries %x, expected avcC %x", avcC, avcConfig)
+	}
+	// Composition offsets at 90 kHz: 66ms, 100ms, 33ms
+	if ctts := find(t, videoStbl, "ctts")[0]; !bytes.Equal(ctts[4:], fields(uint32(3), uint32(1), uint32(5940), uint32(1), uint32(9000), uint32(1), uint32(2970))) {
+		t.Errorf("ctts = %x", ctts)
+	}
+	if stss := find(t, videoStbl, "stss")[0]; !bytes.Equal(stss[4:], fields(uint32(2), uint32(1), uint32(3))) {
+		t.Errorf("stss = %x, expected samples 1 and 3", stss)
+	}
+	// The video edit starts at the first presented frame, 66ms in
+	if elst := find(t, video, "edts", "elst")[0]; !bytes.Equal(elst[4:], fields(uint32(1), uint32(99), int32(5940), uint16(1), uint16(0))) {
+		t.Errorf("video elst = %x", elst)
+	}
+	// The audio starts 10ms after the video
+	if elst := find(t, audio, "edts", "elst")[0]; !bytes.Equal(elst[4:], fields(uint32(2), uint32(10), int32(-1), uint16(1), uint16(0), uint32(69), int32(0), uint16(1), uint16(0))) {
+		t.Errorf("audio elst = %x", elst)
+	}
+	if esds := find(t, audio, "mdia", "minf", "stbl", "stsd")[0]; !bytes.Contains(esds, []byte{0x05, 0x80, 0x80, 0x80, 0x02, 0x12, 0x10}) {
+		t.Errorf("mp4a entry %x does not carry the AudioSpecificConfig", esds)
+	}
+}
+
+func TestFileWithoutMedia(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.mp4")
+	f, err := Create(path)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	mp3, _ := flv.ParseTag(flv.TagTypeAudio, 0, []byte{0x2f, 0xff, 0xfb})
+	if err := f.WriteTag(mp3); err != nil {
+		t.Fatalf("WriteTag() error = %v", err)
+	}
+	if _, err := f.Close(); !errors.Is(err, ErrNoMedia) {
+		t.Errorf("Close() error = %v, expected ErrNoMedia", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file written without media: %v", err)
+	}
+}
+
+func TestFileInvalidSampleRate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audio.mp4")
+	f, err := Create(path)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	// AAC LC with an explicit sampling frequency of 0 Hz
+	if err := f.WriteTag(audioTag(0, 0x00, 0x17, 0x80, 0x00, 0x00, 0x08)); err != nil {
+		t.Fatalf("WriteTag() error = %v", err)
+	}
+	if err := f.WriteTag(audioTag(0, 0x01, 0x21, 0x10)); err != nil {
+		t.Fatalf("WriteTag() error = %v", err)
+	}
+	if _, err := f.Close(); !errors.Is(err, ErrNoMedia) {
+		t.Errorf("Close() error = %v, expected ErrNoMedia", err)
+	}
+}
@@ -0,0 +1,335 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"rtmp-server-poc/internal/codec"
+	"rtmp-server-poc/internal/flv"
+)
+
+// movieTimescale is the mvhd timescale: FLV timestamps are milliseconds
+const movieTimescale = 1000
+
+// videoTimescale is the conventional 90 kHz clock of video tracks
+const videoTimescale = 90000
+
+// sample is one coded frame, stored in the part file until the file is closed
+type sample struct {
+	offset      int64 // offset in the part file
+	size        uint32
+	timestamp   uint32 // decoding time, milliseconds
+	composition int32  // PTS - DTS, milliseconds
+	sync        bool
+}
+
+// track collects the samples of one track and describes them in a trak box
+type track struct {
+	id        uint32
+	handler   string // "vide" or "soun"
+	codec     string // "avc", "hevc" or "aac"
+	config    []byte // decoder configuration record or AudioSpecificConfig
+	codecs    string // RFC 6381 codecs parameter
+	timescale uint32
+
+	width, height int // video
+	channels      int // audio
+
+	samples []sample
+	bytes   int64 // total sample size
+}
+
+// newVideoTrack creates an H.264 or HEVC track from its sequence header
+func newVideoTrack(tag flv.Tag) (*track, error) {
+	config, err := codec.ParseVideoSequenceHeader(tag)
+	if err != nil {
+		return nil, err
+	}
+	return &track{
+		handler:   "vide",
+		codec:     tag.Video.Codec(),
+		config:    append([]byte(nil), tag.Data[tag.Video.PayloadOffset:]...),
+		codecs:    config.Codecs,
+		timescale: videoTimescale,
+		width:     config.Width,
+		height:    config.Height,
+	}, nil
+}
+
+// newAudioTrack creates an AAC track from its sequence header
+func newAudioTrack(tag flv.Tag) (*track, error) {
+	config, err := codec.ParseAudioSequenceHeader(tag)
+	if err != nil {
+		return nil, err
+	}
+	// The sample rate is the track's timescale, which durations divide by
+	if config.SampleRate <= 0 {
+		return nil, fmt.Errorf("mp4: invalid audio sample rate %d", config.SampleRate)
+	}
+	return &track{
+		handler:   "soun",
+		codec:     tag.Audio.Codec(),
+		config:    append([]byte(nil), tag.Data[tag.Audio.PayloadOffset:]...),
+		codecs:    config.Codecs,
+		timescale: uint32(config.SampleRate),
+		channels:  config.Channels,
+	}, nil
+}
+
+// toTimescale converts milliseconds to track units
+func (t *track) toTimescale(ms int64) int64 {
+	return (ms*int64(t.timescale) + 500) / 1000
+}
+
+// sampleDurations returns each sample's duration in track units. Decoding
+// times are converted relative to the first sample so rounding does not
+// accumulate. The last sample lasts as long as the one before it, or a
+// nominal frame when it is the only one.
+func (t *track) sampleDurations() []int64 {
+	durations := make([]int64, len(t.samples))
+	first := int64(t.samples[0].timestamp)
+	var previous int64
+	for i, s := range t.samples[1:] {
+		time := t.toTimescale(int64(s.timestamp) - first)
+		durations[i] = time - previous
+		previous = time
+	}
+	last := len(t.samples) - 1
+	switch {
+	case last > 0:
+		durations[last] = durations[last-1]
+	case t.handler == "soun":
+		durations[last] = 1024 // one AAC frame
+	default:
+		durations[last] = int64(t.timescale) / 30
+	}
+	return durations
+}
+
+// mediaDuration is the total duration of the samples in track units
+func (t *track) mediaDuration() int64 {
+	durations := t.sampleDurations()
+	var total int64
+	for _, d := range durations {
+		total += d
+	}
+	return total
+}
+
+// delay is how long after the start of the movie the track begins, in
+// milliseconds
+func (t *track) delay(movieStart uint32) int64 {
+	return int64(t.samples[0].timestamp) - int64(movieStart)
+}
+
+// duration is the track's presentation duration in the movie timescale,
+// including its delay
+func (t *track) duration(movieStart uint32) int64 {
+	return t.delay(movieStart) + t.mediaDuration()*movieTimescale/int64(t.timescale)
+}
+
+// trak encodes the track. Sample offsets in the part file are moved by
+// baseOffset, where the media data starts in the final file.
+func (t *track) trak(movieStart uint32, baseOffset int64, co64 bool) []byte {
+	return box("trak", t.tkhd(t.duration(movieStart)), t.edts(movieStart), box("mdia",
+		t.mdhd(t.mediaDuration()),
+		t.hdlr(),
+		box("minf", t.mediaHeader(), dinf(), t.stbl(baseOffset, co64)),
+	))
+}
+
+// tkhd encodes the track header, duration in the movie timescale
+func (t *track) tkhd(duration int64) []byte {
+	volume := uint16(0)
+	if t.handler == "soun" {
+		volume = 0x0100
+	}
+	return fullBox("tkhd", 0, 0x000003, fields(
+		uint32(0), uint32(0), t.id, uint32(0), uint32(duration),
+		uint64(0), uint16(0), uint16(0), volume, uint16(0),
+		unityMatrix, uint32(t.width)<<16, uint32(t.height)<<16,
+	))
+}
+
+// mdhd encodes the media header, duration in the track timescale
+func (t *track) mdhd(duration int64) []byte {
+	return fullBox("mdhd", 0, 0, fields(
+		uint32(0), uint32(0), t.timescale, uint32(duration),
+		uint16(0x55c4), uint16(0), // language "und"
+	))
+}
+
+// edts encodes the edit list: an empty edit for a track starting after the
+// movie, then the media from its first presented sample, which with
+// B-frames comes a composition offset after the first decoded one
+func (t *track) edts(movieStart uint32) []byte {
+	var entries [][]byte
+	if delay := t.delay(movieStart); delay > 0 {
+		entries = append(entries, fields(uint32(delay), int32(-1), uint16(1), uint16(0)))
+	}
+	mediaTime := t.toTimescale(int64(t.samples[0].composition))
+	mediaDuration := t.mediaDuration() * movieTimescale / int64(t.timescale)
+	entries = append(entries, fields(uint32(mediaDuration), int32(mediaTime), uint16(1), uint16(0)))
+
+	payload := fields(uint32(len(entries)))
+	for _, e := range entries {
+		payload = append(payload, e...)
+	}
+	return box("edts", fullBox("elst", 0, 0, payload))
+}
+
+// hdlr encodes the handler reference box
+func (t *track) hdlr() []byte {
+	name := "SoundHandler"
+	if t.handler == "vide" {
+		name = "VideoHandler"
+	}
+	return fullBox("hdlr", 0, 0, fields(
+		uint32(0), []byte(t.handler), uint32(0), uint32(0), uint32(0), []byte(name+"\x00"),
+	))
+}
+
+// mediaHeader encodes the vmhd or smhd box
+func (t *track) mediaHeader() []byte {
+	if t.handler == "vide" {
+		return fullBox("vmhd", 0, 1, fields(uint16(0), uint16(0), uint16(0), uint16(0)))
+	}
+	return fullBox("smhd", 0, 0, fields(uint16(0), uint16(0)))
+}
+
+// dinf encodes a data reference to the file itself
+func dinf() []byte {
+	return box("dinf", fullBox("dref", 0, 0, fields(uint32(1)), fullBox("url ", 0, 1)))
+}
+
+// stbl encodes the sample table. Every sample is its own chunk, since
+// audio and video samples are interleaved in arrival order.
+func (t *track) stbl(baseOffset int64, co64 bool) []byte {
+	durations := t.sampleDurations()
+
+	// Decoding time deltas, run-length encoded
+	var stts []byte
+	var sttsEntries uint32
+	for i := 0; i < len(durations); {
+		j := i
+		for j < len(durations) && durations[j] == durations[i] {
+			j++
+		}
+		stts = append(stts, fields(uint32(j-i), uint32(durations[i]))...)
+		sttsEntries++
+		i = j
+	}
+
+	// Composition offsets, only written when some frame has one
+	var ctts []byte
+	var cttsEntries uint32
+	var cttsVersion byte
+	var reordered bool
+	for i := 0; i < len(t.samples); {
+		offset := t.toTimescale(int64(t.samples[i].composition))
+		j := i
+		for j < len(t.samples) && t.samples[j].composition == t.samples[i].composition {
+			j++
+		}
+		if offset != 0 {
+			reordered = true
+		}
+		if offset < 0 {
+			cttsVersion = 1
+		}
+		ctts = append(ctts, fields(uint32(j-i), int32(offset))...)
+		cttsEntries++
+		i = j
+	}
+
+	var stss []byte
+	var syncSamples uint32
+	for i, s := range t.samples {
+		if s.sync {
+			stss = binary.BigEndian.AppendUint32(stss, uint32(i+1))
+			syncSamples++
+		}
+	}
+
+	stsz := fields(uint32(0), uint32(len(t.samples)))
+	offsetType := "stco"
+	offsets := fields(uint32(len(t.samples)))
+	if co64 {
+		offsetType = "co64"
+	}
+	for _, s := range t.samples {
+		stsz = binary.BigEndian.AppendUint32(stsz, s.size)
+		if co64 {
+			offsets = binary.BigEndian.AppendUint64(offsets, uint64(baseOffset+s.offset))
+		} else {
+			offsets = binary.BigEndian.AppendUint32(offsets, uint32(baseOffset+s.offset))
+		}
+	}
+
+	boxes := [][]byte{
+		fullBox("stsd", 0, 0, fields(uint32(1)), t.sampleEntry()),
+		fullBox("stts", 0, 0, fields(sttsEntries), stts),
+	}
+	if reordered {
+		boxes = append(boxes, fullBox("ctts", cttsVersion, 0, fields(cttsEntries), ctts))
+	}
+	if t.handler == "vide" && syncSamples < uint32(len(t.samples)) {
+		boxes = append(boxes, fullBox("stss", 0, 0, fields(syncSamples), stss))
+	}
+	boxes = append(boxes,
+		fullBox("stsc", 0, 0, fields(uint32(1), uint32(1), uint32(1), uint32(1))),
+		fullBox("stsz", 0, 0, stsz),
+		fullBox(offsetType, 0, 0, offsets),
+	)
+	return box("stbl", boxes...)
+}
+
+// sampleEntry encodes the stsd entry with the decoder configuration
+func (t *track) sampleEntry() []byte {
+	// SampleEntry: reserved, data_reference_index
+	entry := fields(uint32(0), uint16(0), uint16(1))
+
+	switch t.codec {
+	case "avc", "hevc":
+		entryType, configType := "avc1", "avcC"
+		if t.codec == "hevc" {
+			entryType, configType = "hvc1", "hvcC"
+		}
+		return box(entryType, entry, fields(
+			uint16(0), uint16(0), uint32(0), uint32(0), uint32(0),
+			uint16(t.width), uint16(t.height),
+			uint32(0x00480000), uint32(0x00480000), // 72 dpi
+			uint32(0), uint16(1), make([]byte, 32), // frame count, compressor name
+			uint16(0x0018), uint16(0xffff),
+		), box(configType, t.config))
+	}
+
+	sampleRate := t.timescale
+	if sampleRate > 0xffff {
+		sampleRate = 0 // does not fit 16.16, decoders use the AudioSpecificConfig
+	}
+	return box("mp4a", entry, fields(
+		uint32(0), uint32(0), uint16(t.channels), uint16(16), uint16(0), uint16(0), sampleRate<<16,
+	), t.esds())
+}
+
+// esds encodes the elementary stream descriptor carrying the AudioSpecificConfig
+func (t *track) esds() []byte {
+	var bitrate uint32 // left unknown in a fragmented file's init segment
+	if len(t.samples) > 0 {
+		if seconds := t.mediaDuration() / int64(t.timescale); seconds > 0 {
+			bitrate = uint32(t.bytes * 8 / seconds)
+		}
+	}
+	decoderConfig := descriptor(0x04,
+		fields(uint8(0x40), uint8(0x15)), // MPEG-4 audio, audio stream
+		[]byte{0x00, 0x00, 0x00},         // bufferSizeDB
+		fields(bitrate, bitrate),
+		descriptor(0x05, t.config),
+	)
+	return fullBox("esds", 0, 0, descriptor(0x03,
+		fields(uint16(t.id), uint8(0)),
+		decoderConfig,
+		descriptor(0x06, []byte{0x02}), // SLConfigDescriptor, predefined MP4
+	))
+}
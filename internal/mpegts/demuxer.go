@@ -0,0 +1,279 @@
+// Package mpegts reads MPEG transport streams, as SRT, UDP and HTTP encoders
+// send them, with H.264 video and AAC audio. Demuxed frames are turned into
+// FLV tags for the stream pipeline.
+package mpegts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// PacketSize is the size of a transport stream packet
+const PacketSize = 188
+
+// syncByte starts every packet
+const syncByte = 0x47
+
+// patPID carries the program association table
+const patPID = 0x0000
+
+// Stream types of the elementary streams handled
+const (
+	StreamTypeAAC  = 0x0f // ADTS
+	StreamTypeH264 = 0x1b // Annex B
+)
+
+// Frame is the payload of a PES packet: a video access unit, or one or more
+// audio frames
+type Frame struct {
+	StreamType byte
+	PTS, DTS   int64 // 90 kHz, DTS equals PTS when absent
+	Data       []byte
+}
+
+// maxPESSize bounds a PES packet being assembled. Video PES packets may leave
+// their length unset, so without a bound one never followed by a new start
+// would grow for as long as the sender keeps sending.
+const maxPESSize = 8 << 20
+
+// elementaryStream assembles the PES packets of a PID
+type elementaryStream struct {
+	streamType byte
+	continuity int    // last continuity counter, -1 before the first packet
+	pes        []byte // the PES packet being assembled, nil when none
+}
+
+// Demuxer reads the frames of the H.264 and AAC streams of the first program
+// of a transport stream. Lost packets drop the PES packet they belong to, and
+// garbage between packets is skipped, as happens over lossy links.
+type Demuxer struct {
+	r       io.Reader
+	packet  [PacketSize]byte
+	pmtPID  int // -1 until the PAT is read
+	streams map[uint16]*elementaryStream
+	frames  []*Frame // complete, not yet returned
+}
+
+// NewDemuxer creates a demuxer reading packets from r
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{
+		r:       r,
+		pmtPID:  -1,
+		streams: make(map[uint16]*elementaryStream),
+	}
+}
+
+// ReadFrame returns the next frame. At the end of the input, the frames
+// still being assembled are returned, then io.EOF.
+func (d *Demuxer) ReadFrame() (*Frame, error) {
+	for len(d.frames) == 0 {
+		if err := d.readPacket(); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return d.flush()
+			}
+			return nil, err
+		}
+		d.handlePacket()
+	}
+	frame := d.frames[0]
+	d.frames = d.frames[1:]
+	return frame, nil
+}
+
+// flush returns the frames still being assembled at the end of the input
+func (d *Demuxer) flush() (*Frame, error) {
+	for _, es := range d.streams {
+		d.finish(es)
+	}
+	if len(d.frames) == 0 {
+		return nil, io.EOF
+	}
+	frame := d.frames[0]
+	d.frames = d.frames[1:]
+	return frame, nil
+}
+
+// readPacket reads the next packet, sliding past bytes that are not one
+func (d *Demuxer) readPacket() error {
+	if _, err := io.ReadFull(d.r, d.packet[:]); err != nil {
+		return err
+	}
+	for d.packet[0] != syncByte {
+		next := bytes.IndexByte(d.packet[1:], syncByte) + 1
+		if next == 0 {
+			next = PacketSize
+		}
+		copy(d.packet[:], d.packet[next:])
+		if _, err := io.ReadFull(d.r, d.packet[PacketSize-next:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePacket dispatches the payload of a packet by PID
+func (d *Demuxer) handlePacket() {
+	p := d.packet[:]
+	if p[1]&0x80 != 0 { // transport error indicator
+		return
+	}
+	pid := binary.BigEndian.Uint16(p[1:3]) & 0x1fff
+	start := p[1]&0x40 != 0
+	adaptation := p[3] >> 4 & 0x03
+	continuity := int(p[3] & 0x0f)
+
+	payload := p[4:]
+	if adaptation&0x02 != 0 {
+		if int(payload[0]) >= len(payload) {
+			return
+		}
+		payload = payload[1+int(payload[0]):]
+	}
+	if adaptation&0x01 == 0 {
+		return
+	}
+
+	switch {
+	case pid == patPID:
+		d.handlePAT(start, payload)
+	case int(pid) == d.pmtPID:
+		d.handlePMT(start, payload)
+	default:
+		if es, ok := d.streams[pid]; ok {
+			d.handlePES(es, start, continuity, payload)
+		}
+	}
+}
+
+// section returns the table section starting in a payload, without its
+// CRC. Sections are expected to fit in a packet, as PAT and PMT do.
+func section(start bool, payload []byte) []byte {
+	if !start || len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return nil
+	}
+	payload = payload[1+int(payload[0]):] // pointer field
+	if len(payload) < 8 {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(payload[1:3]) & 0x0fff)
+	if length < 9 || 3+length > len(payload) {
+		return nil
+	}
+	return payload[:3+length-4]
+}
+
+// handlePAT takes the PMT PID of the first program
+func (d *Demuxer) handlePAT(start bool, payload []byte) {
+	table := section(start, payload)
+	if table == nil {
+		return
+	}
+	for entries := table[8:]; len(entries) >= 4; entries = entries[4:] {
+		program := binary.BigEndian.Uint16(entries[0:2])
+		if program != 0 { // 0 is the network PID
+			d.pmtPID = int(binary.BigEndian.Uint16(entries[2:4]) & 0x1fff)
+			return
+		}
+	}
+}
+
+// handlePMT takes the PIDs of the program's H.264 and AAC streams
+func (d *Demuxer) handlePMT(start bool, payload []byte) {
+	table := section(start, payload)
+	if table == nil || len(table) < 12 {
+		return
+	}
+	infoLength := int(binary.BigEndian.Uint16(table[10:12]) & 0x0fff)
+	if 12+infoLength > len(table) {
+		return
+	}
+	for entries := table[12+infoLength:]; len(entries) >= 5; {
+		streamType := entries[0]
+		pid := binary.BigEndian.Uint16(entries[1:3]) & 0x1fff
+		esInfoLength := int(binary.BigEndian.Uint16(entries[3:5]) & 0x0fff)
+		if streamType == StreamTypeH264 || streamType == StreamTypeAAC {
+			if es, ok := d.streams[pid]; !ok || es.streamType != streamType {
+				d.streams[pid] = &elementaryStream{streamType: streamType, continuity: -1}
+			}
+		}
+		if 5+esInfoLength > len(entries) {
+			return
+		}
+		entries = entries[5+esInfoLength:]
+	}
+}
+
+// handlePES assembles the PES packets of an elementary stream
+func (d *Demuxer) handlePES(es *elementaryStream, start bool, continuity int, payload []byte) {
+	if es.continuity >= 0 && continuity == es.continuity {
+		return // duplicate packet
+	}
+	lost := es.continuity >= 0 && continuity != (es.continuity+1)&0x0f
+	es.continuity = continuity
+
+	if start {
+		d.finish(es)
+		es.pes = append([]byte(nil), payload...)
+		return
+	}
+	if lost {
+		es.pes = nil // the rest of this PES packet cannot be used
+	}
+	if es.pes != nil {
+		if len(es.pes)+len(payload) > pesLimit(es.pes) {
+			es.pes = nil // oversized, dropped
+			return
+		}
+		es.pes = append(es.pes, payload...)
+	}
+}
+
+// pesLimit returns the size a PES packet being assembled may reach: what its
+// PES_packet_length announces, or maxPESSize when that is unset
+func pesLimit(pes []byte) int {
+	if len(pes) >= 6 {
+		if length := int(binary.BigEndian.Uint16(pes[4:6])); length != 0 {
+			return 6 + length
+		}
+	}
+	return maxPESSize
+}
+
+// finish turns the PES packet being assembled into a frame
+func (d *Demuxer) finish(es *elementaryStream) {
+	pes := es.pes
+	es.pes = nil
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return
+	}
+	// A non-zero PES_packet_length tells how much follows it
+	if length := int(binary.BigEndian.Uint16(pes[4:6])); length != 0 {
+		if 6+length > len(pes) {
+			return // truncated
+		}
+		pes = pes[:6+length]
+	}
+	headerLength := int(pes[8])
+	if 9+headerLength > len(pes) {
+		return
+	}
+	frame := &Frame{StreamType: es.streamType, Data: pes[9+headerLength:]}
+	flags := pes[7] >> 6
+	if flags&0x02 == 0 || headerLength < 5 {
+		return // no PTS
+	}
+	frame.PTS = timestamp(pes[9:14])
+	frame.DTS = frame.PTS
+	if flags&0x01 != 0 && headerLength >= 10 {
+		frame.DTS = timestamp(pes[14:19])
+	}
+	if len(frame.Data) > 0 {
+		d.frames = append(d.frames, frame)
+	}
+}
+
+// timestamp decodes a 33 bit PTS or DTS
+func timestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
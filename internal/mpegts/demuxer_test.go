@@ -0,0 +1,152 @@
+package mpegts_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"rtmp-server-poc/internal/mpegts"
+	"rtmp-server-poc/internal/mpegts/mpegtstest"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// annexB joins NAL units with start codes
+func annexB(nalus ...[]byte) []byte {
+	var frame []byte
+	for _, nalu := range nalus {
+		frame = append(append(frame, 0x00, 0x00, 0x00, 0x01), nalu...)
+	}
+	return frame
+}
+
+// adtsFrame builds an ADTS frame of 48 kHz stereo LC AAC
+func adtsFrame(payload []byte) []byte {
+	size := 7 + len(payload)
+	header := []byte{0xff, 0xf1, 0x4c, 0x80 | byte(size>>11), byte(size >> 3), byte(size<<5) | 0x1f, 0xfc}
+	return append(header, payload...)
+}
+
+// testFrames are a keyframe larger than a packet, a B-frame presented later
+// than decoded, and an audio frame
+func testFrames() []*mpegts.Frame {
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 1000)...)
+	return []*mpegts.Frame{
+		{StreamType: mpegts.StreamTypeH264, PTS: 9000 + 3600, DTS: 9000, Data: annexB(testSPS, testPPS, idr)},
+		{StreamType: mpegts.StreamTypeAAC, PTS: 9000, DTS: 9000, Data: adtsFrame([]byte{1, 2, 3})},
+		{StreamType: mpegts.StreamTypeH264, PTS: 9000 + 7200, DTS: 9000 + 3600, Data: annexB([]byte{0x41, 0x9a})},
+		{StreamType: mpegts.StreamTypeAAC, PTS: 9000 + 1920, DTS: 9000 + 1920, Data: adtsFrame([]byte{4, 5})},
+	}
+}
+
+// mux writes frames as a transport stream
+func mux(t *testing.T, frames []*mpegts.Frame) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	m := mpegtstest.NewMuxer(&buf)
+	for _, frame := range frames {
+		if err := m.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.Len()%mpegts.PacketSize != 0 {
+		t.Fatalf("muxed %d bytes, not whole packets", buf.Len())
+	}
+	return buf.Bytes()
+}
+
+// demux reads every frame of a transport stream
+func demux(t *testing.T, data []byte) []*mpegts.Frame {
+	t.Helper()
+	d := mpegts.NewDemuxer(bytes.NewReader(data))
+	var frames []*mpegts.Frame
+	for {
+		frame, err := d.ReadFrame()
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatalf("ReadFrame() error = %v", err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// byStream groups frames by stream type, the order the demuxer keeps
+func byStream(frames []*mpegts.Frame) map[byte][]*mpegts.Frame {
+	streams := map[byte][]*mpegts.Frame{}
+	for _, frame := range frames {
+		streams[frame.StreamType] = append(streams[frame.StreamType], frame)
+	}
+	return streams
+}
+
+func TestDemuxer(t *testing.T) {
+	frames := testFrames()
+	data := mux(t, frames)
+
+	// A packet in the middle of the keyframe, after the tables
+	lost := append(append([]byte(nil), data[:4*mpegts.PacketSize]...), data[5*mpegts.PacketSize:]...)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []*mpegts.Frame
+	}{
+		{"Round trip", data, frames},
+		{"Garbage before and between packets", append(append([]byte{0x00, 0x12}, data[:mpegts.PacketSize]...), append([]byte{0xff, 0xff}, data[mpegts.PacketSize:]...)...), frames},
+		{"Lost packet", lost, frames[1:]},
+		{"Joined after the tables", data[2*mpegts.PacketSize:], nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := byStream(demux(t, tt.data))
+			expected := byStream(tt.expected)
+			if !reflect.DeepEqual(got, expected) {
+				for streamType, frames := range got {
+					for i, frame := range frames {
+						t.Logf("stream %#x frame %d: PTS %d DTS %d, %d bytes", streamType, i, frame.PTS, frame.DTS, len(frame.Data))
+					}
+				}
+				t.Errorf("demuxed frames differ from the expected %d", len(tt.expected))
+			}
+		})
+	}
+}
+
+func TestDemuxerDropsOversizedPES(t *testing.T) {
+	frames := testFrames()
+	tests := []struct {
+		name  string
+		frame *mpegts.Frame
+		extra int // bytes continuing its PES packet
+	}{
+		// Video PES packets leave their length unset
+		{"Unbounded", frames[0], 8 << 20},
+		{"Longer than announced", frames[1], 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := mux(t, []*mpegts.Frame{tt.frame})
+			last := data[len(data)-mpegts.PacketSize:]
+			packet := append([]byte(nil), last[:4]...)
+			packet[1] &^= 0x40 // no start indicator
+			packet[3] = 0x10 | last[3]&0x0f
+			packet = append(packet, bytes.Repeat([]byte{0xab}, mpegts.PacketSize-4)...)
+			for size := 0; size < tt.extra; size += mpegts.PacketSize - 4 {
+				packet[3] = 0x10 | (packet[3]+1)&0x0f
+				data = append(data, packet...)
+			}
+
+			if got := demux(t, data); len(got) != 0 {
+				t.Errorf("demuxed a %d byte frame, expected the oversized PES packet dropped", len(got[0].Data))
+			}
+		})
+	}
+}
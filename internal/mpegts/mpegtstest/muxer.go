@@ -0,0 +1,180 @@
+// Package mpegtstest writes MPEG transport streams, as encoders send them,
+// for the tests of the MPEG-TS ingests
+package mpegtstest
+
+import (
+	"encoding/binary"
+	"io"
+
+	"rtmp-server-poc/internal/codec"
+	"rtmp-server-poc/internal/mpegts"
+)
+
+// PIDs of the single program written by Muxer
+const (
+	patPID   = 0x0000
+	pmtPID   = 0x1000
+	videoPID = 0x0100
+	audioPID = 0x0101
+)
+
+// syncByte starts every packet
+const syncByte = 0x47
+
+// timestampBits is the size of PTS and DTS values
+const timestampBits = 33
+
+// Muxer writes H.264 and AAC frames as a transport stream with one program,
+// repeating the PAT and PMT ahead of every keyframe so that receivers can
+// join at any of them
+type Muxer struct {
+	w          io.Writer
+	continuity map[uint16]byte
+	packet     [mpegts.PacketSize]byte
+	started    bool
+}
+
+// NewMuxer creates a muxer writing packets to w
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{w: w, continuity: make(map[uint16]byte)}
+}
+
+// WriteFrame writes a frame as a PES packet
+func (m *Muxer) WriteFrame(frame *mpegts.Frame) error {
+	pid, streamID := uint16(audioPID), byte(0xc0)
+	if frame.StreamType == mpegts.StreamTypeH264 {
+		pid, streamID = videoPID, 0xe0
+	}
+	if !m.started || (pid == videoPID && isKeyframe(frame.Data)) {
+		if err := m.writeTables(); err != nil {
+			return err
+		}
+		m.started = true
+	}
+
+	// The PES header, with a DTS when it differs from the PTS
+	header := []byte{0x00, 0x00, 0x01, streamID, 0x00, 0x00, 0x80, 0x80, 0x05}
+	header = appendTimestamp(header, 0x20, frame.PTS)
+	if frame.DTS != frame.PTS {
+		header[7], header[8] = 0xc0, 0x0a
+		header[len(header)-5] |= 0x10
+		header = appendTimestamp(header, 0x10, frame.DTS)
+	}
+	// Video PES packets may leave their length unset, and large frames must
+	if length := len(header) - 6 + len(frame.Data); pid != videoPID && length <= 0xffff {
+		binary.BigEndian.PutUint16(header[4:6], uint16(length))
+	}
+	return m.writePayload(pid, append(header, frame.Data...), pid == videoPID, frame.DTS)
+}
+
+// writeTables writes the PAT and the PMT
+func (m *Muxer) writeTables() error {
+	pat := []byte{0x00, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xe0 | pmtPID>>8, pmtPID & 0xff}
+	if err := m.writeSection(patPID, pat); err != nil {
+		return err
+	}
+	pmt := []byte{0x02, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe0 | videoPID>>8, videoPID & 0xff, 0xf0, 0x00,
+		mpegts.StreamTypeH264, 0xe0 | videoPID>>8, videoPID & 0xff, 0xf0, 0x00,
+		mpegts.StreamTypeAAC, 0xe0 | audioPID>>8, audioPID & 0xff, 0xf0, 0x00}
+	return m.writeSection(pmtPID, pmt)
+}
+
+// writeSection writes a table section: its table ID and the fields after
+// the section length, which is filled in along with the CRC
+func (m *Muxer) writeSection(pid uint16, table []byte) error {
+	section := []byte{table[0], 0xb0, byte(len(table) - 1 + 4)} // without the table ID, with the CRC
+	section = append(section, table[1:]...)
+	section = binary.BigEndian.AppendUint32(section, crc32MPEG(section))
+	return m.writePayload(pid, append([]byte{0x00}, section...), false, 0) // pointer field
+}
+
+// writePayload splits a PES packet or a section into packets, the first with
+// the start indicator and, for video, the PCR. The last one is padded with
+// adaptation field stuffing.
+func (m *Muxer) writePayload(pid uint16, payload []byte, pcr bool, dts int64) error {
+	for first := true; first || len(payload) > 0; first = false {
+		p := m.packet[:]
+		p[0] = syncByte
+		p[1] = byte(pid >> 8 & 0x1f)
+		if first {
+			p[1] |= 0x40
+		}
+		p[2] = byte(pid)
+		p[3] = 0x10 | m.continuity[pid]
+		m.continuity[pid] = (m.continuity[pid] + 1) & 0x0f
+
+		var adaptation []byte
+		if first && pcr {
+			base := uint64(dts) & (1<<timestampBits - 1)
+			adaptation = []byte{0x10, byte(base >> 25), byte(base >> 17), byte(base >> 9), byte(base >> 1), byte(base<<7) | 0x7e, 0x00}
+		}
+		room := mpegts.PacketSize - 4
+		if adaptation != nil {
+			room -= 1 + len(adaptation)
+		}
+		if len(payload) < room {
+			// Stuffing: an adaptation field, or a longer one
+			stuffing := room - len(payload)
+			if adaptation == nil {
+				adaptation = []byte{}
+				stuffing--
+				if stuffing > 0 {
+					adaptation = append(adaptation, 0x00)
+					stuffing--
+				}
+			}
+			for ; stuffing > 0; stuffing-- {
+				adaptation = append(adaptation, 0xff)
+			}
+		}
+
+		n := 4
+		if adaptation != nil {
+			p[3] |= 0x20
+			p[4] = byte(len(adaptation))
+			n += 1 + copy(p[5:], adaptation)
+		}
+		copied := copy(p[n:], payload)
+		payload = payload[copied:]
+		if _, err := m.w.Write(p[:n+copied]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendTimestamp appends a 33 bit PTS or DTS with the given 4 bit prefix
+func appendTimestamp(b []byte, prefix byte, ts int64) []byte {
+	return append(b,
+		prefix|byte(ts>>29&0x0e)|0x01,
+		byte(ts>>22),
+		byte(ts>>14)|0x01,
+		byte(ts>>7),
+		byte(ts<<1)|0x01)
+}
+
+// isKeyframe reports whether an H.264 access unit holds an IDR slice
+func isKeyframe(frame []byte) bool {
+	for _, nalu := range codec.SplitAnnexB(frame) {
+		if nalu[0]&0x1f == 5 {
+			return true
+		}
+	}
+	return false
+}
+
+// crc32MPEG computes the CRC of table sections (CRC-32/MPEG-2)
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,49 @@
+package mpegtstest
+
+import (
+	"bytes"
+	"testing"
+
+	"rtmp-server-poc/internal/mpegts"
+)
+
+func TestCRC32MPEG(t *testing.T) {
+	if crc := crc32MPEG([]byte("123456789")); crc != 0x0376e6e7 {
+		t.Errorf("crc32MPEG() = %#x, expected the CRC-32/MPEG-2 check value", crc)
+	}
+}
+
+func TestMuxerTables(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	keyframe := []byte{0x00, 0x00, 0x00, 0x01, 0x65, 0x88, 0x84}
+	if err := m.WriteFrame(&mpegts.Frame{StreamType: mpegts.StreamTypeH264, PTS: 9000, DTS: 9000, Data: keyframe}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if len(data)%mpegts.PacketSize != 0 {
+		t.Fatalf("muxed %d bytes, not whole packets", len(data))
+	}
+	for i := 0; i < len(data); i += mpegts.PacketSize {
+		if data[i] != syncByte {
+			t.Fatalf("packet %d does not start with the sync byte", i/mpegts.PacketSize)
+		}
+	}
+
+	// The PAT, then the PMT, each a section whose CRC covers it
+	for i, pid := range []uint16{patPID, pmtPID} {
+		packet := data[i*mpegts.PacketSize:]
+		if got := uint16(packet[1]&0x1f)<<8 | uint16(packet[2]); got != pid || packet[1]&0x40 == 0 {
+			t.Fatalf("packet %d has PID %#x, expected the start of %#x", i, got, pid)
+		}
+		payload := packet[4:]
+		if packet[3]&0x20 != 0 { // stuffing
+			payload = payload[1+int(payload[0]):]
+		}
+		table := payload[1+int(payload[0]):] // after the pointer field
+		length := int(table[1]&0x0f)<<8 | int(table[2])
+		if crc := crc32MPEG(table[:3+length]); crc != 0 {
+			t.Errorf("section on PID %#x has an invalid CRC", pid)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package mpegts
+
+import (
+	"io"
+
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/remux"
+)
+
+// timestampBits is the size of PTS and DTS values, which wrap around
+const timestampBits = 33
+
+// Remuxer turns the frames of a transport stream into FLV tags, on a
+// timeline that starts at 0 with the first frame
+type Remuxer struct {
+	avc remux.AVC
+	aac remux.AAC
+
+	started  bool
+	base     int64 // DTS of the first frame
+	previous int64 // last DTS, unwrapped
+}
+
+// Tags returns the FLV tags of a frame. Frames of other stream types yield
+// none.
+func (r *Remuxer) Tags(frame *Frame) ([]remux.Tag, error) {
+	dts := r.unwrap(frame.DTS)
+	timestamp := uint32(max(dts-r.base, 0) / 90)
+	switch frame.StreamType {
+	case StreamTypeH264:
+		compositionTime := int32(difference(frame.PTS, frame.DTS) / 90)
+		return r.avc.Tags(timestamp, compositionTime, frame.Data), nil
+	case StreamTypeAAC:
+		return r.aac.Tags(timestamp, frame.Data)
+	}
+	return nil, nil
+}
+
+// unwrap extends a 33 bit DTS past its wraparound, from the last one
+func (r *Remuxer) unwrap(dts int64) int64 {
+	if !r.started {
+		r.started = true
+		r.base, r.previous = dts, dts
+		return dts
+	}
+	r.previous += difference(dts, r.previous)
+	return r.previous
+}
+
+// difference returns a - b for 33 bit timestamps, taking the shorter way
+// around the wraparound: audio may be slightly earlier than video
+func difference(a, b int64) int64 {
+	const modulo = 1 << timestampBits
+	delta := (a - b) % modulo
+	if delta < 0 {
+		delta += modulo
+	}
+	if delta >= modulo/2 {
+		delta -= modulo
+	}
+	return delta
+}
+
+// Writer receives FLV tags, as a stream.Publisher does
+type Writer interface {
+	WriteVideo(timestamp uint32, data []byte) error
+	WriteAudio(timestamp uint32, data []byte) error
+}
+
+// Copy demuxes a transport stream from r and writes its FLV tags to w until
+// r ends, returning nil, or reading or writing fails. Invalid audio frames
+// are skipped.
+func Copy(w Writer, r io.Reader) error {
+	demuxer := NewDemuxer(r)
+	remuxer := &Remuxer{}
+	for {
+		frame, err := demuxer.ReadFrame()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		tags, _ := remuxer.Tags(frame)
+		for _, tag := range tags {
+			write := w.WriteAudio
+			if tag.Type == flv.TagTypeVideo {
+				write = w.WriteVideo
+			}
+			if err := write(tag.Timestamp, tag.Data); err != nil {
+				return err
+			}
+		}
+	}
+}
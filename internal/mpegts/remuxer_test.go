@@ -0,0 +1,81 @@
+package mpegts_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/mpegts"
+)
+
+// fakeWriter records the tags written to it
+type fakeWriter struct {
+	tags []flv.Tag
+}
+
+func (f *fakeWriter) WriteVideo(timestamp uint32, data []byte) error {
+	tag, err := flv.ParseTag(flv.TagTypeVideo, timestamp, data)
+	f.tags = append(f.tags, tag)
+	return err
+}
+
+func (f *fakeWriter) WriteAudio(timestamp uint32, data []byte) error {
+	tag, err := flv.ParseTag(flv.TagTypeAudio, timestamp, data)
+	f.tags = append(f.tags, tag)
+	return err
+}
+
+func TestCopy(t *testing.T) {
+	w := &fakeWriter{}
+	if err := mpegts.Copy(w, bytes.NewReader(mux(t, testFrames()))); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+
+	type tagInfo struct {
+		header          bool
+		timestamp       uint32
+		compositionTime int32
+	}
+	var video, audio []tagInfo
+	for _, tag := range w.tags {
+		if tag.Video != nil {
+			video = append(video, tagInfo{tag.Video.IsSequenceHeader(), tag.Timestamp, tag.Video.CompositionTime})
+		} else {
+			audio = append(audio, tagInfo{tag.Audio.IsSequenceHeader(), tag.Timestamp, 0})
+		}
+	}
+	// Timestamps start at 0 and B-frames keep their composition time
+	expectedVideo := []tagInfo{{true, 0, 0}, {false, 0, 40}, {false, 40, 40}}
+	expectedAudio := []tagInfo{{true, 0, 0}, {false, 0, 0}, {false, 21, 0}}
+	if !reflect.DeepEqual(video, expectedVideo) {
+		t.Errorf("video tags = %+v, expected %+v", video, expectedVideo)
+	}
+	if !reflect.DeepEqual(audio, expectedAudio) {
+		t.Errorf("audio tags = %+v, expected %+v", audio, expectedAudio)
+	}
+}
+
+func TestRemuxerTimeline(t *testing.T) {
+	r := &mpegts.Remuxer{}
+	const wrap = 1 << 33 // PTS and DTS values wrap around at 33 bits
+	frames := []struct {
+		name     string
+		dts      int64
+		expected uint32
+	}{
+		{"First frame at 0", wrap - 9000, 0},
+		{"Before the wraparound", wrap - 4500, 50},
+		{"After the wraparound", 4500, 150},
+		{"Slightly earlier audio", 3600, 140},
+	}
+	for _, f := range frames {
+		tags, err := r.Tags(&mpegts.Frame{StreamType: mpegts.StreamTypeAAC, PTS: f.dts, DTS: f.dts, Data: adtsFrame([]byte{1})})
+		if err != nil || len(tags) == 0 {
+			t.Fatalf("%s: Tags() = %v, %v", f.name, tags, err)
+		}
+		if ts := tags[len(tags)-1].Timestamp; ts != f.expected {
+			t.Errorf("%s: timestamp = %d, expected %d", f.name, ts, f.expected)
+		}
+	}
+}
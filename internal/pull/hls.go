@@ -0,0 +1,263 @@
+package pull
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPlaylistSize bounds the playlists read
+const maxPlaylistSize = 1 << 20
+
+// errFMP4 is returned for playlists of fMP4 segments, which are not demuxed
+var errFMP4 = errors.New("fMP4 HLS segments are not supported")
+
+// playlist is what is used of an HLS playlist
+type playlist struct {
+	targetDuration time.Duration
+	mediaSequence  int64
+	segments       []*url.URL
+	ended          bool
+	// variant is the highest bandwidth media playlist of a master playlist
+	variant *url.URL
+}
+
+// parsePlaylist reads a master or media playlist, resolving its URIs
+// against base
+func parsePlaylist(r io.Reader, base *url.URL) (playlist, error) {
+	var p playlist
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxPlaylistSize)
+	first := true
+	bandwidth, variantBandwidth := int64(-1), int64(-1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			if line != "#EXTM3U" {
+				return playlist{}, errors.New("not an HLS playlist")
+			}
+			first = false
+			continue
+		}
+		tag, value, _ := strings.Cut(line, ":")
+		switch {
+		case line == "":
+		case tag == "#EXT-X-TARGETDURATION":
+			seconds, _ := strconv.Atoi(value)
+			p.targetDuration = time.Duration(seconds) * time.Second
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			p.mediaSequence, _ = strconv.ParseInt(value, 10, 64)
+		case tag == "#EXT-X-ENDLIST":
+			p.ended = true
+		case tag == "#EXT-X-MAP":
+			return playlist{}, errFMP4
+		case tag == "#EXT-X-STREAM-INF":
+			bandwidth = 0
+			for _, attribute := range strings.Split(value, ",") {
+				if v, ok := strings.CutPrefix(attribute, "BANDWIDTH="); ok {
+					bandwidth, _ = strconv.ParseInt(v, 10, 64)
+				}
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			uri, err := base.Parse(line)
+			if err != nil {
+				return playlist{}, fmt.Errorf("invalid URI %q: %w", line, err)
+			}
+			if bandwidth >= 0 {
+				if bandwidth > variantBandwidth {
+					p.variant, variantBandwidth = uri, bandwidth
+				}
+				bandwidth = -1
+				continue
+			}
+			p.segments = append(p.segments, uri)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return playlist{}, err
+	}
+	if first {
+		return playlist{}, errors.New("empty playlist")
+	}
+	return p, nil
+}
+
+// hlsReader reads the segments of a live HLS stream as one transport
+// stream, from the latest segment on, polling the playlist for new ones
+type hlsReader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	client *http.Client
+	url    *url.URL // of the media playlist
+
+	next    int64         // media sequence number of the next segment
+	started bool          // whether next has been set
+	queue   []*url.URL    // segments to read, next first
+	body    io.ReadCloser // segment being read
+	ended   bool          // the playlist has ended
+	polled  time.Time
+	updated time.Time // when the last new segment was listed
+	target  time.Duration
+}
+
+// openHLS fetches an HLS playlist, following a master playlist to its
+// highest bandwidth variant, and starts reading its segments. The reader
+// stops once ctx is done or it is closed.
+func openHLS(ctx context.Context, client *http.Client, rawURL string) (*hlsReader, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &hlsReader{ctx: ctx, cancel: cancel, client: client, url: u}
+	if err := r.start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return r, nil
+}
+
+// start fetches the playlist, or its variant, and queues its latest segment
+func (r *hlsReader) start() error {
+	ctx, cancel := context.WithTimeout(r.ctx, connectTimeout)
+	defer cancel()
+	p, err := r.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if p.variant != nil {
+		r.url = p.variant
+		if p, err = r.fetch(ctx); err != nil {
+			return err
+		}
+		if p.variant != nil {
+			return errors.New("variant is a master playlist")
+		}
+	}
+	if len(p.segments) == 0 && p.ended {
+		return io.EOF
+	}
+	r.update(p)
+	return nil
+}
+
+// Read reads the segments in order, returning io.EOF once the playlist has
+// ended. It fails when the playlist lists no new segment for a few target
+// durations.
+func (r *hlsReader) Read(b []byte) (int, error) {
+	for {
+		if r.body != nil {
+			n, err := r.body.Read(b)
+			if err != nil {
+				r.body.Close()
+				r.body = nil
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		if len(r.queue) > 0 {
+			body, err := r.get(r.ctx, r.queue[0])
+			if err != nil {
+				return 0, err
+			}
+			r.body, r.queue = body, r.queue[1:]
+			continue
+		}
+		if r.ended {
+			return 0, io.EOF
+		}
+		if err := r.poll(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close stops the reader, failing the read in progress if any. It may be
+// called from any goroutine.
+func (r *hlsReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// poll waits for half a target duration since the last fetch, then fetches
+// the playlist again
+func (r *hlsReader) poll() error {
+	if time.Since(r.updated) > 3*r.target+readTimeout {
+		return fmt.Errorf("no new segment for %s", time.Since(r.updated).Round(time.Second))
+	}
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-time.After(time.Until(r.polled.Add(r.target / 2))):
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, readTimeout)
+	defer cancel()
+	p, err := r.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	r.update(p)
+	return nil
+}
+
+// update queues the segments of a playlist not read yet. The first time,
+// only the latest segment is, to start close to the live edge.
+func (r *hlsReader) update(p playlist) {
+	r.polled = time.Now()
+	r.target = max(p.targetDuration, time.Second)
+	r.ended = p.ended
+	last := p.mediaSequence + int64(len(p.segments))
+	if !r.started {
+		r.started = true
+		r.next = max(last-1, p.mediaSequence)
+		r.updated = time.Now()
+	}
+	if r.next < p.mediaSequence {
+		// Fell behind the playlist, skip to what it still lists
+		r.next = p.mediaSequence
+	}
+	for ; r.next < last; r.next++ {
+		r.queue = append(r.queue, p.segments[r.next-p.mediaSequence])
+		r.updated = time.Now()
+	}
+}
+
+// fetch gets and parses the playlist
+func (r *hlsReader) fetch(ctx context.Context) (playlist, error) {
+	body, err := r.get(ctx, r.url)
+	if err != nil {
+		return playlist{}, err
+	}
+	defer body.Close()
+	return parsePlaylist(io.LimitReader(body, maxPlaylistSize), r.url)
+}
+
+// get requests a URL, failing for any status but 200
+func (r *hlsReader) get(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", u.Redacted(), resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,496 @@
+// Package pull ingests remote streams: rather than waiting for an encoder to
+// push, the server plays an RTMP or RTMPS URL, or fetches an HLS playlist,
+// and publishes what it gets under a local stream name, as a primary
+// publisher would. Each pull reconnects with exponential backoff when it
+// fails; on-demand pulls run only while the stream is being watched.
+package pull
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/events"
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/mpegts"
+	"rtmp-server-poc/internal/relay"
+	"rtmp-server-poc/internal/stream"
+)
+
+// segmentTimeout bounds each HTTP request of an HLS pull, segments included
+const segmentTimeout = 30 * time.Second
+
+// idleCheckInterval is how often an on-demand pull checks for viewers
+const idleCheckInterval = time.Second
+
+// validName matches the stream names pulls publish under: usernames of
+// letters, digits, '_', '-' and '.', safe in URLs, paths and HTML
+var validName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,63}$`)
+
+var (
+	// ErrPullExists is returned by Add when a pull of that name exists
+	ErrPullExists = errors.New("pull already exists")
+	// ErrPullNotFound is returned by Remove for an unknown pull
+	ErrPullNotFound = errors.New("pull not found")
+	// ErrClosed is returned by Add once the manager is closed
+	ErrClosed = errors.New("pull manager closed")
+)
+
+// State is what a pull is doing
+type State string
+
+// Pull states
+const (
+	StateIdle       State = "idle"       // on demand, waiting for a viewer
+	StateConnecting State = "connecting" // to the remote server
+	StateLive       State = "live"       // publishing the remote stream
+	StateBackoff    State = "backoff"    // waiting to reconnect after a failure
+	StateStopped    State = "stopped"    // removed
+)
+
+// Status is a snapshot of a pull for the API
+type Status struct {
+	Name      string     `json:"name"`
+	URL       string     `json:"url"` // without the stream key
+	OnDemand  bool       `json:"on_demand"`
+	State     State      `json:"state"`
+	Since     time.Time  `json:"since"`
+	Retry     *time.Time `json:"retry,omitempty"` // next attempt, in backoff
+	LastError string     `json:"last_error,omitempty"`
+	// Connections counts the connections made, Failures those that failed
+	Connections int `json:"connections"`
+	Failures    int `json:"failures"`
+	// Tags and Bytes were published over every connection
+	Tags  uint64 `json:"tags"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// Manager runs the pulls of a stream manager's streams
+type Manager struct {
+	streams *stream.Manager
+	config  config.Config
+	client  *http.Client
+
+	mutex  sync.Mutex
+	pulls  map[string]*Pull
+	closed bool
+}
+
+// NewManager creates a manager publishing to the streams of streams
+func NewManager(streams *stream.Manager, cfg config.Config) *Manager {
+	return &Manager{
+		streams: streams,
+		config:  cfg,
+		client:  &http.Client{Timeout: segmentTimeout},
+		pulls:   make(map[string]*Pull),
+	}
+}
+
+// Add starts pulling an RTMP, RTMPS or HLS URL into the stream name, until
+// removed. An on-demand pull waits for Demand to connect.
+func (m *Manager) Add(name, rawURL string, onDemand bool) (Status, error) {
+	if !validName.MatchString(name) {
+		return Status{}, fmt.Errorf("invalid stream name %q", name)
+	}
+	redacted, err := checkURL(rawURL)
+	if err != nil {
+		return Status{}, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return Status{}, ErrClosed
+	}
+	if _, ok := m.pulls[name]; ok {
+		return Status{}, ErrPullExists
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pull{
+		manager:  m,
+		name:     name,
+		url:      rawURL,
+		onDemand: onDemand,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		demanded: make(chan struct{}, 1),
+		status:   Status{Name: name, URL: redacted, OnDemand: onDemand, State: StateIdle, Since: time.Now()},
+	}
+	if !onDemand {
+		p.status.State = StateConnecting
+	}
+	m.pulls[name] = p
+	go p.run(ctx)
+	log.Printf("Pulling %s into stream %s", redacted, name)
+	return p.Status(), nil
+}
+
+// Remove stops a pull, waiting for its publisher to leave the stream
+func (m *Manager) Remove(name string) error {
+	m.mutex.Lock()
+	p, ok := m.pulls[name]
+	delete(m.pulls, name)
+	m.mutex.Unlock()
+	if !ok {
+		return ErrPullNotFound
+	}
+	p.stop()
+	return nil
+}
+
+// List returns the status of the pulls, sorted by name
+func (m *Manager) List() []Status {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	statuses := make([]Status, 0, len(m.pulls))
+	for _, p := range m.pulls {
+		statuses = append(statuses, p.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Demand reports that the stream name is wanted by a viewer, which starts
+// its pull if it is an idle on-demand one and keeps it running for another
+// idle timeout. It returns whether the stream is pulled.
+func (m *Manager) Demand(name string) bool {
+	m.mutex.Lock()
+	p, ok := m.pulls[name]
+	m.mutex.Unlock()
+	if ok {
+		p.demand()
+	}
+	return ok
+}
+
+// Close stops every pull
+func (m *Manager) Close() {
+	m.mutex.Lock()
+	m.closed = true
+	pulls := m.pulls
+	m.pulls = make(map[string]*Pull)
+	m.mutex.Unlock()
+	for _, p := range pulls {
+		p.stop()
+	}
+}
+
+// checkURL validates a pull URL, returning it without its stream key or
+// credentials
+func checkURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+	switch u.Scheme {
+	case "rtmp", "rtmps":
+		if _, err := relay.ParseURL(rawURL); err != nil {
+			return "", fmt.Errorf("invalid URL: %w", err)
+		}
+		return relay.Redact(rawURL), nil
+	case "http", "https":
+		if u.Host == "" {
+			return "", errors.New("invalid URL: missing host")
+		}
+		return u.Redacted(), nil
+	}
+	return "", fmt.Errorf("invalid URL: unsupported scheme %q", u.Scheme)
+}
+
+// Pull publishes one remote stream
+type Pull struct {
+	manager  *Manager
+	name     string
+	url      string
+	onDemand bool
+
+	cancel   context.CancelFunc
+	done     chan struct{}
+	demanded chan struct{} // signalled by demand, for an idle pull
+
+	mutex      sync.Mutex
+	status     Status
+	lastDemand time.Time
+}
+
+// Status returns a snapshot of the pull
+func (p *Pull) Status() Status {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.status
+}
+
+// stop stops the pull and waits for it
+func (p *Pull) stop() {
+	p.cancel()
+	<-p.done
+}
+
+// demand records a viewer's interest and wakes the pull up when idle
+func (p *Pull) demand() {
+	p.mutex.Lock()
+	p.lastDemand = time.Now()
+	p.mutex.Unlock()
+	select {
+	case p.demanded <- struct{}{}:
+	default:
+	}
+}
+
+// run pulls until stopped, backing off after each failure. An on-demand
+// pull goes idle once unwatched, until demanded again.
+func (p *Pull) run(ctx context.Context) {
+	defer close(p.done)
+	delay := p.manager.config.PullBackoffMin
+	for {
+		for p.onDemand && !p.wanted() {
+			p.setState(StateIdle, nil, time.Time{})
+			select {
+			case <-ctx.Done():
+				p.setState(StateStopped, nil, time.Time{})
+				return
+			case <-p.demanded:
+			}
+		}
+
+		connected, err := p.ingest(ctx)
+		if ctx.Err() != nil {
+			p.setState(StateStopped, nil, time.Time{})
+			return
+		}
+		if !connected.IsZero() && time.Since(connected) > p.manager.config.PullBackoffMax {
+			delay = p.manager.config.PullBackoffMin
+		}
+		if err == nil {
+			// Unwatched for the idle timeout
+			continue
+		}
+		log.Printf("Pull %s from %s failed, retrying in %s: %v", p.name, p.status.URL, delay, err)
+		p.setState(StateBackoff, err, time.Now().Add(delay))
+		select {
+		case <-ctx.Done():
+			p.setState(StateStopped, nil, time.Time{})
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, p.manager.config.PullBackoffMax)
+	}
+}
+
+// wanted returns whether an on-demand pull was demanded within the idle
+// timeout
+func (p *Pull) wanted() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return !p.lastDemand.IsZero() && time.Since(p.lastDemand) < p.manager.config.PullIdleTimeout
+}
+
+// source is a connected remote stream
+type source interface {
+	// copy publishes the stream until it ends, returning io.EOF, or fails
+	copy(w *counter) error
+	// Close interrupts copy, from any goroutine
+	Close() error
+}
+
+// ingest connects to the remote stream and publishes it until it ends or
+// fails, returning an error, or an on-demand pull goes unwatched, returning
+// nil. When the connection was made, it returns the time it was.
+func (p *Pull) ingest(ctx context.Context) (connected time.Time, err error) {
+	p.setState(StateConnecting, nil, time.Time{})
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	src, err := p.open(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer src.Close()
+	// Closing the source unblocks the copy once ctx is done
+	stop := context.AfterFunc(ctx, func() { src.Close() })
+	defer stop()
+	connected = time.Now()
+
+	cfg := p.manager.config
+	// A pull never takes a stream over from a connected publisher
+	sp, publisher, err := p.manager.streams.PublishVacant(p.name, "", stream.RolePrimary, cancel, cfg)
+	if err != nil {
+		return connected, err
+	}
+	defer publisher.Close(cfg)
+
+	p.mutex.Lock()
+	p.status.Connections++
+	p.mutex.Unlock()
+	p.setState(StateLive, nil, time.Time{})
+	if p.onDemand {
+		go p.watchIdle(ctx, sp, cancel)
+	}
+
+	err = src.copy(&counter{publisher: publisher, pull: p})
+	switch {
+	case ctx.Err() != nil && p.onDemand && !p.wanted():
+		log.Printf("Pull %s went idle", p.name)
+		return connected, nil
+	case ctx.Err() != nil:
+		// Stopped, or taken over by another primary publisher
+		return connected, stream.ErrPublisherEvicted
+	case errors.Is(err, io.EOF):
+		return connected, errors.New("remote stream ended")
+	}
+	return connected, err
+}
+
+// open connects to the remote stream
+func (p *Pull) open(ctx context.Context) (source, error) {
+	if strings.HasPrefix(p.url, "rtmp") {
+		player, err := dialRTMP(ctx, p.url)
+		if err != nil {
+			return nil, err
+		}
+		return rtmpSource{player}, nil
+	}
+	reader, err := openHLS(ctx, p.manager.client, p.url)
+	if err != nil {
+		return nil, err
+	}
+	return hlsSource{reader}, nil
+}
+
+// watchIdle cancels an on-demand pull's connection once the stream has no
+// viewer and was not demanded for the idle timeout
+func (p *Pull) watchIdle(ctx context.Context, sp *stream.StreamProcess, cancel context.CancelFunc) {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if sp.Info().Viewers > 0 {
+			p.demand()
+		}
+		if !p.wanted() {
+			cancel()
+			return
+		}
+	}
+}
+
+// setState records a state change and reports it on the bus. An error counts
+// as a failure; retry is the next attempt, in backoff.
+func (p *Pull) setState(state State, err error, retry time.Time) {
+	p.mutex.Lock()
+	p.status.State = state
+	p.status.Since = time.Now()
+	p.status.Retry = nil
+	if !retry.IsZero() {
+		p.status.Retry = &retry
+	}
+	if err != nil {
+		p.status.LastError = err.Error()
+		p.status.Failures++
+	}
+	status := p.status
+	p.mutex.Unlock()
+
+	var eventType events.Type
+	var message string
+	switch state {
+	case StateLive:
+		eventType, message = events.PullConnected, fmt.Sprintf("pull connected to %s", status.URL)
+	case StateBackoff:
+		eventType, message = events.PullFailed, fmt.Sprintf("pull failed: %s", status.LastError)
+	case StateStopped:
+		eventType, message = events.PullStopped, "pull stopped"
+	default:
+		return
+	}
+	p.manager.streams.Events().Publish(events.Event{
+		Type:    eventType,
+		Stream:  status.Name,
+		Message: message,
+		Data: map[string]interface{}{
+			"url":         status.URL,
+			"connections": status.Connections,
+			"failures":    status.Failures,
+		},
+	})
+}
+
+// counter publishes tags, counting them in the pull's status
+type counter struct {
+	publisher *stream.Publisher
+	pull      *Pull
+}
+
+func (c *counter) WriteVideo(timestamp uint32, data []byte) error {
+	return c.write(c.publisher.WriteVideo, timestamp, data)
+}
+
+func (c *counter) WriteAudio(timestamp uint32, data []byte) error {
+	return c.write(c.publisher.WriteAudio, timestamp, data)
+}
+
+func (c *counter) WriteScript(timestamp uint32, data []byte) error {
+	return c.write(c.publisher.WriteScript, timestamp, data)
+}
+
+func (c *counter) write(write func(uint32, []byte) error, timestamp uint32, data []byte) error {
+	if err := write(timestamp, data); err != nil {
+		return err
+	}
+	c.pull.mutex.Lock()
+	c.pull.status.Tags++
+	c.pull.status.Bytes += uint64(len(data))
+	c.pull.mutex.Unlock()
+	return nil
+}
+
+// rtmpSource publishes the tags played from an RTMP server
+type rtmpSource struct {
+	*rtmpPlayer
+}
+
+func (s rtmpSource) copy(w *counter) error {
+	for {
+		tag, err := s.ReadTag()
+		if err != nil {
+			return err
+		}
+		switch tag.Type {
+		case flv.TagTypeVideo:
+			err = w.WriteVideo(tag.Timestamp, tag.Data)
+		case flv.TagTypeAudio:
+			err = w.WriteAudio(tag.Timestamp, tag.Data)
+		case flv.TagTypeScript:
+			err = w.WriteScript(tag.Timestamp, tag.Data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// hlsSource publishes the segments of an HLS playlist
+type hlsSource struct {
+	*hlsReader
+}
+
+func (s hlsSource) copy(w *counter) error {
+	if err := mpegts.Copy(w, s.hlsReader); err != nil {
+		return err
+	}
+	return io.EOF
+}
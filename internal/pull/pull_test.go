@@ -0,0 +1,454 @@
+package pull
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yutopp/go-rtmp"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/events"
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/mpegts"
+	"rtmp-server-poc/internal/mpegts/mpegtstest"
+	"rtmp-server-poc/internal/relay"
+	rtmphandler "rtmp-server-poc/internal/rtmp"
+	"rtmp-server-poc/internal/stream"
+)
+
+// x264 1080p High profile SPS wrapped in an AVCDecoderConfigurationRecord
+var avcConfig = []byte{
+	0x01, 0x64, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x1b,
+	0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00,
+	0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58,
+	0x00,
+}
+
+// testConfig returns a configuration for a local instance, with FFmpeg
+// replaced by a script discarding its input
+func testConfig(t *testing.T) config.Config {
+	t.Helper()
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte("#!/bin/sh\ncat >/dev/null\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := config.DefaultConfig()
+	cfg.OutputDir = t.TempDir()
+	cfg.VODDir = ""
+	cfg.CleanupDelay = 0
+	cfg.PullBackoffMin = 50 * time.Millisecond
+	cfg.PullBackoffMax = 200 * time.Millisecond
+	return cfg
+}
+
+// startOrigin serves RTMP on a local port as the server does, returning its
+// stream manager and address
+func startOrigin(t *testing.T, cfg config.Config) (*stream.Manager, string) {
+	t.Helper()
+	cfg.OutputDir = t.TempDir()
+	cfg.RTMPPlay = true
+	manager := stream.NewManager()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := rtmp.NewServer(&rtmp.ServerConfig{
+		OnConnect: func(conn net.Conn) (io.ReadWriteCloser, *rtmp.ConnConfig) {
+			return conn, &rtmp.ConnConfig{
+				Handler: rtmphandler.NewHandler(manager, cfg),
+				RPreset: rtmphandler.NewResponsePreset(),
+			}
+		},
+	})
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return manager, ln.Addr().String()
+}
+
+// encoder is a relay.Source generating a stream with a keyframe every ten
+// frames of 40ms, as an encoder publishing to the origin would
+type encoder struct {
+	sent int
+}
+
+func (e *encoder) Next(ctx context.Context) (flv.Tag, bool) {
+	if e.sent > 1 {
+		select {
+		case <-ctx.Done():
+			return flv.Tag{}, false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	defer func() { e.sent++ }()
+	switch e.sent {
+	case 0:
+		return flv.Tag{Type: flv.TagTypeVideo, Data: append([]byte{0x17, 0, 0, 0, 0}, avcConfig...)}, true
+	case 1:
+		return flv.Tag{Type: flv.TagTypeAudio, Data: []byte{0xaf, 0x00, 0x11, 0x90}}, true
+	}
+	frame := e.sent - 2
+	timestamp := uint32(frame * 40)
+	if frame%2 == 1 {
+		return flv.Tag{Type: flv.TagTypeAudio, Timestamp: timestamp, Data: []byte{0xaf, 0x01, byte(frame)}}, true
+	}
+	if frame%20 == 0 {
+		return flv.Tag{Type: flv.TagTypeVideo, Timestamp: timestamp, Data: []byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x65, byte(frame)}}, true
+	}
+	return flv.Tag{Type: flv.TagTypeVideo, Timestamp: timestamp, Data: []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x41, byte(frame)}}, true
+}
+
+func (e *encoder) Dropped() uint64 { return 0 }
+func (e *encoder) Close()          {}
+
+// publish publishes a generated stream to the origin as alice, until the
+// test ends
+func publish(t *testing.T, address string) {
+	t.Helper()
+	watch := func() (relay.Source, error) { return &encoder{}, nil }
+	target, err := relay.Start("encoder", "rtmp://"+address+"/live/test/alice/alice", watch,
+		relay.Backoff{Min: 50 * time.Millisecond, Max: 200 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(target.Stop)
+}
+
+// waitFor polls cond until it holds or the timeout passes
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pullStatus returns the status of the pull name
+func pullStatus(m *Manager, name string) Status {
+	for _, s := range m.List() {
+		if s.Name == name {
+			return s
+		}
+	}
+	return Status{}
+}
+
+// watchStream waits for the stream name and reads tags from it until it has
+// seen the video sequence header and two keyframes
+func watchStream(t *testing.T, manager *stream.Manager, name string) {
+	t.Helper()
+	var sp *stream.StreamProcess
+	waitFor(t, 5*time.Second, "stream "+name, func() bool {
+		var ok bool
+		sp, ok = manager.GetStream(name)
+		return ok && sp.IsActive()
+	})
+	viewer, err := sp.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	headers, keyframes, audio := 0, 0, 0
+	for headers == 0 || keyframes < 2 || audio == 0 {
+		tag, ok := viewer.Next(ctx)
+		if !ok {
+			t.Fatalf("stream %s ended after %d sequence headers, %d keyframes and %d audio frames", name, headers, keyframes, audio)
+		}
+		switch {
+		case tag.Type == flv.TagTypeAudio && !tag.IsSequenceHeader():
+			audio++
+		case tag.Type != flv.TagTypeVideo:
+		case tag.IsSequenceHeader():
+			headers++
+		case tag.IsKeyframe():
+			keyframes++
+		}
+	}
+}
+
+func TestPullRTMP(t *testing.T) {
+	cfg := testConfig(t)
+	_, origin := startOrigin(t, cfg)
+
+	manager := stream.NewManager()
+	pulls := NewManager(manager, cfg)
+	t.Cleanup(pulls.Close)
+	if _, err := pulls.Add("bob", "rtmp://"+origin+"/live/test/alice/alice", false); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// Nothing is published yet, so the origin refuses the play
+	waitFor(t, 5*time.Second, "a failed attempt", func() bool {
+		s := pullStatus(pulls, "bob")
+		return s.State == StateBackoff && s.Failures > 0
+	})
+	if s := pullStatus(pulls, "bob"); !strings.Contains(s.LastError, "StreamNotFound") {
+		t.Errorf("LastError = %q, expected the stream not found", s.LastError)
+	}
+	if s := pullStatus(pulls, "bob"); s.URL != "rtmp://"+origin+"/live/test/alice/****" {
+		t.Errorf("URL = %q, expected the key hidden", s.URL)
+	}
+
+	publish(t, origin)
+	watchStream(t, manager, "bob")
+	s := pullStatus(pulls, "bob")
+	if s.State != StateLive || s.Connections != 1 || s.Tags == 0 {
+		t.Errorf("status = %+v, expected live over one connection", s)
+	}
+
+	if _, err := pulls.Add("bob", "rtmp://"+origin+"/live/test/alice/alice", false); err != ErrPullExists {
+		t.Errorf("Add(existing) error = %v, expected ErrPullExists", err)
+	}
+	if err := pulls.Remove("bob"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if err := pulls.Remove("bob"); err != ErrPullNotFound {
+		t.Errorf("Remove(removed) error = %v, expected ErrPullNotFound", err)
+	}
+	var types []events.Type
+	for _, event := range manager.Events().Recent() {
+		if event.Stream == "bob" && strings.HasPrefix(string(event.Type), "pull.") {
+			types = append(types, event.Type)
+		}
+	}
+	if len(types) < 3 || types[0] != events.PullFailed || types[len(types)-2] != events.PullConnected || types[len(types)-1] != events.PullStopped {
+		t.Errorf("events = %v, expected failures, then connected and stopped", types)
+	}
+}
+
+func TestPullOnDemand(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.PullIdleTimeout = 500 * time.Millisecond
+	_, origin := startOrigin(t, cfg)
+	publish(t, origin)
+
+	manager := stream.NewManager()
+	pulls := NewManager(manager, cfg)
+	t.Cleanup(pulls.Close)
+	if _, err := pulls.Add("bob", "rtmp://"+origin+"/live/test/alice/alice", true); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if s := pullStatus(pulls, "bob"); s.State != StateIdle || s.Connections != 0 {
+		t.Fatalf("status = %+v, expected idle until demanded", s)
+	}
+	if pulls.Demand("carol") {
+		t.Errorf("Demand() of a stream not pulled returned true")
+	}
+
+	if !pulls.Demand("bob") {
+		t.Fatalf("Demand() returned false")
+	}
+	// A viewer keeps the pull running past the idle timeout
+	watchStream(t, manager, "bob")
+	waitFor(t, 5*time.Second, "the pull to go idle", func() bool {
+		return pullStatus(pulls, "bob").State == StateIdle
+	})
+	if s := pullStatus(pulls, "bob"); s.Connections != 1 || s.Failures != 0 {
+		t.Errorf("status = %+v, expected one connection and no failure", s)
+	}
+
+	pulls.Demand("bob")
+	waitFor(t, 5*time.Second, "the pull to reconnect", func() bool {
+		s := pullStatus(pulls, "bob")
+		return s.State == StateLive && s.Connections == 2
+	})
+}
+
+// liveHLS serves a live HLS stream of one second segments, the playlist
+// sliding by one segment each time it is fetched
+type liveHLS struct {
+	fetches atomic.Int64
+}
+
+func (l *liveHLS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/master.m3u8":
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=500000\nlow/live.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2000000\nhigh/live.m3u8\n")
+	case r.URL.Path == "/high/live.m3u8":
+		sequence := l.fetches.Add(1)
+		fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+		for i := sequence; i < sequence+3; i++ {
+			fmt.Fprintf(w, "#EXTINF:1.0,\nsegment%d.ts\n", i)
+		}
+	case strings.HasPrefix(r.URL.Path, "/high/segment"):
+		var n int64
+		fmt.Sscanf(r.URL.Path, "/high/segment%d.ts", &n)
+		w.Write(segment(n))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// segment muxes the one second segment n: 25 frames starting with a
+// keyframe, and AAC frames
+func segment(n int64) []byte {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	var buf bytes.Buffer
+	m := mpegtstest.NewMuxer(&buf)
+	for i := range 25 {
+		pts := 90000 + n*90000 + int64(i)*3600
+		frame := []byte{0, 0, 0, 1, 0x41, 0x9a, byte(i)}
+		if i == 0 {
+			frame = append(append([]byte{0, 0, 0, 1}, sps...), 0, 0, 0, 1)
+			frame = append(append(frame, pps...), 0, 0, 0, 1, 0x65, 0x88, byte(n))
+		}
+		m.WriteFrame(&mpegts.Frame{StreamType: mpegts.StreamTypeH264, PTS: pts, DTS: pts, Data: frame})
+		adts := []byte{0xff, 0xf1, 0x4c, 0x80, 0x01, 0x5f, 0xfc, 1, 2, 3}
+		m.WriteFrame(&mpegts.Frame{StreamType: mpegts.StreamTypeAAC, PTS: pts, DTS: pts, Data: adts})
+	}
+	return buf.Bytes()
+}
+
+func TestPullHLS(t *testing.T) {
+	cfg := testConfig(t)
+	origin := httptest.NewServer(&liveHLS{})
+	t.Cleanup(origin.Close)
+
+	manager := stream.NewManager()
+	pulls := NewManager(manager, cfg)
+	t.Cleanup(pulls.Close)
+	if _, err := pulls.Add("bob", origin.URL+"/master.m3u8", false); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	// Two keyframes come from two segments
+	watchStream(t, manager, "bob")
+	if s := pullStatus(pulls, "bob"); s.State != StateLive || s.Failures != 0 {
+		t.Errorf("status = %+v, expected live without failures", s)
+	}
+}
+
+func TestPullDoesNotTakeOver(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DuplicatePublisherPolicy = config.DuplicatePublisherTakeover
+	_, origin := startOrigin(t, cfg)
+	publish(t, origin)
+
+	// bob is already published by an encoder of its own
+	manager := stream.NewManager()
+	sp, err := manager.GetOrCreateStream("bob", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evicted := make(chan struct{})
+	publisher, err := sp.Attach(stream.RolePrimary, func() { close(evicted) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close(cfg)
+
+	pulls := NewManager(manager, cfg)
+	t.Cleanup(pulls.Close)
+	if _, err := pulls.Add("bob", "rtmp://"+origin+"/live/test/alice/alice", false); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	waitFor(t, 5*time.Second, "attempts to publish", func() bool {
+		return pullStatus(pulls, "bob").Failures >= 2
+	})
+	if s := pullStatus(pulls, "bob"); s.LastError != stream.ErrPublisherExists.Error() {
+		t.Errorf("LastError = %q, expected the stream to be taken", s.LastError)
+	}
+	select {
+	case <-evicted:
+		t.Error("the pull evicted the stream's publisher")
+	default:
+	}
+}
+
+func TestAddInvalid(t *testing.T) {
+	pulls := NewManager(stream.NewManager(), config.DefaultConfig())
+	tests := []struct {
+		name, url string
+	}{
+		{"", "rtmp://example.com/live/key"},
+		{"../bob", "rtmp://example.com/live/key"},
+		{".bob", "rtmp://example.com/live/key"},
+		{"<script>alert(1)</script>", "rtmp://example.com/live/key"},
+		{"bob smith", "rtmp://example.com/live/key"},
+		{"-bob", "rtmp://example.com/live/key"},
+		{"bob", "srt://example.com:9000"},
+		{"bob", "rtmp://example.com/key"},
+		{"bob", "http:///live.m3u8"},
+	}
+	for _, tt := range tests {
+		if _, err := pulls.Add(tt.name, tt.url, false); err == nil {
+			t.Errorf("Add(%q, %q) succeeded", tt.name, tt.url)
+		}
+	}
+	if statuses := pulls.List(); len(statuses) != 0 {
+		t.Errorf("List() = %+v, expected nothing added", statuses)
+	}
+}
+
+func TestParsePlaylist(t *testing.T) {
+	base, _ := url.Parse("http://example.com/live/index.m3u8")
+	tests := []struct {
+		name     string
+		playlist string
+		expected playlist
+		wantErr  bool
+	}{
+		{
+			name:     "media",
+			playlist: "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:7\n#EXTINF:4.0,\nseg7.ts\n#EXTINF:4.0,\n/other/seg8.ts\n",
+			expected: playlist{
+				targetDuration: 4 * time.Second,
+				mediaSequence:  7,
+				segments: []*url.URL{
+					{Scheme: "http", Host: "example.com", Path: "/live/seg7.ts"},
+					{Scheme: "http", Host: "example.com", Path: "/other/seg8.ts"},
+				},
+			},
+		},
+		{
+			name:     "ended",
+			playlist: "#EXTM3U\r\n#EXT-X-TARGETDURATION:2\r\n#EXTINF:2.0,\r\nseg0.ts\r\n#EXT-X-ENDLIST\r\n",
+			expected: playlist{
+				targetDuration: 2 * time.Second,
+				segments:       []*url.URL{{Scheme: "http", Host: "example.com", Path: "/live/seg0.ts"}},
+				ended:          true,
+			},
+		},
+		{
+			name:     "master",
+			playlist: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\n360p.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080\n1080p.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2500000\n720p.m3u8\n",
+			expected: playlist{variant: &url.URL{Scheme: "http", Host: "example.com", Path: "/live/1080p.m3u8"}},
+		},
+		{name: "fMP4", playlist: "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:4.0,\nseg0.m4s\n", wantErr: true},
+		{name: "not a playlist", playlist: "<html></html>", wantErr: true},
+		{name: "empty", playlist: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parsePlaylist(strings.NewReader(tt.playlist), base)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePlaylist() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(p, tt.expected) {
+				t.Errorf("parsePlaylist() = %+v, expected %+v", p, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,590 @@
+package pull
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/yutopp/go-amf0"
+	"github.com/yutopp/go-rtmp/handshake"
+
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/relay"
+)
+
+// connectTimeout bounds dialing and the connect, createStream and play
+// commands
+const connectTimeout = 10 * time.Second
+
+// readTimeout is how long a playing server may stay silent before the
+// connection is given up
+const readTimeout = 10 * time.Second
+
+// RTMP message types read or written by the player
+const (
+	typeSetChunkSize = 1
+	typeAck          = 3
+	typeUserControl  = 4
+	typeWinAckSize   = 5
+	typeAudio        = 8
+	typeVideo        = 9
+	typeDataAMF0     = 18
+	typeCommandAMF0  = 20
+	typeAggregate    = 22
+)
+
+// User control events
+const (
+	eventSetBufferLength = 3
+	eventPingRequest     = 6
+	eventPingResponse    = 7
+)
+
+// Chunk stream IDs of the messages written by the player
+const (
+	controlChunkStreamID = 2
+	commandChunkStreamID = 3
+	playChunkStreamID    = 8
+)
+
+// Transaction IDs of the commands waited for
+const (
+	connectTransaction      = 1
+	createStreamTransaction = 2
+)
+
+// errStreamEnded is returned once the server reports the stream has ended
+var errStreamEnded = errors.New("stream ended")
+
+// chunkStream is what has been read of a chunk stream: the header of its
+// last message and the part of the current one read so far
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typeID    byte
+	streamID  uint32
+	extended  bool // the last header carried an extended timestamp
+	payload   []byte
+}
+
+// rtmpPlayer plays a stream from an RTMP server. go-rtmp's client cannot
+// play, its streams having no handler for media, so the chunk stream is read
+// here, with go-rtmp for the handshake and go-amf0 for the commands.
+type rtmpPlayer struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	w         *bufio.Writer
+	chunkSize uint32 // of the chunks read
+	chunks    map[uint32]*chunkStream
+	ackWindow uint32
+	received  *countingReader
+	acked     uint64
+	streamID  uint32
+	pending   []flv.Tag // read while waiting for the play to start
+}
+
+// countingReader counts the bytes read, which the server is acknowledged
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// dialRTMP connects to an RTMP or RTMPS URL and starts playing its stream
+// key. The setup is given up once ctx is done or connectTimeout has passed.
+func dialRTMP(ctx context.Context, rawURL string) (*rtmpPlayer, error) {
+	ep, err := relay.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+
+	var conn net.Conn
+	dialer := &net.Dialer{}
+	if ep.Scheme == "rtmps" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: ep.Host}}).DialContext(ctx, "tcp", ep.Address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", ep.Address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %w", ep.Address, err)
+	}
+	// The commands are waited for with a deadline, which ctx moves closer
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	received := &countingReader{r: conn}
+	p := &rtmpPlayer{
+		conn:      conn,
+		r:         bufio.NewReader(received),
+		w:         bufio.NewWriter(conn),
+		chunkSize: 128,
+		chunks:    make(map[uint32]*chunkStream),
+		received:  received,
+	}
+	if err := p.setup(ep); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("playing %s: %w", ep.TCURL, ctx.Err())
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return p, nil
+}
+
+// setup shakes hands, connects to the application, creates a stream and
+// plays the key on it, until the server starts sending
+func (p *rtmpPlayer) setup(ep relay.Endpoint) error {
+	if err := handshake.HandshakeWithServer(p.r, p.conn, &handshake.Config{}); err != nil {
+		return fmt.Errorf("handshake with %s: %w", ep.Address, err)
+	}
+
+	if err := p.command(0, "connect", connectTransaction, map[string]interface{}{
+		"app":           ep.App,
+		"type":          "nonprivate",
+		"flashVer":      "LNX 9,0,124,2",
+		"tcUrl":         ep.TCURL,
+		"fpad":          false,
+		"capabilities":  15,
+		"audioCodecs":   4071,
+		"videoCodecs":   252,
+		"videoFunction": 1,
+	}); err != nil {
+		return err
+	}
+	if _, err := p.result(connectTransaction); err != nil {
+		return fmt.Errorf("connecting to %s: %w", ep.TCURL, err)
+	}
+
+	if err := p.command(0, "createStream", createStreamTransaction, nil); err != nil {
+		return err
+	}
+	args, err := p.result(createStreamTransaction)
+	if err != nil {
+		return fmt.Errorf("creating a stream on %s: %w", ep.TCURL, err)
+	}
+	id, ok := number(args, 1)
+	if !ok {
+		return fmt.Errorf("creating a stream on %s: no stream ID", ep.TCURL)
+	}
+	p.streamID = uint32(id)
+
+	if err := p.command(p.streamID, "play", 0, nil, ep.Key, -1000); err != nil {
+		return err
+	}
+	// A buffer length lets servers such as nginx-rtmp start sending
+	control := make([]byte, 10)
+	binary.BigEndian.PutUint16(control, eventSetBufferLength)
+	binary.BigEndian.PutUint32(control[2:], p.streamID)
+	binary.BigEndian.PutUint32(control[6:], 3000)
+	if err := p.writeMessage(controlChunkStreamID, typeUserControl, 0, 0, control); err != nil {
+		return err
+	}
+	return p.waitPlay(ep)
+}
+
+// waitPlay reads until the server reports the play started or sends media
+func (p *rtmpPlayer) waitPlay(ep relay.Endpoint) error {
+	for {
+		msg, err := p.readMessage()
+		if err != nil {
+			return fmt.Errorf("playing %s: %w", ep.TCURL, err)
+		}
+		switch msg.typeID {
+		case typeAudio, typeVideo, typeDataAMF0, typeAggregate:
+			tags, err := p.tags(msg)
+			if err != nil {
+				return err
+			}
+			p.pending = append(p.pending, tags...)
+			if len(p.pending) > 0 {
+				return nil
+			}
+		case typeCommandAMF0:
+			name, _, args := parseCommand(msg.payload)
+			if name != "onStatus" {
+				continue
+			}
+			level, code := status(args)
+			switch {
+			case code == "NetStream.Play.Start":
+				return nil
+			case level == "error" || code == "NetStream.Play.StreamNotFound" || code == "NetStream.Play.Failed":
+				return fmt.Errorf("playing %s: %s", ep.TCURL, code)
+			}
+		}
+	}
+}
+
+// ReadTag returns the next tag played, io.EOF once the server reports the
+// stream ended
+func (p *rtmpPlayer) ReadTag() (flv.Tag, error) {
+	for len(p.pending) == 0 {
+		p.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		msg, err := p.readMessage()
+		if err != nil {
+			return flv.Tag{}, err
+		}
+		switch msg.typeID {
+		case typeAudio, typeVideo, typeDataAMF0, typeAggregate:
+			if p.pending, err = p.tags(msg); err != nil {
+				return flv.Tag{}, err
+			}
+		case typeCommandAMF0:
+			name, _, args := parseCommand(msg.payload)
+			if name != "onStatus" {
+				continue
+			}
+			level, code := status(args)
+			switch {
+			case code == "NetStream.Play.UnpublishNotify" || code == "NetStream.Play.Stop" || code == "NetStream.Play.Complete":
+				return flv.Tag{}, io.EOF
+			case level == "error":
+				return flv.Tag{}, fmt.Errorf("server reported %s", code)
+			}
+		}
+	}
+	tag := p.pending[0]
+	p.pending = p.pending[1:]
+	return tag, nil
+}
+
+// Close closes the connection
+func (p *rtmpPlayer) Close() error {
+	return p.conn.Close()
+}
+
+// message is a whole RTMP message read from the server
+type message struct {
+	typeID    byte
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+// tags returns the FLV tags of a media or data message. Script data is kept
+// only for onMetaData, sent as is or through @setDataFrame.
+func (p *rtmpPlayer) tags(msg message) ([]flv.Tag, error) {
+	switch msg.typeID {
+	case typeAudio, typeVideo:
+		if len(msg.payload) == 0 {
+			return nil, nil
+		}
+		return []flv.Tag{{Type: msg.typeID, Timestamp: msg.timestamp, Data: msg.payload}}, nil
+	case typeDataAMF0:
+		data := msg.payload
+		if name, rest, ok := scriptName(data); ok && name == "@setDataFrame" {
+			data = rest
+		}
+		if name, _, ok := scriptName(data); !ok || name != "onMetaData" {
+			return nil, nil
+		}
+		return []flv.Tag{{Type: flv.TagTypeScript, Timestamp: msg.timestamp, Data: data}}, nil
+	case typeAggregate:
+		return aggregateTags(msg)
+	}
+	return nil, nil
+}
+
+// aggregateTags splits an aggregate message into its FLV tags, whose
+// timestamps are offset so that the first one is the message's
+func aggregateTags(msg message) ([]flv.Tag, error) {
+	var tags []flv.Tag
+	data := msg.payload
+	var base uint32
+	for len(data) >= 11 {
+		size := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		timestamp := uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6]) | uint32(data[7])<<24
+		if len(data) < 11+size {
+			return nil, errors.New("truncated aggregate message")
+		}
+		if len(tags) == 0 {
+			base = timestamp
+		}
+		if data[0] == typeAudio || data[0] == typeVideo {
+			tags = append(tags, flv.Tag{Type: data[0], Timestamp: msg.timestamp + timestamp - base, Data: data[11 : 11+size]})
+		}
+		data = data[min(len(data), 11+size+4):]
+	}
+	return tags, nil
+}
+
+// scriptName returns the name opening script data, an AMF0 string, and the
+// data following it
+func scriptName(data []byte) (string, []byte, bool) {
+	if len(data) < 3 || data[0] != 0x02 {
+		return "", nil, false
+	}
+	end := 3 + int(binary.BigEndian.Uint16(data[1:3]))
+	if len(data) < end {
+		return "", nil, false
+	}
+	return string(data[3:end]), data[end:], true
+}
+
+// result waits for the result of a command, returning its arguments after
+// the command object. Other messages read meanwhile are handled or dropped.
+func (p *rtmpPlayer) result(transactionID float64) ([]interface{}, error) {
+	for {
+		msg, err := p.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.typeID != typeCommandAMF0 {
+			continue
+		}
+		name, id, args := parseCommand(msg.payload)
+		if id != transactionID {
+			continue
+		}
+		switch name {
+		case "_result":
+			return args, nil
+		case "_error":
+			_, code := status(args)
+			return nil, fmt.Errorf("refused: %s", code)
+		}
+	}
+}
+
+// parseCommand decodes the name, the transaction ID and the arguments of a
+// command. go-amf0 panics on some valid values, such as a strict array in an
+// object, which is what Enhanced RTMP servers send in their fourCcList: the
+// arguments decoded until then are returned.
+func parseCommand(payload []byte) (name string, transactionID float64, args []interface{}) {
+	defer func() {
+		recover()
+	}()
+	decoder := amf0.NewDecoder(bytes.NewReader(payload))
+	if err := decoder.Decode(&name); err != nil {
+		return "", 0, nil
+	}
+	if err := decoder.Decode(&transactionID); err != nil {
+		return name, 0, nil
+	}
+	for {
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return name, transactionID, args
+		}
+		args = append(args, value)
+	}
+}
+
+// status returns the level and the code of an onStatus or _error info
+// object, the argument following the command object
+func status(args []interface{}) (level, code string) {
+	if len(args) < 2 {
+		return "", ""
+	}
+	var info map[string]interface{}
+	switch v := args[1].(type) {
+	case map[string]interface{}:
+		info = v
+	case amf0.ECMAArray:
+		info = v
+	}
+	level, _ = info["level"].(string)
+	code, _ = info["code"].(string)
+	return level, code
+}
+
+// number returns the argument at i when it is a number
+func number(args []interface{}, i int) (float64, bool) {
+	if len(args) <= i {
+		return 0, false
+	}
+	n, ok := args[i].(float64)
+	return n, ok
+}
+
+// command writes an AMF0 command message
+func (p *rtmpPlayer) command(streamID uint32, name string, transactionID float64, values ...interface{}) error {
+	body := new(bytes.Buffer)
+	encoder := amf0.NewEncoder(body)
+	for _, value := range append([]interface{}{name, transactionID}, values...) {
+		if err := encoder.Encode(value); err != nil {
+			return fmt.Errorf("encoding %s: %w", name, err)
+		}
+	}
+	csid := commandChunkStreamID
+	if streamID != 0 {
+		csid = playChunkStreamID
+	}
+	return p.writeMessage(csid, typeCommandAMF0, streamID, 0, body.Bytes())
+}
+
+// writeMessage writes a message in chunks of the default 128 bytes
+func (p *rtmpPlayer) writeMessage(csid int, typeID byte, streamID, timestamp uint32, payload []byte) error {
+	header := []byte{byte(csid), 0, 0, 0, 0, 0, 0, typeID, 0, 0, 0, 0}
+	putUint24(header[1:], min(timestamp, 0xffffff))
+	putUint24(header[4:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[8:], streamID)
+	p.w.Write(header)
+	if timestamp >= 0xffffff {
+		p.w.Write(binary.BigEndian.AppendUint32(nil, timestamp))
+	}
+	for len(payload) > 0 {
+		n := min(len(payload), 128)
+		p.w.Write(payload[:n])
+		payload = payload[n:]
+		if len(payload) > 0 {
+			p.w.WriteByte(0xc0 | byte(csid))
+			if timestamp >= 0xffffff {
+				p.w.Write(binary.BigEndian.AppendUint32(nil, timestamp))
+			}
+		}
+	}
+	return p.w.Flush()
+}
+
+// readMessage reads chunks until a message is complete. Protocol control
+// messages are handled and not returned; the bytes read are acknowledged
+// once the server's window is half used.
+func (p *rtmpPlayer) readMessage() (message, error) {
+	for {
+		msg, complete, err := p.readChunk()
+		if err != nil {
+			return message{}, err
+		}
+		if p.ackWindow > 0 && p.received.n-p.acked >= uint64(p.ackWindow/2) {
+			p.acked = p.received.n
+			if err := p.writeMessage(controlChunkStreamID, typeAck, 0, 0, binary.BigEndian.AppendUint32(nil, uint32(p.acked))); err != nil {
+				return message{}, err
+			}
+		}
+		if !complete {
+			continue
+		}
+
+		switch msg.typeID {
+		case typeSetChunkSize:
+			if len(msg.payload) < 4 {
+				return message{}, errors.New("invalid SetChunkSize message")
+			}
+			p.chunkSize = binary.BigEndian.Uint32(msg.payload) & 0x7fffffff
+			if p.chunkSize == 0 {
+				return message{}, errors.New("invalid chunk size 0")
+			}
+		case typeWinAckSize:
+			if len(msg.payload) >= 4 {
+				p.ackWindow = binary.BigEndian.Uint32(msg.payload)
+			}
+		case typeUserControl:
+			if len(msg.payload) >= 6 && binary.BigEndian.Uint16(msg.payload) == eventPingRequest {
+				response := binary.BigEndian.AppendUint16(nil, eventPingResponse)
+				if err := p.writeMessage(controlChunkStreamID, typeUserControl, 0, 0, append(response, msg.payload[2:6]...)); err != nil {
+					return message{}, err
+				}
+			}
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// readChunk reads a chunk, returning its message once complete
+func (p *rtmpPlayer) readChunk() (message, bool, error) {
+	b, err := p.r.ReadByte()
+	if err != nil {
+		return message{}, false, err
+	}
+	format := b >> 6
+	csid := uint32(b & 0x3f)
+	switch csid {
+	case 0:
+		b, err := p.r.ReadByte()
+		if err != nil {
+			return message{}, false, err
+		}
+		csid = 64 + uint32(b)
+	case 1:
+		var b [2]byte
+		if _, err := io.ReadFull(p.r, b[:]); err != nil {
+			return message{}, false, err
+		}
+		csid = 64 + uint32(b[0]) + uint32(b[1])<<8
+	}
+
+	cs := p.chunks[csid]
+	if cs == nil {
+		if format != 0 {
+			return message{}, false, fmt.Errorf("chunk stream %d starts without a full header", csid)
+		}
+		cs = &chunkStream{}
+		p.chunks[csid] = cs
+	}
+
+	headerSizes := [4]int{11, 7, 3, 0}
+	var header [11]byte
+	if _, err := io.ReadFull(p.r, header[:headerSizes[format]]); err != nil {
+		return message{}, false, err
+	}
+	var timestamp uint32
+	if format < 3 {
+		timestamp = uint24(header[:3])
+		cs.extended = timestamp == 0xffffff
+	}
+	if cs.extended {
+		var b [4]byte
+		if _, err := io.ReadFull(p.r, b[:]); err != nil {
+			return message{}, false, err
+		}
+		if format < 3 {
+			timestamp = binary.BigEndian.Uint32(b[:])
+		}
+	}
+	switch format {
+	case 0:
+		cs.timestamp, cs.delta = timestamp, 0
+		cs.length, cs.typeID = uint24(header[3:6]), header[6]
+		cs.streamID = binary.LittleEndian.Uint32(header[7:11])
+	case 1:
+		cs.delta = timestamp
+		cs.length, cs.typeID = uint24(header[3:6]), header[6]
+	case 2:
+		cs.delta = timestamp
+	}
+	if format != 0 && len(cs.payload) == 0 {
+		// A new message continues the timeline of the chunk stream
+		cs.timestamp += cs.delta
+	}
+
+	n := min(cs.length-uint32(len(cs.payload)), p.chunkSize)
+	start := len(cs.payload)
+	cs.payload = append(cs.payload, make([]byte, n)...)
+	if _, err := io.ReadFull(p.r, cs.payload[start:]); err != nil {
+		return message{}, false, err
+	}
+	if uint32(len(cs.payload)) < cs.length {
+		return message{}, false, nil
+	}
+	msg := message{typeID: cs.typeID, streamID: cs.streamID, timestamp: cs.timestamp, payload: cs.payload}
+	cs.payload = nil
+	return msg, true, nil
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
@@ -0,0 +1,222 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/yutopp/go-rtmp"
+	"github.com/yutopp/go-rtmp/message"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// connectTimeout bounds dialing and the connect, createStream and publish
+// commands
+const connectTimeout = 10 * time.Second
+
+// chunkSize is the RTMP chunk size used towards upstream servers
+const chunkSize = 4096
+
+// Chunk stream IDs of the messages sent, as usual for encoders
+const (
+	dataChunkStreamID  = 4
+	audioChunkStreamID = 5
+	videoChunkStreamID = 6
+)
+
+// Endpoint is where an RTMP URL leads: rtmp://host/app/key connects to host
+// with the application app and publishes or plays key
+type Endpoint struct {
+	Scheme  string // rtmp or rtmps
+	Address string // host:port
+	Host    string
+	App     string
+	TCURL   string
+	Key     string // the stream name, with its query if any
+}
+
+// ParseURL splits an RTMP or RTMPS URL into its endpoint. The stream key is
+// the last path segment and the application everything before it, so the
+// key of rtmp://host/live/test/johndoe is "johndoe" in the application
+// "live/test".
+func ParseURL(rawURL string) (Endpoint, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	port := "1935"
+	switch u.Scheme {
+	case "rtmp":
+	case "rtmps":
+		port = "443"
+	default:
+		return Endpoint{}, fmt.Errorf("unsupported scheme %q, expected rtmp or rtmps", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return Endpoint{}, errors.New("missing host")
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+
+	path := strings.Trim(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return Endpoint{}, errors.New("expected a URL ending with the application and the stream key")
+	}
+	app, key := path[:i], path[i+1:]
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return Endpoint{
+		Scheme:  u.Scheme,
+		Address: net.JoinHostPort(u.Hostname(), port),
+		Host:    u.Hostname(),
+		App:     app,
+		TCURL:   u.Scheme + "://" + u.Host + "/" + app,
+		Key:     key,
+	}, nil
+}
+
+// Redact returns an RTMP URL without its stream key, for logs and the API
+func Redact(rawURL string) string {
+	ep, err := ParseURL(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return ep.TCURL + "/****"
+}
+
+// conn is a client connection publishing to an upstream server
+type conn struct {
+	client *rtmp.ClientConn
+	stream *rtmp.Stream
+}
+
+// dial connects to the endpoint and starts publishing its stream key. The
+// client library waits for command results without a timeout, so the setup
+// runs aside and is given up, closing the connection, once ctx is done or
+// connectTimeout has passed.
+func dial(ctx context.Context, ep Endpoint) (*conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+
+	type result struct {
+		conn *conn
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		c, err := setup(ep)
+		results <- result{c, err}
+	}()
+	select {
+	case r := <-results:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-results; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("connecting to %s: %w", ep.Address, ctx.Err())
+	}
+}
+
+// setup dials the endpoint, connects to its application and publishes
+func setup(ep Endpoint) (*conn, error) {
+	dialer := &net.Dialer{Timeout: connectTimeout}
+	var client *rtmp.ClientConn
+	var err error
+	if ep.Scheme == "rtmps" {
+		client, err = rtmp.DialWithTLSDialer(&tls.Dialer{
+			NetDialer: dialer,
+			Config:    &tls.Config{ServerName: ep.Host},
+		}, "rtmps", ep.Address, &rtmp.ConnConfig{})
+	} else {
+		client, err = rtmp.DialWithDialer(dialer, "rtmp", ep.Address, &rtmp.ConnConfig{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %w", ep.Address, err)
+	}
+
+	if err := connect(client, &message.NetConnectionConnect{
+		Command: message.NetConnectionConnectCommand{
+			App:      ep.App,
+			Type:     "nonprivate",
+			FlashVer: "FMLE/3.0 (compatible; FMSc/1.0)",
+			TCURL:    ep.TCURL,
+		},
+	}); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connecting to %s: %w", ep.TCURL, err)
+	}
+	stream, err := client.CreateStream(nil, chunkSize)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("creating a stream on %s: %w", ep.TCURL, err)
+	}
+	if err := stream.Publish(&message.NetStreamPublish{
+		PublishingName: ep.Key,
+		PublishingType: "live",
+	}); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("publishing to %s: %w", ep.TCURL, err)
+	}
+	return &conn{client: client, stream: stream}, nil
+}
+
+// connect sends the connect command and waits for its result. The client
+// library panics decoding a result holding a strict array, such as the
+// fourCcList of Enhanced RTMP servers, this one included. The server has
+// answered by then, so the connect is taken as accepted: a refusal closes
+// the connection and fails the next command.
+func connect(client *rtmp.ClientConn, cmd *message.NetConnectionConnect) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*reflect.ValueError); !ok {
+				panic(r)
+			}
+			err = nil
+		}
+	}()
+	return client.Connect(cmd)
+}
+
+// write sends a tag as the matching RTMP message. Script tags other than
+// onMetaData are not forwarded. A server refusing the publish answers with
+// a status and closes the connection, which fails the next write.
+func (c *conn) write(tag flv.Tag, timestamp uint32) error {
+	if err := c.client.LastError(); err != nil {
+		return fmt.Errorf("connection closed: %w", err)
+	}
+	switch tag.Type {
+	case flv.TagTypeAudio:
+		return c.stream.Write(audioChunkStreamID, timestamp, &message.AudioMessage{Payload: bytes.NewReader(tag.Data)})
+	case flv.TagTypeVideo:
+		return c.stream.Write(videoChunkStreamID, timestamp, &message.VideoMessage{Payload: bytes.NewReader(tag.Data)})
+	case flv.TagTypeScript:
+		if tag.Metadata == nil {
+			return nil
+		}
+		return c.stream.Write(dataChunkStreamID, timestamp, &message.DataMessage{
+			Name:     "@setDataFrame",
+			Encoding: message.EncodingTypeAMF0,
+			Body:     bytes.NewReader(tag.Data),
+		})
+	}
+	return nil
+}
+
+// Close closes the connection
+func (c *conn) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,236 @@
+// Package relay forwards live streams to upstream RTMP and RTMPS servers,
+// such as YouTube, Twitch or a CDN. Each target has a connection of its own,
+// reopened with exponential backoff when it fails, and reads the stream from
+// a source of its own, so that a slow or failing target never holds up the
+// ingest or the other targets.
+package relay
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// Source yields the tags of a live stream, as a stream.Viewer does
+type Source interface {
+	// Next returns the next tag, or false once the stream has ended or ctx
+	// is done
+	Next(ctx context.Context) (flv.Tag, bool)
+	// Dropped returns the number of tags missed for falling behind
+	Dropped() uint64
+	Close()
+}
+
+// State is what a target is doing
+type State string
+
+// Target states
+const (
+	StateWaiting    State = "waiting"    // for the stream's media
+	StateConnecting State = "connecting" // to the upstream server
+	StateLive       State = "live"       // forwarding the stream
+	StateBackoff    State = "backoff"    // waiting to reconnect after a failure
+	StateStopped    State = "stopped"    // removed, or the stream ended
+)
+
+// Status is a snapshot of a target for the API
+type Status struct {
+	Name      string     `json:"name"`
+	URL       string     `json:"url"` // without the stream key
+	State     State      `json:"state"`
+	Since     time.Time  `json:"since"`
+	Retry     *time.Time `json:"retry,omitempty"` // next attempt, in backoff
+	LastError string     `json:"last_error,omitempty"`
+	// Connections counts the publishes started, Failures those that failed
+	Connections int `json:"connections"`
+	Failures    int `json:"failures"`
+	// Tags and Bytes were sent over every connection, Dropped were missed
+	// for not keeping up with the stream
+	Tags    uint64 `json:"tags"`
+	Bytes   uint64 `json:"bytes"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Backoff bounds the delay before reconnecting, which doubles from Min with
+// each failure up to Max. It is back to Min once a connection has lasted
+// longer than Max.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// Target forwards a stream to one upstream URL
+type Target struct {
+	endpoint Endpoint
+	watch    func() (Source, error)
+	backoff  Backoff
+	notify   func(Status)
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mutex   sync.Mutex
+	status  Status
+	source  Source // being read, nil when none
+	dropped uint64 // by the previous sources
+}
+
+// Start validates a target URL and starts forwarding to it. Each connection
+// reads the stream from a new source from watch, so it starts with the
+// metadata, the sequence headers and a keyframe; the target stops once watch
+// fails, the stream having ended. notify, when not nil, is called with the
+// status on every state change.
+func Start(name, rawURL string, watch func() (Source, error), backoff Backoff, notify func(Status)) (*Target, error) {
+	ep, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Target{
+		endpoint: ep,
+		watch:    watch,
+		backoff:  backoff,
+		notify:   notify,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		status:   Status{Name: name, URL: Redact(rawURL), State: StateWaiting, Since: time.Now()},
+	}
+	go t.run(ctx)
+	return t, nil
+}
+
+// Stop stops forwarding and waits for the connection to close
+func (t *Target) Stop() {
+	t.cancel()
+	<-t.done
+}
+
+// Done is closed once the target has stopped
+func (t *Target) Done() <-chan struct{} {
+	return t.done
+}
+
+// Status returns a snapshot of the target
+func (t *Target) Status() Status {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	status := t.status
+	status.Dropped = t.dropped
+	if t.source != nil {
+		status.Dropped += t.source.Dropped()
+	}
+	return status
+}
+
+// run connects and forwards until stopped or the stream ends, backing off
+// after each failure
+func (t *Target) run(ctx context.Context) {
+	defer close(t.done)
+	delay := t.backoff.Min
+	for {
+		source, err := t.watch()
+		if err != nil {
+			t.setState(StateStopped, nil, time.Time{})
+			return
+		}
+		t.mutex.Lock()
+		t.source = source
+		t.mutex.Unlock()
+
+		connected, err := t.forward(ctx, source)
+
+		t.mutex.Lock()
+		t.source = nil
+		t.dropped += source.Dropped()
+		t.mutex.Unlock()
+		source.Close()
+
+		if ctx.Err() != nil || err == nil {
+			t.setState(StateStopped, nil, time.Time{})
+			return
+		}
+		if !connected.IsZero() && time.Since(connected) > t.backoff.Max {
+			delay = t.backoff.Min
+		}
+		log.Printf("Relay %s to %s failed, retrying in %s: %v", t.status.Name, t.status.URL, delay, err)
+		t.setState(StateBackoff, err, time.Now().Add(delay))
+		select {
+		case <-ctx.Done():
+			t.setState(StateStopped, nil, time.Time{})
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, t.backoff.Max)
+	}
+}
+
+// forward waits for the stream's first tag, then publishes to the endpoint
+// and sends the tags as they come, rebased so that each connection starts
+// at 0. It returns nil once the source ends, and when the connection was
+// made, the time it was.
+func (t *Target) forward(ctx context.Context, source Source) (connected time.Time, err error) {
+	t.setState(StateWaiting, nil, time.Time{})
+	tag, ok := source.Next(ctx)
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	t.setState(StateConnecting, nil, time.Time{})
+	c, err := dial(ctx, t.endpoint)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer c.Close()
+	connected = time.Now()
+	t.mutex.Lock()
+	t.status.Connections++
+	t.mutex.Unlock()
+	t.setState(StateLive, nil, time.Time{})
+
+	// The metadata and sequence headers ahead of the first frame go at 0
+	var base uint32
+	based := false
+	for {
+		if !based && tag.Type != flv.TagTypeScript && !tag.IsSequenceHeader() {
+			base, based = tag.Timestamp, true
+		}
+		var timestamp uint32
+		if based && tag.Timestamp > base {
+			timestamp = tag.Timestamp - base
+		}
+		if err := c.write(tag, timestamp); err != nil {
+			return connected, err
+		}
+		t.mutex.Lock()
+		t.status.Tags++
+		t.status.Bytes += uint64(len(tag.Data))
+		t.mutex.Unlock()
+
+		if tag, ok = source.Next(ctx); !ok {
+			return connected, nil
+		}
+	}
+}
+
+// setState records a state change and notifies it. An error counts as a
+// failure; retry is the next attempt, in backoff.
+func (t *Target) setState(state State, err error, retry time.Time) {
+	t.mutex.Lock()
+	t.status.State = state
+	t.status.Since = time.Now()
+	t.status.Retry = nil
+	if !retry.IsZero() {
+		t.status.Retry = &retry
+	}
+	if err != nil {
+		t.status.LastError = err.Error()
+		t.status.Failures++
+	}
+	t.mutex.Unlock()
+	if t.notify != nil {
+		t.notify(t.Status())
+	}
+}
@@ -0,0 +1,371 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yutopp/go-rtmp"
+	"github.com/yutopp/go-rtmp/message"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected Endpoint
+		wantErr  bool
+	}{
+		{
+			url: "rtmp://a.rtmp.youtube.com/live2/abcd-efgh",
+			expected: Endpoint{Scheme: "rtmp", Address: "a.rtmp.youtube.com:1935", Host: "a.rtmp.youtube.com",
+				App: "live2", TCURL: "rtmp://a.rtmp.youtube.com/live2", Key: "abcd-efgh"},
+		},
+		{
+			url: "rtmps://live.example.com/app/key",
+			expected: Endpoint{Scheme: "rtmps", Address: "live.example.com:443", Host: "live.example.com",
+				App: "app", TCURL: "rtmps://live.example.com/app", Key: "key"},
+		},
+		{
+			url: "rtmp://localhost:1936/live/test/johndoe?role=backup",
+			expected: Endpoint{Scheme: "rtmp", Address: "localhost:1936", Host: "localhost",
+				App: "live/test", TCURL: "rtmp://localhost:1936/live/test", Key: "johndoe?role=backup"},
+		},
+		{url: "http://example.com/live/key", wantErr: true},
+		{url: "rtmp:///live/key", wantErr: true},
+		{url: "rtmp://example.com/key", wantErr: true},
+		{url: "rtmp://example.com/live/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			ep, err := ParseURL(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ep != tt.expected {
+				t.Errorf("ParseURL() = %+v, expected %+v", ep, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	if got := Redact("rtmp://a.rtmp.youtube.com/live2/abcd-efgh"); got != "rtmp://a.rtmp.youtube.com/live2/****" {
+		t.Errorf("Redact() = %q, expected the key hidden", got)
+	}
+}
+
+// received is what the upstream server got over one connection
+type received struct {
+	app, name string
+	tags      []flv.Tag
+}
+
+// upstream is an RTMP server recording what is published to it
+type upstream struct {
+	mutex       sync.Mutex
+	connections []*received
+	rejects     int // publishes still to refuse
+	address     string
+}
+
+// startUpstream serves RTMP on a local port
+func startUpstream(t *testing.T) *upstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &upstream{address: ln.Addr().String()}
+	srv := rtmp.NewServer(&rtmp.ServerConfig{
+		OnConnect: func(conn net.Conn) (io.ReadWriteCloser, *rtmp.ConnConfig) {
+			// Advertise Enhanced RTMP codecs as our own server does
+			preset := rtmp.NewDefaultResponsePreset()
+			preset.ServerConnectResultData["fourCcList"] = []interface{}{"avc1", "hvc1"}
+			return conn, &rtmp.ConnConfig{Handler: &upstreamHandler{upstream: u}, RPreset: preset}
+		},
+	})
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return u
+}
+
+// snapshot returns a copy of the connections so far
+func (u *upstream) snapshot() []received {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	var connections []received
+	for _, r := range u.connections {
+		connections = append(connections, received{r.app, r.name, append([]flv.Tag(nil), r.tags...)})
+	}
+	return connections
+}
+
+// upstreamHandler records one connection
+type upstreamHandler struct {
+	rtmp.DefaultHandler
+	upstream *upstream
+	received *received
+}
+
+func (h *upstreamHandler) OnConnect(timestamp uint32, cmd *message.NetConnectionConnect) error {
+	h.received = &received{app: cmd.Command.App}
+	return nil
+}
+
+func (h *upstreamHandler) OnPublish(ctx *rtmp.StreamContext, timestamp uint32, cmd *message.NetStreamPublish) error {
+	u := h.upstream
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.rejects > 0 {
+		u.rejects--
+		return errors.New("publish refused")
+	}
+	h.received.name = cmd.PublishingName
+	u.connections = append(u.connections, h.received)
+	return nil
+}
+
+func (h *upstreamHandler) record(tagType byte, timestamp uint32, payload io.Reader) error {
+	data, err := io.ReadAll(payload)
+	if err != nil {
+		return err
+	}
+	tag, _ := flv.ParseTag(tagType, timestamp, data)
+	h.upstream.mutex.Lock()
+	defer h.upstream.mutex.Unlock()
+	h.received.tags = append(h.received.tags, tag)
+	return nil
+}
+
+func (h *upstreamHandler) OnSetDataFrame(timestamp uint32, data *message.NetStreamSetDataFrame) error {
+	tag, _ := flv.ParseTag(flv.TagTypeScript, timestamp, data.Payload)
+	h.upstream.mutex.Lock()
+	defer h.upstream.mutex.Unlock()
+	h.received.tags = append(h.received.tags, tag)
+	return nil
+}
+
+func (h *upstreamHandler) OnAudio(timestamp uint32, payload io.Reader) error {
+	return h.record(flv.TagTypeAudio, timestamp, payload)
+}
+
+func (h *upstreamHandler) OnVideo(timestamp uint32, payload io.Reader) error {
+	return h.record(flv.TagTypeVideo, timestamp, payload)
+}
+
+// feed is a stream the sources of a target read from
+type feed struct {
+	tags    chan flv.Tag
+	sources chan struct{} // one per source handed out
+	ended   bool
+}
+
+func newFeed() *feed {
+	return &feed{tags: make(chan flv.Tag, 64), sources: make(chan struct{}, 16)}
+}
+
+// watch hands out a source reading the feed's tags
+func (f *feed) watch() (Source, error) {
+	if f.ended {
+		return nil, errors.New("stream has ended")
+	}
+	f.sources <- struct{}{}
+	return feedSource{f}, nil
+}
+
+type feedSource struct{ feed *feed }
+
+func (s feedSource) Next(ctx context.Context) (flv.Tag, bool) {
+	select {
+	case tag, ok := <-s.feed.tags:
+		return tag, ok
+	case <-ctx.Done():
+		return flv.Tag{}, false
+	}
+}
+
+func (s feedSource) Dropped() uint64 { return 0 }
+func (s feedSource) Close()          {}
+
+// testTags are onMetaData, an AVC sequence header and two frames from
+// 5s into a stream
+func testTags(t *testing.T) []flv.Tag {
+	t.Helper()
+	metadata := []byte{
+		0x02, 0x00, 0x0a, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a',
+		0x08, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x05, 'w', 'i', 'd', 't', 'h', 0x00, 0x40, 0x94, 0x00, 0, 0, 0, 0, 0, // 1280
+		0x00, 0x00, 0x09,
+	}
+	var tags []flv.Tag
+	for _, raw := range []struct {
+		tagType   byte
+		timestamp uint32
+		data      []byte
+	}{
+		{flv.TagTypeScript, 5000, metadata},
+		{flv.TagTypeVideo, 5000, []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x42, 0xc0, 0x1f, 0xff, 0xe0, 0x00, 0x00}},
+		{flv.TagTypeVideo, 5000, []byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, 1, 0x65}},
+		{flv.TagTypeVideo, 5040, []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 1, 0x41}},
+	} {
+		tag, err := flv.ParseTag(raw.tagType, raw.timestamp, raw.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// waitFor polls until condition holds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTargetForwards(t *testing.T) {
+	u := startUpstream(t)
+	f := newFeed()
+	for _, tag := range testTags(t) {
+		f.tags <- tag
+	}
+	target, err := Start("test", "rtmp://"+u.address+"/live/test/johndoe", f.watch, Backoff{Min: 10 * time.Millisecond, Max: time.Second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Stop()
+
+	waitFor(t, "the tags upstream", func() bool {
+		connections := u.snapshot()
+		return len(connections) == 1 && len(connections[0].tags) == 4
+	})
+	r := u.snapshot()[0]
+	if r.app != "live/test" || r.name != "johndoe" {
+		t.Errorf("published %q to %q, expected johndoe to live/test", r.name, r.app)
+	}
+	if r.tags[0].Metadata == nil || r.tags[0].Metadata.Width != 1280 {
+		t.Errorf("first tag %+v, expected onMetaData with the width", r.tags[0])
+	}
+	if !r.tags[1].IsSequenceHeader() || !r.tags[2].IsKeyframe() {
+		t.Errorf("got %+v then %+v, expected a sequence header then a keyframe", r.tags[1].Video, r.tags[2].Video)
+	}
+	var timestamps []uint32
+	for _, tag := range r.tags {
+		timestamps = append(timestamps, tag.Timestamp)
+	}
+	if !reflect.DeepEqual(timestamps, []uint32{0, 0, 0, 40}) {
+		t.Errorf("timestamps = %v, expected the stream rebased to 0", timestamps)
+	}
+
+	status := target.Status()
+	if status.State != StateLive || status.Connections != 1 || status.Tags != 4 || status.URL != "rtmp://"+u.address+"/live/test/****" {
+		t.Errorf("status = %+v, expected live after 1 connection and 4 tags, without the key", status)
+	}
+}
+
+func TestTargetReconnects(t *testing.T) {
+	u := startUpstream(t)
+	u.rejects = 1
+	f := newFeed()
+	var mutex sync.Mutex
+	var states []State
+	target, err := Start("test", "rtmp://"+u.address+"/live/johndoe", f.watch, Backoff{Min: 10 * time.Millisecond, Max: time.Second}, func(status Status) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		states = append(states, status.State)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Stop()
+
+	// The refused publish closes the connection, which the next writes find
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		tags := testTags(t)
+		for i := 0; ; i++ {
+			tag := tags[min(i, 3)]
+			tag.Timestamp += uint32(i * 40)
+			select {
+			case f.tags <- tag:
+			case <-stop:
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	waitFor(t, "the second connection", func() bool {
+		connections := u.snapshot()
+		return len(connections) == 1 && len(connections[0].tags) > 0
+	})
+	status := target.Status()
+	if status.Connections != 2 || status.Failures != 1 || status.LastError == "" {
+		t.Errorf("status = %+v, expected 2 connections and 1 failure", status)
+	}
+	if len(f.sources) != 2 {
+		t.Errorf("watched %d times, expected once per connection", len(f.sources))
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !containsSequence(states, []State{StateLive, StateBackoff, StateWaiting, StateConnecting, StateLive}) {
+		t.Errorf("states = %v, expected to back off and reconnect", states)
+	}
+}
+
+// containsSequence reports whether sequence appears in states, in a row
+func containsSequence(states, sequence []State) bool {
+	for i := 0; i+len(sequence) <= len(states); i++ {
+		if reflect.DeepEqual(states[i:i+len(sequence)], sequence) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTargetStops(t *testing.T) {
+	f := newFeed()
+	target, err := Start("test", "rtmp://127.0.0.1:1/live/johndoe", f.watch, Backoff{Min: time.Hour, Max: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listens: the first attempt fails and backs off for an hour
+	f.tags <- testTags(t)[0]
+	waitFor(t, "the backoff", func() bool { return target.Status().State == StateBackoff })
+	target.Stop()
+	if status := target.Status(); status.State != StateStopped || status.Failures != 1 {
+		t.Errorf("status = %+v, expected stopped after 1 failure", status)
+	}
+
+	// A target whose stream has ended stops by itself
+	f.ended = true
+	target, err = Start("test", "rtmp://127.0.0.1:1/live/johndoe", f.watch, Backoff{Min: time.Hour, Max: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-target.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("target still running after its stream ended")
+	}
+
+	if _, err := Start("test", "http://example.com/live/key", f.watch, Backoff{}, nil); err == nil {
+		t.Error("Start() accepted an http URL")
+	}
+}
@@ -0,0 +1,47 @@
+package remux
+
+import (
+	"bytes"
+	"fmt"
+
+	"rtmp-server-poc/internal/codec"
+	"rtmp-server-poc/internal/flv"
+)
+
+// aacFrameSamples is the number of samples in an AAC frame
+const aacFrameSamples = 1024
+
+// AAC turns AAC frames in ADTS into FLV audio tags: an AAC sequence header
+// whenever the configuration changes, then raw frames
+type AAC struct {
+	config []byte
+}
+
+// Tags returns the FLV audio tags for ADTS data starting at timestamp, such
+// as the payload of an MPEG-TS PES packet, which may hold several frames.
+// A truncated or invalid frame ends the data.
+func (a *AAC) Tags(timestamp uint32, data []byte) ([]Tag, error) {
+	var tags []Tag
+	samples := 0
+	for len(data) > 0 {
+		header, err := codec.ParseADTSHeader(data)
+		if err != nil {
+			return tags, err
+		}
+		if header.FrameSize > len(data) {
+			return tags, fmt.Errorf("remux: truncated ADTS frame, %d of %d bytes", len(data), header.FrameSize)
+		}
+		frameTimestamp := timestamp + uint32(samples*1000/header.SampleRate())
+
+		if config := header.AudioSpecificConfig(); !bytes.Equal(config, a.config) {
+			a.config = config
+			tags = append(tags, Tag{Type: flv.TagTypeAudio, Timestamp: frameTimestamp, Data: append([]byte{0xaf, 0x00}, config...)})
+		}
+		frame := append([]byte{0xaf, 0x01}, data[header.HeaderSize:header.FrameSize]...)
+		tags = append(tags, Tag{Type: flv.TagTypeAudio, Timestamp: frameTimestamp, Data: frame})
+
+		samples += aacFrameSamples
+		data = data[header.FrameSize:]
+	}
+	return tags, nil
+}
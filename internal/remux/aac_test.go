@@ -0,0 +1,55 @@
+package remux
+
+import (
+	"bytes"
+	"testing"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// adtsFrame builds an ADTS frame of LC AAC with the given sampling
+// frequency index and payload
+func adtsFrame(sampleRateIndex byte, payload []byte) []byte {
+	size := 7 + len(payload)
+	header := []byte{0xff, 0xf1, 0x40 | sampleRateIndex<<2, 0x80 | byte(size>>11), byte(size >> 3), byte(size<<5) | 0x1f, 0xfc}
+	return append(header, payload...)
+}
+
+func TestAAC(t *testing.T) {
+	aac := &AAC{}
+
+	// Two 48 kHz frames in one PES payload
+	tags, err := aac.Tags(1000, append(adtsFrame(3, []byte{1, 2, 3}), adtsFrame(3, []byte{4, 5})...))
+	if err != nil {
+		t.Fatalf("Tags() error = %v", err)
+	}
+	expected := []Tag{
+		{flv.TagTypeAudio, 1000, []byte{0xaf, 0x00, 0x11, 0x90}},
+		{flv.TagTypeAudio, 1000, []byte{0xaf, 0x01, 1, 2, 3}},
+		{flv.TagTypeAudio, 1021, []byte{0xaf, 0x01, 4, 5}},
+	}
+	if len(tags) != len(expected) {
+		t.Fatalf("got %d tags, expected %d", len(tags), len(expected))
+	}
+	for i := range tags {
+		if tags[i].Timestamp != expected[i].Timestamp || !bytes.Equal(tags[i].Data, expected[i].Data) {
+			t.Errorf("tag %d = %+v, expected %+v", i, tags[i], expected[i])
+		}
+	}
+
+	// The sequence header is only sent again when the configuration changes
+	tags, _ = aac.Tags(2000, adtsFrame(3, []byte{6}))
+	if len(tags) != 1 {
+		t.Errorf("got %d tags for a frame of the same configuration, expected 1", len(tags))
+	}
+	tags, _ = aac.Tags(3000, adtsFrame(4, []byte{7}))
+	if len(tags) != 2 || !bytes.Equal(tags[0].Data, []byte{0xaf, 0x00, 0x12, 0x10}) {
+		t.Errorf("tags for a 44.1 kHz frame = %+v, expected a new sequence header", tags)
+	}
+
+	// A truncated frame ends the data, after the complete ones
+	truncated := append(adtsFrame(4, []byte{8}), adtsFrame(4, []byte{9, 9})[:8]...)
+	if tags, err = aac.Tags(4000, truncated); err == nil || len(tags) != 1 {
+		t.Errorf("Tags() = %d tags, %v for a truncated frame", len(tags), err)
+	}
+}
@@ -0,0 +1,37 @@
+package remux
+
+import (
+	"encoding/binary"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// Opus turns Opus packets into Enhanced RTMP audio tags, after a sequence
+// start describing them
+type Opus struct {
+	Channels int
+	started  bool
+}
+
+// Tags returns the FLV audio tags for an Opus packet
+func (o *Opus) Tags(timestamp uint32, packet []byte) []Tag {
+	var tags []Tag
+	if !o.started {
+		tags = append(tags, Tag{Type: flv.TagTypeAudio, Timestamp: timestamp, Data: o.sequenceStart()})
+		o.started = true
+	}
+	data := append([]byte{0x91, 'O', 'p', 'u', 's'}, packet...)
+	return append(tags, Tag{Type: flv.TagTypeAudio, Timestamp: timestamp, Data: data})
+}
+
+// sequenceStart returns the Opus sequence start, whose OpusHead describes
+// 48 kHz Opus with the stream's channels
+func (o *Opus) sequenceStart() []byte {
+	data := []byte{0x90, 'O', 'p', 'u', 's'}
+	data = append(data, "OpusHead"...)
+	data = append(data, 1, byte(o.Channels)) // version, channels
+	data = binary.LittleEndian.AppendUint16(data, 0)
+	data = binary.LittleEndian.AppendUint32(data, 48000)
+	data = binary.LittleEndian.AppendUint16(data, 0) // output gain
+	return append(data, 0)                           // channel mapping family
+}
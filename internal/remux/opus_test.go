@@ -0,0 +1,32 @@
+package remux
+
+import (
+	"bytes"
+	"testing"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+func TestOpus(t *testing.T) {
+	opus := &Opus{Channels: 2}
+	tags := opus.Tags(20, []byte{0xfc, 0xff})
+	if len(tags) != 2 {
+		t.Fatalf("got %d tags, expected a sequence start and a frame", len(tags))
+	}
+
+	header, err := flv.ParseAudioHeader(tags[0].Data)
+	if err != nil || !header.IsSequenceHeader() || header.Codec() != "opus" {
+		t.Errorf("sequence start header = %+v, %v", header, err)
+	}
+	if head := tags[0].Data[header.PayloadOffset:]; len(head) != 19 || string(head[:8]) != "OpusHead" || head[9] != 2 {
+		t.Errorf("OpusHead = %x", head)
+	}
+
+	header, err = flv.ParseAudioHeader(tags[1].Data)
+	if err != nil || header.IsSequenceHeader() || header.Codec() != "opus" || !bytes.Equal(tags[1].Data[header.PayloadOffset:], []byte{0xfc, 0xff}) {
+		t.Errorf("frame header = %+v, %v", header, err)
+	}
+	if tags := opus.Tags(40, []byte{0xfc}); len(tags) != 1 || tags[0].Timestamp != 40 {
+		t.Errorf("later packet tags = %+v, expected only the frame", tags)
+	}
+}
@@ -0,0 +1,85 @@
+// Package remux turns elementary streams into FLV tags, for the ingest paths
+// other than RTMP: H.264 access units in Annex B, AAC frames in ADTS and
+// Opus packets, as WebRTC and MPEG-TS carry them.
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"rtmp-server-poc/internal/codec"
+	"rtmp-server-poc/internal/flv"
+)
+
+// H.264 NAL unit types handled by AVC
+const (
+	naluTypeIDR = 5
+	naluTypeSPS = 7
+	naluTypePPS = 8
+	naluTypeAUD = 9
+)
+
+// Tag is the payload of an FLV tag and its timestamp
+type Tag struct {
+	Type      byte // flv.TagTypeAudio or flv.TagTypeVideo
+	Timestamp uint32
+	Data      []byte
+}
+
+// AVC turns H.264 access units in Annex B, with the parameter sets in band,
+// into FLV video tags: an AVC sequence header whenever the parameter sets
+// change, then AVCC frames
+type AVC struct {
+	sps, pps   []byte
+	configured bool // a sequence header has been sent
+}
+
+// Tags returns the FLV video tags for an access unit decoded at timestamp
+// and presented compositionTime milliseconds later. Frames before the first
+// keyframe with parameter sets cannot be decoded and are dropped.
+func (a *AVC) Tags(timestamp uint32, compositionTime int32, frame []byte) []Tag {
+	var nalus [][]byte
+	keyframe, changed := false, false
+	for _, nalu := range codec.SplitAnnexB(frame) {
+		switch nalu[0] & 0x1f {
+		case naluTypeSPS:
+			changed = changed || !bytes.Equal(nalu, a.sps)
+			a.sps = bytes.Clone(nalu)
+		case naluTypePPS:
+			changed = changed || !bytes.Equal(nalu, a.pps)
+			a.pps = bytes.Clone(nalu)
+		case naluTypeAUD:
+		default:
+			keyframe = keyframe || nalu[0]&0x1f == naluTypeIDR
+			nalus = append(nalus, nalu)
+		}
+	}
+
+	var tags []Tag
+	if keyframe && a.sps != nil && a.pps != nil && (changed || !a.configured) {
+		params := codec.AVCParameterSets{SPS: [][]byte{a.sps}, PPS: [][]byte{a.pps}, LengthSize: 4}
+		record, err := params.Record()
+		if err != nil {
+			// A malformed SPS cannot be described; drop the frame
+			return nil
+		}
+		data := append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, record...)
+		tags = append(tags, Tag{Type: flv.TagTypeVideo, Timestamp: timestamp, Data: data})
+		a.configured = true
+	}
+	if !a.configured || len(nalus) == 0 {
+		return tags
+	}
+
+	frameType := byte(0x27)
+	if keyframe {
+		frameType = 0x17
+	}
+	// The composition time is a signed 24 bit integer
+	data := []byte{frameType, 0x01, byte(compositionTime >> 16), byte(compositionTime >> 8), byte(compositionTime)}
+	for _, nalu := range nalus {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nalu)))
+		data = append(data, nalu...)
+	}
+	return append(tags, Tag{Type: flv.TagTypeVideo, Timestamp: timestamp, Data: data})
+}
@@ -0,0 +1,74 @@
+package remux
+
+import (
+	"bytes"
+	"testing"
+
+	"rtmp-server-poc/internal/codec"
+	"rtmp-server-poc/internal/flv"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00}
+)
+
+// annexB joins NAL units with start codes
+func annexB(nalus ...[]byte) []byte {
+	var frame []byte
+	for _, nalu := range nalus {
+		frame = append(append(frame, 0x00, 0x00, 0x00, 0x01), nalu...)
+	}
+	return frame
+}
+
+func TestAVC(t *testing.T) {
+	aud := []byte{0x09, 0xf0}
+	slice := []byte{0x41, 0x9a, 0x02}
+	otherSPS := []byte{0x67, 0x64, 0x00, 0x1f, 0xac}
+
+	avc := &AVC{}
+	steps := []struct {
+		name     string
+		frame    []byte
+		expected []string // tag kinds: "header", "key" or "inter"
+	}{
+		{"Inter frame before a keyframe", annexB(slice), nil},
+		{"Keyframe without parameter sets", annexB(testIDR), nil},
+		{"First keyframe", annexB(aud, testSPS, testPPS, testIDR), []string{"header", "key"}},
+		{"Inter frame", annexB(aud, slice), []string{"inter"}},
+		{"Keyframe with the same parameter sets", annexB(testSPS, testPPS, testIDR), []string{"key"}},
+		{"Keyframe with new parameter sets", annexB(otherSPS, testPPS, testIDR), []string{"header", "key"}},
+		{"Parameter sets alone", annexB(testSPS, testPPS), nil},
+		{"Keyframe with a 1 byte SPS", annexB([]byte{0x67}, testPPS, testIDR), nil},
+	}
+
+	for i, step := range steps {
+		tags := avc.Tags(uint32(i*40), 80, step.frame)
+		if len(tags) != len(step.expected) {
+			t.Fatalf("%s: got %d tags, expected %v", step.name, len(tags), step.expected)
+		}
+		for j, data := range tags {
+			tag, err := flv.ParseTag(data.Type, data.Timestamp, data.Data)
+			if err != nil || tag.Video == nil || tag.Timestamp != uint32(i*40) {
+				t.Fatalf("%s: tag %d = %+v, %v", step.name, j, data, err)
+			}
+			switch step.expected[j] {
+			case "header":
+				params, err := codec.ParseAVCParameterSets(tag.Data[tag.Video.PayloadOffset:])
+				if err != nil || !bytes.Equal(params.SPS[0], avc.sps) || !bytes.Equal(params.PPS[0], testPPS) {
+					t.Errorf("%s: sequence header = %x", step.name, tag.Data)
+				}
+			case "key", "inter":
+				if !tag.Video.IsCodedFrame() || tag.IsKeyframe() != (step.expected[j] == "key") || tag.Video.CompositionTime != 80 {
+					t.Errorf("%s: tag %d = %x, expected a %s frame", step.name, j, tag.Data, step.expected[j])
+				}
+				// Only slices are left, with 4 byte lengths
+				if payload := tag.Data[tag.Video.PayloadOffset:]; payload[4]&0x1f != naluTypeIDR && payload[4]&0x1f != 1 {
+					t.Errorf("%s: frame starts with NAL unit type %d", step.name, payload[4]&0x1f)
+				}
+			}
+		}
+	}
+}
@@ -1,34 +1,45 @@
 package rtmp
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"sync"
-	"time"
 
 	"github.com/yutopp/go-rtmp"
 	"github.com/yutopp/go-rtmp/message"
 
 	"rtmp-server-poc/internal/auth"
 	"rtmp-server-poc/internal/config"
-	"rtmp-server-poc/internal/flv"
 	"rtmp-server-poc/internal/models"
 	"rtmp-server-poc/internal/stream"
 )
 
+// statusChunkStreamID is the chunk stream used for onStatus commands
+const statusChunkStreamID = 5
+
+// statusPublishRejected tells the client its stream was refused by policy
+const statusPublishRejected message.NetStreamOnStatusCode = "NetStream.Publish.Rejected"
+
 // Each connection gets its own handler instance
 // So we need to store the connection info for this handler instance
 // Since each connection gets its own handler instance (from main.go)
 
 // Handler implements the RTMP handler interface
 type Handler struct {
-	streamProcess *stream.StreamProcess
-	streamManager *stream.Manager
-	config        config.Config
-	authorizer    *auth.Authorizer
-	flvWriter     *flv.Writer
+	conn           *rtmp.Conn
+	streamProcess  *stream.StreamProcess
+	streamManager  *stream.Manager
+	config         config.Config
+	authorizer     *auth.Authorizer
+	publisher      *stream.Publisher
+	publishContext *rtmp.StreamContext
 	connectionInfo *models.ConnectionInfo
+	stopPlay       context.CancelFunc // stops sending the stream played, nil when none
 	connMutex      sync.RWMutex
 }
 
@@ -43,34 +54,35 @@ func NewHandler(manager *stream.Manager, cfg config.Config) *Handler {
 
 // RTMP handler methods
 func (h *Handler) OnServe(conn *rtmp.Conn) {
+	h.conn = conn
 	log.Printf("New RTMP connection established")
 }
 
 func (h *Handler) OnConnect(timestamp uint32, cmd *message.NetConnectionConnect) error {
 	log.Printf("RTMP connection from %s", cmd.Command.TCURL)
-	
+
 	// Extract variables from TCURL
 	vars, ok := h.authorizer.ExtractVariables(cmd.Command.TCURL)
 	if !ok {
 		log.Printf("Failed to extract variables from TCURL '%s'", cmd.Command.TCURL)
 		return fmt.Errorf("failed to extract variables from TCURL: %s", cmd.Command.TCURL)
 	}
-	
+
 	// Check if TCURL is authorized
 	if !h.authorizer.IsAuthorized(cmd.Command.TCURL) {
 		log.Printf("Unauthorized TCURL '%s' in OnConnect", cmd.Command.TCURL)
 		return fmt.Errorf("unauthorized TCURL: %s", cmd.Command.TCURL)
 	}
-	
+
 	// Store connection information for this handler instance
 	h.connMutex.Lock()
 	h.connectionInfo = &models.ConnectionInfo{
-		App:     cmd.Command.App,
-		TCURL:   cmd.Command.TCURL,
-		Vars:    vars,
+		App:   cmd.Command.App,
+		TCURL: cmd.Command.TCURL,
+		Vars:  vars,
 	}
 	h.connMutex.Unlock()
-	
+
 	log.Printf("RTMP connection authorized for path: %s", cmd.Command.TCURL)
 	return nil
 }
@@ -80,8 +92,26 @@ func (h *Handler) OnCreateStream(timestamp uint32, cmd *message.NetConnectionCre
 }
 
 func (h *Handler) OnPlay(ctx *rtmp.StreamContext, timestamp uint32, cmd *message.NetStreamPlay) error {
-	log.Printf("Play connection refused: %s", cmd.StreamName)
-	return fmt.Errorf("play connections are not allowed")
+	if !h.config.RTMPPlay {
+		log.Printf("Play connection refused: %s", cmd.StreamName)
+		return fmt.Errorf("play connections are not allowed")
+	}
+
+	h.connMutex.RLock()
+	connInfo := h.connectionInfo
+	h.connMutex.RUnlock()
+	if connInfo == nil {
+		return fmt.Errorf("play before connect")
+	}
+
+	// Players are authorized as publishers are, the stream name standing
+	// for the publishing name
+	name, _ := auth.SplitPublishingName(cmd.StreamName)
+	if err := h.authorizer.ValidateAuthentication(connInfo.Vars, name); err != nil {
+		log.Printf("Play refused for TCURL %s: %v", connInfo.TCURL, err)
+		return err
+	}
+	return h.play(ctx, timestamp, connInfo, name)
 }
 
 func (h *Handler) OnPublish(ctx *rtmp.StreamContext, timestamp uint32, cmd *message.NetStreamPublish) error {
@@ -91,49 +121,142 @@ func (h *Handler) OnPublish(ctx *rtmp.StreamContext, timestamp uint32, cmd *mess
 	h.connMutex.RLock()
 	connInfo := h.connectionInfo
 	h.connMutex.RUnlock()
-	
-	if connInfo != nil {
-		// Use the stored variables for authentication
-		if err := h.authorizer.ValidateAuthentication(connInfo.Vars, cmd.PublishingName); err != nil {
-			log.Printf("Authentication failed for TCURL access %s: %v", connInfo.TCURL, err)
-			return err
-		}
 
-		log.Printf("Publishing to TCURL: %s", connInfo.TCURL)
+	if connInfo == nil {
+		return fmt.Errorf("publish before connect")
+	}
+
+	// The publishing name may carry options, e.g. "johndoe?role=backup"
+	publishingName, query := auth.SplitPublishingName(cmd.PublishingName)
+
+	// Use the stored variables for authentication
+	if err := h.authorizer.ValidateAuthentication(connInfo.Vars, publishingName); err != nil {
+		log.Printf("Authentication failed for TCURL access %s: %v", connInfo.TCURL, err)
+		return err
 	}
 
-	streamProcess, err := h.streamManager.GetOrCreateStream(cmd.PublishingName, h.config)
+	role, err := publisherRole(connInfo, query)
 	if err != nil {
-		log.Printf("Failed to create stream for TCURL %s: %v", connInfo.TCURL, err)
+		log.Printf("Invalid publisher role for TCURL %s: %v", connInfo.TCURL, err)
+		return err
+	}
+
+	log.Printf("Publishing to TCURL: %s as %s", connInfo.TCURL, role)
+
+	// The stream owns the FLV feed into FFmpeg; a reconnecting publisher
+	// continues the same feed with rebased timestamps
+	streamProcess, publisher, err := h.streamManager.Publish(publishingName, appName(connInfo), role, h.evict, h.config)
+	if err != nil {
+		log.Printf("Publish refused for TCURL %s: %v", connInfo.TCURL, err)
+		if errors.Is(err, stream.ErrPublisherExists) {
+			h.notifyStatus(ctx, timestamp, message.NetStreamOnStatusCodePublishBadName, "Stream name is already being published.")
+		}
 		return err
 	}
 
 	h.streamProcess = streamProcess
-	h.flvWriter = flv.NewWriter(streamProcess.Stdin())
+	h.publisher = publisher
+	h.publishContext = ctx
 	log.Printf("Stream started for TCURL: %s", connInfo.TCURL)
 	return nil
 }
 
+// publisherRole picks the ingest role from, in order, the publishing name
+// query, the TCURL query and a {role} pattern variable
+func publisherRole(connInfo *models.ConnectionInfo, query url.Values) (stream.Role, error) {
+	role := query.Get("role")
+	if role == "" {
+		role = auth.QueryFromTCURL(connInfo.TCURL).Get("role")
+	}
+	if role == "" {
+		role, _ = connInfo.GetVar("role")
+	}
+	return stream.ParseRole(role)
+}
+
+// appName returns the app a connection publishes to, preferring the {app}
+// pattern variable over the RTMP app
+func appName(connInfo *models.ConnectionInfo) string {
+	if app, ok := connInfo.GetVar("app"); ok {
+		return app
+	}
+	return connInfo.App
+}
+
 func (h *Handler) OnClose() {
 	if h.streamProcess != nil {
 		log.Printf("Connection closed for user: %s", h.streamProcess.Username())
 
-		go func() {
-			time.Sleep(h.config.ReconnectDelay)
-
-			if h.streamProcess.IsActive() {
-				log.Printf("No reconnection detected for user %s, stopping stream", h.streamProcess.Username())
-				h.streamProcess.Stop(h.config)
-			}
-		}()
+		// The stream waits ReconnectDelay for the publisher before stopping
+		h.publisher.Close(h.config)
 	}
-	
+
 	// Clean up connection information
 	h.connMutex.Lock()
 	h.connectionInfo = nil
+	if h.stopPlay != nil {
+		h.stopPlay()
+	}
 	h.connMutex.Unlock()
 }
 
+// evict drops the connection after another publisher took over its stream
+func (h *Handler) evict() {
+	log.Printf("Publisher replaced by a newer connection, closing: %s", h.GetTCURL())
+	if h.conn != nil {
+		h.conn.Close()
+	}
+}
+
+// notifyStatus sends a NetStream.onStatus error to the client. go-rtmp only
+// ever answers a refused publish with NetStream.Publish.Failed, so more
+// specific codes such as BadName are sent ahead of it.
+func (h *Handler) notifyStatus(ctx *rtmp.StreamContext, timestamp uint32, code message.NetStreamOnStatusCode, description string) {
+	h.writeStatus(ctx, timestamp, message.NetStreamOnStatusLevelError, code, description)
+}
+
+// writeStatus sends a NetStream.onStatus command to the client
+func (h *Handler) writeStatus(ctx *rtmp.StreamContext, timestamp uint32, level message.NetStreamOnStatusLevel, code message.NetStreamOnStatusCode, description string) {
+	if h.conn == nil {
+		return
+	}
+
+	body := new(bytes.Buffer)
+	encoder := message.NewAMFEncoder(body, message.EncodingTypeAMF0)
+	if err := message.EncodeBodyAnyValues(encoder, &message.NetStreamOnStatus{
+		InfoObject: message.NetStreamOnStatusInfoObject{
+			Level:       level,
+			Code:        code,
+			Description: description,
+		},
+	}); err != nil {
+		log.Printf("Failed to encode onStatus %s: %v", code, err)
+		return
+	}
+
+	if err := h.conn.Write(context.Background(), statusChunkStreamID, timestamp, &rtmp.ChunkMessage{
+		StreamID: ctx.StreamID,
+		Message: &message.CommandMessage{
+			CommandName: "onStatus",
+			Encoding:    message.EncodingTypeAMF0,
+			Body:        body,
+		},
+	}); err != nil {
+		log.Printf("Failed to send onStatus %s: %v", code, err)
+	}
+}
+
+// rejectOnPolicy tells the client when a write error means its stream was
+// refused by the metadata or video policy. The error is returned as is, and
+// ends the connection.
+func (h *Handler) rejectOnPolicy(timestamp uint32, err error) error {
+	if errors.Is(err, stream.ErrMetadataRejected) || errors.Is(err, stream.ErrCodecRejected) {
+		log.Printf("Publish rejected for TCURL %s: %v", h.GetTCURL(), err)
+		h.notifyStatus(h.publishContext, timestamp, statusPublishRejected, err.Error())
+	}
+	return err
+}
+
 // Other RTMP handler methods (empty implementations)
 func (h *Handler) OnReleaseStream(timestamp uint32, cmd *message.NetConnectionReleaseStream) error {
 	return nil
@@ -155,33 +278,35 @@ func (h *Handler) OnUnknownDataMessage(timestamp uint32, data *message.DataMessa
 
 // Required RTMP handler methods
 func (h *Handler) OnSetDataFrame(timestamp uint32, data *message.NetStreamSetDataFrame) error {
-	if h.flvWriter != nil {
-		// Write metadata as FLV script tag
-		return h.flvWriter.WriteScript(timestamp, data.Payload)
+	if h.publisher != nil {
+		// Write metadata as FLV script tag; onMetaData is checked against
+		// the app's metadata policy and may end the publish
+		return h.rejectOnPolicy(timestamp, h.publisher.WriteScript(timestamp, data.Payload))
 	}
 	return nil
 }
 
 func (h *Handler) OnAudio(timestamp uint32, payload io.Reader) error {
-	if h.flvWriter != nil {
+	if h.publisher != nil {
 		// Read audio data and write as FLV audio tag
 		data, err := io.ReadAll(payload)
 		if err != nil {
 			return err
 		}
-		return h.flvWriter.WriteAudio(timestamp, data)
+		return h.publisher.WriteAudio(timestamp, data)
 	}
 	return nil
 }
 
 func (h *Handler) OnVideo(timestamp uint32, payload io.Reader) error {
-	if h.flvWriter != nil {
+	if h.publisher != nil {
 		// Read video data and write as FLV video tag
 		data, err := io.ReadAll(payload)
 		if err != nil {
 			return err
 		}
-		return h.flvWriter.WriteVideo(timestamp, data)
+		// The video policy may refuse the codec and end the publish
+		return h.rejectOnPolicy(timestamp, h.publisher.WriteVideo(timestamp, data))
 	}
 	return nil
 }
@@ -231,4 +356,4 @@ func (h *Handler) GetVars() map[string]string {
 		return connInfo.GetVars()
 	}
 	return make(map[string]string)
-}
\ No newline at end of file
+}
@@ -1,10 +1,15 @@
 package rtmp
 
 import (
+	"reflect"
 	"testing"
 
+	"github.com/yutopp/go-rtmp/message"
+
 	"rtmp-server-poc/internal/auth"
+	"rtmp-server-poc/internal/config"
 	"rtmp-server-poc/internal/models"
+	"rtmp-server-poc/internal/stream"
 )
 
 func TestExtractPathFromTCURL(t *testing.T) {
@@ -221,4 +226,112 @@ func TestGetVar(t *testing.T) {
 			}
 		})
 	}
-} 
\ No newline at end of file
+} 
+
+func TestPublisherRole(t *testing.T) {
+	tests := []struct {
+		name           string
+		tcurl          string
+		publishingName string
+		vars           map[string]string
+		expectedName   string
+		expectedRole   stream.Role
+		expectError    bool
+	}{
+		{
+			name:           "Default role is primary",
+			tcurl:          "rtmp://localhost/live/test/johndoe",
+			publishingName: "johndoe",
+			expectedName:   "johndoe",
+			expectedRole:   stream.RolePrimary,
+		},
+		{
+			name:           "Role in publishing name query",
+			tcurl:          "rtmp://localhost/live/test/johndoe",
+			publishingName: "johndoe?role=backup",
+			expectedName:   "johndoe",
+			expectedRole:   stream.RoleBackup,
+		},
+		{
+			name:           "Role in TCURL query",
+			tcurl:          "rtmp://localhost/live/test/johndoe?role=backup",
+			publishingName: "johndoe",
+			expectedName:   "johndoe",
+			expectedRole:   stream.RoleBackup,
+		},
+		{
+			name:           "Role from pattern variable",
+			tcurl:          "rtmp://localhost/live/test/johndoe/backup",
+			publishingName: "johndoe",
+			vars:           map[string]string{"role": "backup"},
+			expectedName:   "johndoe",
+			expectedRole:   stream.RoleBackup,
+		},
+		{
+			name:           "Unknown role",
+			tcurl:          "rtmp://localhost/live/test/johndoe",
+			publishingName: "johndoe?role=tertiary",
+			expectedName:   "johndoe",
+			expectError:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, query := auth.SplitPublishingName(tt.publishingName)
+			if name != tt.expectedName {
+				t.Errorf("SplitPublishingName(%q) name = %q, expected %q", tt.publishingName, name, tt.expectedName)
+			}
+			role, err := publisherRole(&models.ConnectionInfo{TCURL: tt.tcurl, Vars: tt.vars}, query)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("publisherRole() error = %v, expectError %v", err, tt.expectError)
+			}
+			if !tt.expectError && role != tt.expectedRole {
+				t.Errorf("publisherRole() = %q, expected %q", role, tt.expectedRole)
+			}
+		})
+	}
+}
+
+func TestResponsePresetAdvertisesFourCCs(t *testing.T) {
+	data := NewResponsePreset().GetServerConnectResultData()
+	fourCCs, ok := data["fourCcList"].([]interface{})
+	if !ok {
+		t.Fatalf("fourCcList = %#v, expected a list", data["fourCcList"])
+	}
+	expected := []interface{}{"avc1", "hvc1", "av01", "vp09"}
+	if !reflect.DeepEqual(fourCCs, expected) {
+		t.Errorf("fourCcList = %v, expected %v", fourCCs, expected)
+	}
+}
+
+func TestOnPlayAuthorization(t *testing.T) {
+	tests := []struct {
+		name       string
+		rtmpPlay   bool
+		tcurl      string // empty before connect
+		streamName string
+	}{
+		{"Play disabled", false, "rtmp://localhost/live/test/johndoe", "johndoe"},
+		{"Play before connect", true, "", "johndoe"},
+		{"Stream name not authorized", true, "rtmp://localhost/live/test/johndoe", "alice"},
+		{"Empty stream name", true, "rtmp://localhost/live/test/johndoe", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.RTMPPlay = tt.rtmpPlay
+			manager := stream.NewManager()
+			h := NewHandler(manager, cfg)
+			if tt.tcurl != "" {
+				if err := h.OnConnect(0, &message.NetConnectionConnect{Command: message.NetConnectionConnectCommand{App: "live", TCURL: tt.tcurl}}); err != nil {
+					t.Fatalf("OnConnect() error = %v", err)
+				}
+			}
+			if err := h.OnPlay(nil, 0, &message.NetStreamPlay{StreamName: tt.streamName}); err == nil {
+				t.Error("OnPlay() = nil, expected the player refused")
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/yutopp/go-rtmp"
+	"github.com/yutopp/go-rtmp/message"
+
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/models"
+	"rtmp-server-poc/internal/stream"
+)
+
+// Chunk stream IDs of the media sent to players
+const (
+	playAudioChunkStreamID = 6
+	playVideoChunkStreamID = 7
+	playDataChunkStreamID  = 8
+)
+
+// Status codes sent to players that go-rtmp has no constants for
+const (
+	statusPlayStreamNotFound  message.NetStreamOnStatusCode = "NetStream.Play.StreamNotFound"
+	statusPlayUnpublishNotify message.NetStreamOnStatusCode = "NetStream.Play.UnpublishNotify"
+)
+
+// play starts sending an authorized player the live stream name. The player
+// gets the stream as a viewer does: the metadata, the sequence headers and
+// the current GOP first, then skipping to the next keyframe when it falls
+// behind.
+func (h *Handler) play(ctx *rtmp.StreamContext, timestamp uint32, connInfo *models.ConnectionInfo, name string) error {
+	sp, ok := h.streamManager.GetStream(name)
+	if !ok || !sp.IsActive() {
+		h.notifyStatus(ctx, timestamp, statusPlayStreamNotFound, "Stream not found.")
+		return fmt.Errorf("stream %s not found", name)
+	}
+	viewer, err := sp.Watch()
+	if err != nil {
+		h.notifyStatus(ctx, timestamp, statusPlayStreamNotFound, "Stream not found.")
+		return err
+	}
+
+	h.connMutex.Lock()
+	if h.stopPlay != nil {
+		h.connMutex.Unlock()
+		viewer.Close()
+		return errors.New("play already started")
+	}
+	playCtx, cancel := context.WithCancel(context.Background())
+	h.stopPlay = cancel
+	h.connMutex.Unlock()
+
+	// go-rtmp answers with NetStream.Play.Start once this returns, which may
+	// be after the first tags; players expect it first
+	h.writeStatus(ctx, timestamp, message.NetStreamOnStatusLevelStatus, message.NetStreamOnStatusCodePlayStart, "Started playing "+name+".")
+	log.Printf("Playing stream %s to %s", name, connInfo.TCURL)
+	go h.sendStream(playCtx, ctx, viewer)
+	return nil
+}
+
+// sendStream writes the viewer's tags to the player until the stream ends,
+// the connection closes or the player falls too far behind to be written to
+func (h *Handler) sendStream(ctx context.Context, streamCtx *rtmp.StreamContext, viewer *stream.Viewer) {
+	defer viewer.Close()
+	for {
+		tag, ok := viewer.Next(ctx)
+		if !ok {
+			if ctx.Err() == nil {
+				h.writeStatus(streamCtx, 0, message.NetStreamOnStatusLevelStatus, statusPlayUnpublishNotify, "Stream ended.")
+				h.conn.Close()
+			}
+			return
+		}
+		csid, msg := playMessage(tag)
+		if msg == nil {
+			continue
+		}
+		if err := h.conn.Write(ctx, csid, tag.Timestamp, &rtmp.ChunkMessage{StreamID: streamCtx.StreamID, Message: msg}); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to send stream to player, closing: %v", err)
+				h.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// playMessage returns the RTMP message carrying a tag to players, and its
+// chunk stream. Script tags other than onMetaData are not sent.
+func playMessage(tag flv.Tag) (int, message.Message) {
+	switch tag.Type {
+	case flv.TagTypeAudio:
+		return playAudioChunkStreamID, &message.AudioMessage{Payload: bytes.NewReader(tag.Data)}
+	case flv.TagTypeVideo:
+		return playVideoChunkStreamID, &message.VideoMessage{Payload: bytes.NewReader(tag.Data)}
+	case flv.TagTypeScript:
+		body, ok := scriptBody(tag.Data, "onMetaData")
+		if !ok {
+			return 0, nil
+		}
+		return playDataChunkStreamID, &message.DataMessage{
+			Name:     "onMetaData",
+			Encoding: message.EncodingTypeAMF0,
+			Body:     bytes.NewReader(body),
+		}
+	}
+	return 0, nil
+}
+
+// scriptBody returns the values of script data following its name, an AMF0
+// string, when the name is the one given
+func scriptBody(data []byte, name string) ([]byte, bool) {
+	if len(data) < 3 || data[0] != 0x02 {
+		return nil, false
+	}
+	end := 3 + int(binary.BigEndian.Uint16(data[1:3]))
+	if len(data) < end || string(data[3:end]) != name {
+		return nil, false
+	}
+	return data[end:], true
+}
@@ -0,0 +1,24 @@
+package rtmp
+
+import (
+	"github.com/yutopp/go-rtmp"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// SupportedFourCCs are the Enhanced RTMP video codecs accepted for ingest
+var SupportedFourCCs = []flv.FourCC{flv.FourCCAVC, flv.FourCCHEVC, flv.FourCCAV1, flv.FourCCVP9}
+
+// NewResponsePreset returns the connect response preset advertising our
+// Enhanced RTMP support. go-rtmp encodes the connect result properties from
+// a fixed struct, so fourCcList is sent in the information object's data.
+func NewResponsePreset() rtmp.ResponsePreset {
+	fourCCs := make([]interface{}, len(SupportedFourCCs))
+	for i, fourCC := range SupportedFourCCs {
+		fourCCs[i] = string(fourCC)
+	}
+
+	preset := rtmp.NewDefaultResponsePreset()
+	preset.ServerConnectResultData["fourCcList"] = fourCCs
+	return preset
+}
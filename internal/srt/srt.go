@@ -0,0 +1,210 @@
+// Package srt ingests live streams over SRT: encoders connect in caller mode
+// to the listener and send MPEG-TS, naming the stream in their streamid as
+// the SRT access control syntax does, "#!::r=live/app/user,m=publish". The
+// resource is authorized like an RTMP URL, and the stream is fed to the same
+// pipeline as RTMP publishers.
+package srt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	gosrt "github.com/datarhei/gosrt"
+
+	"rtmp-server-poc/internal/auth"
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/mpegts"
+	"rtmp-server-poc/internal/stream"
+)
+
+// streamIDPrefix starts streamids in the SRT access control syntax
+const streamIDPrefix = "#!::"
+
+// request is what an accepted connection publishes
+type request struct {
+	name string // the publishing name
+	role stream.Role
+	app  string
+}
+
+// publisher receives a connection's FLV tags, as a stream.Publisher does
+type publisher interface {
+	mpegts.Writer
+	// Close detaches the publisher once the connection ends
+	Close()
+}
+
+// rejection is an error refusing a connection with an SRT rejection reason
+type rejection struct {
+	reason gosrt.RejectionReason
+	err    error
+}
+
+func (r *rejection) Error() string {
+	return r.err.Error()
+}
+
+// reject returns a rejection with the given reason
+func reject(reason gosrt.RejectionReason, format string, args ...any) error {
+	return &rejection{reason: reason, err: fmt.Errorf(format, args...)}
+}
+
+// Server accepts SRT publishers
+type Server struct {
+	manager    *stream.Manager
+	config     config.Config
+	authorizer *auth.Authorizer
+
+	// attach starts publishing an accepted request, to the stream manager
+	// but for tests
+	attach func(req request) (publisher, error)
+}
+
+// NewServer creates a server publishing to the manager's streams
+func NewServer(manager *stream.Manager, cfg config.Config) *Server {
+	s := &Server{
+		manager:    manager,
+		config:     cfg,
+		authorizer: auth.NewAuthorizer(cfg.AuthorizedPatterns),
+	}
+	s.attach = s.attachStream
+	return s
+}
+
+// Listen opens an SRT listener on a UDP address
+func Listen(address string) (gosrt.Listener, error) {
+	return gosrt.Listen("srt", address, gosrt.DefaultConfig())
+}
+
+// Serve accepts connections on the listener until it is closed
+func (s *Server) Serve(ln gosrt.Listener) error {
+	for {
+		req, err := ln.Accept2()
+		if err != nil {
+			if errors.Is(err, gosrt.ErrListenerClosed) {
+				return nil
+			}
+			return err
+		}
+		s.handle(req)
+	}
+}
+
+// handle authorizes a connection request and, once accepted, copies its
+// transport stream to the stream in the background
+func (s *Server) handle(req gosrt.ConnRequest) {
+	streamID := req.StreamId()
+	p, err := s.publish(streamID)
+	if err != nil {
+		log.Printf("SRT publish from %s refused (streamid %q): %v", req.RemoteAddr(), streamID, err)
+		reason := gosrt.REJX_ISE
+		var r *rejection
+		if errors.As(err, &r) {
+			reason = r.reason
+		}
+		req.Reject(reason)
+		return
+	}
+	conn, err := req.Accept()
+	if err != nil {
+		log.Printf("SRT connection from %s failed: %v", req.RemoteAddr(), err)
+		p.Close()
+		return
+	}
+
+	log.Printf("SRT publisher %s started stream (streamid %q)", conn.RemoteAddr(), streamID)
+	go func() {
+		defer p.Close()
+		defer conn.Close()
+		// Writes through an evicted publisher fail, which ends the copy
+		if err := mpegts.Copy(p, conn); err != nil {
+			log.Printf("SRT publisher %s stopped: %v", conn.RemoteAddr(), err)
+			return
+		}
+		log.Printf("SRT publisher %s disconnected", conn.RemoteAddr())
+	}()
+}
+
+// publish authorizes a streamid and attaches its publisher
+func (s *Server) publish(streamID string) (publisher, error) {
+	req, err := s.authorize(streamID)
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.attach(req)
+	if errors.Is(err, stream.ErrPublisherExists) {
+		return nil, reject(gosrt.REJX_CONFLICT, "%v", err)
+	}
+	return p, err
+}
+
+// authorize maps a streamid onto the authorized patterns, the resource
+// standing for the TCURL path and its last segment for the publishing name,
+// which may carry a role ("live/app/johndoe?role=backup"). A u key, when
+// given, is the publishing name instead. A streamid without the access
+// control syntax is the resource itself.
+func (s *Server) authorize(streamID string) (request, error) {
+	keys, err := parseStreamID(streamID)
+	if err != nil {
+		return request{}, reject(gosrt.REJX_BAD_REQUEST, "%v", err)
+	}
+	// The listener only ingests, so publish is the default
+	if mode := keys["m"]; mode != "" && mode != "publish" {
+		return request{}, reject(gosrt.REJX_BAD_MODE, "mode %q is not supported", mode)
+	}
+
+	resource, query := auth.SplitPublishingName(keys["r"])
+	resourcePath := "/" + strings.Trim(resource, "/")
+	vars, ok := s.authorizer.ExtractVariables(resourcePath)
+	if !ok {
+		return request{}, reject(gosrt.REJX_FORBIDDEN, "unauthorized resource %q", resource)
+	}
+	name := path.Base(resourcePath)
+	if user := keys["u"]; user != "" {
+		name = user
+	}
+	if err := s.authorizer.ValidateAuthentication(vars, name); err != nil {
+		return request{}, reject(gosrt.REJX_UNAUTHORIZED, "%v", err)
+	}
+
+	role := query.Get("role")
+	if role == "" {
+		role = vars["role"]
+	}
+	parsedRole, err := stream.ParseRole(role)
+	if err != nil {
+		return request{}, reject(gosrt.REJX_BAD_REQUEST, "%v", err)
+	}
+	return request{name: name, role: parsedRole, app: vars["app"]}, nil
+}
+
+// parseStreamID returns the keys of a streamid in the access control syntax,
+// "#!::r=live/app/user,m=publish", or the streamid as the r key otherwise
+func parseStreamID(streamID string) (map[string]string, error) {
+	body, ok := strings.CutPrefix(streamID, streamIDPrefix)
+	if !ok {
+		return map[string]string{"r": streamID}, nil
+	}
+	keys := map[string]string{}
+	for _, pair := range strings.Split(body, ",") {
+		key, value, found := strings.Cut(pair, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid streamid key %q", pair)
+		}
+		keys[key] = value
+	}
+	return keys, nil
+}
+
+// attachStream attaches a publisher to the request's stream, as for RTMP
+// publishers
+func (s *Server) attachStream(req request) (publisher, error) {
+	_, p, err := s.manager.Publish(req.name, req.app, req.role, nil, s.config)
+	if err != nil {
+		return nil, err
+	}
+	return p.Bind(s.config), nil
+}
@@ -0,0 +1,240 @@
+package srt
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	gosrt "github.com/datarhei/gosrt"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/mpegts"
+	"rtmp-server-poc/internal/mpegts/mpegtstest"
+	"rtmp-server-poc/internal/stream"
+)
+
+func TestAuthorize(t *testing.T) {
+	s := NewServer(nil, config.Config{AuthorizedPatterns: []string{"/live/{app}/{username}"}})
+
+	tests := []struct {
+		name     string
+		streamID string
+		expected request
+		reason   gosrt.RejectionReason
+	}{
+		{
+			name:     "Access control syntax",
+			streamID: "#!::r=live/test/johndoe,m=publish",
+			expected: request{name: "johndoe", role: stream.RolePrimary, app: "test"},
+		},
+		{
+			name:     "Backup role",
+			streamID: "#!::r=live/test/johndoe?role=backup,m=publish",
+			expected: request{name: "johndoe", role: stream.RoleBackup, app: "test"},
+		},
+		{
+			name:     "Plain resource",
+			streamID: "live/test/johndoe",
+			expected: request{name: "johndoe", role: stream.RolePrimary, app: "test"},
+		},
+		{
+			name:     "Matching user",
+			streamID: "#!::r=live/test/johndoe,u=johndoe",
+			expected: request{name: "johndoe", role: stream.RolePrimary, app: "test"},
+		},
+		{
+			name:     "Other user",
+			streamID: "#!::r=live/test/johndoe,u=alice",
+			reason:   gosrt.REJX_UNAUTHORIZED,
+		},
+		{
+			name:     "Unauthorized resource",
+			streamID: "#!::r=other/johndoe,m=publish",
+			reason:   gosrt.REJX_FORBIDDEN,
+		},
+		{
+			name:     "Playback",
+			streamID: "#!::r=live/test/johndoe,m=request",
+			reason:   gosrt.REJX_BAD_MODE,
+		},
+		{
+			name:     "Malformed",
+			streamID: "#!::live/test/johndoe",
+			reason:   gosrt.REJX_BAD_REQUEST,
+		},
+		{
+			name:     "Invalid role",
+			streamID: "#!::r=live/test/johndoe?role=spare",
+			reason:   gosrt.REJX_BAD_REQUEST,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := s.authorize(tt.streamID)
+			if tt.reason != 0 {
+				var r *rejection
+				if !errors.As(err, &r) || r.reason != tt.reason {
+					t.Errorf("authorize() error = %v, expected rejection %d", err, tt.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authorize() error = %v", err)
+			}
+			if req != tt.expected {
+				t.Errorf("authorize() = %+v, expected %+v", req, tt.expected)
+			}
+		})
+	}
+}
+
+// fakePublisher records the tags of a connection
+type fakePublisher struct {
+	mutex  sync.Mutex
+	tags   []flv.Tag
+	closed chan struct{}
+}
+
+func (f *fakePublisher) write(tagType byte, timestamp uint32, data []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	tag, err := flv.ParseTag(tagType, timestamp, data)
+	f.tags = append(f.tags, tag)
+	return err
+}
+
+func (f *fakePublisher) WriteVideo(timestamp uint32, data []byte) error {
+	return f.write(flv.TagTypeVideo, timestamp, data)
+}
+
+func (f *fakePublisher) WriteAudio(timestamp uint32, data []byte) error {
+	return f.write(flv.TagTypeAudio, timestamp, data)
+}
+
+func (f *fakePublisher) Close() {
+	close(f.closed)
+}
+
+// startServer serves on a local port, attaching requests with attach
+func startServer(t *testing.T, attach func(req request) (publisher, error)) string {
+	t.Helper()
+	s := NewServer(nil, config.Config{AuthorizedPatterns: []string{"/live/{app}/{username}"}})
+	s.attach = attach
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ln.Close)
+	go s.Serve(ln)
+	return ln.Addr().String()
+}
+
+// dial connects an SRT caller with the streamid
+func dial(address, streamID string) (gosrt.Conn, error) {
+	cfg := gosrt.DefaultConfig()
+	cfg.StreamId = streamID
+	return gosrt.Dial("srt", address, cfg)
+}
+
+// transportStream muxes a second of 25 fps H.264, keyframes every 10 frames
+func transportStream(t *testing.T) []byte {
+	t.Helper()
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	var buf bytes.Buffer
+	m := mpegtstest.NewMuxer(&buf)
+	for i := range 25 {
+		frame := []byte{0, 0, 0, 1, 0x41, 0x9a, byte(i)}
+		if i%10 == 0 {
+			frame = append([]byte{0, 0, 0, 1}, sps...)
+			frame = append(append(frame, 0, 0, 0, 1), pps...)
+			frame = append(frame, 0, 0, 0, 1, 0x65, 0x88, byte(i))
+		}
+		pts := int64(90000 + i*3600)
+		if err := m.WriteFrame(&mpegts.Frame{StreamType: mpegts.StreamTypeH264, PTS: pts, DTS: pts, Data: frame}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestServerPublish(t *testing.T) {
+	p := &fakePublisher{closed: make(chan struct{})}
+	requests := make(chan request, 1)
+	address := startServer(t, func(req request) (publisher, error) {
+		requests <- req
+		return p, nil
+	})
+
+	conn, err := dial(address, "#!::r=live/test/johndoe,m=publish")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	if req := <-requests; req.name != "johndoe" || req.app != "test" {
+		t.Errorf("attached %+v, expected johndoe in test", req)
+	}
+	data := transportStream(t)
+	for len(data) > 0 {
+		n := min(len(data), 7*mpegts.PacketSize) // the usual SRT payload
+		if _, err := conn.Write(data[:n]); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		data = data[n:]
+	}
+
+	// Frames are released as the next one arrives, so all but the last
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mutex.Lock()
+		count := len(p.tags)
+		p.mutex.Unlock()
+		if count >= 24 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d tags, expected a sequence header and 24 frames", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn.Close()
+	select {
+	case <-p.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher not closed after the caller left")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.tags[0].Video.IsSequenceHeader() || !p.tags[1].IsKeyframe() {
+		t.Errorf("stream starts with %+v, %+v, expected a sequence header and a keyframe", p.tags[0].Video, p.tags[1].Video)
+	}
+	var timestamps []uint32
+	for _, tag := range p.tags[1:4] {
+		timestamps = append(timestamps, tag.Timestamp)
+	}
+	if !reflect.DeepEqual(timestamps, []uint32{0, 40, 80}) {
+		t.Errorf("timestamps = %v, expected 40 ms apart from 0", timestamps)
+	}
+}
+
+func TestServerRejects(t *testing.T) {
+	address := startServer(t, func(req request) (publisher, error) {
+		return nil, stream.ErrPublisherExists
+	})
+
+	for name, streamID := range map[string]string{
+		"Unauthorized":   "#!::r=other/johndoe,m=publish",
+		"Already live":   "#!::r=live/test/johndoe,m=publish",
+		"Wrong username": "#!::r=live/test/johndoe,u=alice",
+	} {
+		if conn, err := dial(address, streamID); err == nil {
+			conn.Close()
+			t.Errorf("%s: Dial() succeeded, expected a rejection", name)
+		}
+	}
+}
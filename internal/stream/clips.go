@@ -0,0 +1,343 @@
+package stream
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/events"
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/mp4"
+)
+
+var (
+	// ErrClipsDisabled is returned when clips are requested with no clip buffer
+	ErrClipsDisabled = errors.New("clips are disabled")
+	// ErrClipOutOfRange is returned for clips outside the buffered window
+	ErrClipOutOfRange = errors.New("clip is outside the buffered window")
+	// ErrInvalidClip is returned for a negative offset or a duration that is not positive
+	ErrInvalidClip = errors.New("invalid clip range")
+	// ErrClipQuotaExceeded is returned once the clips take ClipMaxSize bytes
+	ErrClipQuotaExceeded = errors.New("clip storage is full")
+)
+
+// ClipInfo describes a clip cut from a stream's buffer
+type ClipInfo struct {
+	ID     string `json:"id"`
+	Stream string `json:"stream"`
+	// File is the clip's path relative to the clip directory
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`
+	Duration  float64   `json:"duration"` // seconds, from the keyframe it starts on
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// clipBuffer keeps the last window of a stream's tags. It always starts on
+// a keyframe (any audio frame for audio-only streams), so it may hold up to
+// a GOP more than the window.
+type clipBuffer struct {
+	mutex  sync.Mutex
+	window uint32 // milliseconds
+
+	tags      []flv.Tag
+	dropped   int   // tags dropped from the front so far
+	keyframes []int // positions of the tags a clip may start on, counting dropped tags
+	hasVideo  bool
+
+	// seqHeaders are the sequence headers in effect before the first
+	// buffered tag
+	seqHeaders seqHeaders
+}
+
+// seqHeaders tracks the latest video and audio sequence headers
+type seqHeaders struct {
+	video flv.Tag
+	audio flv.Tag
+}
+
+// remember records tag if it is a sequence header
+func (h *seqHeaders) remember(tag flv.Tag) {
+	if tag.IsSequenceHeader() {
+		if tag.Type == flv.TagTypeVideo {
+			h.video = tag
+		} else {
+			h.audio = tag
+		}
+	}
+}
+
+// newClipBuffer creates a buffer keeping window of tags
+func newClipBuffer(window time.Duration) *clipBuffer {
+	return &clipBuffer{window: uint32(window.Milliseconds())}
+}
+
+// add appends a tag from the dispatcher and trims the buffer to the window
+func (b *clipBuffer) add(tag flv.Tag) {
+	if tag.Type == flv.TagTypeScript || tag.Video != nil && tag.Video.IsSequenceEnd() {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if tag.Video != nil && !b.hasVideo {
+		b.hasVideo = true
+		b.keyframes = nil // audio frames no longer start clips
+	}
+	if tag.IsKeyframe() || tag.Audio != nil && !b.hasVideo && !tag.IsSequenceHeader() {
+		b.keyframes = append(b.keyframes, b.dropped+len(b.tags))
+	}
+	b.tags = append(b.tags, tag)
+
+	// Drop whole GOPs while the next one still starts within the window
+	if tag.Timestamp < b.window {
+		return
+	}
+	cutoff := tag.Timestamp - b.window
+	for len(b.keyframes) >= 2 && b.tags[b.keyframes[1]-b.dropped].Timestamp <= cutoff {
+		b.drop(b.keyframes[1] - b.dropped)
+		b.keyframes = b.keyframes[1:]
+	}
+	// Nothing before the first keyframe can start a clip
+	if len(b.keyframes) > 0 && b.keyframes[0] > b.dropped {
+		b.drop(b.keyframes[0] - b.dropped)
+	}
+}
+
+// drop removes the first n tags, remembering the sequence headers among
+// them. The dropped entries are cleared so their payloads can be collected
+// before append moves the buffer to a new array.
+func (b *clipBuffer) drop(n int) {
+	for _, tag := range b.tags[:n] {
+		b.seqHeaders.remember(tag)
+	}
+	clear(b.tags[:n])
+	b.tags = b.tags[n:]
+	b.dropped += n
+}
+
+// extract returns the tags of a clip starting offset before the live edge
+// and lasting duration, moved back to the keyframe at or before its start.
+// The clip begins with the sequence headers in effect at that keyframe.
+func (b *clipBuffer) extract(offset, duration time.Duration) ([]flv.Tag, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.keyframes) == 0 {
+		return nil, fmt.Errorf("%w: nothing buffered yet", ErrClipOutOfRange)
+	}
+	first := b.tags[b.keyframes[0]-b.dropped].Timestamp
+	last := b.tags[len(b.tags)-1].Timestamp
+	back := uint32(offset.Milliseconds())
+	if back > last-first {
+		return nil, fmt.Errorf("%w: %.1fs buffered", ErrClipOutOfRange, float64(last-first)/1000)
+	}
+	start := last - back
+	end := start + uint32(duration.Milliseconds())
+
+	// The last keyframe at or before start
+	from := b.keyframes[0] - b.dropped
+	for _, k := range b.keyframes {
+		if b.tags[k-b.dropped].Timestamp > start {
+			break
+		}
+		from = k - b.dropped
+	}
+
+	headers := b.seqHeaders
+	for _, tag := range b.tags[:from] {
+		headers.remember(tag)
+	}
+
+	var tags []flv.Tag
+	for _, header := range []flv.Tag{headers.video, headers.audio} {
+		if header.Data != nil {
+			header.Timestamp = b.tags[from].Timestamp
+			tags = append(tags, header)
+		}
+	}
+	for _, tag := range b.tags[from:] {
+		if tag.Timestamp >= end {
+			break
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// CreateClip writes an MP4 of the stream starting offset before the live
+// edge and lasting duration. The clip starts on the keyframe at or before
+// the requested start. Neither offset nor duration may exceed ClipBuffer.
+func (sp *StreamProcess) CreateClip(offset, duration time.Duration) (ClipInfo, error) {
+	if sp.clips == nil {
+		return ClipInfo{}, ErrClipsDisabled
+	}
+	if offset < 0 || duration <= 0 {
+		return ClipInfo{}, fmt.Errorf("%w: offset %v, duration %v", ErrInvalidClip, offset, duration)
+	}
+	if window := sp.config.ClipBuffer; offset > window || duration > window {
+		return ClipInfo{}, fmt.Errorf("%w: offset %v and duration %v must be within the %v buffer", ErrInvalidClip, offset, duration, window)
+	}
+	tags, err := sp.clips.extract(offset, duration)
+	if err != nil {
+		return ClipInfo{}, err
+	}
+	if sp.config.ClipMaxSize > 0 {
+		used, err := dirSize(sp.config.ClipDir)
+		if err != nil {
+			return ClipInfo{}, err
+		}
+		if used >= sp.config.ClipMaxSize {
+			return ClipInfo{}, fmt.Errorf("%w: %d of %d bytes used", ErrClipQuotaExceeded, used, sp.config.ClipMaxSize)
+		}
+	}
+
+	id, err := newClipID()
+	if err != nil {
+		return ClipInfo{}, err
+	}
+	file := filepath.Join(pathElement(sp.username), id+".mp4")
+	path := filepath.Join(sp.config.ClipDir, file)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return ClipInfo{}, err
+	}
+
+	f, err := mp4.Create(path)
+	if err != nil {
+		return ClipInfo{}, err
+	}
+	for _, tag := range tags {
+		if err := f.WriteTag(tag); err != nil {
+			f.Close()
+			os.Remove(path)
+			return ClipInfo{}, err
+		}
+	}
+	info, err := f.Close()
+	if err != nil {
+		return ClipInfo{}, err
+	}
+
+	clip := ClipInfo{
+		ID:        id,
+		Stream:    sp.username,
+		File:      filepath.ToSlash(file),
+		Size:      info.Size,
+		Duration:  info.Duration,
+		CreatedAt: time.Now(),
+	}
+	sp.manager.events.Publish(events.Event{
+		Type:    events.ClipCreated,
+		Stream:  sp.username,
+		Message: fmt.Sprintf("clip %s (%.1fs, %d bytes)", id, clip.Duration, clip.Size),
+		Data: map[string]interface{}{
+			"id":       id,
+			"file":     clip.File,
+			"size":     clip.Size,
+			"duration": clip.Duration,
+		},
+	})
+	return clip, nil
+}
+
+// newClipID returns a unique clip name: the creation time and random bits
+func newClipID() (string, error) {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(random), nil
+}
+
+// dirSize returns the total size of the files under dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// clipRetentionInterval is how often expired clips are looked for
+const clipRetentionInterval = time.Hour
+
+// StartClipRetention deletes clips older than cfg.ClipRetention, now and
+// every clipRetentionInterval. It does nothing when clips are kept forever.
+func (sm *Manager) StartClipRetention(cfg config.Config) {
+	if cfg.ClipBuffer <= 0 || cfg.ClipRetention <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if err := sm.pruneClips(cfg.ClipDir, time.Now().Add(-cfg.ClipRetention)); err != nil {
+				log.Printf("Error deleting expired clips: %v", err)
+			}
+			time.Sleep(clipRetentionInterval)
+		}
+	}()
+}
+
+// pruneClips deletes the clips under dir, laid out as {username}/{id}.mp4,
+// last modified before cutoff, and the user directories left empty
+func (sm *Manager) pruneClips(dir string, cutoff time.Time) error {
+	users, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if !user.IsDir() {
+			continue
+		}
+		userDir := filepath.Join(dir, user.Name())
+		clips, err := os.ReadDir(userDir)
+		if err != nil {
+			return err
+		}
+		kept := 0
+		for _, clip := range clips {
+			info, err := clip.Info()
+			if err != nil || clip.IsDir() || !info.ModTime().Before(cutoff) {
+				kept++
+				continue
+			}
+			if err := os.Remove(filepath.Join(userDir, clip.Name())); err != nil {
+				return err
+			}
+			sm.events.Publish(events.Event{
+				Type:    events.ClipExpired,
+				Stream:  user.Name(),
+				Message: fmt.Sprintf("deleted clip %s/%s", user.Name(), clip.Name()),
+				Data:    map[string]interface{}{"file": user.Name() + "/" + clip.Name()},
+			})
+		}
+		if kept == 0 {
+			os.Remove(userDir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package stream
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/events"
+	"rtmp-server-poc/internal/flv"
+)
+
+// gopTags returns sequence headers then a keyframe every second and an
+// inter frame half a second later, up to end milliseconds
+func gopTags(end uint32) []flv.Tag {
+	videoHeader, _ := flv.ParseTag(flv.TagTypeVideo, 0, avcSequenceHeader)
+	audioHeader, _ := flv.ParseTag(flv.TagTypeAudio, 0, []byte{0xaf, 0x00, 0x12, 0x10})
+	tags := []flv.Tag{videoHeader, audioHeader}
+	for ts := uint32(0); ts <= end; ts += 500 {
+		frame := []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x41}
+		if ts%1000 == 0 {
+			frame = []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65}
+		}
+		tag, _ := flv.ParseTag(flv.TagTypeVideo, ts, frame)
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func TestClipBuffer(t *testing.T) {
+	b := newClipBuffer(2 * time.Second)
+	for _, tag := range gopTags(4500) {
+		b.add(tag)
+	}
+	// The window starts at 2500ms, inside the GOP starting at 2000ms
+	if first := b.tags[0]; first.Timestamp != 2000 || !first.IsKeyframe() {
+		t.Errorf("buffer starts with %+v, expected the keyframe at 2000ms", first)
+	}
+	if b.seqHeaders.video.Data == nil || b.seqHeaders.audio.Data == nil {
+		t.Error("sequence headers dropped from the buffer were not kept")
+	}
+
+	tests := []struct {
+		name        string
+		offset      time.Duration
+		duration    time.Duration
+		expected    []uint32 // timestamps, sequence headers included
+		expectError error
+	}{
+		{
+			name:     "Moved back to the keyframe",
+			offset:   1200 * time.Millisecond,
+			duration: time.Second,
+			expected: []uint32{3000, 3000, 3000, 3500, 4000},
+		},
+		{
+			name:     "Ends at the live edge",
+			offset:   0,
+			duration: 10 * time.Second,
+			expected: []uint32{4000, 4000, 4000, 4500},
+		},
+		{
+			name:     "Whole buffer",
+			offset:   2500 * time.Millisecond,
+			duration: 10 * time.Second,
+			expected: []uint32{2000, 2000, 2000, 2500, 3000, 3500, 4000, 4500},
+		},
+		{
+			name:        "Before the buffer",
+			offset:      3 * time.Second,
+			duration:    time.Second,
+			expectError: ErrClipOutOfRange,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags, err := b.extract(tt.offset, tt.duration)
+			if !errors.Is(err, tt.expectError) {
+				t.Fatalf("extract() error = %v, expected %v", err, tt.expectError)
+			}
+			var timestamps []uint32
+			for _, tag := range tags {
+				timestamps = append(timestamps, tag.Timestamp)
+			}
+			if len(timestamps) != len(tt.expected) || (len(tags) > 0 && !tags[0].IsSequenceHeader()) {
+				t.Fatalf("extract() = %v, expected %v starting with the sequence headers", timestamps, tt.expected)
+			}
+			for i := range timestamps {
+				if timestamps[i] != tt.expected[i] {
+					t.Errorf("extract() = %v, expected %v", timestamps, tt.expected)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestCreateClip(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.OutputDir = t.TempDir()
+	cfg.ClipDir = t.TempDir()
+	cfg.ClipBuffer = 5 * time.Minute
+
+	sp := newStreamProcess("alice", cfg.OutputDir, NewManager(), cfg)
+	sp.transcoder = &transcoder{writer: flv.NewWriter(&strings.Builder{}), done: make(chan struct{})}
+	created, unsubscribe := sp.manager.events.Subscribe(8)
+	defer unsubscribe()
+
+	p := mustAttach(t, sp)
+	for _, tag := range gopTags(3500) {
+		if err := p.WriteVideo(tag.Timestamp, tag.Data); tag.Type == flv.TagTypeVideo && err != nil {
+			t.Fatalf("WriteVideo() error = %v", err)
+		}
+		if tag.Type == flv.TagTypeAudio {
+			p.WriteAudio(tag.Timestamp, tag.Data)
+		}
+	}
+	sp.queue.flush()
+
+	if _, err := sp.CreateClip(time.Second, 0); !errors.Is(err, ErrInvalidClip) {
+		t.Errorf("CreateClip() without duration error = %v, expected ErrInvalidClip", err)
+	}
+	if _, err := sp.CreateClip(time.Second, time.Duration(math.MaxInt64)); !errors.Is(err, ErrInvalidClip) {
+		t.Errorf("CreateClip() longer than the buffer error = %v, expected ErrInvalidClip", err)
+	}
+	if _, err := sp.CreateClip(6*time.Minute, time.Second); !errors.Is(err, ErrInvalidClip) {
+		t.Errorf("CreateClip() before the buffer error = %v, expected ErrInvalidClip", err)
+	}
+	clip, err := sp.CreateClip(1500*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatalf("CreateClip() error = %v", err)
+	}
+	// Requested from 2000ms to 3000ms, which starts on a keyframe
+	if clip.Stream != "alice" || clip.Duration != 1.0 || !strings.HasPrefix(clip.File, "alice/") {
+		t.Errorf("CreateClip() = %+v, expected a 1s clip of alice", clip)
+	}
+	data, err := os.ReadFile(filepath.Join(cfg.ClipDir, clip.File))
+	if err != nil || int64(len(data)) != clip.Size || string(data[4:8]) != "ftyp" {
+		t.Errorf("clip file is not the %d byte MP4 reported: %v", clip.Size, err)
+	}
+
+	// Once the clips fill ClipMaxSize, no more are cut
+	sp.config.ClipMaxSize = clip.Size
+	if _, err := sp.CreateClip(1500*time.Millisecond, time.Second); !errors.Is(err, ErrClipQuotaExceeded) {
+		t.Errorf("CreateClip() over quota error = %v, expected ErrClipQuotaExceeded", err)
+	}
+
+	for {
+		select {
+		case event := <-created:
+			if event.Type != events.ClipCreated {
+				continue
+			}
+			if event.Data["id"] != clip.ID {
+				t.Errorf("event data = %v, expected clip %s", event.Data, clip.ID)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event", events.ClipCreated)
+		}
+	}
+}
+
+func TestPruneClips(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	clips := map[string]time.Duration{
+		"alice/20250101-120000-00000000.mp4": 2 * 24 * time.Hour,
+		"alice/20250103-110000-00000000.mp4": time.Hour,
+		"bob/20250101-120000-00000000.mp4":   30 * time.Hour,
+	}
+	for clip, age := range clips {
+		path := filepath.Join(dir, clip)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(path, []byte("clip"), 0644)
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+	}
+
+	sm := NewManager()
+	if err := sm.pruneClips(dir, now.Add(-24*time.Hour)); err != nil {
+		t.Fatalf("pruneClips() error = %v", err)
+	}
+
+	for clip, expectKept := range map[string]bool{
+		"alice/20250101-120000-00000000.mp4": false,
+		"alice/20250103-110000-00000000.mp4": true,
+		"bob":                                false, // left empty
+	} {
+		_, err := os.Stat(filepath.Join(dir, clip))
+		if kept := err == nil; kept != expectKept {
+			t.Errorf("%s kept = %v, expected %v", clip, kept, expectKept)
+		}
+	}
+	if expired := sm.events.Recent(); len(expired) != 2 {
+		t.Errorf("got %d events, expected one per expired clip", len(expired))
+	}
+}
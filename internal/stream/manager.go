@@ -1,35 +1,58 @@
 package stream
 
 import (
-	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
 	"sync"
 
 	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/events"
 )
 
 // Manager manages multiple active streams
 type Manager struct {
-	streams sync.Map // thread-safe map of username -> *StreamProcess
+	streams     sync.Map   // thread-safe map of username -> *StreamProcess
+	createMutex sync.Mutex // serialises GetOrCreateStream so a name maps to one process
+	events      *events.Bus
 }
 
+// eventHistorySize is the number of events kept for the API
+const eventHistorySize = 256
+
 // NewManager creates a new stream manager
 func NewManager() *Manager {
-	return &Manager{}
+	return &Manager{
+		events: events.NewBus(eventHistorySize),
+	}
+}
+
+// Events returns the bus on which stream events are published
+func (sm *Manager) Events() *events.Bus {
+	return sm.events
 }
 
 // GetOrCreateStream gets an existing stream or creates a new one
 func (sm *Manager) GetOrCreateStream(username string, cfg config.Config) (*StreamProcess, error) {
+	sm.createMutex.Lock()
+	defer sm.createMutex.Unlock()
+
 	// Try to get existing stream
 	if stream, ok := sm.streams.Load(username); ok {
-		if sp := stream.(*StreamProcess); sp.active.Load() {
+		sp := stream.(*StreamProcess)
+		switch sp.State() {
+		case StateStarting, StateLive:
 			return sp, nil
+		case StateAwaitingReconnect:
+			if sp.reconnect() {
+				return sp, nil
+			}
 		}
 		// Clean up inactive stream
-		sm.streams.Delete(username)
+		sm.streams.CompareAndDelete(username, sp)
 	}
 
 	// Create new stream
@@ -42,51 +65,83 @@ func (sm *Manager) GetOrCreateStream(username string, cfg config.Config) (*Strea
 	return stream, nil
 }
 
-// createNewStream creates a new FFmpeg process for a streamer
-func (sm *Manager) createNewStream(username string, cfg config.Config) (*StreamProcess, error) {
-	outputDir := filepath.Join(cfg.OutputDir, username)
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create output directory: %v", err)
-	}
+// Publish attaches a publisher with the given role to the named stream,
+// creating it if needed, and applies the app's metadata policy, recording
+// and relays. Every ingest publishes through it. onEvict is passed on to
+// Attach.
+func (sm *Manager) Publish(username, app string, role Role, onEvict func(), cfg config.Config) (*StreamProcess, *Publisher, error) {
+	return sm.publish(username, app, role, onEvict, cfg, cfg.DuplicatePublisherPolicy)
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	cmd := createFFmpegCommand(ctx, outputDir)
+// PublishVacant is Publish through AttachVacant, for publishers the server
+// starts itself
+func (sm *Manager) PublishVacant(username, app string, role Role, onEvict func(), cfg config.Config) (*StreamProcess, *Publisher, error) {
+	return sm.publish(username, app, role, onEvict, cfg, config.DuplicatePublisherReject)
+}
 
-	stdin, err := cmd.StdinPipe()
+// publish implements Publish with a duplicate publisher policy
+func (sm *Manager) publish(username, app string, role Role, onEvict func(), cfg config.Config, policy string) (*StreamProcess, *Publisher, error) {
+	sp, err := sm.GetOrCreateStream(username, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	publisher, err := sp.attach(role, onEvict, policy)
 	if err != nil {
-		cancel()
-		return nil, fmt.Errorf("failed to get stdin pipe: %v", err)
+		return nil, nil, err
+	}
+	publisher.SetMetadataPolicy(cfg.MetadataPolicyFor(app))
+	if cfg.ShouldRecord(app, username) {
+		sp.EnableRecording(app)
 	}
+	sp.EnableRelays(app)
+	return sp, publisher, nil
+}
 
-	if err := cmd.Start(); err != nil {
-		cancel()
+// createNewStream creates a new stream for a streamer. FFmpeg is started by
+// the stream once the first media tells which codecs it carries.
+func (sm *Manager) createNewStream(username string, cfg config.Config) (*StreamProcess, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
 		return nil, fmt.Errorf("failed to start FFmpeg: %v", err)
 	}
 
-	stream := &StreamProcess{
-		username:  username,
-		cmd:       cmd,
-		stdin:     stdin,
-		cancel:    cancel,
-		outputDir: outputDir,
+	outputDir := filepath.Join(cfg.OutputDir, username)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
 	}
-	stream.active.Store(true)
 
-	// Start monitoring goroutine
-	go stream.monitor(sm)
+	stream := newStreamProcess(username, outputDir, sm, cfg)
 
 	log.Printf("Started new stream for user: %s", username)
 	return stream, nil
 }
 
-// GetActiveStreams returns a list of usernames for all active streams
-func (sm *Manager) GetActiveStreams() []string {
-	var activeStreams []string
+// GetStream returns the stream registered under username, if any
+func (sm *Manager) GetStream(username string) (*StreamProcess, bool) {
+	if stream, ok := sm.streams.Load(username); ok {
+		return stream.(*StreamProcess), true
+	}
+	return nil, false
+}
+
+// ListStreams returns a snapshot of every active stream, sorted by username.
+// Streams waiting for their publisher to reconnect are included.
+func (sm *Manager) ListStreams() []StreamInfo {
+	var infos []StreamInfo
 	sm.streams.Range(func(key, value interface{}) bool {
-		if sp := value.(*StreamProcess); sp.active.Load() {
-			activeStreams = append(activeStreams, key.(string))
+		if sp := value.(*StreamProcess); sp.IsActive() {
+			infos = append(infos, sp.Info())
 		}
 		return true
 	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Username < infos[j].Username })
+	return infos
+}
+
+// GetActiveStreams returns a list of usernames for all active streams
+func (sm *Manager) GetActiveStreams() []string {
+	var activeStreams []string
+	for _, info := range sm.ListStreams() {
+		activeStreams = append(activeStreams, info.Username)
+	}
 	return activeStreams
-} 
\ No newline at end of file
+}
@@ -0,0 +1,31 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/flv"
+)
+
+// ErrMetadataRejected is returned when a publisher's onMetaData exceeds the
+// metadata policy of its app
+var ErrMetadataRejected = errors.New("stream metadata rejected by policy")
+
+// checkMetadata returns an error wrapping ErrMetadataRejected if md declares
+// more than the policy allows
+func checkMetadata(policy config.MetadataPolicy, md *flv.StreamMetadata) error {
+	switch {
+	case policy.MaxWidth > 0 && md.Width > policy.MaxWidth:
+		return fmt.Errorf("%w: width %d exceeds %d", ErrMetadataRejected, md.Width, policy.MaxWidth)
+	case policy.MaxHeight > 0 && md.Height > policy.MaxHeight:
+		return fmt.Errorf("%w: height %d exceeds %d", ErrMetadataRejected, md.Height, policy.MaxHeight)
+	case policy.MaxFrameRate > 0 && md.FrameRate > policy.MaxFrameRate:
+		return fmt.Errorf("%w: frame rate %g exceeds %g", ErrMetadataRejected, md.FrameRate, policy.MaxFrameRate)
+	case policy.MaxVideoBitrate > 0 && md.VideoDataRate > policy.MaxVideoBitrate:
+		return fmt.Errorf("%w: video bitrate %g kbit/s exceeds %g", ErrMetadataRejected, md.VideoDataRate, policy.MaxVideoBitrate)
+	case policy.MaxAudioBitrate > 0 && md.AudioDataRate > policy.MaxAudioBitrate:
+		return fmt.Errorf("%w: audio bitrate %g kbit/s exceeds %g", ErrMetadataRejected, md.AudioDataRate, policy.MaxAudioBitrate)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package stream
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// opusQueueSize is the number of Opus packets buffered for each listener,
+// about ten seconds of 20 ms frames
+const opusQueueSize = 512
+
+// maxRTPPacketSize bounds the RTP packets read from FFmpeg
+const maxRTPPacketSize = 1500
+
+// opusFeed receives the Opus RTP packets FFmpeg encodes from a stream's
+// audio on a local UDP socket, and fans them out to WebRTC viewers. The
+// socket outlives transcoder restarts.
+type opusFeed struct {
+	conn *net.UDPConn
+
+	mutex     sync.Mutex
+	listeners map[*OpusListener]struct{}
+	closed    bool
+}
+
+// OpusListener receives a stream's audio as Opus RTP packets. A listener
+// that falls behind misses packets.
+type OpusListener struct {
+	feed    *opusFeed
+	packets chan []byte
+}
+
+// newOpusFeed opens a loopback UDP socket for FFmpeg to send to
+func newOpusFeed() (*opusFeed, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	f := &opusFeed{conn: conn, listeners: make(map[*OpusListener]struct{})}
+	go f.receive()
+	return f, nil
+}
+
+// addr returns the address FFmpeg sends its RTP output to
+func (f *opusFeed) addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+// receive hands every packet to the listeners until the socket is closed
+func (f *opusFeed) receive() {
+	buf := make([]byte, maxRTPPacketSize)
+	for {
+		n, err := f.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		packet := append([]byte(nil), buf[:n]...)
+
+		f.mutex.Lock()
+		for l := range f.listeners {
+			select {
+			case l.packets <- packet:
+			default:
+			}
+		}
+		f.mutex.Unlock()
+	}
+}
+
+// listen adds a listener, or returns nil once the feed is closed
+func (f *opusFeed) listen() *OpusListener {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return nil
+	}
+	l := &OpusListener{feed: f, packets: make(chan []byte, opusQueueSize)}
+	f.listeners[l] = struct{}{}
+	return l
+}
+
+// remove stops delivering to a listener and closes its queue
+func (f *opusFeed) remove(l *OpusListener) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.listeners[l]; ok {
+		delete(f.listeners, l)
+		close(l.packets)
+	}
+}
+
+// close ends every listener and the socket once the stream's media stops
+func (f *opusFeed) close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	for l := range f.listeners {
+		close(l.packets)
+	}
+	clear(f.listeners)
+	f.conn.Close()
+}
+
+// ListenOpus starts receiving the stream's audio as encoded to Opus by
+// FFmpeg. It returns nil when the audio is not encoded to Opus, because
+// WHEP is disabled or the stream has ended. The listener must be closed
+// once done with.
+func (sp *StreamProcess) ListenOpus() *OpusListener {
+	if sp.opus == nil {
+		return nil
+	}
+	return sp.opus.listen()
+}
+
+// Next returns the listener's next RTP packet, waiting for it. It returns
+// false once the stream has ended, the listener was closed or ctx is done.
+func (l *OpusListener) Next(ctx context.Context) ([]byte, bool) {
+	select {
+	case packet, ok := <-l.packets:
+		return packet, ok
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// Close stops the listener
+func (l *OpusListener) Close() {
+	l.feed.remove(l)
+}
@@ -0,0 +1,106 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+)
+
+// withLibopus makes FFmpeg look built with libopus or not for a test
+func withLibopus(t *testing.T, available bool) {
+	probe := ffmpegHasLibopus
+	ffmpegHasLibopus = func() bool { return available }
+	t.Cleanup(func() { ffmpegHasLibopus = probe })
+}
+
+func TestOpusFeed(t *testing.T) {
+	withLibopus(t, true)
+	cfg := config.DefaultConfig()
+	cfg.WHEP = true
+	sp, recorder := newDeferredStreamConfig(t, cfg)
+	listener := sp.ListenOpus()
+	if listener == nil {
+		t.Fatal("ListenOpus() = nil with WHEP enabled")
+	}
+	defer listener.Close()
+
+	// FFmpeg sends the audio to the feed once the stream has audio
+	p := mustAttach(t, sp)
+	p.WriteVideo(0, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01})
+	p.WriteAudio(0, []byte{0xaf, 0x00, 0x12, 0x10})
+	p.WriteVideo(0, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65})
+	sp.queue.flush()
+	recorder.mutex.Lock()
+	addr := recorder.options[0].opusAddr
+	recorder.mutex.Unlock()
+	if addr != sp.opus.addr() {
+		t.Fatalf("FFmpeg sends Opus to %q, expected %q", addr, sp.opus.addr())
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packets := [][]byte{{0x80, 0x6f, 0x00, 0x01}, {0x80, 0x6f, 0x00, 0x02}}
+	for _, packet := range packets {
+		conn.Write(packet)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, expected := range packets {
+		packet, ok := listener.Next(ctx)
+		if !ok || !bytes.Equal(packet, expected) {
+			t.Fatalf("Next() = %x, %v, expected %x", packet, ok, expected)
+		}
+	}
+
+	sp.opus.close()
+	if _, ok := listener.Next(ctx); ok {
+		t.Error("Next() returned a packet after the feed closed")
+	}
+	if sp.ListenOpus() != nil {
+		t.Error("ListenOpus() returned a listener after the feed closed")
+	}
+}
+
+func TestOpusFeedWithoutLibopus(t *testing.T) {
+	tests := []struct {
+		name    string
+		whep    bool
+		libopus bool
+	}{
+		{"WHEP disabled", false, true},
+		{"No libopus", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withLibopus(t, tt.libopus)
+			cfg := config.DefaultConfig()
+			cfg.WHEP = tt.whep
+			sp, recorder := newDeferredStreamConfig(t, cfg)
+			if listener := sp.ListenOpus(); listener != nil {
+				listener.Close()
+				t.Error("ListenOpus() returned a listener")
+			}
+
+			// FFmpeg writes HLS alone
+			p := mustAttach(t, sp)
+			p.WriteVideo(0, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01})
+			p.WriteAudio(0, []byte{0xaf, 0x00, 0x12, 0x10})
+			p.WriteVideo(0, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65})
+			sp.queue.flush()
+			recorder.mutex.Lock()
+			defer recorder.mutex.Unlock()
+			if len(recorder.options) != 1 || recorder.options[0].opusAddr != "" {
+				t.Errorf("FFmpeg started with %+v, expected no Opus output", recorder.options)
+			}
+		})
+	}
+}
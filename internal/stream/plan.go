@@ -0,0 +1,91 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"rtmp-server-poc/internal/config"
+)
+
+// ErrCodecRejected is returned when a publisher sends video the video
+// policy does not accept
+var ErrCodecRejected = errors.New("video codec rejected by policy")
+
+// TrackAction is what FFmpeg does with a track
+type TrackAction string
+
+const (
+	// ActionCopy passes the track through unchanged
+	ActionCopy TrackAction = "copy"
+	// ActionTranscode re-encodes the track
+	ActionTranscode TrackAction = "transcode"
+)
+
+// TrackPlan is how one track is turned into HLS
+type TrackPlan struct {
+	Input  string      `json:"input"` // codec as published
+	Action TrackAction `json:"action"`
+	Output string      `json:"output"` // codec in the HLS output
+}
+
+// TranscodePlan records, per track, whether FFmpeg copies or re-encodes it.
+// It is decided when FFmpeg starts, from the codecs seen so far.
+type TranscodePlan struct {
+	Video *TrackPlan `json:"video,omitempty"`
+	Audio *TrackPlan `json:"audio,omitempty"`
+	// FMP4 is set when the segments are fragmented MP4 rather than MPEG-TS
+	FMP4 bool `json:"fmp4"`
+}
+
+// fmp4Codecs are the video codecs that can only be segmented as fMP4
+var fmp4Codecs = map[string]bool{"hevc": true, "av1": true, "vp9": true}
+
+// planTranscode decides between copy and transcode for each track. AAC and
+// H.264 are copied and other audio becomes AAC. Other video is copied into
+// fMP4 segments or transcoded to H.264 depending on videoPolicy. An empty
+// codec means the stream has no such track.
+func planTranscode(videoCodec, audioCodec, videoPolicy string) TranscodePlan {
+	var plan TranscodePlan
+	if videoCodec != "" {
+		plan.Video = &TrackPlan{Input: videoCodec, Action: ActionCopy, Output: videoCodec}
+		if videoCodec != "avc" {
+			if videoPolicy == config.VideoPolicyFMP4 && fmp4Codecs[videoCodec] {
+				plan.FMP4 = true
+			} else {
+				plan.Video.Action, plan.Video.Output = ActionTranscode, "avc"
+			}
+		}
+	}
+	if audioCodec != "" {
+		plan.Audio = &TrackPlan{Input: audioCodec, Action: ActionCopy, Output: audioCodec}
+		if audioCodec != "aac" {
+			plan.Audio.Action, plan.Audio.Output = ActionTranscode, "aac"
+		}
+	}
+	return plan
+}
+
+// videoAccepted reports whether the video policy lets a publisher send codec
+func videoAccepted(codec, videoPolicy string) bool {
+	return codec == "avc" || videoPolicy != config.VideoPolicyReject
+}
+
+// describePlan summarizes a plan for logging, e.g. "video avc copy, audio mp3 transcode to aac"
+func describePlan(plan TranscodePlan) string {
+	var parts []string
+	for _, track := range []struct {
+		kind string
+		plan *TrackPlan
+	}{{"video", plan.Video}, {"audio", plan.Audio}} {
+		switch {
+		case track.plan == nil:
+			parts = append(parts, "no "+track.kind)
+		case track.plan.Action == ActionCopy:
+			parts = append(parts, fmt.Sprintf("%s %s copy", track.kind, track.plan.Input))
+		default:
+			parts = append(parts, fmt.Sprintf("%s %s transcode to %s", track.kind, track.plan.Input, track.plan.Output))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,60 @@
+package stream
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"rtmp-server-poc/internal/config"
+)
+
+func TestPlanTranscode(t *testing.T) {
+	copyTrack := func(codec string) *TrackPlan {
+		return &TrackPlan{Input: codec, Action: ActionCopy, Output: codec}
+	}
+	transcodeTrack := func(input, output string) *TrackPlan {
+		return &TrackPlan{Input: input, Action: ActionTranscode, Output: output}
+	}
+
+	tests := []struct {
+		name       string
+		videoCodec string
+		audioCodec string
+		policy     string
+		expected   TranscodePlan
+	}{
+		{"H.264 and AAC are copied", "avc", "aac", config.VideoPolicyFMP4, TranscodePlan{Video: copyTrack("avc"), Audio: copyTrack("aac")}},
+		{"MP3 becomes AAC", "avc", "mp3", config.VideoPolicyFMP4, TranscodePlan{Video: copyTrack("avc"), Audio: transcodeTrack("mp3", "aac")}},
+		{"Speex becomes AAC", "", "speex", config.VideoPolicyFMP4, TranscodePlan{Audio: transcodeTrack("speex", "aac")}},
+		{"Nellymoser becomes AAC", "avc", "nellymoser", config.VideoPolicyTranscode, TranscodePlan{Video: copyTrack("avc"), Audio: transcodeTrack("nellymoser", "aac")}},
+		{"HEVC copied into fMP4", "hevc", "aac", config.VideoPolicyFMP4, TranscodePlan{Video: copyTrack("hevc"), Audio: copyTrack("aac"), FMP4: true}},
+		{"HEVC transcoded", "hevc", "opus", config.VideoPolicyTranscode, TranscodePlan{Video: transcodeTrack("hevc", "avc"), Audio: transcodeTrack("opus", "aac")}},
+		{"VP6 transcoded under the fMP4 policy", "vp6", "", config.VideoPolicyFMP4, TranscodePlan{Video: transcodeTrack("vp6", "avc")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := planTranscode(tt.videoCodec, tt.audioCodec, tt.policy)
+			if !reflect.DeepEqual(plan, tt.expected) {
+				t.Errorf("planTranscode() = %s, expected %s", describePlan(plan), describePlan(tt.expected))
+			}
+		})
+	}
+}
+
+func TestVideoPolicyRejectsPublisher(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.OutputDir = t.TempDir()
+	cfg.VideoPolicy = config.VideoPolicyReject
+	sp := newStreamProcess("alice", cfg.OutputDir, NewManager(), cfg)
+	sp.startTranscoder = (&startRecorder{}).start
+
+	p := mustAttach(t, sp)
+	if err := p.WriteVideo(0, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}); err != nil {
+		t.Fatalf("WriteVideo() of H.264 error = %v", err)
+	}
+	backup := mustAttachRole(t, sp, RoleBackup)
+	if err := backup.WriteVideo(0, []byte{0x90, 'h', 'v', 'c', '1', 0x01}); !errors.Is(err, ErrCodecRejected) {
+		t.Errorf("WriteVideo() of HEVC error = %v, expected ErrCodecRejected", err)
+	}
+}
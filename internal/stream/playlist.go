@@ -0,0 +1,99 @@
+package stream
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rtmp-server-poc/internal/codec"
+	"rtmp-server-poc/internal/flv"
+)
+
+// defaultBandwidth is advertised in the master playlist, in bit/s, when the
+// publisher did not declare its data rates
+const defaultBandwidth = 2500000
+
+// variant is the single rendition listed in a stream's master playlist
+type variant struct {
+	uri       string
+	bandwidth int
+	codecs    []string
+	complete  bool // every track's codecs string is known
+	width     int
+	height    int
+	frameRate float64
+}
+
+// masterPlaylist renders an HLS master playlist for v. CODECS is only
+// written when every track's codec string is known, since an incomplete
+// list makes players reject the variant.
+func masterPlaylist(v variant) string {
+	attributes := []string{fmt.Sprintf("BANDWIDTH=%d", v.bandwidth)}
+	if v.complete && len(v.codecs) > 0 {
+		attributes = append(attributes, fmt.Sprintf(`CODECS="%s"`, strings.Join(v.codecs, ",")))
+	}
+	if v.width > 0 && v.height > 0 {
+		attributes = append(attributes, fmt.Sprintf("RESOLUTION=%dx%d", v.width, v.height))
+	}
+	if v.frameRate > 0 {
+		attributes = append(attributes, fmt.Sprintf("FRAME-RATE=%.3f", v.frameRate))
+	}
+
+	return fmt.Sprintf("#EXTM3U\n#EXT-X-INDEPENDENT-SEGMENTS\n#EXT-X-STREAM-INF:%s\n%s\n",
+		strings.Join(attributes, ","), v.uri)
+}
+
+// transcodedAACCodecs is the codecs string of audio transcoded by FFmpeg,
+// which encodes AAC-LC
+const transcodedAACCodecs = "mp4a.40.2"
+
+// variantFor describes the stream's HLS output from the transcode plan, the
+// inspected input tracks and the declared metadata. Copied tracks keep
+// their inspected codecs string; transcoded video keeps its resolution but
+// its profile and level are FFmpeg's choice, so CODECS is left out.
+func variantFor(plan *TranscodePlan, video *codec.VideoConfig, audio *codec.AudioConfig, md *flv.StreamMetadata) variant {
+	v := variant{
+		uri:       "live.m3u8",
+		bandwidth: defaultBandwidth,
+		complete:  true,
+	}
+	if plan != nil && plan.Video != nil {
+		if video != nil && plan.Video.Action == ActionCopy {
+			v.codecs = append(v.codecs, video.Codecs)
+		} else {
+			v.complete = false
+		}
+		if video != nil {
+			v.width, v.height = video.Width, video.Height
+		}
+	}
+	if plan != nil && plan.Audio != nil {
+		switch {
+		case plan.Audio.Action == ActionTranscode:
+			v.codecs = append(v.codecs, transcodedAACCodecs)
+		case audio != nil:
+			v.codecs = append(v.codecs, audio.Codecs)
+		default:
+			v.complete = false
+		}
+	}
+	if md != nil {
+		if declared := md.VideoDataRate + md.AudioDataRate; declared > 0 {
+			v.bandwidth = int(declared * 1000)
+		}
+		if plan != nil && plan.Video != nil {
+			v.frameRate = md.FrameRate
+		}
+	}
+	return v
+}
+
+// writeMasterPlaylist atomically replaces master.m3u8 in dir
+func writeMasterPlaylist(dir string, v variant) error {
+	tmp := filepath.Join(dir, "master.m3u8.tmp")
+	if err := os.WriteFile(tmp, []byte(masterPlaylist(v)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "master.m3u8"))
+}
@@ -0,0 +1,99 @@
+package stream
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rtmp-server-poc/internal/codec"
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/flv"
+)
+
+func TestMasterPlaylist(t *testing.T) {
+	avc := &codec.VideoConfig{Codec: "avc", Width: 1280, Height: 720, Codecs: "avc1.64001f"}
+	aac := &codec.AudioConfig{Codec: "aac", SampleRate: 48000, Channels: 2, Codecs: "mp4a.40.2"}
+
+	copied := planTranscode("avc", "aac", config.VideoPolicyFMP4)
+	tests := []struct {
+		name     string
+		variant  variant
+		expected string
+	}{
+		{
+			name:     "Audio and video with declared rates",
+			variant:  variantFor(&copied, avc, aac, &flv.StreamMetadata{VideoDataRate: 2500, AudioDataRate: 128, FrameRate: 30}),
+			expected: `BANDWIDTH=2628000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=1280x720,FRAME-RATE=30.000`,
+		},
+		{
+			name:     "Audio only",
+			variant:  variantFor(&TranscodePlan{Audio: copied.Audio}, nil, aac, nil),
+			expected: `BANDWIDTH=2500000,CODECS="mp4a.40.2"`,
+		},
+		{
+			name:     "Uninspected audio leaves out CODECS",
+			variant:  variantFor(&copied, avc, nil, nil),
+			expected: `BANDWIDTH=2500000,RESOLUTION=1280x720`,
+		},
+		{
+			name: "Transcoded audio is AAC-LC",
+			variant: func() variant {
+				plan := planTranscode("avc", "mp3", config.VideoPolicyFMP4)
+				return variantFor(&plan, avc, nil, nil)
+			}(),
+			expected: `BANDWIDTH=2500000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=1280x720`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := "#EXTM3U\n#EXT-X-INDEPENDENT-SEGMENTS\n#EXT-X-STREAM-INF:" + tt.expected + "\nlive.m3u8\n"
+			if playlist := masterPlaylist(tt.variant); playlist != expected {
+				t.Errorf("masterPlaylist() = %q, expected %q", playlist, expected)
+			}
+		})
+	}
+}
+
+func TestTranscoderInspectsSequenceHeaders(t *testing.T) {
+	sp, _ := newDeferredStream(t)
+	p := mustAttach(t, sp)
+
+	avcHeader := []byte{
+		0x17, 0x00, 0x00, 0x00, 0x00, // AVC sequence header
+		0x01, 0x64, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x1b,
+		0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00,
+		0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58,
+	}
+	for _, err := range []error{
+		p.WriteVideo(0, avcHeader),
+		p.WriteAudio(0, []byte{0xaf, 0x00, 0x11, 0x90}),
+		p.WriteVideo(0, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65}),
+	} {
+		if err != nil {
+			t.Fatalf("write error = %v", err)
+		}
+	}
+	sp.queue.flush()
+
+	info := sp.Info()
+	if info.Video == nil || info.Video.Width != 1920 || info.Video.Height != 1080 || info.Video.Profile != "High" {
+		t.Errorf("video track = %+v, expected 1080p High", info.Video)
+	}
+	if info.Audio == nil || info.Audio.SampleRate != 48000 || info.Audio.ChannelLayout != "stereo" {
+		t.Errorf("audio track = %+v, expected 48 kHz stereo", info.Audio)
+	}
+
+	if info.Plan == nil || info.Plan.Video.Action != ActionCopy || info.Plan.Audio.Action != ActionCopy {
+		t.Errorf("plan = %+v, expected both tracks copied", info.Plan)
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(sp.outputDir, "master.m3u8"))
+	if err != nil {
+		t.Fatalf("master playlist not written: %v", err)
+	}
+	if !strings.Contains(string(playlist), `CODECS="avc1.640028,mp4a.40.2",RESOLUTION=1920x1080`) {
+		t.Errorf("master playlist = %q, expected the inspected codecs and resolution", playlist)
+	}
+}
@@ -1,100 +1,605 @@
 package stream
 
 import (
-	"context"
-	"io"
+	"bytes"
+	"errors"
+	"fmt"
 	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"sync/atomic"
+	"sync"
 	"time"
 
+	"rtmp-server-poc/internal/codec"
 	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/relay"
 )
 
 // StreamProcess represents a single stream with its FFmpeg process
 type StreamProcess struct {
 	username  string
-	cmd       *exec.Cmd
-	stdin     io.WriteCloser
-	cancel    context.CancelFunc
 	outputDir string
-	active    atomic.Bool // atomic boolean for active state
-}
-
-// createFFmpegCommand creates an FFmpeg command with the specified settings
-func createFFmpegCommand(ctx context.Context, outputDir string) *exec.Cmd {
-	return exec.CommandContext(ctx, "ffmpeg",
-		"-re",                  // clock to incoming timestamps
-		"-fflags", "+nobuffer", // disable buffering
-		"-flags", "low_delay",  // low delay mode
-		"-f", "flv",
-		"-i", "pipe:0",
-		"-c:v", "copy",
-		"-c:a", "copy",
-		"-f", "hls",
-		"-hls_time", "1",
-		"-hls_list_size", "3",
-		"-hls_flags", "delete_segments+temp_file+independent_segments",
-		"-hls_segment_type", "mpegts",
-		"-hls_allow_cache", "0", // disable client caching
-		"-hls_segment_filename", filepath.Join(outputDir, "live_%03d.ts"),
-		filepath.Join(outputDir, "live.m3u8"),
-	)
-}
-
-// monitor waits for the FFmpeg process to exit and cleans up
-func (sp *StreamProcess) monitor(sm *Manager) {
+	config    config.Config
+	manager   *Manager
+
+	stateMutex        sync.Mutex
+	state             State
+	stateSince        time.Time
+	reconnectDeadline time.Time
+	reconnectTimer    *time.Timer
+	transitions       []Transition
+	videoTrack        *codec.VideoConfig // inspected by the dispatcher from the sequence headers
+	audioTrack        *codec.AudioConfig
+	plan              *TranscodePlan // set by the dispatcher each time FFmpeg starts
+
+	// writeMutex guards the stream timeline shared by every publisher. Tags
+	// are rebased under it and queued for the dispatcher goroutine.
+	writeMutex    sync.Mutex
+	lastTimestamp uint32 // highest timestamp queued for the transcoder
+	hasTimestamp  bool
+
+	// enqueueMutex keeps tags in timeline order while they are pushed to the
+	// queue, which may block under the block overflow policy
+	enqueueMutex sync.Mutex
+	queue        *frameQueue
+
+	// sinkMutex guards the transcoder and the recorder, which only the
+	// dispatcher writes to
+	sinkMutex  sync.Mutex
+	transcoder *transcoder
+	sinkClosed bool // torn down, the transcoder must not be restarted
+	recorder   *recorder
+
+	// clips buffers the last ClipBuffer of tags, nil when clips are disabled
+	clips *clipBuffer
+
+	// viewers receive the stream's tags live, over HTTP-FLV and the like
+	viewers *viewerHub
+
+	// opus receives the audio as encoded to Opus for WebRTC viewers, nil
+	// without WHEP
+	opus *opusFeed
+
+	// relays forward the stream to upstream servers, by target name
+	relayMutex   sync.Mutex
+	relays       map[string]*relay.Target
+	relaysClosed bool // the stream ended, no target may be added
+
+	// startTranscoder launches FFmpeg, replaced in tests
+	startTranscoder func(outputDir string, opts transcoderOptions) (*transcoder, error)
+
+	// Owned by the dispatcher goroutine
+	videoSeqHeader flv.Tag     // last video decoder configuration sent to FFmpeg
+	audioSeqHeader flv.Tag     // last audio decoder configuration sent to FFmpeg
+	pending        []flv.Tag   // tags held back until the codecs are known
+	codecChanged   bool        // a sequence header changed, restart before the next frame
+	videoCodec     string      // codec of the last video tag delivered
+	audioCodec     string      // codec of the last audio tag delivered
+	failedSink     *transcoder // transcoder whose write error was already logged
+
+	primary         *Publisher
+	backup          *Publisher
+	active          *Publisher   // the publisher forwarded to FFmpeg, primary or backup
+	standby         []*Publisher // hot standby publishers, promoted in order
+	nextPublisherID uint64
+	metadata        *flv.StreamMetadata // onMetaData of the active publisher
+}
+
+// maxTransitionHistory bounds the transition log kept per stream
+const maxTransitionHistory = 32
+
+// StreamInfo is a point-in-time snapshot of a stream for the UI and API
+type StreamInfo struct {
+	Username           string          `json:"username"`
+	State              State           `json:"state"`
+	StateSince         time.Time       `json:"state_since"`
+	ReconnectDeadline  *time.Time      `json:"reconnect_deadline,omitempty"`
+	ReconnectRemaining float64         `json:"reconnect_remaining_seconds,omitempty"`
+	Transitions        []Transition    `json:"transitions"`
+	Publishers         []PublisherInfo `json:"publishers"`
+	Queue              QueueStats      `json:"queue"`
+	Viewers            int             `json:"viewers"`
+	// Metadata is the onMetaData of the active publisher
+	Metadata *flv.StreamMetadata `json:"metadata,omitempty"`
+	// Video and Audio are the tracks as coded, read from the sequence headers
+	Video *codec.VideoConfig `json:"video,omitempty"`
+	Audio *codec.AudioConfig `json:"audio,omitempty"`
+	// Plan is how FFmpeg turns each track into HLS
+	Plan *TranscodePlan `json:"plan,omitempty"`
+	// Relays are the upstream servers the stream is forwarded to
+	Relays []relay.Status `json:"relays,omitempty"`
+}
+
+// newStreamProcess creates a stream in the Starting state and starts the
+// goroutine that feeds its queued tags to the transcoder
+func newStreamProcess(username, outputDir string, sm *Manager, cfg config.Config) *StreamProcess {
+	sp := &StreamProcess{
+		username:   username,
+		outputDir:  outputDir,
+		config:     cfg,
+		manager:    sm,
+		state:      StateStarting,
+		stateSince: time.Now(),
+		queue:      newFrameQueue(cfg.QueueSize, cfg.QueueOverflowPolicy),
+		viewers:    newViewerHub(),
+
+		startTranscoder: startTranscoder,
+	}
+	if cfg.ClipBuffer > 0 {
+		sp.clips = newClipBuffer(cfg.ClipBuffer)
+	}
+	if cfg.WHEP && ffmpegHasLibopus() {
+		feed, err := newOpusFeed()
+		if err != nil {
+			log.Printf("Cannot receive Opus audio for user %s: %v", username, err)
+		}
+		sp.opus = feed
+	}
+	go sp.dispatch()
+	return sp
+}
+
+// transition moves the stream to the next state, rejecting invalid changes
+func (sp *StreamProcess) transition(next State, reason string) error {
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+	return sp.transitionLocked(next, reason)
+}
+
+// transitionLocked is transition for callers already holding stateMutex
+func (sp *StreamProcess) transitionLocked(next State, reason string) error {
+	if !sp.state.CanTransition(next) {
+		return &ErrInvalidTransition{From: sp.state, To: next}
+	}
+
+	now := time.Now()
+	sp.transitions = append(sp.transitions, Transition{From: sp.state, To: next, At: now, Reason: reason})
+	if len(sp.transitions) > maxTransitionHistory {
+		sp.transitions = sp.transitions[len(sp.transitions)-maxTransitionHistory:]
+	}
+	log.Printf("Stream %s: %s -> %s (%s)", sp.username, sp.state, next, reason)
+
+	if sp.state == StateAwaitingReconnect {
+		sp.reconnectDeadline = time.Time{}
+		if sp.reconnectTimer != nil {
+			sp.reconnectTimer.Stop()
+			sp.reconnectTimer = nil
+		}
+	}
+	sp.state = next
+	sp.stateSince = now
+	return nil
+}
+
+// MarkLive records that media is flowing; it is a no-op once the stream is live
+func (sp *StreamProcess) MarkLive() {
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+	if sp.state == StateStarting {
+		_ = sp.transitionLocked(StateLive, "first media received")
+	}
+}
+
+// Disconnect is called when the publisher goes away. The stream waits
+// ReconnectDelay for the publisher to come back before stopping.
+func (sp *StreamProcess) Disconnect(cfg config.Config) {
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+
+	if err := sp.transitionLocked(StateAwaitingReconnect, "publisher disconnected"); err != nil {
+		return
+	}
+
+	sp.reconnectDeadline = sp.stateSince.Add(cfg.ReconnectDelay)
+	sp.reconnectTimer = time.AfterFunc(cfg.ReconnectDelay, func() {
+		sp.stateMutex.Lock()
+		if sp.state != StateAwaitingReconnect {
+			sp.stateMutex.Unlock()
+			return
+		}
+		err := sp.transitionLocked(StateStopping, "reconnect grace period expired")
+		sp.stateMutex.Unlock()
+
+		if err == nil {
+			log.Printf("No reconnection detected for user %s, stopping stream", sp.username)
+			sp.teardown(cfg)
+		}
+	})
+}
+
+// reconnect resumes a stream that was waiting for its publisher
+func (sp *StreamProcess) reconnect() bool {
+	return sp.transition(StateLive, "publisher reconnected") == nil
+}
+
+// monitor waits for a transcoder to exit and cleans up the stream, unless
+// the transcoder was deliberately replaced by a restart
+func (sp *StreamProcess) monitor(t *transcoder) {
+	<-t.done
+
+	sp.sinkMutex.Lock()
+	current := sp.transcoder == t
+	if current {
+		sp.sinkClosed = true
+	}
+	sp.sinkMutex.Unlock()
+	if !current {
+		log.Printf("FFmpeg restarted for user: %s", sp.username)
+		return
+	}
+	sp.queue.close()
+
 	defer func() {
-		sp.active.Store(false)
-		sm.streams.Delete(sp.username)
+		sp.manager.streams.CompareAndDelete(sp.username, sp)
 		log.Printf("Stream ended and cleaned up for user: %s", sp.username)
 	}()
 
-	if err := sp.cmd.Wait(); err != nil {
-		log.Printf("FFmpeg exited for user %s: %v", sp.username, err)
+	sp.stateMutex.Lock()
+	if sp.state == StateStopping {
+		_ = sp.transitionLocked(StateEnded, "ffmpeg exited after stop")
+	} else if !sp.state.IsTerminal() {
+		_ = sp.transitionLocked(StateFailed, "ffmpeg exited unexpectedly")
+	}
+	sp.stateMutex.Unlock()
+
+	if t.err != nil {
+		log.Printf("FFmpeg exited for user %s: %v", sp.username, t.err)
 	} else {
 		log.Printf("FFmpeg exited normally for user: %s", sp.username)
 	}
 }
 
-// Stop gracefully stops the stream
-func (sp *StreamProcess) Stop(cfg config.Config) {
-	if !sp.active.Swap(false) {
-		return // already stopped
+// advanceLocked records the highest timestamp handed to the queue, which
+// the next publisher's timeline continues from. The caller holds writeMutex.
+func (sp *StreamProcess) advanceLocked(timestamp uint32) {
+	if !sp.hasTimestamp || timestamp > sp.lastTimestamp {
+		sp.lastTimestamp = timestamp
+		sp.hasTimestamp = true
+	}
+}
+
+// dispatch feeds queued tags to the transcoder until the queue is closed
+func (sp *StreamProcess) dispatch() {
+	for {
+		tag, ok := sp.queue.pop()
+		if !ok {
+			sp.stopRecording()
+			sp.viewers.close()
+			sp.stopRelays()
+			if sp.opus != nil {
+				sp.opus.close()
+			}
+			return
+		}
+		sp.record(tag)
+		if sp.clips != nil {
+			sp.clips.add(tag)
+		}
+		sp.viewers.publish(tag)
+		if err := sp.deliver(tag); err != nil {
+			sp.sinkMutex.Lock()
+			t := sp.transcoder
+			sp.sinkMutex.Unlock()
+			if t != sp.failedSink {
+				sp.failedSink = t
+				log.Printf("Error writing to FFmpeg for user %s: %v", sp.username, err)
+			}
+		}
 	}
+}
 
-	// Close stdin to signal FFmpeg to stop
-	if sp.stdin != nil {
-		sp.stdin.Close()
+// EnableRecording archives the stream's incoming FLV for the rest of its
+// life, under the configured record path for app. It is a no-op when the
+// stream is already recorded.
+func (sp *StreamProcess) EnableRecording(app string) {
+	sp.sinkMutex.Lock()
+	defer sp.sinkMutex.Unlock()
+	if sp.recorder == nil && !sp.sinkClosed {
+		sp.recorder = newRecorder(sp.username, app, sp)
 	}
+}
 
-	// Cancel the context
-	if sp.cancel != nil {
-		sp.cancel()
+// record hands a tag to the recorder. A recording error is logged and ends
+// the recording; the live stream carries on.
+func (sp *StreamProcess) record(tag flv.Tag) {
+	sp.sinkMutex.Lock()
+	r := sp.recorder
+	sp.sinkMutex.Unlock()
+	if r == nil {
+		return
 	}
+	if err := r.write(tag); err != nil {
+		log.Printf("Error recording stream %s, recording stopped: %v", sp.username, err)
+		sp.stopRecording()
+	}
+}
 
-	// Wait for FFmpeg to exit with timeout
-	done := make(chan struct{})
-	go func() {
-		sp.cmd.Wait()
-		close(done)
-	}()
+// stopRecording finalizes the file being recorded and disables recording
+func (sp *StreamProcess) stopRecording() {
+	sp.sinkMutex.Lock()
+	r := sp.recorder
+	sp.recorder = nil
+	sp.sinkMutex.Unlock()
+	if r == nil {
+		return
+	}
+	if err := r.closeFiles(); err != nil {
+		log.Printf("Error finishing recording of stream %s: %v", sp.username, err)
+	}
+}
+
+// deliver writes a tag to the transcoder, starting FFmpeg once the codecs
+// are known. Sequence headers identical to the ones FFmpeg already has are
+// dropped; changed ones restart FFmpeg so the HLS output gets a
+// discontinuity. Sequence end markers are dropped as the feed continues
+// across publishers.
+func (sp *StreamProcess) deliver(tag flv.Tag) error {
+	if tag.Video != nil && tag.Video.IsSequenceEnd() {
+		return nil
+	}
+	switch {
+	case tag.Video != nil:
+		sp.videoCodec = tag.Video.Codec()
+	case tag.Audio != nil:
+		sp.audioCodec = tag.Audio.Codec()
+	}
 
-	select {
-	case <-done:
-		log.Printf("FFmpeg process exited cleanly for user: %s", sp.username)
-	case <-time.After(cfg.CleanupDelay):
-		log.Printf("FFmpeg process did not exit cleanly for user: %s, forcing termination", sp.username)
-		if sp.cmd.Process != nil {
-			sp.cmd.Process.Kill()
+	if tag.IsSequenceHeader() {
+		cached := &sp.audioSeqHeader
+		if tag.Type == flv.TagTypeVideo {
+			cached = &sp.videoSeqHeader
+		}
+		if bytes.Equal(cached.Data, tag.Data) {
+			return nil // unchanged, FFmpeg already has it
+		}
+		changed := cached.Data != nil
+		*cached = tag.Clone()
+		sp.inspectSequenceHeader(tag)
+		if changed && sp.transcoderStarted() && !sp.codecChanged {
+			log.Printf("Codec parameters changed for user %s, restarting FFmpeg with a discontinuity", sp.username)
+			sp.codecChanged = true
+		}
+		if sp.codecChanged {
+			return nil // sent to the new FFmpeg ahead of the next frame
+		}
+	} else if sp.codecChanged && isMedia(tag) {
+		sp.codecChanged = false
+		if err := sp.restartTranscoder(tag.Timestamp); err != nil {
+			return err
 		}
+		sp.updateMasterPlaylist()
 	}
 
-	// Clean up the output directory
+	if !sp.transcoderStarted() {
+		sp.pending = append(sp.pending, tag)
+		if !sp.probeComplete() {
+			return nil
+		}
+		pending := sp.pending
+		sp.pending = nil
+		t, err := sp.launchTranscoder(false)
+		if err != nil {
+			return err
+		}
+		sp.updateMasterPlaylist()
+		t.writer.WriteHeader()
+		for _, tag := range pending {
+			if err := t.writer.WriteTag(tag.Type, tag.Timestamp, tag.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	sp.sinkMutex.Lock()
+	t := sp.transcoder
+	sp.sinkMutex.Unlock()
+	if t == nil {
+		return fmt.Errorf("stream %s has no running transcoder", sp.username)
+	}
+
+	t.writer.WriteHeader()
+	return t.writer.WriteTag(tag.Type, tag.Timestamp, tag.Data)
+}
+
+// inspectSequenceHeader reads the track parameters from a decoder
+// configuration. Codecs that are not inspected leave the track unknown.
+func (sp *StreamProcess) inspectSequenceHeader(tag flv.Tag) {
+	var err error
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+	if tag.Type == flv.TagTypeVideo {
+		sp.videoTrack, err = codec.ParseVideoSequenceHeader(tag)
+	} else {
+		sp.audioTrack, err = codec.ParseAudioSequenceHeader(tag)
+	}
+	if err != nil && !errors.Is(err, codec.ErrUnsupportedCodec) {
+		log.Printf("Cannot inspect sequence header for user %s: %v", sp.username, err)
+	}
+}
+
+// updateMasterPlaylist writes master.m3u8 describing the HLS output FFmpeg
+// was just started for. Only the dispatcher calls it.
+func (sp *StreamProcess) updateMasterPlaylist() {
+	sp.writeMutex.Lock()
+	md := sp.metadata
+	sp.writeMutex.Unlock()
+
+	sp.stateMutex.Lock()
+	v := variantFor(sp.plan, sp.videoTrack, sp.audioTrack, md)
+	sp.stateMutex.Unlock()
+
+	if err := writeMasterPlaylist(sp.outputDir, v); err != nil {
+		log.Printf("Failed to write master playlist for user %s: %v", sp.username, err)
+	}
+}
+
+// probeDuration is how long, in stream time, audio is held back waiting for
+// video before FFmpeg is started for an audio-only stream
+const probeDuration = 2000
+
+// probeComplete reports whether the pending tags tell enough about the
+// stream's codecs to start FFmpeg: a video frame has arrived, or audio has
+// been flowing for probeDuration without one
+func (sp *StreamProcess) probeComplete() bool {
+	var firstAudio, lastAudio uint32
+	sawAudio := false
+	for _, tag := range sp.pending {
+		if !isMedia(tag) {
+			continue
+		}
+		if tag.Type == flv.TagTypeVideo {
+			return true
+		}
+		if !sawAudio {
+			firstAudio, sawAudio = tag.Timestamp, true
+		}
+		lastAudio = tag.Timestamp
+	}
+	return sawAudio && lastAudio-firstAudio >= probeDuration
+}
+
+// transcoderOptionsFor derives the FFmpeg settings from the codecs seen so far
+func (sp *StreamProcess) transcoderOptionsFor(discontinuity bool) transcoderOptions {
+	opts := transcoderOptions{
+		discontinuity: discontinuity,
+		plan:          planTranscode(sp.videoCodec, sp.audioCodec, sp.config.VideoPolicy),
+		listSize:      dvrListSize(sp.config.DVRWindow),
+		event:         sp.config.DVREvent,
+	}
+	if sp.opus != nil && sp.audioCodec != "" {
+		opts.opusAddr = sp.opus.addr()
+	}
+	return opts
+}
+
+// transcoderStarted reports whether FFmpeg has been started for this stream
+func (sp *StreamProcess) transcoderStarted() bool {
+	sp.sinkMutex.Lock()
+	defer sp.sinkMutex.Unlock()
+	return sp.transcoder != nil || sp.sinkClosed
+}
+
+// launchTranscoder starts FFmpeg with settings matching the current codecs
+func (sp *StreamProcess) launchTranscoder(discontinuity bool) (*transcoder, error) {
+	sp.sinkMutex.Lock()
+	defer sp.sinkMutex.Unlock()
+	return sp.launchTranscoderLocked(discontinuity)
+}
+
+// launchTranscoderLocked starts FFmpeg, failing the stream if it cannot be
+// started. Only the dispatcher calls it, holding sinkMutex.
+func (sp *StreamProcess) launchTranscoderLocked(discontinuity bool) (*transcoder, error) {
+	if sp.sinkClosed {
+		return nil, fmt.Errorf("stream %s is stopping", sp.username)
+	}
+
+	opts := sp.transcoderOptionsFor(discontinuity)
+	t, err := sp.startTranscoder(sp.outputDir, opts)
+	if err != nil {
+		sp.transcoder = nil
+		sp.sinkClosed = true
+		sp.queue.close()
+		if sp.transition(StateFailed, "ffmpeg failed to start") == nil {
+			sp.manager.streams.CompareAndDelete(sp.username, sp)
+		}
+		return nil, err
+	}
+	log.Printf("Started FFmpeg for user %s (%s, fmp4 %v)", sp.username, describePlan(opts.plan), opts.plan.FMP4)
+	sp.transcoder = t
+	sp.stateMutex.Lock()
+	sp.plan = &opts.plan
+	sp.stateMutex.Unlock()
+	go sp.monitor(t)
+	return t, nil
+}
+
+// restartTranscoder replaces FFmpeg with a new process that appends to the
+// existing playlist after a discontinuity, and primes it with the current
+// sequence headers. Only the dispatcher calls it.
+func (sp *StreamProcess) restartTranscoder(timestamp uint32) error {
+	sp.sinkMutex.Lock()
+	defer sp.sinkMutex.Unlock()
+	if sp.sinkClosed || sp.transcoder == nil {
+		return fmt.Errorf("stream %s has no running transcoder", sp.username)
+	}
+
+	// The monitor of the old process sees it replaced once sinkMutex is released
+	sp.transcoder.finish(sp.config.CleanupDelay)
+
+	t, err := sp.launchTranscoderLocked(true)
+	if err != nil {
+		return err
+	}
+	t.writer.WriteHeader()
+	for _, header := range []flv.Tag{sp.videoSeqHeader, sp.audioSeqHeader} {
+		if header.Data != nil {
+			if err := t.writer.WriteTag(header.Type, timestamp, header.Data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isMedia reports whether a tag carries coded audio or video
+func isMedia(tag flv.Tag) bool {
+	switch {
+	case tag.Video != nil:
+		return tag.Video.IsCodedFrame()
+	case tag.Audio != nil:
+		return !tag.Audio.IsSequenceHeader()
+	}
+	return tag.Type != flv.TagTypeScript && !tag.IsSequenceHeader()
+}
+
+// Stop gracefully stops the stream
+func (sp *StreamProcess) Stop(cfg config.Config) {
+	if err := sp.transition(StateStopping, "stop requested"); err != nil {
+		return // already stopping or stopped
+	}
+	sp.teardown(cfg)
+}
+
+// teardown terminates FFmpeg, archives its output as VOD when configured
+// and schedules removal of the output directory. The caller must already
+// have moved the stream to StateStopping.
+func (sp *StreamProcess) teardown(cfg config.Config) {
+	// Stop feeding FFmpeg; tags still queued are discarded
+	sp.queue.close()
+
+	sp.sinkMutex.Lock()
+	sp.sinkClosed = true
+	t := sp.transcoder
+	sp.sinkMutex.Unlock()
+
+	if t == nil {
+		// FFmpeg never started, so no monitor will end the stream
+		if sp.transition(StateEnded, "stopped before ffmpeg started") == nil {
+			sp.manager.streams.CompareAndDelete(sp.username, sp)
+		}
+	} else {
+		// Close stdin to signal FFmpeg to stop and cancel its context
+		t.close()
+
+		// Wait for FFmpeg to exit with timeout
+		select {
+		case <-t.done:
+			log.Printf("FFmpeg process exited cleanly for user: %s", sp.username)
+		case <-time.After(cfg.CleanupDelay):
+			log.Printf("FFmpeg process did not exit cleanly for user: %s, forcing termination", sp.username)
+			t.kill()
+		}
+		sp.archive()
+	}
+
+	// Clean up the output directory, unless a new stream took it over meanwhile
 	go func() {
 		time.Sleep(cfg.CleanupDelay)
+		if current, ok := sp.manager.streams.Load(sp.username); ok && current != sp {
+			log.Printf("Keeping stream directory for user %s, a new stream is using it", sp.username)
+			return
+		}
 		if err := os.RemoveAll(sp.outputDir); err != nil {
 			log.Printf("Error cleaning up stream directory for user %s: %v", sp.username, err)
 		} else {
@@ -103,17 +608,55 @@ func (sp *StreamProcess) Stop(cfg config.Config) {
 	}()
 }
 
+// State returns the current lifecycle state
+func (sp *StreamProcess) State() State {
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+	return sp.state
+}
+
+// Info returns a snapshot of the stream state
+func (sp *StreamProcess) Info() StreamInfo {
+	sp.writeMutex.Lock()
+	publishers := sp.publishersLocked()
+	metadata := sp.metadata
+	sp.writeMutex.Unlock()
+	relays := sp.Relays()
+
+	sp.stateMutex.Lock()
+	defer sp.stateMutex.Unlock()
+
+	info := StreamInfo{
+		Username:    sp.username,
+		Publishers:  publishers,
+		Queue:       sp.queue.snapshot(),
+		Viewers:     sp.viewers.count(),
+		Metadata:    metadata,
+		State:       sp.state,
+		StateSince:  sp.stateSince,
+		Transitions: append([]Transition(nil), sp.transitions...),
+		Video:       sp.videoTrack,
+		Audio:       sp.audioTrack,
+		Plan:        sp.plan,
+		Relays:      relays,
+	}
+	if sp.state == StateAwaitingReconnect && !sp.reconnectDeadline.IsZero() {
+		deadline := sp.reconnectDeadline
+		info.ReconnectDeadline = &deadline
+		if remaining := time.Until(deadline); remaining > 0 {
+			info.ReconnectRemaining = remaining.Seconds()
+		}
+	}
+	return info
+}
+
 // IsActive returns whether the stream is currently active
 func (sp *StreamProcess) IsActive() bool {
-	return sp.active.Load()
+	state := sp.State()
+	return state != StateStopping && !state.IsTerminal()
 }
 
 // Username returns the username for this stream
 func (sp *StreamProcess) Username() string {
 	return sp.username
 }
-
-// Stdin returns the stdin writer for this stream
-func (sp *StreamProcess) Stdin() io.WriteCloser {
-	return sp.stdin
-} 
\ No newline at end of file
@@ -0,0 +1,506 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/events"
+	"rtmp-server-poc/internal/flv"
+)
+
+// reconnectTimestampGap is the spacing in milliseconds left between the last
+// tag written by a previous publisher and the first tag of the next one
+const reconnectTimestampGap = 40
+
+var (
+	// ErrPublisherExists is returned by Attach when the stream already has a
+	// live publisher and the duplicate publisher policy rejects newcomers
+	ErrPublisherExists = errors.New("stream already has a live publisher")
+	// ErrPublisherEvicted is returned when writing through a publisher that
+	// was replaced by a newer one
+	ErrPublisherEvicted = errors.New("publisher was replaced by a newer publisher")
+)
+
+// Role is the ingest role of a publisher
+type Role string
+
+const (
+	// RolePrimary publishers are forwarded whenever they are healthy
+	RolePrimary Role = "primary"
+	// RoleBackup publishers are forwarded only while the primary is missing
+	// or stalled
+	RoleBackup Role = "backup"
+)
+
+// ParseRole validates a role name; an empty name means primary
+func ParseRole(name string) (Role, error) {
+	switch Role(name) {
+	case "", RolePrimary:
+		return RolePrimary, nil
+	case RoleBackup:
+		return RoleBackup, nil
+	}
+	return "", fmt.Errorf("unknown publisher role %q", name)
+}
+
+// Publisher is one ingest session (e.g. an RTMP connection) feeding a stream.
+// Its timestamps are rebased onto the stream's timeline, so a publisher that
+// reconnects mid-stream, or a backup taking over, continues where the
+// previous one stopped instead of restarting at zero.
+//
+// A stream holds at most one primary and one backup publisher. Only the
+// active one reaches FFmpeg; the other is kept warm so the stream can fail
+// over at its next keyframe. Standby publishers (see DuplicatePublisherPolicy)
+// wait for their role's slot to free up.
+type Publisher struct {
+	id          uint64
+	role        Role
+	stream      *StreamProcess
+	connectedAt time.Time
+	onEvict     func()
+
+	// Guarded by the stream's writeMutex
+	closed         bool
+	started        bool  // whether offset has been computed from the first tag
+	offset         int64 // added to every incoming timestamp
+	waitKeyframe   bool  // drop media until the next video keyframe
+	sawVideo       bool
+	lastMediaAt    time.Time // when the last audio/video tag arrived
+	streamingSince time.Time // start of the current run of media without stalls
+	videoSeqHeader flv.Tag   // latest decoder configuration sent by this publisher
+	audioSeqHeader flv.Tag
+	videoCodec     string
+	audioCodec     string
+	malformedTags  uint64
+	policy         config.MetadataPolicy
+	metadata       *flv.StreamMetadata // latest onMetaData sent by this publisher
+	rejected       error               // set once the metadata or video policy refused this publisher
+}
+
+// PublisherInfo describes a publisher attached to a stream
+type PublisherInfo struct {
+	ID          uint64     `json:"id"`
+	Role        Role       `json:"role"`
+	Active      bool       `json:"active"`
+	Standby     bool       `json:"standby,omitempty"`
+	ConnectedAt time.Time  `json:"connected_at"`
+	LastMediaAt *time.Time `json:"last_media_at,omitempty"`
+	VideoCodec  string     `json:"video_codec,omitempty"`
+	AudioCodec  string     `json:"audio_codec,omitempty"`
+	// MalformedTags counts tags dropped because their header did not parse
+	MalformedTags uint64 `json:"malformed_tags,omitempty"`
+}
+
+// Attach creates a new publisher session with the given role. If the role's
+// slot is already taken the configured duplicate publisher policy decides
+// the outcome. onEvict is called, if set, when this publisher is later
+// displaced by a takeover so the caller can drop the connection.
+func (sp *StreamProcess) Attach(role Role, onEvict func()) (*Publisher, error) {
+	return sp.attach(role, onEvict, sp.config.DuplicatePublisherPolicy)
+}
+
+// AttachVacant attaches a publisher only if the role's slot is free,
+// whatever the duplicate publisher policy, returning ErrPublisherExists
+// otherwise. Publishers the server starts itself, such as pulls, use it so
+// they never displace a connected publisher.
+func (sp *StreamProcess) AttachVacant(role Role, onEvict func()) (*Publisher, error) {
+	return sp.attach(role, onEvict, config.DuplicatePublisherReject)
+}
+
+// attach implements Attach with a duplicate publisher policy
+func (sp *StreamProcess) attach(role Role, onEvict func(), policy string) (*Publisher, error) {
+	sp.writeMutex.Lock()
+	defer sp.writeMutex.Unlock()
+
+	sp.nextPublisherID++
+	p := &Publisher{
+		id:          sp.nextPublisherID,
+		role:        role,
+		stream:      sp,
+		connectedAt: time.Now(),
+		onEvict:     onEvict,
+	}
+
+	slot := sp.slot(role)
+	if *slot == nil {
+		*slot = p
+		if sp.active == nil {
+			sp.active = p
+			sp.publishEvent(events.PublisherAccepted, fmt.Sprintf("%s publisher %d is live", role, p.id), p)
+		} else {
+			sp.publishEvent(events.PublisherAccepted, fmt.Sprintf("%s publisher %d connected, %s publisher %d stays live", role, p.id, sp.active.role, sp.active.id), p)
+		}
+		return p, nil
+	}
+
+	switch policy {
+	case config.DuplicatePublisherTakeover:
+		old := *slot
+		old.closed = true
+		*slot = p
+		if sp.active == old {
+			sp.active = p
+		}
+		sp.publishEvent(events.PublisherTakeover, fmt.Sprintf("%s publisher %d took over from publisher %d", role, p.id, old.id), p)
+		if old.onEvict != nil {
+			go old.onEvict()
+		}
+		return p, nil
+
+	case config.DuplicatePublisherStandby:
+		sp.standby = append(sp.standby, p)
+		sp.publishEvent(events.PublisherStandby, fmt.Sprintf("%s publisher %d queued as standby (%d waiting)", role, p.id, len(sp.standby)), p)
+		return p, nil
+
+	default:
+		sp.publishEvent(events.PublisherRejected, fmt.Sprintf("%s publisher %d rejected, publisher %d holds the slot", role, p.id, (*slot).id), p)
+		return nil, ErrPublisherExists
+	}
+}
+
+// slot returns the field holding the publisher for a role
+func (sp *StreamProcess) slot(role Role) **Publisher {
+	if role == RoleBackup {
+		return &sp.backup
+	}
+	return &sp.primary
+}
+
+// detach removes a publisher from the stream. Its slot goes to the first
+// standby publisher of the same role; if it was the active publisher the
+// stream fails over to the other role or waits for a reconnection.
+func (sp *StreamProcess) detach(p *Publisher, cfg config.Config) {
+	sp.writeMutex.Lock()
+	if p.closed {
+		sp.writeMutex.Unlock()
+		return
+	}
+	p.closed = true
+
+	slot := sp.slot(p.role)
+	if *slot != p {
+		for i, standby := range sp.standby {
+			if standby == p {
+				sp.standby = append(sp.standby[:i], sp.standby[i+1:]...)
+				break
+			}
+		}
+		sp.publishEvent(events.PublisherLeft, fmt.Sprintf("standby publisher %d left", p.id), p)
+		sp.writeMutex.Unlock()
+		return
+	}
+
+	*slot = nil
+	for i, standby := range sp.standby {
+		if standby.role == p.role {
+			sp.standby = append(sp.standby[:i], sp.standby[i+1:]...)
+			*slot = standby
+			break
+		}
+	}
+
+	if sp.active != p {
+		sp.publishEvent(events.PublisherLeft, fmt.Sprintf("%s publisher %d left", p.role, p.id), p)
+		if *slot != nil {
+			sp.publishEvent(events.PublisherPromoted, fmt.Sprintf("standby publisher %d is the new %s", (*slot).id, p.role), *slot)
+		}
+		sp.writeMutex.Unlock()
+		return
+	}
+
+	next := *slot
+	if next == nil {
+		next = sp.primary
+		if next == nil {
+			next = sp.backup
+		}
+	}
+	if next != nil {
+		sp.activateLocked(next)
+		sp.publishEvent(events.PublisherPromoted, fmt.Sprintf("%s publisher %d replaced %s publisher %d", next.role, next.id, p.role, p.id), next)
+		sp.writeMutex.Unlock()
+		return
+	}
+
+	sp.active = nil
+	sp.publishEvent(events.PublisherLeft, fmt.Sprintf("%s publisher %d left", p.role, p.id), p)
+	sp.writeMutex.Unlock()
+
+	// The stream waits ReconnectDelay for a publisher before stopping
+	sp.Disconnect(cfg)
+}
+
+// activateLocked makes p the publisher forwarded to FFmpeg. Its timeline is
+// rebased from its next keyframe. The caller holds writeMutex.
+func (sp *StreamProcess) activateLocked(p *Publisher) {
+	sp.active = p
+	if p.metadata != nil {
+		sp.metadata = p.metadata
+	}
+	p.started = false
+	p.waitKeyframe = p.sawVideo
+}
+
+// shouldFailoverLocked reports whether the stream should switch from the
+// active publisher to p. A backup takes over when the primary is gone or has
+// stalled; the primary takes back over once it has been stable for
+// FailoverRecoveryDelay. The caller holds writeMutex.
+func (sp *StreamProcess) shouldFailoverLocked(p *Publisher, now time.Time) bool {
+	switch {
+	case p == sp.backup && sp.active == sp.primary:
+		return sp.primary == nil || now.Sub(sp.primary.lastMediaAt) > sp.config.FailoverStallTimeout
+	case p == sp.primary && sp.active == sp.backup:
+		return now.Sub(p.streamingSince) >= sp.config.FailoverRecoveryDelay
+	}
+	return false
+}
+
+// publishEvent reports a publisher event for this stream
+func (sp *StreamProcess) publishEvent(eventType events.Type, message string, p *Publisher) {
+	sp.manager.events.Publish(events.Event{
+		Type:    eventType,
+		Stream:  sp.username,
+		Message: message,
+		Data:    map[string]interface{}{"publisher_id": p.id, "role": p.role},
+	})
+}
+
+// publishersLocked describes the attached publishers. The caller holds writeMutex.
+func (sp *StreamProcess) publishersLocked() []PublisherInfo {
+	var infos []PublisherInfo
+	describe := func(p *Publisher, standby bool) {
+		info := PublisherInfo{
+			ID:            p.id,
+			Role:          p.role,
+			Active:        p == sp.active,
+			Standby:       standby,
+			ConnectedAt:   p.connectedAt,
+			VideoCodec:    p.videoCodec,
+			AudioCodec:    p.audioCodec,
+			MalformedTags: p.malformedTags,
+		}
+		if !p.lastMediaAt.IsZero() {
+			lastMediaAt := p.lastMediaAt
+			info.LastMediaAt = &lastMediaAt
+		}
+		infos = append(infos, info)
+	}
+	for _, p := range []*Publisher{sp.primary, sp.backup} {
+		if p != nil {
+			describe(p, false)
+		}
+	}
+	for _, p := range sp.standby {
+		describe(p, true)
+	}
+	return infos
+}
+
+// ID returns the identifier of this publisher, unique within its stream
+func (p *Publisher) ID() uint64 {
+	return p.id
+}
+
+// Role returns the ingest role of this publisher
+func (p *Publisher) Role() Role {
+	return p.role
+}
+
+// Stream returns the stream this publisher writes into
+func (p *Publisher) Stream() *StreamProcess {
+	return p.stream
+}
+
+// WriteAudio writes an audio tag
+func (p *Publisher) WriteAudio(timestamp uint32, data []byte) error {
+	return p.write(flv.TagTypeAudio, timestamp, data)
+}
+
+// WriteVideo writes a video tag
+func (p *Publisher) WriteVideo(timestamp uint32, data []byte) error {
+	return p.write(flv.TagTypeVideo, timestamp, data)
+}
+
+// WriteScript writes a script tag (metadata)
+func (p *Publisher) WriteScript(timestamp uint32, data []byte) error {
+	return p.write(flv.TagTypeScript, timestamp, data)
+}
+
+// SetMetadataPolicy sets the limits this publisher's onMetaData is checked
+// against
+func (p *Publisher) SetMetadataPolicy(policy config.MetadataPolicy) {
+	p.stream.writeMutex.Lock()
+	defer p.stream.writeMutex.Unlock()
+	p.policy = policy
+}
+
+// Metadata returns the latest onMetaData sent by this publisher, if any
+func (p *Publisher) Metadata() *flv.StreamMetadata {
+	p.stream.writeMutex.Lock()
+	defer p.stream.writeMutex.Unlock()
+	return p.metadata
+}
+
+// Close detaches the publisher. If it was the active publisher the stream
+// fails over to another publisher or waits for a reconnection.
+func (p *Publisher) Close(cfg config.Config) {
+	p.stream.detach(p, cfg)
+}
+
+// BoundPublisher is a publisher closed with the configuration it is bound
+// to, for ingests that close it once their connection or session ends
+type BoundPublisher struct {
+	*Publisher
+	config config.Config
+}
+
+// Bind returns the publisher bound to cfg
+func (p *Publisher) Bind(cfg config.Config) BoundPublisher {
+	return BoundPublisher{p, cfg}
+}
+
+// Close detaches the publisher; the stream waits ReconnectDelay for it
+func (p BoundPublisher) Close() {
+	p.Publisher.Close(p.config)
+}
+
+// write rebases the timestamp and hands the tag to the stream. Tags are
+// queued outside writeMutex, so a publisher blocked by a full queue does not
+// hold up the rest of the stream.
+func (p *Publisher) write(tagType byte, timestamp uint32, data []byte) error {
+	sp := p.stream
+	sp.writeMutex.Lock()
+	tags, err := p.prepareLocked(tagType, timestamp, data)
+	if len(tags) == 0 {
+		sp.writeMutex.Unlock()
+		return err
+	}
+	// Taken before releasing writeMutex so tags are queued in timeline order
+	sp.enqueueMutex.Lock()
+	sp.writeMutex.Unlock()
+	defer sp.enqueueMutex.Unlock()
+
+	for _, tag := range tags {
+		sp.queue.push(tag)
+	}
+	return nil
+}
+
+// prepareLocked parses a tag, applies failover and keyframe gating, and
+// returns the rebased tags to queue, which may include cached sequence
+// headers. The caller holds writeMutex.
+func (p *Publisher) prepareLocked(tagType byte, timestamp uint32, data []byte) ([]flv.Tag, error) {
+	sp := p.stream
+	if p.closed {
+		return nil, ErrPublisherEvicted
+	}
+	if p.rejected != nil {
+		return nil, p.rejected
+	}
+
+	tag, err := flv.ParseTag(tagType, timestamp, data)
+	if err != nil {
+		// Malformed tags are dropped rather than fed to FFmpeg; the
+		// connection is kept since encoders occasionally send empty tags
+		if p.malformedTags == 0 {
+			log.Printf("Dropping malformed tag from publisher %d of stream %s: %v", p.id, sp.username, err)
+		}
+		p.malformedTags++
+		return nil, nil
+	}
+
+	switch {
+	case tag.Metadata != nil:
+		if err := checkMetadata(p.policy, tag.Metadata); err != nil {
+			p.rejected = err
+			sp.publishEvent(events.PublisherRejected, fmt.Sprintf("%s publisher %d rejected: %v", p.role, p.id, err), p)
+			return nil, err
+		}
+		p.metadata = tag.Metadata
+		if p == sp.active {
+			sp.metadata = tag.Metadata
+		}
+	case tag.Video != nil:
+		p.videoCodec = tag.Video.Codec()
+		if !videoAccepted(p.videoCodec, sp.config.VideoPolicy) {
+			p.rejected = fmt.Errorf("%w: %s", ErrCodecRejected, p.videoCodec)
+			sp.publishEvent(events.PublisherRejected, fmt.Sprintf("%s publisher %d rejected: %v", p.role, p.id, p.rejected), p)
+			return nil, p.rejected
+		}
+		if tag.IsSequenceHeader() {
+			p.videoSeqHeader = tag.Clone()
+		}
+	case tag.Audio != nil:
+		p.audioCodec = tag.Audio.Codec()
+		if tag.IsSequenceHeader() {
+			p.audioSeqHeader = tag.Clone()
+		}
+	}
+	isKeyframe := tag.IsKeyframe()
+	if tagType != flv.TagTypeScript {
+		now := time.Now()
+		if p.lastMediaAt.IsZero() || now.Sub(p.lastMediaAt) > sp.config.FailoverStallTimeout {
+			p.streamingSince = now
+		}
+		p.lastMediaAt = now
+		if tagType == flv.TagTypeVideo {
+			p.sawVideo = true
+		}
+
+		if p != sp.active && (isKeyframe || !p.sawVideo) && sp.shouldFailoverLocked(p, now) {
+			sp.activateLocked(p)
+			sp.publishEvent(events.PublisherPromoted, fmt.Sprintf("failover to %s publisher %d", p.role, p.id), p)
+		}
+	}
+
+	if p != sp.active {
+		return nil, nil // standby and inactive publishers are kept warm but not forwarded
+	}
+	if p.waitKeyframe {
+		// Headers are cached above and flushed with the keyframe
+		if !isKeyframe {
+			return nil, nil
+		}
+		p.waitKeyframe = false
+	}
+
+	tag.Timestamp = p.rebaseLocked(timestamp)
+	var tags []flv.Tag
+	if !p.started {
+		p.started = true
+		// A publisher taking over sent its sequence headers while inactive;
+		// only the one this tag replaces is left out
+		for _, header := range []flv.Tag{p.videoSeqHeader, p.audioSeqHeader} {
+			if header.Data != nil && !(tag.IsSequenceHeader() && header.Type == tagType) {
+				header.Timestamp = tag.Timestamp
+				tags = append(tags, header)
+			}
+		}
+	}
+
+	if tagType != flv.TagTypeScript {
+		sp.MarkLive()
+	}
+	sp.advanceLocked(tag.Timestamp)
+	return append(tags, tag), nil
+}
+
+// rebaseLocked maps an incoming timestamp onto the stream timeline,
+// computing the offset on the first tag. The caller holds writeMutex.
+func (p *Publisher) rebaseLocked(timestamp uint32) uint32 {
+	if !p.started {
+		p.offset = 0
+		if p.stream.hasTimestamp {
+			p.offset = int64(p.stream.lastTimestamp) + reconnectTimestampGap - int64(timestamp)
+		}
+	}
+
+	rebased := int64(timestamp) + p.offset
+	if rebased < 0 {
+		rebased = 0
+	}
+	return uint32(rebased)
+}
@@ -0,0 +1,333 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/yutopp/go-amf0"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/flv"
+)
+
+// newBufferedStream returns a stream whose FLV feed goes into a buffer
+func newBufferedStream(t *testing.T) (*StreamProcess, *bytes.Buffer) {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.OutputDir = t.TempDir()
+
+	buf := &bytes.Buffer{}
+	sp := newStreamProcess("alice", cfg.OutputDir, NewManager(), cfg)
+	sp.transcoder = &transcoder{writer: flv.NewWriter(buf), done: make(chan struct{})}
+	return sp, buf
+}
+
+// readTags waits for the queued tags to be delivered and decodes the FLV feed
+func readTags(t *testing.T, sp *StreamProcess, buf *bytes.Buffer) []flv.Tag {
+	t.Helper()
+	sp.queue.flush()
+	return readFeed(t, buf)
+}
+
+// readFeed decodes the FLV feed written into buf
+func readFeed(t *testing.T, buf *bytes.Buffer) []flv.Tag {
+	t.Helper()
+	reader := flv.NewReader(bytes.NewReader(buf.Bytes()))
+	var tags []flv.Tag
+	for {
+		tag, err := reader.ReadTag()
+		if err == io.EOF {
+			return tags
+		}
+		if err != nil {
+			t.Fatalf("invalid FLV feed: %v", err)
+		}
+		tags = append(tags, tag)
+	}
+}
+
+// mustAttach attaches a primary publisher and fails the test if it is refused
+func mustAttach(t *testing.T, sp *StreamProcess) *Publisher {
+	t.Helper()
+	return mustAttachRole(t, sp, RolePrimary)
+}
+
+// mustAttachRole attaches a publisher with the given role
+func mustAttachRole(t *testing.T, sp *StreamProcess, role Role) *Publisher {
+	t.Helper()
+	p, err := sp.Attach(role, nil)
+	if err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	return p
+}
+
+func TestPublisherReconnectRebasesTimestamps(t *testing.T) {
+	sp, buf := newBufferedStream(t)
+	avcHeader := []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x64}
+	aacHeader := []byte{0xaf, 0x00, 0x12, 0x10}
+
+	first := mustAttach(t, sp)
+	for _, err := range []error{
+		first.WriteVideo(1000, avcHeader),
+		first.WriteAudio(1000, aacHeader),
+		first.WriteVideo(1000, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xaa}),
+		first.WriteVideo(1033, []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0xbb}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The reconnecting encoder restarts at zero and re-sends identical headers
+	first.Close(sp.config)
+	second := mustAttach(t, sp)
+	for _, err := range []error{
+		second.WriteVideo(0, avcHeader),
+		second.WriteAudio(0, aacHeader),
+		second.WriteVideo(0, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xcc}),
+		second.WriteAudio(21, []byte{0xaf, 0x01, 0xdd}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tags := readTags(t, sp, buf)
+	expected := []uint32{1000, 1000, 1000, 1033, 1073, 1094}
+	if len(tags) != len(expected) {
+		t.Fatalf("wrote %d tags, expected %d (duplicate sequence headers must be dropped)", len(tags), len(expected))
+	}
+	for i, tag := range tags {
+		if tag.Timestamp != expected[i] {
+			t.Errorf("tag %d timestamp = %d, expected %d", i, tag.Timestamp, expected[i])
+		}
+	}
+	if !bytes.Equal(tags[4].Data, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xcc}) {
+		t.Errorf("first tag after reconnect = %x, expected the new keyframe", tags[4].Data)
+	}
+	if bytes.Count(buf.Bytes(), []byte("FLV")) != 1 {
+		t.Errorf("expected a single FLV header in the feed")
+	}
+}
+
+func TestDuplicatePublisherPolicies(t *testing.T) {
+	keyframe := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xaa}
+	interframe := []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0xbb}
+	standbyHeader := []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x4d, 0x00, 0x1f}
+
+	t.Run("reject", func(t *testing.T) {
+		sp, _ := newBufferedStream(t)
+		sp.config.DuplicatePublisherPolicy = config.DuplicatePublisherReject
+		mustAttach(t, sp)
+		if _, err := sp.Attach(RolePrimary, nil); err != ErrPublisherExists {
+			t.Fatalf("Attach() error = %v, expected ErrPublisherExists", err)
+		}
+	})
+
+	t.Run("takeover", func(t *testing.T) {
+		sp, buf := newBufferedStream(t)
+		sp.config.DuplicatePublisherPolicy = config.DuplicatePublisherTakeover
+		evicted := make(chan struct{})
+		old, err := sp.Attach(RolePrimary, func() { close(evicted) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		newcomer := mustAttach(t, sp)
+
+		<-evicted
+		if err := old.WriteVideo(0, keyframe); err != ErrPublisherEvicted {
+			t.Errorf("write from evicted publisher error = %v, expected ErrPublisherEvicted", err)
+		}
+		if err := newcomer.WriteVideo(0, keyframe); err != nil {
+			t.Fatal(err)
+		}
+		if tags := readTags(t, sp, buf); len(tags) != 1 {
+			t.Errorf("wrote %d tags, expected only the newcomer's", len(tags))
+		}
+	})
+
+	t.Run("vacant", func(t *testing.T) {
+		sp, _ := newBufferedStream(t)
+		sp.config.DuplicatePublisherPolicy = config.DuplicatePublisherTakeover
+		mustAttach(t, sp)
+		if _, err := sp.AttachVacant(RolePrimary, nil); err != ErrPublisherExists {
+			t.Fatalf("AttachVacant() error = %v, expected ErrPublisherExists", err)
+		}
+		if _, err := sp.AttachVacant(RoleBackup, nil); err != nil {
+			t.Errorf("AttachVacant() of a free slot error = %v", err)
+		}
+	})
+
+	t.Run("standby", func(t *testing.T) {
+		sp, buf := newBufferedStream(t)
+		sp.config.DuplicatePublisherPolicy = config.DuplicatePublisherStandby
+		primary := mustAttach(t, sp)
+		standby := mustAttach(t, sp)
+
+		for _, err := range []error{
+			primary.WriteVideo(500, keyframe),
+			standby.WriteVideo(8900, standbyHeader),
+			standby.WriteVideo(9000, keyframe),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		primary.Close(sp.config)
+		if info := sp.Info(); len(info.Publishers) != 1 || info.Publishers[0].ID != standby.ID() {
+			t.Fatalf("Publishers = %+v, expected the standby to be promoted", info.Publishers)
+		}
+		// Promotion waits for the standby's next keyframe
+		for _, err := range []error{
+			standby.WriteVideo(9033, interframe),
+			standby.WriteVideo(9066, keyframe),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tags := readTags(t, sp, buf)
+		if len(tags) != 3 || !bytes.Equal(tags[1].Data, standbyHeader) || tags[2].Timestamp != 500+reconnectTimestampGap {
+			t.Fatalf("tags = %+v, expected the primary keyframe, then the standby's sequence header and rebased keyframe", tags)
+		}
+		if sp.State() != StateLive {
+			t.Errorf("State() = %s, expected the stream to stay live across the promotion", sp.State())
+		}
+	})
+}
+
+func TestPrimaryBackupFailover(t *testing.T) {
+	keyframe := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xaa}
+	backupKeyframe := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xbb}
+	backupHeader := []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x4d, 0x00, 0x1f}
+
+	sp, buf := newBufferedStream(t)
+	sp.config.FailoverStallTimeout = 30 * time.Millisecond
+	sp.config.FailoverRecoveryDelay = 60 * time.Millisecond
+	primary := mustAttachRole(t, sp, RolePrimary)
+	backup := mustAttachRole(t, sp, RoleBackup)
+
+	write := func(p *Publisher, timestamp uint32, data []byte) {
+		t.Helper()
+		if err := p.WriteVideo(timestamp, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the primary is forwarded while it is healthy
+	write(primary, 1000, keyframe)
+	write(backup, 4900, backupHeader)
+	write(backup, 5000, backupKeyframe)
+	if tags := readTags(t, sp, buf); len(tags) != 1 {
+		t.Fatalf("wrote %d tags, expected only the primary's", len(tags))
+	}
+
+	// The primary stalls: the backup takes over at its next keyframe, which
+	// its own sequence header precedes
+	time.Sleep(2 * sp.config.FailoverStallTimeout)
+	write(backup, 5100, backupKeyframe)
+	tags := readTags(t, sp, buf)
+	if len(tags) != 3 || !bytes.Equal(tags[1].Data, backupHeader) || !bytes.Equal(tags[2].Data, backupKeyframe) ||
+		tags[2].Timestamp != 1000+reconnectTimestampGap {
+		t.Fatalf("tags = %+v, expected the backup's sequence header and rebased keyframe after failover", tags)
+	}
+
+	// The primary returns but must be stable before switching back
+	write(primary, 1200, keyframe)
+	write(backup, 5200, backupKeyframe)
+	if tags := readTags(t, sp, buf); !bytes.Equal(tags[len(tags)-1].Data, backupKeyframe) {
+		t.Fatalf("switched back to an unstable primary")
+	}
+	timestamp := uint32(1200)
+	for deadline := time.Now().Add(sp.config.FailoverRecoveryDelay); time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		timestamp += 5
+		write(primary, timestamp, []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0xcc})
+	}
+	write(primary, timestamp+5, keyframe)
+
+	tags = readTags(t, sp, buf)
+	last := tags[len(tags)-1]
+	if !bytes.Equal(last.Data, keyframe) || last.Timestamp != tags[len(tags)-2].Timestamp+reconnectTimestampGap {
+		t.Fatalf("tags = %+v, expected a rebased primary keyframe after recovery", tags)
+	}
+	for _, info := range sp.Info().Publishers {
+		if info.Active != (info.Role == RolePrimary) {
+			t.Errorf("publisher %+v has the wrong active flag", info)
+		}
+	}
+}
+
+func TestPublisherParsesTags(t *testing.T) {
+	sp, buf := newBufferedStream(t)
+	p := mustAttach(t, sp)
+
+	for _, err := range []error{
+		p.WriteVideo(0, []byte{0x90, 'h', 'v', 'c', '1', 0x01}),
+		p.WriteVideo(0, []byte{}), // malformed, dropped
+		p.WriteVideo(0, []byte{0x91, 'h', 'v', 'c', '1', 0x00, 0x00, 0x00, 0x26}),
+		p.WriteAudio(0, []byte{0xaf}), // malformed, dropped
+		p.WriteAudio(0, []byte{0xaf, 0x00, 0x12, 0x10}),
+	} {
+		if err != nil {
+			t.Fatalf("write error = %v", err)
+		}
+	}
+
+	if tags := readTags(t, sp, buf); len(tags) != 3 {
+		t.Errorf("got %d tags, expected the 3 well formed ones", len(tags))
+	}
+	info := sp.Info().Publishers[0]
+	if info.VideoCodec != "hevc" || info.AudioCodec != "aac" || info.MalformedTags != 2 {
+		t.Errorf("publisher info = %+v, expected hevc/aac with 2 malformed tags", info)
+	}
+}
+
+// onMetaData encodes an @setDataFrame payload as sent by RTMP encoders
+func onMetaData(t *testing.T, object amf0.ECMAArray) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	encoder := amf0.NewEncoder(buf)
+	for _, v := range []interface{}{"onMetaData", object} {
+		if err := encoder.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestPublisherMetadataPolicy(t *testing.T) {
+	sp, buf := newBufferedStream(t)
+	policy := config.MetadataPolicy{MaxHeight: 1080, MaxVideoBitrate: 8000}
+
+	p := mustAttach(t, sp)
+	p.SetMetadataPolicy(policy)
+	if err := p.WriteScript(0, onMetaData(t, amf0.ECMAArray{"width": 1280.0, "height": 720.0, "videodatarate": 2500.0})); err != nil {
+		t.Fatalf("WriteScript() error = %v", err)
+	}
+	if md := sp.Info().Metadata; md == nil || md.Height != 720 || md.VideoDataRate != 2500 {
+		t.Errorf("stream metadata = %+v, expected 720p at 2500 kbit/s", md)
+	}
+	if tags := readTags(t, sp, buf); len(tags) != 1 || tags[0].Type != flv.TagTypeScript {
+		t.Errorf("tags = %+v, expected the onMetaData tag", tags)
+	}
+
+	backup := mustAttachRole(t, sp, RoleBackup)
+	backup.SetMetadataPolicy(policy)
+	err := backup.WriteScript(0, onMetaData(t, amf0.ECMAArray{"width": 3840.0, "height": 2160.0}))
+	if !errors.Is(err, ErrMetadataRejected) {
+		t.Fatalf("WriteScript() error = %v, expected ErrMetadataRejected", err)
+	}
+	if err := backup.WriteVideo(0, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}); !errors.Is(err, ErrMetadataRejected) {
+		t.Errorf("WriteVideo() after rejection error = %v, expected ErrMetadataRejected", err)
+	}
+	if md := sp.Info().Metadata; md.Height != 720 {
+		t.Errorf("stream metadata = %+v, expected the active publisher's", md)
+	}
+}
@@ -0,0 +1,264 @@
+package stream
+
+import (
+	"sync"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/flv"
+)
+
+// QueueStats reports the state of a stream's frame queue
+type QueueStats struct {
+	Depth        int    `json:"depth"`
+	Capacity     int    `json:"capacity"`
+	Policy       string `json:"policy"`
+	DroppedVideo uint64 `json:"dropped_video_frames"`
+	DroppedAudio uint64 `json:"dropped_audio_frames"`
+	DroppedGOPs  uint64 `json:"dropped_gops"`
+	Blocked      uint64 `json:"blocked_writes"`
+}
+
+// frameQueue is a bounded FIFO of tags between the publishers of a stream
+// and the goroutine feeding FFmpeg, so a slow FFmpeg never stalls the RTMP
+// read loop. When the queue is full the overflow policy decides what to
+// shed. Sequence headers and script tags are never dropped.
+type frameQueue struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	tags     []flv.Tag
+	capacity int
+	policy   string
+	closed   bool
+	busy     bool // the consumer is delivering the last popped tag
+
+	// skipToKeyframe is set once frames of the newest GOP were dropped: the
+	// frames that follow depend on them and are dropped up to the next keyframe
+	skipToKeyframe bool
+
+	stats QueueStats
+}
+
+// newFrameQueue creates a queue holding at most capacity tags
+func newFrameQueue(capacity int, policy string) *frameQueue {
+	if capacity < 1 {
+		capacity = 1
+	}
+	switch policy {
+	case config.QueueOverflowDropFrames, config.QueueOverflowDropGOP, config.QueueOverflowBlock:
+	default:
+		policy = config.QueueOverflowDropFrames
+	}
+
+	q := &frameQueue{capacity: capacity, policy: policy}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// push appends a tag, shedding older frames or blocking when the queue is
+// full depending on the policy. Tags pushed after close are discarded.
+func (q *frameQueue) push(tag flv.Tag) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	waited := false
+	for {
+		if q.closed {
+			return
+		}
+		if q.skipToKeyframe && tag.Type == flv.TagTypeVideo && !tag.IsSequenceHeader() {
+			if !tag.IsKeyframe() {
+				q.countDropLocked(tag)
+				return
+			}
+			q.skipToKeyframe = false
+		}
+		if len(q.tags) < q.capacity {
+			break
+		}
+
+		if q.policy == config.QueueOverflowBlock {
+			if !waited {
+				waited = true
+				q.stats.Blocked++
+			}
+			q.cond.Wait()
+			continue
+		}
+		if !q.shedLocked() {
+			// Nothing left to shed: drop the newcomer, or let a header in
+			// over capacity rather than lose it
+			if droppable(tag) {
+				q.countDropLocked(tag)
+				return
+			}
+			break
+		}
+	}
+
+	q.tags = append(q.tags, tag)
+	q.cond.Broadcast()
+}
+
+// pop removes the oldest tag, waiting for one to arrive. It returns false
+// once the queue is closed; tags still queued at that point are discarded.
+func (q *frameQueue) pop() (flv.Tag, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.busy = false
+	q.cond.Broadcast()
+	for len(q.tags) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return flv.Tag{}, false
+	}
+
+	tag := q.tags[0]
+	q.tags[0] = flv.Tag{}
+	q.tags = q.tags[1:]
+	q.busy = true
+	q.cond.Broadcast()
+	return tag, true
+}
+
+// flush waits until every queued tag has been delivered by the consumer
+func (q *frameQueue) flush() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for (len(q.tags) > 0 || q.busy) && !q.closed {
+		q.cond.Wait()
+	}
+}
+
+// close discards the queued tags and releases blocked producers and the consumer
+func (q *frameQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	q.tags = nil
+	q.cond.Broadcast()
+}
+
+// snapshot returns the queue counters and current depth
+func (q *frameQueue) snapshot() QueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	stats := q.stats
+	stats.Depth = len(q.tags)
+	stats.Capacity = q.capacity
+	stats.Policy = q.policy
+	return stats
+}
+
+// shedLocked makes room according to the overflow policy and reports
+// whether anything was dropped
+func (q *frameQueue) shedLocked() bool {
+	if q.policy == config.QueueOverflowDropFrames && q.dropFrameLocked() {
+		return true
+	}
+	return q.dropGOPLocked()
+}
+
+// dropFrameLocked drops the last non-key video frame of the oldest GOP that
+// has one. Frames are taken from the end of a GOP so nothing left in the
+// queue references them.
+func (q *frameQueue) dropFrameLocked() bool {
+	for start := 0; start < len(q.tags); {
+		end := q.gopEndLocked(start)
+		open := end == len(q.tags)
+		for i := end - 1; i >= start; i-- {
+			tag := q.tags[i]
+			if tag.Type == flv.TagTypeVideo && droppable(tag) && !tag.IsKeyframe() {
+				q.removeLocked(i)
+				q.countDropLocked(tag)
+				if open {
+					q.skipToKeyframe = true // the GOP is still being received
+				}
+				return true
+			}
+		}
+		start = end
+	}
+	return false
+}
+
+// dropGOPLocked drops every droppable tag of the oldest GOP. Without video
+// there are no GOPs and only the oldest droppable tag goes.
+func (q *frameQueue) dropGOPLocked() bool {
+	start := 0
+	for start < len(q.tags) && !droppable(q.tags[start]) {
+		start++ // leading headers do not open a GOP
+	}
+	if start == len(q.tags) {
+		return false
+	}
+
+	end := q.gopEndLocked(start)
+	hasVideo := false
+	for _, tag := range q.tags[start:end] {
+		if tag.Type == flv.TagTypeVideo && droppable(tag) {
+			hasVideo = true
+			break
+		}
+	}
+	if !hasVideo {
+		q.countDropLocked(q.tags[start])
+		q.removeLocked(start)
+		return true
+	}
+
+	open := end == len(q.tags)
+	kept := q.tags[:start]
+	for _, tag := range q.tags[start:end] {
+		if droppable(tag) {
+			q.countDropLocked(tag)
+		} else {
+			kept = append(kept, tag)
+		}
+	}
+	kept = append(kept, q.tags[end:]...)
+	for i := len(kept); i < len(q.tags); i++ {
+		q.tags[i] = flv.Tag{}
+	}
+	q.tags = kept
+	q.stats.DroppedGOPs++
+	if open {
+		q.skipToKeyframe = true
+	}
+	return true
+}
+
+// gopEndLocked returns the index of the first keyframe after start, or the
+// queue length when the GOP starting at start is the newest one
+func (q *frameQueue) gopEndLocked(start int) int {
+	for i := start + 1; i < len(q.tags); i++ {
+		if q.tags[i].IsKeyframe() {
+			return i
+		}
+	}
+	return len(q.tags)
+}
+
+// removeLocked removes the tag at index i
+func (q *frameQueue) removeLocked(i int) {
+	copy(q.tags[i:], q.tags[i+1:])
+	q.tags[len(q.tags)-1] = flv.Tag{}
+	q.tags = q.tags[:len(q.tags)-1]
+}
+
+// countDropLocked records a dropped tag in the counters
+func (q *frameQueue) countDropLocked(tag flv.Tag) {
+	if tag.Type == flv.TagTypeVideo {
+		q.stats.DroppedVideo++
+	} else {
+		q.stats.DroppedAudio++
+	}
+}
+
+// droppable reports whether the queue may shed a tag: only coded frames
+// are. Sequence headers, metadata and script tags apply to every frame that
+// follows and are always kept.
+func droppable(tag flv.Tag) bool {
+	return isMedia(tag)
+}
@@ -0,0 +1,224 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/flv"
+)
+
+var (
+	testVideoHeader = flv.Tag{Type: flv.TagTypeVideo, Data: []byte{0x17, 0x00, 0x00, 0x00, 0x00}}
+	testAudioHeader = flv.Tag{Type: flv.TagTypeAudio, Data: []byte{0xaf, 0x00, 0x12, 0x10}}
+)
+
+// testFrame builds a tag: 'K' keyframe, 'P' inter frame, 'A' AAC frame
+func testFrame(kind byte, timestamp uint32) flv.Tag {
+	switch kind {
+	case 'K':
+		return flv.Tag{Type: flv.TagTypeVideo, Timestamp: timestamp, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, kind}}
+	case 'P':
+		return flv.Tag{Type: flv.TagTypeVideo, Timestamp: timestamp, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, kind}}
+	}
+	return flv.Tag{Type: flv.TagTypeAudio, Timestamp: timestamp, Data: []byte{0xaf, 0x01, kind}}
+}
+
+// queueKinds describes the queue content, 'V'/'H' for video/audio headers
+func queueKinds(q *frameQueue) string {
+	var kinds []byte
+	for _, tag := range q.tags {
+		switch {
+		case tag.IsSequenceHeader() && tag.Type == flv.TagTypeVideo:
+			kinds = append(kinds, 'V')
+		case tag.IsSequenceHeader():
+			kinds = append(kinds, 'H')
+		default:
+			kinds = append(kinds, tag.Data[len(tag.Data)-1])
+		}
+	}
+	return string(kinds)
+}
+
+func TestFrameQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        string
+		capacity      int
+		push          string
+		expectedQueue string
+		expectedVideo uint64
+		expectedAudio uint64
+		expectedGOPs  uint64
+	}{
+		{
+			name:          "Drop frames takes the tail of the oldest GOP first",
+			policy:        config.QueueOverflowDropFrames,
+			capacity:      6,
+			push:          "KPPPKPP",
+			expectedQueue: "KPPKPP",
+			expectedVideo: 1,
+		},
+		{
+			name:          "Drop frames skips the rest of the newest GOP",
+			policy:        config.QueueOverflowDropFrames,
+			capacity:      3,
+			push:          "KPPPPK",
+			expectedQueue: "KPK",
+			expectedVideo: 3,
+		},
+		{
+			name:          "Drop frames falls back to whole GOPs",
+			policy:        config.QueueOverflowDropFrames,
+			capacity:      3,
+			push:          "KAKAK",
+			expectedQueue: "KAK",
+			expectedVideo: 1,
+			expectedAudio: 1,
+			expectedGOPs:  1,
+		},
+		{
+			name:          "Drop GOP drops the oldest GOP at once",
+			policy:        config.QueueOverflowDropGOP,
+			capacity:      5,
+			push:          "KPAPKP",
+			expectedQueue: "KP",
+			expectedVideo: 3,
+			expectedAudio: 1,
+			expectedGOPs:  1,
+		},
+		{
+			name:          "Audio only drops the oldest frame",
+			policy:        config.QueueOverflowDropGOP,
+			capacity:      3,
+			push:          "HAAAA",
+			expectedQueue: "HAA",
+			expectedAudio: 2,
+		},
+		{
+			name:          "Sequence headers are never dropped",
+			policy:        config.QueueOverflowDropGOP,
+			capacity:      4,
+			push:          "VHKPKP",
+			expectedQueue: "VHKP",
+			expectedVideo: 2,
+			expectedGOPs:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newFrameQueue(tt.capacity, tt.policy)
+			for i, kind := range []byte(tt.push) {
+				tag := testFrame(kind, uint32(i*33))
+				switch kind {
+				case 'V':
+					tag = testVideoHeader
+				case 'H':
+					tag = testAudioHeader
+				}
+				q.push(tag)
+			}
+
+			if got := queueKinds(q); got != tt.expectedQueue {
+				t.Errorf("queue = %q, expected %q", got, tt.expectedQueue)
+			}
+			stats := q.snapshot()
+			if stats.DroppedVideo != tt.expectedVideo || stats.DroppedAudio != tt.expectedAudio || stats.DroppedGOPs != tt.expectedGOPs {
+				t.Errorf("dropped video/audio/gops = %d/%d/%d, expected %d/%d/%d",
+					stats.DroppedVideo, stats.DroppedAudio, stats.DroppedGOPs,
+					tt.expectedVideo, tt.expectedAudio, tt.expectedGOPs)
+			}
+			if stats.Depth != len(tt.expectedQueue) || stats.Capacity != tt.capacity {
+				t.Errorf("depth/capacity = %d/%d, expected %d/%d", stats.Depth, stats.Capacity, len(tt.expectedQueue), tt.capacity)
+			}
+		})
+	}
+}
+
+func TestFrameQueueBlockPolicy(t *testing.T) {
+	q := newFrameQueue(1, config.QueueOverflowBlock)
+	q.push(testFrame('K', 0))
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push(testFrame('P', 33))
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push returned while the queue was full")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if tag, ok := q.pop(); !ok || !tag.IsKeyframe() {
+		t.Fatalf("pop() = %v, %v, expected the keyframe", tag, ok)
+	}
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("push still blocked after the queue drained")
+	}
+
+	stats := q.snapshot()
+	if stats.Blocked != 1 || stats.DroppedVideo != 0 {
+		t.Errorf("blocked/dropped = %d/%d, expected 1/0", stats.Blocked, stats.DroppedVideo)
+	}
+
+	// Closing releases a blocked publisher
+	released := make(chan struct{})
+	go func() {
+		q.push(testFrame('P', 66))
+		close(released)
+	}()
+	q.close()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("push still blocked after close")
+	}
+}
+
+func TestSlowTranscoderDoesNotBlockPublisher(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.QueueSize = 8
+	release := make(chan struct{})
+	defer close(release)
+
+	sp := newStreamProcess("alice", t.TempDir(), NewManager(), cfg)
+	sp.transcoder = &transcoder{writer: flv.NewWriter(blockingWriter(release)), done: make(chan struct{})}
+
+	p := mustAttach(t, sp)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			frame := []byte{0x27, 0x01, 0x00, 0x00, 0x00}
+			if i%30 == 0 {
+				frame[0] = 0x17
+			}
+			if err := p.WriteVideo(uint32(i*33), frame); err != nil {
+				t.Errorf("WriteVideo() error = %v", err)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publisher blocked by a stuck transcoder")
+	}
+	if info := sp.Info(); info.Queue.DroppedVideo == 0 || info.Queue.Depth > 8 {
+		t.Errorf("queue stats = %+v, expected drops and depth <= 8", info.Queue)
+	}
+}
+
+// blockingWriter is an io.Writer that blocks until release is closed
+type blockingWriter chan struct{}
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w
+	return len(p), nil
+}
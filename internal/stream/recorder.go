@@ -0,0 +1,296 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/events"
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/mp4"
+)
+
+// recordedFile describes a finished recording file
+type recordedFile struct {
+	Path      string
+	Size      int64
+	Duration  float64 // seconds
+	Keyframes int
+}
+
+// recordingFile is a file being recorded in one of the recording formats
+type recordingFile interface {
+	WriteTag(tag flv.Tag) error
+	Size() int64
+	finish() (recordedFile, error)
+}
+
+// flvRecording records the FLV as received, with a keyframes index
+type flvRecording struct{ *flv.IndexedFile }
+
+func (f flvRecording) finish() (recordedFile, error) {
+	info, err := f.Close()
+	return recordedFile(info), err
+}
+
+// mp4Recording muxes the recording into MP4
+type mp4Recording struct{ *mp4.File }
+
+func (f mp4Recording) finish() (recordedFile, error) {
+	info, err := f.Close()
+	return recordedFile(info), err
+}
+
+// createRecordingFile starts a file in format at path, without extension
+func createRecordingFile(format, path string) (recordingFile, error) {
+	switch format {
+	case config.RecordFormatFLV:
+		f, err := flv.CreateIndexedFile(path + ".flv")
+		return flvRecording{f}, err
+	case config.RecordFormatMP4:
+		f, err := mp4.Create(path + ".mp4")
+		return mp4Recording{f}, err
+	}
+	return nil, fmt.Errorf("unknown recording format %q", format)
+}
+
+// recorder archives a stream's incoming FLV into one file per recording
+// format. It is owned by the dispatcher goroutine, so it sees the stream's
+// single timeline across publishers.
+type recorder struct {
+	stream      string
+	app         string
+	dir         string
+	template    string
+	formats     []string
+	maxSize     int64
+	maxDuration uint32 // milliseconds
+	events      *events.Bus
+	now         func() time.Time
+
+	files          []recordingFile // empty between files
+	base           uint32          // stream timestamp of the file's first tag
+	videoSeqHeader flv.Tag         // replayed at the start of each file
+	audioSeqHeader flv.Tag
+	metadata       []byte // last onMetaData body, replayed at the start of each file
+	hasVideo       bool
+}
+
+// newRecorder creates a recorder for a stream published to app. Files are
+// only created once media arrives.
+func newRecorder(stream, app string, sp *StreamProcess) *recorder {
+	return &recorder{
+		stream:      stream,
+		app:         app,
+		dir:         sp.config.RecordDir,
+		template:    sp.config.RecordPath,
+		formats:     sp.config.RecordFormats,
+		maxSize:     sp.config.RecordMaxSize,
+		maxDuration: uint32(sp.config.RecordMaxDuration.Milliseconds()),
+		events:      sp.manager.events,
+		now:         time.Now,
+	}
+}
+
+// write records a tag. Sequence headers and onMetaData are kept to start
+// each file with; a file is opened at the first media tag and split at the
+// first keyframe past the size or duration limit.
+func (r *recorder) write(tag flv.Tag) error {
+	switch {
+	case tag.Type == flv.TagTypeScript:
+		if tag.Metadata == nil {
+			return nil
+		}
+		r.metadata = append([]byte(nil), tag.Data...)
+		return r.setMetadata()
+	case tag.Video != nil && tag.Video.IsSequenceEnd():
+		return nil
+	case tag.IsSequenceHeader():
+		if tag.Type == flv.TagTypeVideo {
+			r.videoSeqHeader = tag.Clone()
+		} else {
+			r.audioSeqHeader = tag.Clone()
+		}
+		if r.files == nil {
+			return nil
+		}
+		return r.writeTag(tag)
+	}
+
+	if tag.Video != nil {
+		r.hasVideo = true
+	}
+	if r.files != nil && r.limitReached(tag.Timestamp) && r.splitPoint(tag) {
+		if err := r.closeFiles(); err != nil {
+			return err
+		}
+	}
+	if r.files == nil {
+		if err := r.openFiles(tag.Timestamp); err != nil {
+			return err
+		}
+	}
+	return r.writeTag(tag)
+}
+
+// setMetadata passes the last onMetaData to the FLV file being written
+func (r *recorder) setMetadata() error {
+	for _, file := range r.files {
+		if f, ok := file.(flvRecording); ok && r.metadata != nil {
+			if err := f.SetMetadata(r.metadata); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// limitReached reports whether the current files are due to be split. The
+// size limit applies to the largest of them.
+func (r *recorder) limitReached(timestamp uint32) bool {
+	for _, file := range r.files {
+		if r.maxSize > 0 && file.Size() >= r.maxSize {
+			return true
+		}
+	}
+	return r.maxDuration > 0 && timestamp-r.base >= r.maxDuration
+}
+
+// splitPoint reports whether a file may start with tag: a video keyframe,
+// or any audio frame when the stream has no video
+func (r *recorder) splitPoint(tag flv.Tag) bool {
+	if tag.Video != nil {
+		return tag.IsKeyframe()
+	}
+	return tag.Audio != nil && !r.hasVideo
+}
+
+// openFiles starts new files whose timeline begins at base, with the
+// cached onMetaData and sequence headers
+func (r *recorder) openFiles(base uint32) error {
+	path, err := r.nextPath()
+	if err != nil {
+		return err
+	}
+	r.base = base
+	for _, format := range r.formats {
+		file, err := createRecordingFile(format, path)
+		if err != nil {
+			r.closeFiles()
+			return err
+		}
+		r.files = append(r.files, file)
+	}
+
+	if err := r.setMetadata(); err != nil {
+		return err
+	}
+	for _, header := range []flv.Tag{r.videoSeqHeader, r.audioSeqHeader} {
+		if header.Data == nil {
+			continue
+		}
+		header.Timestamp = base
+		if err := r.writeTag(header); err != nil {
+			return err
+		}
+	}
+	log.Printf("Recording stream %s to %s", r.stream, path)
+	return nil
+}
+
+// writeTag writes a tag to the current files, rebased on their start.
+// Tags interleaved slightly ahead of the first one are clamped to zero.
+func (r *recorder) writeTag(tag flv.Tag) error {
+	if tag.Timestamp > r.base {
+		tag.Timestamp -= r.base
+	} else {
+		tag.Timestamp = 0
+	}
+	for _, file := range r.files {
+		if err := file.WriteTag(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeFiles finalizes the current files and announces each of them. An
+// MP4 of a stream without a supported codec is not written.
+func (r *recorder) closeFiles() error {
+	files := r.files
+	r.files = nil
+
+	var firstErr error
+	for i, file := range files {
+		info, err := file.finish()
+		if errors.Is(err, mp4.ErrNoMedia) {
+			continue
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		r.events.Publish(events.Event{
+			Type:    events.RecordingFinished,
+			Stream:  r.stream,
+			Message: fmt.Sprintf("recorded %s (%.1fs, %d bytes)", info.Path, info.Duration, info.Size),
+			Data: map[string]interface{}{
+				"app":       r.app,
+				"format":    r.formats[i],
+				"path":      info.Path,
+				"size":      info.Size,
+				"duration":  info.Duration,
+				"keyframes": info.Keyframes,
+			},
+		})
+	}
+	return firstErr
+}
+
+// nextPath expands the path template for files starting now, without
+// extension. A name already taken in any format, e.g. when a split happens
+// within the same second, gets a numeric suffix.
+func (r *recorder) nextPath() (string, error) {
+	name := strings.NewReplacer(
+		"{app}", pathElement(r.app),
+		"{username}", pathElement(r.stream),
+		"{timestamp}", r.now().UTC().Format("20060102-150405"),
+	).Replace(r.template)
+	path := filepath.Join(r.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	stem := path
+	for i := 1; r.taken(path); i++ {
+		path = fmt.Sprintf("%s-%d", stem, i)
+	}
+	return path, nil
+}
+
+// taken reports whether a file exists at path in any recording format
+func (r *recorder) taken(path string) bool {
+	for _, format := range r.formats {
+		if _, err := os.Stat(path + "." + format); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathElement makes a name safe to use as a single path element
+func pathElement(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
@@ -0,0 +1,156 @@
+package stream
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yutopp/go-amf0"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/events"
+	"rtmp-server-poc/internal/flv"
+)
+
+func TestRecordingSplitsAtKeyframes(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.OutputDir = t.TempDir()
+	cfg.RecordDir = t.TempDir()
+	cfg.RecordMaxDuration = 2 * time.Second
+
+	sp := newStreamProcess("alice", cfg.OutputDir, NewManager(), cfg)
+	sp.transcoder = &transcoder{writer: flv.NewWriter(&strings.Builder{}), done: make(chan struct{})}
+	finished, unsubscribe := sp.manager.events.Subscribe(8)
+	defer unsubscribe()
+
+	sp.EnableRecording("live")
+	p := mustAttach(t, sp)
+	for _, err := range []error{
+		p.WriteScript(0, onMetaData(t, amf0.ECMAArray{"width": 1280.0, "height": 720.0})),
+		p.WriteVideo(0, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}),
+		p.WriteAudio(0, []byte{0xaf, 0x00, 0x12, 0x10}),
+		p.WriteVideo(0, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65}),
+		p.WriteAudio(20, []byte{0xaf, 0x01, 0x21}),
+		p.WriteVideo(2000, []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x41}), // past the limit, not a keyframe
+		p.WriteVideo(2500, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65}), // split
+		p.WriteAudio(2520, []byte{0xaf, 0x01, 0x21}),
+		p.WriteVideo(4500, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65}), // split
+	} {
+		if err != nil {
+			t.Fatalf("write error = %v", err)
+		}
+	}
+	sp.queue.flush()
+	sp.queue.close()
+
+	expected := []struct {
+		duration float64
+		tags     int
+	}{
+		{2.0, 5}, // sequence headers, keyframe, audio, inter frame
+		{0.02, 4},
+		{0, 3},
+	}
+	for i, e := range expected {
+		var event events.Event
+		for event.Type != events.RecordingFinished {
+			select {
+			case event = <-finished:
+			case <-time.After(time.Second):
+				t.Fatalf("file %d: no %s event", i, events.RecordingFinished)
+			}
+		}
+		if event.Data["app"] != "live" {
+			t.Errorf("file %d: event data = %v, expected app live", i, event.Data)
+		}
+		path := event.Data["path"].(string)
+		if dir := filepath.Join(cfg.RecordDir, "live", "alice"); filepath.Dir(path) != dir {
+			t.Errorf("file %d: path = %s, expected a file in %s", i, path, dir)
+		}
+		if event.Data["duration"] != e.duration {
+			t.Errorf("file %d: duration = %v, expected %v", i, event.Data["duration"], e.duration)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("file %d: %v", i, err)
+		}
+		tags := readFeed(t, bytes.NewBuffer(data))
+		if len(tags) != e.tags+1 || tags[0].Type != flv.TagTypeScript {
+			t.Fatalf("file %d: got %d tags, expected onMetaData and %d tags", i, len(tags), e.tags)
+		}
+		if !flv.IsSequenceHeader(tags[1].Type, tags[1].Data) || !flv.IsSequenceHeader(tags[2].Type, tags[2].Data) {
+			t.Errorf("file %d: does not start with the sequence headers", i)
+		}
+		if !flv.IsKeyframe(tags[3].Type, tags[3].Data) || tags[3].Timestamp != 0 {
+			t.Errorf("file %d: first frame at %dms, expected a keyframe at 0", i, tags[3].Timestamp)
+		}
+		md, err := flv.ParseMetadata(tags[0].Data)
+		if err != nil || md.Width != 1280 {
+			t.Errorf("file %d: onMetaData = %+v, %v, expected the publisher's", i, md, err)
+		}
+	}
+}
+
+// avcSequenceHeader carries the AVCDecoderConfigurationRecord of an x264
+// 1080p High profile stream
+var avcSequenceHeader = []byte{
+	0x17, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x64, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x1b,
+	0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00,
+	0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58,
+	0x00,
+}
+
+func TestRecordingMP4(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.OutputDir = t.TempDir()
+	cfg.RecordDir = t.TempDir()
+	cfg.RecordFormats = []string{config.RecordFormatFLV, config.RecordFormatMP4}
+
+	sp := newStreamProcess("alice", cfg.OutputDir, NewManager(), cfg)
+	sp.transcoder = &transcoder{writer: flv.NewWriter(&strings.Builder{}), done: make(chan struct{})}
+	finished, unsubscribe := sp.manager.events.Subscribe(8)
+	defer unsubscribe()
+
+	sp.EnableRecording("live")
+	p := mustAttach(t, sp)
+	for _, err := range []error{
+		p.WriteVideo(0, avcSequenceHeader),
+		p.WriteAudio(0, []byte{0xaf, 0x00, 0x12, 0x10}),
+		p.WriteVideo(0, []byte{0x17, 0x01, 0x00, 0x00, 0x42, 0x65}),
+		p.WriteAudio(20, []byte{0xaf, 0x01, 0x21}),
+		p.WriteVideo(33, []byte{0x27, 0x01, 0x00, 0x00, 0x42, 0x41}),
+	} {
+		if err != nil {
+			t.Fatalf("write error = %v", err)
+		}
+	}
+	sp.queue.flush()
+	sp.queue.close()
+
+	paths := map[string]string{}
+	for len(paths) < 2 {
+		select {
+		case event := <-finished:
+			if event.Type == events.RecordingFinished {
+				paths[event.Data["format"].(string)] = event.Data["path"].(string)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got recordings %v, expected FLV and MP4", paths)
+		}
+	}
+	if strings.TrimSuffix(paths["flv"], ".flv") != strings.TrimSuffix(paths["mp4"], ".mp4") {
+		t.Errorf("recordings %v, expected the same name in both formats", paths)
+	}
+	data, err := os.ReadFile(paths["mp4"])
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if len(data) < 8 || string(data[4:8]) != "ftyp" || !bytes.Contains(data, []byte("avcC")) || !bytes.Contains(data, []byte("esds")) {
+		t.Errorf("%s is not an MP4 file with H.264 and AAC", paths["mp4"])
+	}
+}
@@ -0,0 +1,125 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"rtmp-server-poc/internal/events"
+	"rtmp-server-poc/internal/relay"
+)
+
+var (
+	// ErrRelayExists is returned by AddRelay when the stream already has a
+	// target of that name
+	ErrRelayExists = errors.New("relay target already exists")
+	// ErrRelayNotFound is returned by RemoveRelay for an unknown target
+	ErrRelayNotFound = errors.New("relay target not found")
+)
+
+// EnableRelays forwards the stream to the targets configured for app and
+// its username. Targets already forwarded to are left as they are, so
+// publishers reconnecting do not restart them.
+func (sp *StreamProcess) EnableRelays(app string) {
+	for _, target := range sp.config.RelayTargetsFor(app, sp.username) {
+		if err := sp.AddRelay(target.Name, target.URL); err != nil && !errors.Is(err, ErrRelayExists) {
+			log.Printf("Cannot relay stream %s to %s: %v", sp.username, target.Name, err)
+		}
+	}
+}
+
+// AddRelay forwards the stream to an RTMP or RTMPS URL ending with the
+// stream key, for the rest of its life or until removed. The target reads
+// the stream as a viewer does, so it never holds up the publisher.
+func (sp *StreamProcess) AddRelay(name, url string) error {
+	sp.relayMutex.Lock()
+	defer sp.relayMutex.Unlock()
+	if sp.relaysClosed {
+		return ErrStreamEnded
+	}
+	if _, ok := sp.relays[name]; ok {
+		return ErrRelayExists
+	}
+
+	watch := func() (relay.Source, error) {
+		v, err := sp.Watch()
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	backoff := relay.Backoff{Min: sp.config.RelayBackoffMin, Max: sp.config.RelayBackoffMax}
+	t, err := relay.Start(name, url, watch, backoff, sp.relayChanged)
+	if err != nil {
+		return fmt.Errorf("invalid relay URL: %w", err)
+	}
+	if sp.relays == nil {
+		sp.relays = make(map[string]*relay.Target)
+	}
+	sp.relays[name] = t
+	return nil
+}
+
+// RemoveRelay stops forwarding the stream to a target
+func (sp *StreamProcess) RemoveRelay(name string) error {
+	sp.relayMutex.Lock()
+	t, ok := sp.relays[name]
+	delete(sp.relays, name)
+	sp.relayMutex.Unlock()
+	if !ok {
+		return ErrRelayNotFound
+	}
+	t.Stop()
+	return nil
+}
+
+// Relays returns the status of the stream's targets, sorted by name
+func (sp *StreamProcess) Relays() []relay.Status {
+	sp.relayMutex.Lock()
+	defer sp.relayMutex.Unlock()
+	statuses := make([]relay.Status, 0, len(sp.relays))
+	for _, t := range sp.relays {
+		statuses = append(statuses, t.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// stopRelays stops every target once the stream's media stops, without
+// waiting for their connections to close
+func (sp *StreamProcess) stopRelays() {
+	sp.relayMutex.Lock()
+	defer sp.relayMutex.Unlock()
+	sp.relaysClosed = true
+	for _, t := range sp.relays {
+		go t.Stop()
+	}
+}
+
+// relayChanged reports a target connecting, failing or stopping on the bus
+func (sp *StreamProcess) relayChanged(status relay.Status) {
+	var eventType events.Type
+	var message string
+	switch status.State {
+	case relay.StateLive:
+		eventType, message = events.RelayConnected, fmt.Sprintf("relay %s connected to %s", status.Name, status.URL)
+	case relay.StateBackoff:
+		eventType, message = events.RelayFailed, fmt.Sprintf("relay %s failed: %s", status.Name, status.LastError)
+	case relay.StateStopped:
+		eventType, message = events.RelayStopped, fmt.Sprintf("relay %s stopped", status.Name)
+	default:
+		return
+	}
+	sp.manager.events.Publish(events.Event{
+		Type:    eventType,
+		Stream:  sp.username,
+		Message: message,
+		Data: map[string]interface{}{
+			"name":        status.Name,
+			"url":         status.URL,
+			"connections": status.Connections,
+			"failures":    status.Failures,
+		},
+	})
+}
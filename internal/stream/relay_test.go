@@ -0,0 +1,77 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/events"
+	"rtmp-server-poc/internal/relay"
+)
+
+func TestStreamRelays(t *testing.T) {
+	sp, _ := newBufferedStream(t)
+	// Nothing is published, so the targets wait without dialing
+	sp.config.RelayApps = map[string][]config.RelayTarget{
+		"live": {{Name: "youtube", URL: "rtmp://127.0.0.1:1/live2/app-key"}},
+	}
+	sp.config.RelayUsers = map[string][]config.RelayTarget{
+		"alice": {
+			{Name: "youtube", URL: "rtmp://127.0.0.1:2/live2/user-key"},
+			{Name: "cdn", URL: "rtmps://127.0.0.1/ingest/secret"},
+		},
+	}
+
+	sp.EnableRelays("live")
+	sp.EnableRelays("live") // a reconnecting publisher leaves them be
+	statuses := sp.Relays()
+	if len(statuses) != 2 || statuses[0].Name != "cdn" || statuses[1].Name != "youtube" {
+		t.Fatalf("Relays() = %+v, expected cdn and youtube", statuses)
+	}
+	if url := statuses[1].URL; url != "rtmp://127.0.0.1:2/live2/****" {
+		t.Errorf("youtube URL = %q, expected the user's target without its key", url)
+	}
+	if state := statuses[0].State; state != relay.StateWaiting {
+		t.Errorf("cdn state = %s, expected %s", state, relay.StateWaiting)
+	}
+
+	if err := sp.AddRelay("cdn", "rtmp://127.0.0.1/live/other"); !errors.Is(err, ErrRelayExists) {
+		t.Errorf("AddRelay(existing) error = %v, expected ErrRelayExists", err)
+	}
+	if err := sp.AddRelay("web", "http://127.0.0.1/live/key"); err == nil {
+		t.Errorf("AddRelay(http URL) succeeded")
+	}
+	if err := sp.RemoveRelay("cdn"); err != nil {
+		t.Errorf("RemoveRelay() error = %v", err)
+	}
+	if err := sp.RemoveRelay("cdn"); !errors.Is(err, ErrRelayNotFound) {
+		t.Errorf("RemoveRelay(removed) error = %v, expected ErrRelayNotFound", err)
+	}
+
+	sp.queue.close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		statuses = sp.Relays()
+		if len(statuses) == 1 && statuses[0].State == relay.StateStopped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Relays() = %+v, expected youtube stopped with the stream", statuses)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := sp.AddRelay("late", "rtmp://127.0.0.1/live/key"); !errors.Is(err, ErrStreamEnded) {
+		t.Errorf("AddRelay() after the stream ended error = %v, expected ErrStreamEnded", err)
+	}
+
+	stopped := 0
+	for _, event := range sp.manager.Events().Recent() {
+		if event.Type == events.RelayStopped {
+			stopped++
+		}
+	}
+	if stopped != 2 {
+		t.Errorf("got %d %s events, expected 2", stopped, events.RelayStopped)
+	}
+}
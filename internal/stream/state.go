@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"fmt"
+	"time"
+)
+
+// State is the lifecycle state of a StreamProcess
+type State int
+
+const (
+	// StateStarting means FFmpeg is running but no media has arrived yet
+	StateStarting State = iota
+	// StateLive means a publisher is attached and sending media
+	StateLive
+	// StateAwaitingReconnect means the publisher left and the stream is kept
+	// alive for ReconnectDelay in case it comes back
+	StateAwaitingReconnect
+	// StateStopping means Stop is tearing down the FFmpeg process
+	StateStopping
+	// StateEnded means the stream was stopped cleanly
+	StateEnded
+	// StateFailed means FFmpeg exited unexpectedly or could not be started
+	StateFailed
+)
+
+var stateNames = map[State]string{
+	StateStarting:          "starting",
+	StateLive:              "live",
+	StateAwaitingReconnect: "awaiting_reconnect",
+	StateStopping:          "stopping",
+	StateEnded:             "ended",
+	StateFailed:            "failed",
+}
+
+// validTransitions lists the states reachable from each state
+var validTransitions = map[State][]State{
+	StateStarting:          {StateLive, StateAwaitingReconnect, StateStopping, StateFailed},
+	StateLive:              {StateAwaitingReconnect, StateStopping, StateFailed},
+	StateAwaitingReconnect: {StateLive, StateStopping, StateFailed},
+	StateStopping:          {StateEnded, StateFailed},
+}
+
+// String returns the lower-case name of the state
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// MarshalText encodes the state by name so it reads well in JSON
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// IsTerminal reports whether no further transitions are possible
+func (s State) IsTerminal() bool {
+	return s == StateEnded || s == StateFailed
+}
+
+// CanTransition reports whether moving from s to next is allowed
+func (s State) CanTransition(next State) bool {
+	for _, allowed := range validTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition records a single state change
+type Transition struct {
+	From   State     `json:"from"`
+	To     State     `json:"to"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// ErrInvalidTransition is returned when a state change is not allowed
+type ErrInvalidTransition struct {
+	From State
+	To   State
+}
+
+func (e *ErrInvalidTransition) Error() string {
+	return fmt.Sprintf("invalid stream state transition from %s to %s", e.From, e.To)
+}
@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+)
+
+func TestStateTransitions(t *testing.T) {
+	tests := []struct {
+		from, to State
+		allowed  bool
+	}{
+		{StateStarting, StateLive, true},
+		{StateLive, StateAwaitingReconnect, true},
+		{StateAwaitingReconnect, StateLive, true},
+		{StateAwaitingReconnect, StateStopping, true},
+		{StateStopping, StateEnded, true},
+		{StateLive, StateFailed, true},
+		{StateLive, StateStarting, false},
+		{StateEnded, StateLive, false},
+		{StateFailed, StateStopping, false},
+		{StateStopping, StateLive, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from.String()+"->"+tt.to.String(), func(t *testing.T) {
+			if got := tt.from.CanTransition(tt.to); got != tt.allowed {
+				t.Errorf("CanTransition(%s, %s) = %v, expected %v", tt.from, tt.to, got, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestStreamProcessReconnectGracePeriod(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.ReconnectDelay = 50 * time.Millisecond
+	cfg.CleanupDelay = 10 * time.Millisecond
+	cfg.OutputDir = t.TempDir()
+
+	sp := newStreamProcess("alice", cfg.OutputDir, NewManager(), cfg)
+	sp.MarkLive()
+	if sp.State() != StateLive {
+		t.Fatalf("State() = %s, expected live", sp.State())
+	}
+
+	sp.Disconnect(cfg)
+	info := sp.Info()
+	if info.State != StateAwaitingReconnect || info.ReconnectDeadline == nil {
+		t.Fatalf("Info() = %+v, expected awaiting_reconnect with a deadline", info)
+	}
+	if info.ReconnectRemaining <= 0 || info.ReconnectRemaining > cfg.ReconnectDelay.Seconds() {
+		t.Errorf("ReconnectRemaining = %v, expected within (0, %v]", info.ReconnectRemaining, cfg.ReconnectDelay.Seconds())
+	}
+
+	if !sp.reconnect() {
+		t.Fatal("reconnect() failed while awaiting reconnect")
+	}
+	time.Sleep(2 * cfg.ReconnectDelay)
+	if sp.State() != StateLive {
+		t.Fatalf("State() = %s after reconnect, expected the grace timer to be cancelled", sp.State())
+	}
+
+	sp.Disconnect(cfg)
+	time.Sleep(2 * cfg.ReconnectDelay)
+	// FFmpeg never started, so the stream ends as soon as it stops
+	if state := sp.State(); state != StateEnded {
+		t.Fatalf("State() = %s after grace period, expected ended", state)
+	}
+	if _, ok := sp.manager.GetStream("alice"); ok {
+		t.Error("ended stream is still registered")
+	}
+
+	transitions := sp.Info().Transitions
+	if len(transitions) != 6 {
+		t.Fatalf("recorded %d transitions, expected 6: %+v", len(transitions), transitions)
+	}
+	for i := 1; i < len(transitions); i++ {
+		if transitions[i].From != transitions[i-1].To || transitions[i].At.Before(transitions[i-1].At) {
+			t.Errorf("transition %d (%+v) does not follow %+v", i, transitions[i], transitions[i-1])
+		}
+	}
+}
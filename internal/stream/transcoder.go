@@ -0,0 +1,222 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// transcoder is a single FFmpeg run turning the stream's FLV feed into HLS.
+// It is started once the stream's codecs are known, and replaced when codec
+// parameters change mid-stream.
+type transcoder struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	cancel context.CancelFunc
+	writer *flv.Writer
+	done   chan struct{} // closed once FFmpeg has exited
+	err    error         // exit error, valid after done is closed
+}
+
+// transcoderOptions selects how a transcoder writes its HLS output
+type transcoderOptions struct {
+	// discontinuity continues the existing playlist after an
+	// EXT-X-DISCONTINUITY tag instead of starting a new one
+	discontinuity bool
+	// plan selects copy or transcode per track, and fMP4 segments
+	plan TranscodePlan
+	// listSize is the number of segments kept in the live playlist
+	listSize int
+	// event writes an EVENT playlist keeping every segment, ignoring listSize
+	event bool
+	// opusAddr receives the audio encoded to Opus as RTP, for WebRTC
+	// viewers; empty for none
+	opusAddr string
+}
+
+// segmentDuration is the target HLS segment duration, in seconds
+const segmentDuration = 1
+
+// liveListSize is the number of segments in the live playlist without DVR
+const liveListSize = 3
+
+// dvrListSize returns the number of segments covering a DVR window, at
+// least liveListSize
+func dvrListSize(window time.Duration) int {
+	return max(liveListSize, int(math.Ceil(window.Seconds()/segmentDuration)))
+}
+
+// createFFmpegCommand creates an FFmpeg command with the specified settings
+func createFFmpegCommand(ctx context.Context, outputDir string, opts transcoderOptions) *exec.Cmd {
+	hlsFlags := "delete_segments+temp_file+independent_segments"
+	listSize := opts.listSize
+	if opts.event {
+		hlsFlags = "temp_file+independent_segments"
+		listSize = 0
+	}
+	if opts.discontinuity {
+		hlsFlags += "+append_list+discont_start"
+	}
+
+	args := []string{
+		"-re",                  // clock to incoming timestamps
+		"-fflags", "+nobuffer", // disable buffering
+		"-flags", "low_delay", // low delay mode
+		"-f", "flv",
+		"-i", "pipe:0",
+	}
+	args = append(args, videoCodecArgs(opts.plan.Video)...)
+	args = append(args, audioCodecArgs(opts.plan.Audio)...)
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segmentDuration),
+		"-hls_list_size", strconv.Itoa(listSize),
+		"-hls_flags", hlsFlags,
+		"-hls_allow_cache", "0", // disable client caching
+	)
+	if opts.event {
+		args = append(args, "-hls_playlist_type", "event")
+	}
+	if opts.plan.FMP4 {
+		args = append(args,
+			"-hls_segment_type", "fmp4",
+			"-hls_fmp4_init_filename", "init.mp4",
+			"-hls_segment_filename", filepath.Join(outputDir, "live_%03d.m4s"),
+		)
+	} else {
+		args = append(args,
+			"-hls_segment_type", "mpegts",
+			"-hls_segment_filename", filepath.Join(outputDir, "live_%03d.ts"),
+		)
+	}
+	args = append(args, filepath.Join(outputDir, "live.m3u8"))
+	if opts.opusAddr != "" {
+		args = append(args, opusOutputArgs(opts.opusAddr)...)
+	}
+
+	return exec.CommandContext(ctx, "ffmpeg", args...)
+}
+
+// videoCodecArgs returns the FFmpeg video encoding options for a track plan
+func videoCodecArgs(track *TrackPlan) []string {
+	if track == nil || track.Action == ActionCopy {
+		args := []string{"-c:v", "copy"}
+		if track != nil && track.Input == "hevc" {
+			args = append(args, "-tag:v", "hvc1") // the sample entry Apple players expect
+		}
+		return args
+	}
+	return []string{
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-tune", "zerolatency",
+		"-profile:v", "high",
+		"-pix_fmt", "yuv420p",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentDuration), // a keyframe per segment
+		"-sc_threshold", "0",
+	}
+}
+
+// audioCodecArgs returns the FFmpeg audio encoding options for a track plan
+func audioCodecArgs(track *TrackPlan) []string {
+	if track == nil || track.Action == ActionCopy {
+		return []string{"-c:a", "copy"}
+	}
+	return []string{
+		"-c:a", "aac",
+		"-profile:a", "aac_low",
+		"-b:a", "128k",
+	}
+}
+
+// ffmpegHasLibopus reports whether FFmpeg can encode Opus, probing its
+// encoders once. Without libopus the Opus output would fail the whole
+// command, HLS included, so streams are then transcoded to HLS only.
+var ffmpegHasLibopus = sync.OnceValue(func() bool {
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil || !bytes.Contains(out, []byte(" libopus ")) {
+		log.Printf("FFmpeg has no libopus encoder, WHEP sessions carry no audio")
+		return false
+	}
+	return true
+})
+
+// opusOutputArgs returns the options of a second FFmpeg output sending the
+// audio to addr as Opus over RTP, the only audio codec WebRTC players share
+func opusOutputArgs(addr string) []string {
+	return []string{
+		"-map", "0:a:0",
+		"-c:a", "libopus",
+		"-b:a", "96k",
+		"-ar", "48000",
+		"-ac", "2",
+		"-application", "lowdelay",
+		"-f", "rtp",
+		"rtp://" + addr + "?pkt_size=1200",
+	}
+}
+
+// startTranscoder launches FFmpeg writing HLS into outputDir
+func startTranscoder(outputDir string, opts transcoderOptions) (*transcoder, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := createFFmpegCommand(ctx, outputDir, opts)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to get stdin pipe: %v", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start FFmpeg: %v", err)
+	}
+
+	t := &transcoder{
+		cmd:    cmd,
+		stdin:  stdin,
+		cancel: cancel,
+		writer: flv.NewWriter(stdin),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		t.err = cmd.Wait()
+		close(t.done)
+	}()
+	return t, nil
+}
+
+// close signals FFmpeg to finish by closing its input and cancelling it
+func (t *transcoder) close() {
+	t.stdin.Close()
+	t.cancel()
+}
+
+// finish closes FFmpeg's input so it can flush the last segment and playlist,
+// killing it if it has not exited within timeout
+func (t *transcoder) finish(timeout time.Duration) {
+	t.stdin.Close()
+	select {
+	case <-t.done:
+	case <-time.After(timeout):
+		t.kill()
+	}
+	t.cancel()
+}
+
+// kill forcibly terminates FFmpeg
+func (t *transcoder) kill() {
+	if t.cmd.Process != nil {
+		t.cmd.Process.Kill()
+	}
+}
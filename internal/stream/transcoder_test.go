@@ -0,0 +1,229 @@
+package stream
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/flv"
+)
+
+// startRecorder stands in for FFmpeg, recording how each transcoder was started
+type startRecorder struct {
+	mutex   sync.Mutex
+	options []transcoderOptions
+	feeds   []*bytes.Buffer
+}
+
+func (r *startRecorder) start(outputDir string, opts transcoderOptions) (*transcoder, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	buf := &bytes.Buffer{}
+	r.options = append(r.options, opts)
+	r.feeds = append(r.feeds, buf)
+	return &transcoder{writer: flv.NewWriter(buf), done: make(chan struct{})}, nil
+}
+
+// newDeferredStream returns a stream that starts its transcoder on demand
+func newDeferredStream(t *testing.T) (*StreamProcess, *startRecorder) {
+	t.Helper()
+	return newDeferredStreamConfig(t, config.DefaultConfig())
+}
+
+// newDeferredStreamConfig is newDeferredStream with cfg
+func newDeferredStreamConfig(t *testing.T, cfg config.Config) (*StreamProcess, *startRecorder) {
+	t.Helper()
+	cfg.OutputDir = t.TempDir()
+
+	recorder := &startRecorder{}
+	sp := newStreamProcess("alice", cfg.OutputDir, NewManager(), cfg)
+	sp.startTranscoder = recorder.start
+	return sp, recorder
+}
+
+func TestTranscoderStartsWithCodecOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		writes        func(p *Publisher) []error
+		expectedCodec string
+		expectedFMP4  bool
+		expectedTags  int
+	}{
+		{
+			name: "AVC uses MPEG-TS",
+			writes: func(p *Publisher) []error {
+				return []error{
+					p.WriteScript(0, []byte{0x02, 0x00, 0x0a}),
+					p.WriteVideo(0, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}),
+					p.WriteAudio(0, []byte{0xaf, 0x00, 0x12, 0x10}),
+					p.WriteVideo(0, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65}),
+				}
+			},
+			expectedCodec: "avc",
+			expectedTags:  4,
+		},
+		{
+			name: "Enhanced HEVC uses fMP4",
+			writes: func(p *Publisher) []error {
+				return []error{
+					p.WriteVideo(0, []byte{0x90, 'h', 'v', 'c', '1', 0x01}),
+					p.WriteVideo(0, []byte{0x94, 'h', 'v', 'c', '1', 0x02}), // HDR metadata
+					p.WriteVideo(0, []byte{0x91, 'h', 'v', 'c', '1', 0x00, 0x00, 0x00, 0x26}),
+					p.WriteVideo(33, []byte{0xa2, 'h', 'v', 'c', '1'}), // sequence end, dropped
+				}
+			},
+			expectedCodec: "hevc",
+			expectedFMP4:  true,
+			expectedTags:  3,
+		},
+		{
+			name: "Enhanced AV1 uses fMP4",
+			writes: func(p *Publisher) []error {
+				return []error{
+					p.WriteVideo(0, []byte{0x90, 'a', 'v', '0', '1', 0x81}),
+					p.WriteVideo(0, []byte{0x91, 'a', 'v', '0', '1', 0x12}),
+				}
+			},
+			expectedCodec: "av1",
+			expectedFMP4:  true,
+			expectedTags:  2,
+		},
+		{
+			name: "Audio only starts after the probe duration",
+			writes: func(p *Publisher) []error {
+				errs := []error{p.WriteAudio(0, []byte{0xaf, 0x00, 0x12, 0x10})}
+				for ts := uint32(0); ts <= probeDuration; ts += 500 {
+					errs = append(errs, p.WriteAudio(ts, []byte{0xaf, 0x01, 0x21}))
+				}
+				return errs
+			},
+			expectedTags: 6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp, recorder := newDeferredStream(t)
+			p := mustAttach(t, sp)
+			for _, err := range tt.writes(p) {
+				if err != nil {
+					t.Fatalf("write error = %v", err)
+				}
+			}
+			sp.queue.flush()
+
+			recorder.mutex.Lock()
+			defer recorder.mutex.Unlock()
+			if len(recorder.options) != 1 {
+				t.Fatalf("transcoder started %d times, expected once", len(recorder.options))
+			}
+			opts := recorder.options[0]
+			videoCodec := ""
+			if opts.plan.Video != nil {
+				videoCodec = opts.plan.Video.Input
+			}
+			if videoCodec != tt.expectedCodec || opts.plan.FMP4 != tt.expectedFMP4 || opts.discontinuity {
+				t.Errorf("options = %+v, expected codec %q fmp4 %v", opts, tt.expectedCodec, tt.expectedFMP4)
+			}
+			if tags := readFeed(t, recorder.feeds[0]); len(tags) != tt.expectedTags {
+				t.Errorf("FFmpeg got %d tags, expected %d", len(tags), tt.expectedTags)
+			}
+		})
+	}
+}
+
+func TestTranscoderWaitsForCodecs(t *testing.T) {
+	sp, recorder := newDeferredStream(t)
+	p := mustAttach(t, sp)
+	p.WriteVideo(0, []byte{0x90, 'v', 'p', '0', '9', 0x01})
+	p.WriteAudio(0, []byte{0xaf, 0x00, 0x12, 0x10})
+	p.WriteAudio(0, []byte{0xaf, 0x01, 0x21})
+	sp.queue.flush()
+
+	recorder.mutex.Lock()
+	started := len(recorder.options)
+	recorder.mutex.Unlock()
+	if started != 0 {
+		t.Fatalf("transcoder started before the first video frame")
+	}
+
+	p.WriteVideo(0, []byte{0x91, 'v', 'p', '0', '9', 0x82})
+	sp.queue.flush()
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if len(recorder.options) != 1 || !recorder.options[0].plan.FMP4 {
+		t.Fatalf("options = %+v, expected a single fMP4 start", recorder.options)
+	}
+	if tags := readFeed(t, recorder.feeds[0]); len(tags) != 4 {
+		t.Errorf("FFmpeg got %d tags, expected the 4 held back", len(tags))
+	}
+}
+
+func TestCreateFFmpegCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     transcoderOptions
+		expected []string
+		absent   []string
+	}{
+		{
+			name:     "MPEG-TS",
+			opts:     transcoderOptions{plan: planTranscode("avc", "aac", config.VideoPolicyFMP4), listSize: liveListSize},
+			expected: []string{"-c:v copy -c:a copy", "-hls_segment_type mpegts", "live_%03d.ts", "-hls_list_size 3 -hls_flags delete_segments+temp_file+independent_segments "},
+			absent:   []string{"fmp4", "-tag:v"},
+		},
+		{
+			name:     "HEVC in fMP4",
+			opts:     transcoderOptions{plan: planTranscode("hevc", "aac", config.VideoPolicyFMP4)},
+			expected: []string{"-c:v copy -tag:v hvc1", "-hls_segment_type fmp4", "-hls_fmp4_init_filename init.mp4", "live_%03d.m4s"},
+		},
+		{
+			name:     "Transcoded tracks",
+			opts:     transcoderOptions{plan: planTranscode("vp6", "mp3", config.VideoPolicyFMP4)},
+			expected: []string{"-c:v libx264", "-force_key_frames", "-c:a aac -profile:a aac_low", "-hls_segment_type mpegts"},
+			absent:   []string{"copy"},
+		},
+		{
+			name:     "Discontinuity",
+			opts:     transcoderOptions{discontinuity: true},
+			expected: []string{"+append_list+discont_start"},
+		},
+		{
+			name:     "DVR window",
+			opts:     transcoderOptions{listSize: dvrListSize(2 * time.Hour)},
+			expected: []string{"-hls_list_size 7200 -hls_flags delete_segments"},
+			absent:   []string{"-hls_playlist_type"},
+		},
+		{
+			name:     "Event playlist",
+			opts:     transcoderOptions{listSize: liveListSize, event: true, discontinuity: true},
+			expected: []string{"-hls_list_size 0 -hls_flags temp_file+independent_segments+append_list+discont_start", "-hls_playlist_type event"},
+			absent:   []string{"delete_segments"},
+		},
+		{
+			name:     "Opus for WebRTC",
+			opts:     transcoderOptions{opusAddr: "127.0.0.1:5004"},
+			expected: []string{"live.m3u8 -map 0:a:0 -c:a libopus", "-f rtp rtp://127.0.0.1:5004?pkt_size=1200"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := createFFmpegCommand(t.Context(), "/out/alice", tt.opts)
+			args := strings.Join(cmd.Args, " ")
+			for _, expected := range tt.expected {
+				if !strings.Contains(args, expected) {
+					t.Errorf("args %q do not contain %q", args, expected)
+				}
+			}
+			for _, absent := range tt.absent {
+				if strings.Contains(args, absent) {
+					t.Errorf("args %q contain %q", args, absent)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// ErrStreamEnded is returned when watching a stream that no longer has media
+// flowing
+var ErrStreamEnded = errors.New("stream has ended")
+
+// viewerQueueSize is the number of tags buffered for each viewer
+const viewerQueueSize = 512
+
+// maxGOPCache bounds the tags of the current GOP kept for new viewers. A
+// longer GOP is not cached and new viewers wait for the next keyframe.
+const maxGOPCache = 4096
+
+// Viewer receives a live stream's tags as they leave the dispatcher. A
+// viewer that does not keep up misses tags: delivery resumes at the next
+// keyframe, preceded by the sequence headers, so the publisher and the
+// other viewers are never held up.
+type Viewer struct {
+	hub   *viewerHub
+	start []flv.Tag // cached tags to play before the live ones
+	tags  chan flv.Tag
+
+	// Guarded by the hub's mutex
+	skipping bool // tags were dropped, waiting for the next keyframe
+	dropped  uint64
+}
+
+// viewerHub fans the dispatcher's tags out to the viewers of a stream and
+// caches what a new viewer needs to start playing: the onMetaData, the
+// sequence headers and the current GOP
+type viewerHub struct {
+	mutex    sync.Mutex
+	viewers  map[*Viewer]struct{}
+	closed   bool
+	metadata flv.Tag
+	headers  seqHeaders
+	gop      []flv.Tag // tags since the last keyframe, empty when not cached
+	hasAudio bool
+	hasVideo bool
+}
+
+// newViewerHub creates a hub without viewers
+func newViewerHub() *viewerHub {
+	return &viewerHub{viewers: make(map[*Viewer]struct{})}
+}
+
+// startsGOP reports whether a viewer may start or resume playing at tag: a
+// video keyframe, or any audio frame when the stream has no video
+func (h *viewerHub) startsGOP(tag flv.Tag) bool {
+	if tag.Video != nil {
+		return tag.IsKeyframe()
+	}
+	return tag.Audio != nil && !h.hasVideo && !tag.IsSequenceHeader()
+}
+
+// publish caches a tag from the dispatcher and hands it to every viewer
+func (h *viewerHub) publish(tag flv.Tag) {
+	if tag.Video != nil && tag.Video.IsSequenceEnd() {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return
+	}
+	h.cache(tag)
+	for v := range h.viewers {
+		h.send(v, tag)
+	}
+}
+
+// cache remembers what a new viewer starts with. The caller holds mutex.
+func (h *viewerHub) cache(tag flv.Tag) {
+	if tag.Audio != nil {
+		h.hasAudio = true
+	}
+	if tag.Video != nil && !h.hasVideo {
+		h.hasVideo = true
+		h.gop = nil // audio frames no longer start a viewer
+	}
+	switch {
+	case tag.Type == flv.TagTypeScript:
+		if tag.Metadata != nil {
+			h.metadata = tag
+		}
+		return
+	case tag.IsSequenceHeader():
+		h.headers.remember(tag)
+		return
+	}
+
+	switch {
+	case h.startsGOP(tag):
+		clear(h.gop)
+		h.gop = append(h.gop[:0], tag)
+	case len(h.gop) >= maxGOPCache:
+		clear(h.gop)
+		h.gop = h.gop[:0]
+	case len(h.gop) > 0:
+		h.gop = append(h.gop, tag)
+	}
+}
+
+// send queues a tag for a viewer without blocking. A full queue makes the
+// viewer skip to the next keyframe, which is only queued along with the
+// sequence headers once there is room for all of them. The caller holds
+// mutex.
+func (h *viewerHub) send(v *Viewer, tag flv.Tag) {
+	if v.skipping {
+		if !h.startsGOP(tag) || cap(v.tags)-len(v.tags) < 3 {
+			v.dropped++
+			return
+		}
+		for _, header := range []flv.Tag{h.headers.video, h.headers.audio} {
+			if header.Data != nil {
+				header.Timestamp = tag.Timestamp
+				v.tags <- header
+			}
+		}
+		v.skipping = false
+	}
+
+	select {
+	case v.tags <- tag:
+	default:
+		v.skipping = true
+		v.dropped++
+	}
+}
+
+// watch adds a viewer starting with the cached metadata, sequence headers
+// and current GOP. Without a cached GOP, a video stream's viewer starts at
+// the next keyframe.
+func (h *viewerHub) watch() (*Viewer, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return nil, ErrStreamEnded
+	}
+
+	v := &Viewer{hub: h, tags: make(chan flv.Tag, viewerQueueSize)}
+	var timestamp uint32
+	if len(h.gop) > 0 {
+		timestamp = h.gop[0].Timestamp
+	}
+	for _, tag := range []flv.Tag{h.metadata, h.headers.video, h.headers.audio} {
+		if tag.Data != nil {
+			tag.Timestamp = timestamp
+			v.start = append(v.start, tag)
+		}
+	}
+	v.start = append(v.start, h.gop...)
+	v.skipping = h.hasVideo && len(h.gop) == 0
+	h.viewers[v] = struct{}{}
+	return v, nil
+}
+
+// remove stops delivering to a viewer and closes its queue
+func (h *viewerHub) remove(v *Viewer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.viewers[v]; ok {
+		delete(h.viewers, v)
+		close(v.tags)
+	}
+}
+
+// close ends every viewer once the stream's media stops
+func (h *viewerHub) close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.closed = true
+	for v := range h.viewers {
+		close(v.tags)
+	}
+	clear(h.viewers)
+	h.gop = nil
+}
+
+// count returns the number of viewers
+func (h *viewerHub) count() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.viewers)
+}
+
+// Watch starts a viewer of the stream's live tags. The viewer must be
+// closed once done with.
+func (sp *StreamProcess) Watch() (*Viewer, error) {
+	return sp.viewers.watch()
+}
+
+// Next returns the viewer's next tag, waiting for it. It returns false
+// once the stream has ended, the viewer was closed or ctx is done.
+func (v *Viewer) Next(ctx context.Context) (flv.Tag, bool) {
+	if len(v.start) > 0 {
+		tag := v.start[0]
+		v.start = v.start[1:]
+		return tag, true
+	}
+	select {
+	case tag, ok := <-v.tags:
+		return tag, ok
+	case <-ctx.Done():
+		return flv.Tag{}, false
+	}
+}
+
+// Tracks reports whether the stream has carried audio and video so far,
+// e.g. to fill in an FLV header. Both are assumed before any media.
+func (v *Viewer) Tracks() (hasAudio, hasVideo bool) {
+	v.hub.mutex.Lock()
+	defer v.hub.mutex.Unlock()
+	if !v.hub.hasAudio && !v.hub.hasVideo {
+		return true, true
+	}
+	return v.hub.hasAudio, v.hub.hasVideo
+}
+
+// Dropped returns the number of tags the viewer missed for falling behind
+func (v *Viewer) Dropped() uint64 {
+	v.hub.mutex.Lock()
+	defer v.hub.mutex.Unlock()
+	return v.dropped
+}
+
+// Close stops the viewer
+func (v *Viewer) Close() {
+	v.hub.remove(v)
+}
@@ -0,0 +1,139 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yutopp/go-amf0"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// parsedFrame builds a tag like testFrame, with its header parsed as the
+// dispatcher hands it over
+func parsedFrame(kind byte, timestamp uint32) flv.Tag {
+	raw := testFrame(kind, timestamp)
+	tag, _ := flv.ParseTag(raw.Type, raw.Timestamp, raw.Data)
+	return tag
+}
+
+// parsedHeaders returns the video and audio sequence headers, parsed
+func parsedHeaders() []flv.Tag {
+	video, _ := flv.ParseTag(flv.TagTypeVideo, 0, testVideoHeader.Data)
+	audio, _ := flv.ParseTag(flv.TagTypeAudio, 0, testAudioHeader.Data)
+	return []flv.Tag{video, audio}
+}
+
+// viewerKinds reads n tags from a viewer and describes them like queueKinds,
+// 'M' for onMetaData
+func viewerKinds(t *testing.T, v *Viewer, n int) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var kinds []byte
+	for range n {
+		tag, ok := v.Next(ctx)
+		if !ok {
+			t.Fatalf("viewer ended after %q", kinds)
+		}
+		switch {
+		case tag.Type == flv.TagTypeScript:
+			kinds = append(kinds, 'M')
+		case tag.IsSequenceHeader() && tag.Type == flv.TagTypeVideo:
+			kinds = append(kinds, 'V')
+		case tag.IsSequenceHeader():
+			kinds = append(kinds, 'H')
+		default:
+			kinds = append(kinds, tag.Data[len(tag.Data)-1])
+		}
+	}
+	return string(kinds)
+}
+
+func TestViewerStartsWithCurrentGOP(t *testing.T) {
+	h := newViewerHub()
+	metadata, _ := flv.ParseTag(flv.TagTypeScript, 0, onMetaData(t, amf0.ECMAArray{"width": 1280.0}))
+	for _, tag := range append(append([]flv.Tag{metadata}, parsedHeaders()...),
+		parsedFrame('K', 0), parsedFrame('P', 33), parsedFrame('A', 40),
+		parsedFrame('K', 1000), parsedFrame('P', 1033), parsedFrame('A', 1040),
+	) {
+		h.publish(tag)
+	}
+
+	v, err := h.watch()
+	if err != nil {
+		t.Fatalf("watch() error = %v", err)
+	}
+	defer v.Close()
+	if v.start[0].Timestamp != 1000 {
+		t.Errorf("cached headers at %dms, expected at the GOP start", v.start[0].Timestamp)
+	}
+	h.publish(parsedFrame('P', 1066))
+	if kinds := viewerKinds(t, v, 7); kinds != "MVHKPAP" {
+		t.Errorf("viewer got %q, expected metadata, headers, the GOP, then live tags", kinds)
+	}
+	if hasAudio, hasVideo := v.Tracks(); !hasAudio || !hasVideo {
+		t.Errorf("Tracks() = %v, %v, expected both", hasAudio, hasVideo)
+	}
+	if h.count() != 1 {
+		t.Errorf("count() = %d, expected 1", h.count())
+	}
+}
+
+func TestSlowViewerSkipsToKeyframe(t *testing.T) {
+	h := newViewerHub()
+	slow, _ := h.watch()
+	fast, _ := h.watch()
+	defer slow.Close()
+	defer fast.Close()
+
+	for _, tag := range append(parsedHeaders(), parsedFrame('K', 0)) {
+		h.publish(tag)
+	}
+	fastKinds := viewerKinds(t, fast, 3)
+	for i := range viewerQueueSize {
+		h.publish(parsedFrame('P', uint32(i+1)))
+		fastKinds += viewerKinds(t, fast, 1)
+	}
+	if len(slow.tags) != viewerQueueSize || slow.Dropped() != 3 {
+		t.Fatalf("slow viewer has %d tags queued, %d dropped, expected a full queue", len(slow.tags), slow.Dropped())
+	}
+	if len(fastKinds) != viewerQueueSize+3 {
+		t.Errorf("fast viewer got %d tags, expected all %d", len(fastKinds), viewerQueueSize+3)
+	}
+
+	viewerKinds(t, slow, viewerQueueSize) // catches up
+	h.publish(parsedFrame('P', 1000))     // still skipping
+	h.publish(parsedFrame('K', 1033))
+	h.publish(parsedFrame('P', 1066))
+	if kinds := viewerKinds(t, slow, 4); kinds != "VHKP" {
+		t.Errorf("slow viewer resumed with %q, expected the headers and the keyframe", kinds)
+	}
+}
+
+func TestViewersEndWithStream(t *testing.T) {
+	sp, _ := newBufferedStream(t)
+	v, err := sp.Watch()
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	p := mustAttach(t, sp)
+	p.WriteVideo(0, testVideoHeader.Data)
+	p.WriteVideo(0, testFrame('K', 0).Data)
+	if kinds := viewerKinds(t, v, 2); kinds != "VK" {
+		t.Errorf("viewer got %q, expected the live tags", kinds)
+	}
+
+	sp.queue.close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, ok := v.Next(ctx); ok || ctx.Err() != nil {
+		t.Errorf("viewer not ended with the stream")
+	}
+	if _, err := sp.Watch(); !errors.Is(err, ErrStreamEnded) {
+		t.Errorf("Watch() error = %v, expected ErrStreamEnded", err)
+	}
+	v.Close() // no-op once ended
+}
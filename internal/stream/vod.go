@@ -0,0 +1,254 @@
+package stream
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/events"
+)
+
+// errNoSegments is returned when an ended stream left no segment to archive
+var errNoSegments = errors.New("playlist has no segments")
+
+// vodPlaylist is an ended stream's media playlist turned into a VOD playlist
+type vodPlaylist struct {
+	content  string
+	files    []string // segments and init sections the playlist refers to
+	segments int
+	duration float64 // seconds
+}
+
+// playlistTagsDropped are the live playlist tags a VOD playlist replaces
+var playlistTagsDropped = []string{"#EXT-X-PLAYLIST-TYPE:", "#EXT-X-ENDLIST", "#EXT-X-ALLOW-CACHE:"}
+
+// parseVODPlaylist reads a live media playlist written by FFmpeg and
+// closes it as a VOD playlist: EXT-X-PLAYLIST-TYPE:VOD after the header
+// and EXT-X-ENDLIST at the end
+func parseVODPlaylist(r io.Reader) (vodPlaylist, error) {
+	var p vodPlaylist
+	var lines []string
+	listed := make(map[string]bool)
+	refer := func(uri string) {
+		if !listed[uri] {
+			listed[uri] = true
+			p.files = append(p.files, uri)
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		dropped := line == ""
+		for _, tag := range playlistTagsDropped {
+			dropped = dropped || strings.HasPrefix(line, tag)
+		}
+		if dropped {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			if d, err := strconv.ParseFloat(value, 64); err == nil {
+				p.duration += d
+			}
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			if _, uri, ok := strings.Cut(line, `URI="`); ok {
+				uri, _, _ = strings.Cut(uri, `"`)
+				refer(uri)
+			}
+		case !strings.HasPrefix(line, "#"):
+			refer(line)
+			p.segments++
+		}
+		lines = append(lines, line)
+		if line == "#EXTM3U" {
+			lines = append(lines, "#EXT-X-PLAYLIST-TYPE:VOD")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return vodPlaylist{}, err
+	}
+	if len(lines) == 0 || lines[0] != "#EXTM3U" {
+		return vodPlaylist{}, errors.New("not an HLS playlist")
+	}
+	if p.segments == 0 {
+		return vodPlaylist{}, errNoSegments
+	}
+
+	p.content = strings.Join(append(lines, "#EXT-X-ENDLIST"), "\n") + "\n"
+	return p, nil
+}
+
+// archiveVOD moves the segments listed in outputDir's live playlist to
+// dir, with the playlist closed as VOD and the master playlist next to it
+func archiveVOD(outputDir, dir string) (vodPlaylist, error) {
+	f, err := os.Open(filepath.Join(outputDir, "live.m3u8"))
+	if err != nil {
+		return vodPlaylist{}, err
+	}
+	p, err := parseVODPlaylist(f)
+	f.Close()
+	if err != nil {
+		return vodPlaylist{}, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return vodPlaylist{}, err
+	}
+	for _, file := range append(p.files, "master.m3u8") {
+		if file != filepath.Base(file) {
+			return vodPlaylist{}, fmt.Errorf("playlist refers to %q outside its directory", file)
+		}
+		err := moveFile(filepath.Join(outputDir, file), filepath.Join(dir, file))
+		if err != nil && !(file == "master.m3u8" && os.IsNotExist(err)) {
+			return vodPlaylist{}, err
+		}
+	}
+
+	tmp := filepath.Join(dir, "live.m3u8.tmp")
+	if err := os.WriteFile(tmp, []byte(p.content), 0644); err != nil {
+		return vodPlaylist{}, err
+	}
+	return p, os.Rename(tmp, filepath.Join(dir, "live.m3u8"))
+}
+
+// moveFile renames a file, copying it when the destination is on another
+// file system
+func moveFile(from, to string) error {
+	err := os.Rename(from, to)
+	var linkErr *os.LinkError
+	if err == nil || !errors.As(err, &linkErr) || os.IsNotExist(err) {
+		return err
+	}
+
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
+
+// archive keeps the HLS output of the ended stream under VODDir, in a
+// directory named after the time it ended. Only teardown calls it, once
+// FFmpeg has exited.
+func (sp *StreamProcess) archive() {
+	if sp.config.VODDir == "" {
+		return
+	}
+	dir := filepath.Join(sp.config.VODDir, pathElement(sp.username), time.Now().UTC().Format("20060102-150405"))
+	stem := dir
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			break
+		}
+		dir = fmt.Sprintf("%s-%d", stem, i)
+	}
+
+	p, err := archiveVOD(sp.outputDir, dir)
+	if errors.Is(err, errNoSegments) || os.IsNotExist(err) {
+		return // nothing was streamed
+	}
+	if err != nil {
+		log.Printf("Error archiving VOD of stream %s: %v", sp.username, err)
+		return
+	}
+
+	id := filepath.ToSlash(filepath.Join(pathElement(sp.username), filepath.Base(dir)))
+	sp.manager.events.Publish(events.Event{
+		Type:    events.VODArchived,
+		Stream:  sp.username,
+		Message: fmt.Sprintf("archived %s (%.1fs, %d segments)", id, p.duration, p.segments),
+		Data: map[string]interface{}{
+			"id":       id,
+			"path":     dir,
+			"segments": p.segments,
+			"duration": p.duration,
+		},
+	})
+}
+
+// vodRetentionInterval is how often expired VOD archives are looked for
+const vodRetentionInterval = time.Hour
+
+// StartVODRetention deletes VOD archives older than cfg.VODRetention, now
+// and every vodRetentionInterval. It does nothing when VOD is disabled or
+// kept forever.
+func (sm *Manager) StartVODRetention(cfg config.Config) {
+	if cfg.VODDir == "" || cfg.VODRetention <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if err := sm.pruneVOD(cfg.VODDir, time.Now().Add(-cfg.VODRetention)); err != nil {
+				log.Printf("Error deleting expired VOD archives: %v", err)
+			}
+			time.Sleep(vodRetentionInterval)
+		}
+	}()
+}
+
+// pruneVOD deletes the archives under dir, laid out as {username}/{id},
+// last modified before cutoff, and the user directories left empty
+func (sm *Manager) pruneVOD(dir string, cutoff time.Time) error {
+	users, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if !user.IsDir() {
+			continue
+		}
+		userDir := filepath.Join(dir, user.Name())
+		archives, err := os.ReadDir(userDir)
+		if err != nil {
+			return err
+		}
+		kept := 0
+		for _, archive := range archives {
+			info, err := archive.Info()
+			if err != nil || !archive.IsDir() || !info.ModTime().Before(cutoff) {
+				kept++
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(userDir, archive.Name())); err != nil {
+				return err
+			}
+			sm.events.Publish(events.Event{
+				Type:    events.VODExpired,
+				Stream:  user.Name(),
+				Message: fmt.Sprintf("deleted VOD %s/%s", user.Name(), archive.Name()),
+				Data:    map[string]interface{}{"id": user.Name() + "/" + archive.Name()},
+			})
+		}
+		if kept == 0 {
+			os.Remove(userDir)
+		}
+	}
+	return nil
+}
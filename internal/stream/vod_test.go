@@ -0,0 +1,127 @@
+package stream
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// livePlaylist is an fMP4 playlist as FFmpeg leaves it after a restart
+const livePlaylist = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-ALLOW-CACHE:NO
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:4
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:1.000000,
+live_004.m4s
+#EXTINF:0.500000,
+live_005.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:1.000000,
+live_006.m4s
+#EXT-X-ENDLIST
+`
+
+func TestArchiveVOD(t *testing.T) {
+	outputDir, dir := t.TempDir(), filepath.Join(t.TempDir(), "alice", "20250101-120000")
+	files := map[string]string{
+		"live.m3u8":    livePlaylist,
+		"master.m3u8":  "#EXTM3U\n",
+		"init.mp4":     "init",
+		"live_003.m4s": "deleted from the playlist",
+		"live_004.m4s": "4",
+		"live_005.m4s": "5",
+		"live_006.m4s": "6",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(outputDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := archiveVOD(outputDir, dir)
+	if err != nil {
+		t.Fatalf("archiveVOD() error = %v", err)
+	}
+	if p.segments != 3 || p.duration != 2.5 {
+		t.Errorf("archiveVOD() = %d segments, %.1fs, expected 3 segments, 2.5s", p.segments, p.duration)
+	}
+
+	expected := `#EXTM3U
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:4
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:1.000000,
+live_004.m4s
+#EXTINF:0.500000,
+live_005.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:1.000000,
+live_006.m4s
+#EXT-X-ENDLIST
+`
+	if data, _ := os.ReadFile(filepath.Join(dir, "live.m3u8")); string(data) != expected {
+		t.Errorf("VOD playlist =\n%s\nexpected\n%s", data, expected)
+	}
+	for _, name := range []string{"master.m3u8", "init.mp4", "live_004.m4s", "live_005.m4s", "live_006.m4s"} {
+		if data, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != files[name] {
+			t.Errorf("%s not moved to the archive: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "live_003.m4s")); !os.IsNotExist(err) {
+		t.Errorf("segment outside the playlist archived: %v", err)
+	}
+}
+
+func TestArchiveVODWithoutSegments(t *testing.T) {
+	outputDir := t.TempDir()
+	os.WriteFile(filepath.Join(outputDir, "live.m3u8"), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:1\n"), 0644)
+	if _, err := archiveVOD(outputDir, filepath.Join(t.TempDir(), "vod")); err != errNoSegments {
+		t.Errorf("archiveVOD() error = %v, expected errNoSegments", err)
+	}
+}
+
+func TestPruneVOD(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	archives := map[string]time.Duration{
+		"alice/20250101-120000": 10 * 24 * time.Hour,
+		"alice/20250108-120000": time.Hour,
+		"bob/20250101-120000":   8 * 24 * time.Hour,
+	}
+	for archive, age := range archives {
+		path := filepath.Join(dir, archive)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(filepath.Join(path, "live.m3u8"), []byte("#EXTM3U\n"), 0644)
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+	}
+
+	sm := NewManager()
+	if err := sm.pruneVOD(dir, now.Add(-7*24*time.Hour)); err != nil {
+		t.Fatalf("pruneVOD() error = %v", err)
+	}
+
+	for archive, expectKept := range map[string]bool{
+		"alice/20250101-120000": false,
+		"alice/20250108-120000": true,
+		"bob":                   false, // left empty
+	} {
+		_, err := os.Stat(filepath.Join(dir, archive))
+		if kept := err == nil; kept != expectKept {
+			t.Errorf("%s kept = %v, expected %v", archive, kept, expectKept)
+		}
+	}
+	if expired := sm.events.Recent(); len(expired) != 2 {
+		t.Errorf("got %d events, expected one per expired archive", len(expired))
+	}
+}
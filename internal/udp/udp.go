@@ -0,0 +1,167 @@
+// Package udp ingests live streams sent as MPEG-TS over UDP, unicast or
+// multicast, as hardware encoders do. Each configured address publishes to
+// one stream: the publish starts with the first datagram and ends once the
+// encoder has been silent for a while, and the stream is fed to the same
+// pipeline as RTMP publishers.
+package udp
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/mpegts"
+	"rtmp-server-poc/internal/stream"
+)
+
+// DefaultIdleTimeout is how long an encoder may be silent before its
+// publish ends
+const DefaultIdleTimeout = 5 * time.Second
+
+// maxDatagramSize bounds the datagrams read, encoders sending 7 packets each
+const maxDatagramSize = 65536
+
+// publisher receives a port's FLV tags, as a stream.Publisher does
+type publisher interface {
+	mpegts.Writer
+	// Close detaches the publisher once the encoder goes silent
+	Close()
+}
+
+// Server publishes the transport streams received on UDP ports
+type Server struct {
+	manager     *stream.Manager
+	config      config.Config
+	idleTimeout time.Duration
+
+	// attach starts publishing to a port's stream, to the stream manager but
+	// for tests
+	attach func(ingest config.UDPIngest) (publisher, error)
+}
+
+// NewServer creates a server publishing to the manager's streams
+func NewServer(manager *stream.Manager, cfg config.Config) *Server {
+	s := &Server{
+		manager:     manager,
+		config:      cfg,
+		idleTimeout: DefaultIdleTimeout,
+	}
+	s.attach = s.attachStream
+	return s
+}
+
+// Listen opens a UDP address, joining its group when it is a multicast one
+func Listen(address string) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		return net.ListenMulticastUDP("udp", nil, addr)
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+// Serve publishes the transport stream received on conn to the ingest's
+// stream until conn is closed. A publish that is refused or evicted drops
+// datagrams until the encoder goes silent, then tries again with the next.
+func (s *Server) Serve(conn net.PacketConn, ingest config.UDPIngest) error {
+	r := &datagramReader{conn: conn, buf: make([]byte, maxDatagramSize)}
+	for {
+		// Wait for the encoder, as long as it takes
+		conn.SetReadDeadline(time.Time{})
+		if err := r.next(); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		r.timeout = s.idleTimeout
+
+		p, err := s.attach(ingest)
+		if err != nil {
+			log.Printf("UDP publish on %s to stream %s refused: %v", conn.LocalAddr(), ingest.Username, err)
+		} else {
+			log.Printf("UDP publisher on %s started stream %s", conn.LocalAddr(), ingest.Username)
+			// Writes through an evicted publisher fail, which ends the copy
+			err = mpegts.Copy(p, r)
+			p.Close()
+			switch {
+			case r.err != nil: // the connection is closed, returned below
+			case err != nil:
+				log.Printf("UDP publisher on %s stopped: %v", conn.LocalAddr(), err)
+			default:
+				log.Printf("UDP publisher on %s went silent", conn.LocalAddr())
+			}
+		}
+		if err != nil && r.err == nil {
+			io.Copy(io.Discard, r)
+		}
+		if r.err != nil {
+			if errors.Is(r.err, net.ErrClosed) {
+				return nil
+			}
+			return r.err
+		}
+		r.timeout = 0
+	}
+}
+
+// datagramReader reads the datagrams of a connection as a stream, ending
+// with io.EOF once none arrives within the timeout
+type datagramReader struct {
+	conn    net.PacketConn
+	timeout time.Duration // zero to wait forever
+	buf     []byte
+	rest    []byte // read but not yet returned
+	err     error  // the read error other than the timeout, once it happens
+}
+
+// next reads the next datagram
+func (r *datagramReader) next() error {
+	if r.timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	n, _, err := r.conn.ReadFrom(r.buf)
+	if err != nil {
+		return err
+	}
+	r.rest = r.buf[:n]
+	return nil
+}
+
+func (r *datagramReader) Read(p []byte) (int, error) {
+	for len(r.rest) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if err := r.next(); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return 0, io.EOF
+			}
+			r.err = err
+			return 0, err
+		}
+	}
+	n := copy(p, r.rest)
+	r.rest = r.rest[n:]
+	return n, nil
+}
+
+// attachStream attaches a publisher to the ingest's stream, as for RTMP
+// publishers
+func (s *Server) attachStream(ingest config.UDPIngest) (publisher, error) {
+	role, err := stream.ParseRole(ingest.Role)
+	if err != nil {
+		return nil, err
+	}
+	_, p, err := s.manager.Publish(ingest.Username, ingest.App, role, nil, s.config)
+	if err != nil {
+		return nil, err
+	}
+	return p.Bind(s.config), nil
+}
@@ -0,0 +1,186 @@
+package udp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"rtmp-server-poc/internal/config"
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/mpegts"
+	"rtmp-server-poc/internal/mpegts/mpegtstest"
+	"rtmp-server-poc/internal/stream"
+)
+
+// fakePublisher records the tags of a publish
+type fakePublisher struct {
+	mutex  sync.Mutex
+	tags   []flv.Tag
+	closed chan struct{}
+}
+
+func newFakePublisher() *fakePublisher {
+	return &fakePublisher{closed: make(chan struct{})}
+}
+
+func (f *fakePublisher) write(tagType byte, timestamp uint32, data []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	tag, err := flv.ParseTag(tagType, timestamp, data)
+	f.tags = append(f.tags, tag)
+	return err
+}
+
+func (f *fakePublisher) WriteVideo(timestamp uint32, data []byte) error {
+	return f.write(flv.TagTypeVideo, timestamp, data)
+}
+
+func (f *fakePublisher) WriteAudio(timestamp uint32, data []byte) error {
+	return f.write(flv.TagTypeAudio, timestamp, data)
+}
+
+func (f *fakePublisher) Close() {
+	close(f.closed)
+}
+
+// waitClosed waits for the publish to end, returning its tags
+func (f *fakePublisher) waitClosed(t *testing.T) []flv.Tag {
+	t.Helper()
+	select {
+	case <-f.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher not closed after the encoder went silent")
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.tags
+}
+
+// startServer serves on a local port, attaching with attach, and returns a
+// connection sending to it
+func startServer(t *testing.T, attach func(ingest config.UDPIngest) (publisher, error)) net.Conn {
+	t.Helper()
+	s := NewServer(nil, config.Config{})
+	s.attach = attach
+	s.idleTimeout = 100 * time.Millisecond
+	conn, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.Serve(conn, config.UDPIngest{App: "studio", Username: "camera1"})
+
+	encoder, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { encoder.Close() })
+	return encoder
+}
+
+// send writes a second of 25 fps H.264 as a transport stream, 7 packets per
+// datagram as encoders do
+func send(t *testing.T, encoder net.Conn) {
+	t.Helper()
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	var buf bytes.Buffer
+	m := mpegtstest.NewMuxer(&buf)
+	for i := range 25 {
+		frame := []byte{0, 0, 0, 1, 0x41, 0x9a, byte(i)}
+		if i%10 == 0 {
+			frame = append([]byte{0, 0, 0, 1}, sps...)
+			frame = append(append(frame, 0, 0, 0, 1), pps...)
+			frame = append(frame, 0, 0, 0, 1, 0x65, 0x88, byte(i))
+		}
+		pts := int64(90000 + i*3600)
+		if err := m.WriteFrame(&mpegts.Frame{StreamType: mpegts.StreamTypeH264, PTS: pts, DTS: pts, Data: frame}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for data := buf.Bytes(); len(data) > 0; {
+		n := min(len(data), 7*mpegts.PacketSize)
+		if _, err := encoder.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+		time.Sleep(time.Millisecond) // not to overflow the socket buffer
+	}
+}
+
+func TestServerPublish(t *testing.T) {
+	publishers := make(chan *fakePublisher, 2)
+	ingests := make(chan config.UDPIngest, 2)
+	encoder := startServer(t, func(ingest config.UDPIngest) (publisher, error) {
+		p := newFakePublisher()
+		publishers <- p
+		ingests <- ingest
+		return p, nil
+	})
+
+	// Each burst is a publish of its own, ending with the silence after it
+	for i := range 2 {
+		send(t, encoder)
+		p := <-publishers
+		if ingest := <-ingests; ingest.Username != "camera1" {
+			t.Errorf("publish %d attached %+v, expected camera1", i, ingest)
+		}
+		tags := p.waitClosed(t)
+		if len(tags) != 26 {
+			t.Fatalf("publish %d got %d tags, expected a sequence header and 25 frames", i, len(tags))
+		}
+		if !tags[0].Video.IsSequenceHeader() || !tags[1].IsKeyframe() || tags[1].Timestamp != 0 || tags[25].Timestamp != 960 {
+			t.Errorf("publish %d got %+v first and %d ms last, expected a sequence header then 0 to 960 ms", i, tags[1], tags[25].Timestamp)
+		}
+	}
+}
+
+func TestServerRefused(t *testing.T) {
+	var attempts int
+	publishers := make(chan *fakePublisher, 1)
+	encoder := startServer(t, func(ingest config.UDPIngest) (publisher, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, stream.ErrPublisherExists
+		}
+		p := newFakePublisher()
+		publishers <- p
+		return p, nil
+	})
+
+	// A refused publish drops the whole burst rather than retrying with each
+	// datagram, and the next burst tries again
+	send(t, encoder)
+	time.Sleep(300 * time.Millisecond)
+	send(t, encoder)
+	p := <-publishers
+	if tags := p.waitClosed(t); len(tags) != 26 {
+		t.Errorf("got %d tags, expected the second burst's 26", len(tags))
+	}
+	if attempts != 2 {
+		t.Errorf("attached %d times, expected 2", attempts)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s := NewServer(nil, config.Config{})
+	conn, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(conn, config.UDPIngest{Username: "camera1"})
+	}()
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve() = %v, expected nil once closed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() still running after Close()")
+	}
+}
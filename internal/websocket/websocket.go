@@ -0,0 +1,318 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455) on top of net/http: the opening handshake, framing, and the
+// ping and close control frames. It is meant for streaming binary media to
+// browsers and receiving small messages back, so extensions and
+// subprotocols are not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message types, the opcodes of data frames
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+// Control frame opcodes and the continuation opcode
+const (
+	opContinuation = 0
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// Close status codes
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseMessageTooBig   = 1009
+	closeNoStatusPresent = 1005
+)
+
+// acceptGUID is appended to the client's key to compute the accept value
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// MaxMessageSize bounds the messages read from clients
+const MaxMessageSize = 64 * 1024
+
+// closeTimeout bounds how long Close waits to write its close frame
+const closeTimeout = time.Second
+
+var (
+	// ErrNotWebSocket is returned by Upgrade for requests that are not a
+	// WebSocket opening handshake
+	ErrNotWebSocket = errors.New("websocket: not a websocket handshake")
+	// ErrProtocol is returned when the client breaks the framing rules
+	ErrProtocol = errors.New("websocket: protocol error")
+	// ErrMessageTooBig is returned for messages larger than MaxMessageSize
+	ErrMessageTooBig = errors.New("websocket: message too big")
+)
+
+// CloseError is returned by ReadMessage once the client closed the connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed by peer (%d %s)", e.Code, e.Reason)
+}
+
+// Conn is a server side WebSocket connection. Messages may be written
+// concurrently with each other and with a single reader.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMutex sync.Mutex
+	closeSent  bool
+}
+
+// headerContains reports whether a comma separated header lists token,
+// ignoring case
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept value for a client key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Upgrade completes the opening handshake and takes over the connection.
+// A request that is not a valid handshake gets an error response and
+// ErrNotWebSocket.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	switch {
+	case r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket"):
+		http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, ErrNotWebSocket
+	case err != nil || len(decoded) != 16:
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "cannot upgrade the connection", http.StatusInternalServerError)
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, reader: rw.Reader}, nil
+}
+
+// RemoteAddr returns the client's address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetWriteDeadline sets the deadline for the following writes
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// WriteMessage sends a text or binary message in a single frame
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	return c.writeFrame(byte(messageType), data)
+}
+
+// writeFrame sends a final, unmasked frame
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	buffers := net.Buffers{header, payload}
+	_, err := buffers.WriteTo(c.conn)
+	return err
+}
+
+// frame is a frame as read from the client, unmasked
+type frame struct {
+	final   bool
+	opcode  byte
+	payload []byte
+}
+
+// readFrame reads one frame. Client frames must be masked, and control
+// frames short and unfragmented.
+func (c *Conn) readFrame() (frame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{final: header[0]&0x80 != 0, opcode: header[0] & 0x0f}
+	if header[0]&0x70 != 0 || header[1]&0x80 == 0 {
+		return frame{}, fmt.Errorf("%w: reserved bits set or unmasked frame", ErrProtocol)
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return frame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return frame{}, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if f.opcode >= opClose && (length > 125 || !f.final) {
+		return frame{}, fmt.Errorf("%w: invalid control frame", ErrProtocol)
+	}
+	if length > MaxMessageSize {
+		return frame{}, ErrMessageTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return frame{}, err
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, f.payload); err != nil {
+		return frame{}, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// ReadMessage returns the next text or binary message, reassembling
+// fragmented ones. Pings are answered while waiting. Once the client closes
+// the connection, the close is acknowledged and a *CloseError returned; a
+// client breaking the protocol is sent a close frame and the error.
+func (c *Conn) ReadMessage() (messageType int, data []byte, err error) {
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			c.failWith(err)
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case opPing:
+			c.writeFrame(opPong, f.payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			closeErr := &CloseError{Code: closeNoStatusPresent}
+			if len(f.payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(f.payload))
+				closeErr.Reason = string(f.payload[2:])
+			}
+			c.writeFrame(opClose, f.payload[:min(2, len(f.payload))])
+			return 0, nil, closeErr
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				err = fmt.Errorf("%w: new message inside a fragmented one", ErrProtocol)
+			}
+			messageType = int(f.opcode)
+		case opContinuation:
+			if messageType == 0 {
+				err = fmt.Errorf("%w: continuation without a message", ErrProtocol)
+			}
+		default:
+			err = fmt.Errorf("%w: unknown opcode %d", ErrProtocol, f.opcode)
+		}
+		if err == nil && len(data)+len(f.payload) > MaxMessageSize {
+			err = ErrMessageTooBig
+		}
+		if err != nil {
+			c.failWith(err)
+			return 0, nil, err
+		}
+
+		data = append(data, f.payload...)
+		if f.final {
+			return messageType, data, nil
+		}
+	}
+}
+
+// failWith closes the connection after a read error, telling the client
+// why when the error is theirs
+func (c *Conn) failWith(err error) {
+	switch {
+	case errors.Is(err, ErrMessageTooBig):
+		c.CloseWithReason(CloseMessageTooBig, "message too big")
+	case errors.Is(err, ErrProtocol):
+		c.CloseWithReason(CloseProtocolError, "protocol error")
+	}
+}
+
+// CloseWithReason sends a close frame with a status code and reason, then
+// closes the connection
+func (c *Conn) CloseWithReason(code int, reason string) error {
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	c.writeFrame(opClose, append(payload, reason...))
+	return c.conn.Close()
+}
+
+// Close closes the connection normally
+func (c *Conn) Close() error {
+	return c.CloseWithReason(CloseNormal, "")
+}
@@ -0,0 +1,194 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// The example of RFC 6455 section 1.3
+	if got := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("AcceptKey() = %q", got)
+	}
+}
+
+// testClient is the client end of a connection, writing masked frames
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dial performs the opening handshake against server
+func dial(t *testing.T, server *httptest.Server, header string) (*testClient, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	request := "GET /ws HTTP/1.1\r\nHost: test\r\n" + header + "\r\n"
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{conn: conn, reader: reader}, response
+}
+
+const handshake = "Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+
+// send writes a masked frame
+func (c *testClient) send(t *testing.T, first byte, payload []byte) {
+	t.Helper()
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{first, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive reads an unmasked frame
+func (c *testClient) receive(t *testing.T) (first byte, payload []byte) {
+	t.Helper()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1])
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		io.ReadFull(c.reader, extended)
+		length = int(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		io.ReadFull(c.reader, extended)
+		length = int(binary.BigEndian.Uint64(extended))
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0], payload
+}
+
+func TestUpgradeRejectsInvalidHandshakes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := Upgrade(w, r); !errors.Is(err, ErrNotWebSocket) {
+			t.Errorf("Upgrade() error = %v, expected ErrNotWebSocket", err)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		header   string
+		expected int
+	}{
+		{"Plain request", "", http.StatusBadRequest},
+		{"Old version", strings.Replace(handshake, "13", "8", 1), http.StatusUpgradeRequired},
+		{"Bad key", strings.Replace(handshake, "dGhlIHNhbXBsZSBub25jZQ==", "c2hvcnQ=", 1), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, response := dial(t, server, tt.header)
+			if response.StatusCode != tt.expected {
+				t.Errorf("status = %d, expected %d", response.StatusCode, tt.expected)
+			}
+		})
+	}
+}
+
+func TestConn(t *testing.T) {
+	received := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			received <- err
+			return
+		}
+		defer conn.Close()
+		if err := conn.WriteMessage(BinaryMessage, bytes.Repeat([]byte{0xab}, 300)); err != nil {
+			received <- err
+			return
+		}
+		// Echo messages until the client closes
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				received <- err
+				return
+			}
+			conn.WriteMessage(messageType, data)
+		}
+	}))
+	defer server.Close()
+
+	client, response := dial(t, server, handshake)
+	if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake response = %d %v", response.StatusCode, response.Header)
+	}
+
+	if first, payload := client.receive(t); first != 0x82 || len(payload) != 300 {
+		t.Errorf("got frame %#x of %d bytes, expected a 300 byte binary message", first, len(payload))
+	}
+
+	// A fragmented text message with a ping in between
+	client.send(t, 0x01, []byte(`{"type":`))
+	client.send(t, 0x89, []byte("ping"))
+	client.send(t, 0x80, []byte(`"pause"}`))
+	if first, payload := client.receive(t); first != 0x8a || string(payload) != "ping" {
+		t.Errorf("got frame %#x %q, expected the pong", first, payload)
+	}
+	if first, payload := client.receive(t); first != 0x81 || string(payload) != `{"type":"pause"}` {
+		t.Errorf("got frame %#x %q, expected the reassembled message", first, payload)
+	}
+
+	client.send(t, 0x88, []byte{0x03, 0xe8, 'b', 'y', 'e'})
+	if first, payload := client.receive(t); first != 0x88 || !bytes.Equal(payload, []byte{0x03, 0xe8}) {
+		t.Errorf("got frame %#x %x, expected the close to be acknowledged", first, payload)
+	}
+	var closeErr *CloseError
+	if err := <-received; !errors.As(err, &closeErr) || closeErr.Code != CloseNormal || closeErr.Reason != "bye" {
+		t.Errorf("ReadMessage() error = %v, expected the client's close", err)
+	}
+}
+
+func TestConnRejectsUnmaskedFrames(t *testing.T) {
+	received := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			received <- err
+			return
+		}
+		_, _, err = conn.ReadMessage()
+		received <- err
+	}))
+	defer server.Close()
+
+	client, _ := dial(t, server, handshake)
+	client.conn.Write([]byte{0x81, 0x02, 'h', 'i'})
+	if err := <-received; !errors.Is(err, ErrProtocol) {
+		t.Errorf("ReadMessage() error = %v, expected ErrProtocol", err)
+	}
+	if first, payload := client.receive(t); first != 0x88 || binary.BigEndian.Uint16(payload) != CloseProtocolError {
+		t.Errorf("got frame %#x %x, expected a protocol error close", first, payload)
+	}
+}
@@ -0,0 +1,120 @@
+package whep
+
+import (
+	"math/rand/v2"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+
+	"rtmp-server-poc/internal/codec"
+	"rtmp-server-poc/internal/flv"
+)
+
+// videoClockRate is the RTP clock rate of video, in Hz
+const videoClockRate = 90000
+
+// rtpPayloadSize bounds RTP payloads so packets fit the path MTU along with
+// the RTP, SRTP, UDP and IP headers
+const rtpPayloadSize = 1200
+
+// naluTypeSPS is the NAL unit type of sequence parameter sets
+const naluTypeSPS = 7
+
+// annexBStartCode prefixes each NAL unit handed to the payloader
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// h264Packetizer turns the H.264 frames of FLV tags into RTP packets. FLV
+// frames are AVCC: NAL units prefixed by their length, without the
+// parameter sets, which the sequence header carries instead. RTP carries
+// them in band, so they are sent ahead of every keyframe.
+type h264Packetizer struct {
+	params    *codec.AVCParameterSets
+	payloader codecs.H264Payloader
+	sequence  uint16
+}
+
+// newH264Packetizer creates a packetizer waiting for a sequence header
+func newH264Packetizer() *h264Packetizer {
+	return &h264Packetizer{sequence: randomSequenceNumber()}
+}
+
+// randomSequenceNumber returns the first RTP sequence number of a track,
+// random as RFC 3550 recommends
+func randomSequenceNumber() uint16 {
+	return uint16(rand.Uint32())
+}
+
+// configure takes the parameter sets of an AVC sequence header
+func (p *h264Packetizer) configure(tag flv.Tag) error {
+	params, err := codec.ParseAVCParameterSets(tag.Data[tag.Video.PayloadOffset:])
+	if err != nil {
+		return err
+	}
+	p.params = params
+	return nil
+}
+
+// annexB converts a coded frame to Annex B, with the parameter sets ahead of
+// a keyframe that lacks them. It returns nil for frames that cannot be
+// decoded: before the sequence header, or with invalid NAL unit lengths.
+func (p *h264Packetizer) annexB(tag flv.Tag) []byte {
+	if p.params == nil {
+		return nil
+	}
+	var nalus [][]byte
+	hasSPS := false
+	for payload := tag.Data[tag.Video.PayloadOffset:]; len(payload) > 0; {
+		if len(payload) < p.params.LengthSize {
+			return nil
+		}
+		size := 0
+		for _, b := range payload[:p.params.LengthSize] {
+			size = size<<8 | int(b)
+		}
+		payload = payload[p.params.LengthSize:]
+		if size == 0 || size > len(payload) {
+			return nil
+		}
+		nalus = append(nalus, payload[:size])
+		hasSPS = hasSPS || payload[0]&0x1f == naluTypeSPS
+		payload = payload[size:]
+	}
+
+	var frame []byte
+	if tag.IsKeyframe() && !hasSPS {
+		for _, nalu := range append(p.params.SPS, p.params.PPS...) {
+			frame = append(append(frame, annexBStartCode...), nalu...)
+		}
+	}
+	for _, nalu := range nalus {
+		frame = append(append(frame, annexBStartCode...), nalu...)
+	}
+	return frame
+}
+
+// packetize returns the RTP packets of a coded frame, time stamped with its
+// presentation time. The payload type and SSRC are left to the track.
+func (p *h264Packetizer) packetize(tag flv.Tag) []*rtp.Packet {
+	frame := p.annexB(tag)
+	if frame == nil {
+		return nil
+	}
+	pts := int64(tag.Timestamp) + int64(tag.Video.CompositionTime)
+	timestamp := uint32(pts * videoClockRate / 1000)
+
+	payloads := p.payloader.Payload(rtpPayloadSize, frame)
+	packets := make([]*rtp.Packet, len(payloads))
+	for i, payload := range payloads {
+		packets[i] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1, // last packet of the frame
+				SequenceNumber: p.sequence,
+				Timestamp:      timestamp,
+			},
+			Payload: payload,
+		}
+		p.sequence++
+	}
+	return packets
+}
@@ -0,0 +1,106 @@
+package whep
+
+import (
+	"bytes"
+	"testing"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// sequenceHeader builds an AVC sequence header with testSPS and testPPS
+// and 4 byte NAL unit lengths
+func sequenceHeader() flv.Tag {
+	data := []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x42, 0xc0, 0x1f, 0xff, 0xe1, 0x00, byte(len(testSPS))}
+	data = append(data, testSPS...)
+	data = append(data, 0x01, 0x00, byte(len(testPPS)))
+	data = append(data, testPPS...)
+	tag, _ := flv.ParseTag(flv.TagTypeVideo, 0, data)
+	return tag
+}
+
+// videoTag builds an AVC frame of the given NAL units
+func videoTag(timestamp uint32, keyframe bool, composition byte, nalus ...[]byte) flv.Tag {
+	frameType := byte(0x27)
+	if keyframe {
+		frameType = 0x17
+	}
+	data := []byte{frameType, 0x01, 0x00, 0x00, composition}
+	for _, nalu := range nalus {
+		data = append(data, 0x00, 0x00, byte(len(nalu)>>8), byte(len(nalu)))
+		data = append(data, nalu...)
+	}
+	tag, _ := flv.ParseTag(flv.TagTypeVideo, timestamp, data)
+	return tag
+}
+
+// annexB joins NAL units with start codes
+func annexB(nalus ...[]byte) []byte {
+	var frame []byte
+	for _, nalu := range nalus {
+		frame = append(append(frame, annexBStartCode...), nalu...)
+	}
+	return frame
+}
+
+func TestH264PacketizerAnnexB(t *testing.T) {
+	idr := []byte{0x65, 0x88, 0x84}
+	slice := []byte{0x41, 0x9a, 0x02}
+	truncated := videoTag(0, false, 0, slice)
+	truncated.Data = truncated.Data[:len(truncated.Data)-1]
+
+	tests := []struct {
+		name       string
+		configured bool
+		tag        flv.Tag
+		expected   []byte
+	}{
+		{"Before the sequence header", false, videoTag(0, true, 0, idr), nil},
+		{"Keyframe gets the parameter sets", true, videoTag(0, true, 0, idr), annexB(testSPS, testPPS, idr)},
+		{"Keyframe with its own SPS", true, videoTag(0, true, 0, testSPS, idr), annexB(testSPS, idr)},
+		{"Inter frame", true, videoTag(40, false, 0, slice), annexB(slice)},
+		{"Truncated NAL unit", true, truncated, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newH264Packetizer()
+			if tt.configured {
+				if err := p.configure(sequenceHeader()); err != nil {
+					t.Fatalf("configure() error = %v", err)
+				}
+			}
+			if got := p.annexB(tt.tag); !bytes.Equal(got, tt.expected) {
+				t.Errorf("annexB() = %x, expected %x", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestH264PacketizerPacketize(t *testing.T) {
+	p := newH264Packetizer()
+	p.configure(sequenceHeader())
+	first := p.sequence
+
+	// A keyframe larger than a packet is fragmented after the parameter sets
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 2*rtpPayloadSize)...)
+	packets := p.packetize(videoTag(1000, true, 66, idr))
+	if len(packets) != 4 {
+		t.Fatalf("got %d packets, expected STAP-A and 3 FU-A", len(packets))
+	}
+	for i, packet := range packets {
+		if packet.SequenceNumber != first+uint16(i) || packet.Timestamp != (1000+66)*90 || packet.Marker != (i == 3) {
+			t.Errorf("packet %d header = %+v", i, packet.Header)
+		}
+		if len(packet.Payload) > rtpPayloadSize {
+			t.Errorf("packet %d has %d bytes", i, len(packet.Payload))
+		}
+	}
+	if naluType := packets[0].Payload[0] & 0x1f; naluType != 24 {
+		t.Errorf("first packet NAL unit type = %d, expected STAP-A", naluType)
+	}
+}
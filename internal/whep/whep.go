@@ -0,0 +1,341 @@
+// Package whep serves live streams to WebRTC players over WHEP, the
+// WebRTC-HTTP Egress Protocol: a player posts an SDP offer and gets back an
+// answer, then receives the stream's H.264 video, repacketized from its FLV
+// tags into RTP, and its audio as encoded to Opus by the transcoder.
+package whep
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+var (
+	// ErrInvalidOffer is returned for offers that cannot be answered
+	ErrInvalidOffer = errors.New("whep: invalid SDP offer")
+	// ErrSessionNotFound is returned when closing an unknown session
+	ErrSessionNotFound = errors.New("whep: session not found")
+)
+
+// connectTimeout bounds how long a session waits for the player to connect
+// after the answer
+const connectTimeout = 15 * time.Second
+
+// h264Capability is the video codec sessions send: H.264 in
+// non-interleaved mode, as browsers support it. The level of the stream may
+// differ from the one negotiated.
+var h264Capability = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeH264,
+	ClockRate:   videoClockRate,
+	SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+}
+
+// opusCapability is the audio codec sessions send
+var opusCapability = webrtc.RTPCodecCapability{
+	MimeType:  webrtc.MimeTypeOpus,
+	ClockRate: 48000,
+	Channels:  2,
+}
+
+// TagSource is a live stream's FLV tags, as a stream.Viewer delivers them
+type TagSource interface {
+	// Next returns the next tag, or false once the stream has ended
+	Next(ctx context.Context) (flv.Tag, bool)
+	Close()
+}
+
+// PacketSource is a live stream's audio as Opus RTP packets, as a
+// stream.OpusListener delivers them
+type PacketSource interface {
+	// Next returns the next packet, or false once the stream has ended
+	Next(ctx context.Context) ([]byte, bool)
+	Close()
+}
+
+// Manager answers WHEP offers and keeps the sessions until they end
+type Manager struct {
+	api           *webrtc.API
+	configuration webrtc.Configuration
+
+	mutex    sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewManager creates a manager whose peer connections gather candidates
+// with the given STUN and TURN servers
+func NewManager(iceServers []string) (*Manager, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	// NACK responses, RTCP reports and the like
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		api:      webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry)),
+		sessions: make(map[string]*Session),
+	}
+	if len(iceServers) > 0 {
+		m.configuration.ICEServers = []webrtc.ICEServer{{URLs: iceServers}}
+	}
+	return m, nil
+}
+
+// Session sends a live stream to one WebRTC player
+type Session struct {
+	// ID identifies the session in its WHEP resource URL
+	ID string
+
+	manager *Manager
+	pc      *webrtc.PeerConnection
+	video   TagSource
+	audio   PacketSource // nil without audio
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	videoTrack *webrtc.TrackLocalStaticRTP
+	audioTrack *webrtc.TrackLocalStaticRTP
+	connected  chan struct{} // closed once the player is connected
+	closeOnce  sync.Once
+}
+
+// newSessionID returns a random session ID
+func newSessionID() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// Offer answers a player's SDP offer with a session sending video and, when
+// audio is not nil, audio. The session owns the sources and closes them once
+// it ends, or right away when the offer fails. The answer carries every ICE
+// candidate, so the player does not need to trickle them.
+func (m *Manager) Offer(ctx context.Context, offer string, video TagSource, audio PacketSource) (*Session, string, error) {
+	s, err := m.newSession(video, audio)
+	if err != nil {
+		video.Close()
+		if audio != nil {
+			audio.Close()
+		}
+		return nil, "", err
+	}
+	answer, err := s.negotiate(ctx, offer)
+	if err != nil {
+		s.Close()
+		return nil, "", err
+	}
+
+	m.mutex.Lock()
+	m.sessions[s.ID] = s
+	m.mutex.Unlock()
+	go s.run()
+	return s, answer, nil
+}
+
+// newSession creates a peer connection with the session's tracks
+func (m *Manager) newSession(video TagSource, audio PacketSource) (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := m.api.NewPeerConnection(m.configuration)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		ID:        id,
+		manager:   m,
+		pc:        pc,
+		video:     video,
+		audio:     audio,
+		ctx:       ctx,
+		cancel:    cancel,
+		connected: make(chan struct{}),
+	}
+
+	s.videoTrack, err = s.addTrack(h264Capability, "video")
+	if err == nil && audio != nil {
+		s.audioTrack, err = s.addTrack(opusCapability, "audio")
+	}
+	if err != nil {
+		cancel()
+		pc.Close()
+		return nil, err
+	}
+
+	var connectedOnce sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			connectedOnce.Do(func() { close(s.connected) })
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			s.Close()
+		}
+	})
+	return s, nil
+}
+
+// addTrack adds a send-only track, reading its RTCP so that NACKs and
+// receiver reports reach the interceptors
+func (s *Session) addTrack(capability webrtc.RTPCodecCapability, id string) (*webrtc.TrackLocalStaticRTP, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(capability, id, "live")
+	if err != nil {
+		return nil, err
+	}
+	sender, err := s.pc.AddTrack(track)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return track, nil
+}
+
+// negotiate applies the offer and returns the answer once every candidate
+// has been gathered
+func (s *Session) negotiate(ctx context.Context, offer string) (string, error) {
+	err := s.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidOffer, err)
+	}
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidOffer, err)
+	}
+	gathered := webrtc.GatheringCompletePromise(s.pc)
+	if err := s.pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	return s.pc.LocalDescription().SDP, nil
+}
+
+// run sends the stream once the player is connected, until either goes away
+func (s *Session) run() {
+	defer s.Close()
+	select {
+	case <-s.connected:
+	case <-time.After(connectTimeout):
+		log.Printf("WHEP session %s: player did not connect within %v", s.ID, connectTimeout)
+		return
+	case <-s.ctx.Done():
+		return
+	}
+
+	log.Printf("WHEP session %s connected", s.ID)
+	if s.audio != nil {
+		go s.sendAudio()
+	}
+	s.sendVideo()
+}
+
+// sendVideo repacketizes the H.264 frames of the stream until it ends.
+// Tracks in other codecs are not sent.
+func (s *Session) sendVideo() {
+	packetizer := newH264Packetizer()
+	for {
+		tag, ok := s.video.Next(s.ctx)
+		if !ok {
+			return
+		}
+		if tag.Video == nil || tag.Video.Codec() != "avc" {
+			continue
+		}
+		if tag.Video.IsSequenceHeader() {
+			if err := packetizer.configure(tag); err != nil {
+				log.Printf("WHEP session %s: invalid AVC sequence header: %v", s.ID, err)
+			}
+			continue
+		}
+		if !tag.Video.IsCodedFrame() {
+			continue
+		}
+		for _, packet := range packetizer.packetize(tag) {
+			s.videoTrack.WriteRTP(packet)
+		}
+	}
+}
+
+// sendAudio forwards the Opus packets, numbered anew so that transcoder
+// restarts do not break the sequence
+func (s *Session) sendAudio() {
+	sequence := randomSequenceNumber()
+	for {
+		data, ok := s.audio.Next(s.ctx)
+		if !ok {
+			return
+		}
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(data); err != nil {
+			continue
+		}
+		packet.SequenceNumber = sequence
+		sequence++
+		s.audioTrack.WriteRTP(packet)
+	}
+}
+
+// Close ends the session and releases its sources
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.manager.mutex.Lock()
+		if s.manager.sessions[s.ID] == s {
+			delete(s.manager.sessions, s.ID)
+		}
+		s.manager.mutex.Unlock()
+
+		s.pc.Close()
+		s.video.Close()
+		if s.audio != nil {
+			s.audio.Close()
+		}
+		log.Printf("WHEP session %s closed", s.ID)
+	})
+}
+
+// Close ends a session by ID
+func (m *Manager) Close(id string) error {
+	m.mutex.Lock()
+	s, ok := m.sessions[id]
+	m.mutex.Unlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+	s.Close()
+	return nil
+}
+
+// Count returns the number of sessions
+func (m *Manager) Count() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.sessions)
+}
@@ -0,0 +1,230 @@
+package whep
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+// fakeSource stands in for a stream's viewer or Opus listener
+type fakeSource[T any] struct {
+	items     chan T
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeSource[T any](items ...T) *fakeSource[T] {
+	f := &fakeSource[T]{items: make(chan T, len(items)+16), closed: make(chan struct{})}
+	for _, item := range items {
+		f.items <- item
+	}
+	return f
+}
+
+func (f *fakeSource[T]) Next(ctx context.Context) (T, bool) {
+	var zero T
+	select {
+	case item := <-f.items:
+		return item, true
+	case <-f.closed:
+		return zero, false
+	case <-ctx.Done():
+		return zero, false
+	}
+}
+
+func (f *fakeSource[T]) Close() {
+	f.closeOnce.Do(func() { close(f.closed) })
+}
+
+func (f *fakeSource[T]) isClosed() bool {
+	select {
+	case <-f.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// whepClient is a receive-only peer connection, as a WHEP player creates it
+type whepClient struct {
+	pc     *webrtc.PeerConnection
+	tracks chan *webrtc.TrackRemote
+}
+
+// newWHEPClient creates a client and its offer, with every candidate
+func newWHEPClient(t *testing.T) (*whepClient, string) {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		init := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+		if _, err := pc.AddTransceiverFromKind(kind, init); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &whepClient{pc: pc, tracks: make(chan *webrtc.TrackRemote, 2)}
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		c.tracks <- track
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return c, pc.LocalDescription().SDP
+}
+
+// track waits for the server to start sending a track of the given kind
+func (c *whepClient) track(t *testing.T, kind webrtc.RTPCodecType, others map[webrtc.RTPCodecType]*webrtc.TrackRemote) *webrtc.TrackRemote {
+	t.Helper()
+	for others[kind] == nil {
+		select {
+		case track := <-c.tracks:
+			others[track.Kind()] = track
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no %s track received", kind)
+		}
+	}
+	return others[kind]
+}
+
+// readFrame reads the RTP packets of a video frame, returning it in Annex B
+func readFrame(t *testing.T, track *webrtc.TrackRemote) (uint32, []byte) {
+	t.Helper()
+	depacketizer := &codecs.H264Packet{}
+	var frame []byte
+	for {
+		track.SetReadDeadline(time.Now().Add(10 * time.Second))
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			t.Fatalf("ReadRTP() error = %v", err)
+		}
+		data, err := depacketizer.Unmarshal(packet.Payload)
+		if err != nil {
+			t.Fatalf("invalid H.264 payload: %v", err)
+		}
+		frame = append(frame, data...)
+		if packet.Marker {
+			return packet.Timestamp, frame
+		}
+	}
+}
+
+func TestWHEPSession(t *testing.T) {
+	m, err := NewManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 3000)...)
+	slice := []byte{0x41, 0x9a, 0x02}
+	video := newFakeSource(
+		sequenceHeader(),
+		videoTag(1000, true, 0, idr),
+		videoTag(1040, false, 0, slice),
+	)
+	opus := rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: 7, Timestamp: 960, SSRC: 1}, Payload: []byte{0xfc, 0xff, 0xfe}}
+	opusData, _ := opus.Marshal()
+	audio := newFakeSource(opusData)
+
+	client, offer := newWHEPClient(t)
+	session, answer, err := m.Offer(t.Context(), offer, video, audio)
+	if err != nil {
+		t.Fatalf("Offer() error = %v", err)
+	}
+	if err := client.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatalf("SetRemoteDescription() error = %v", err)
+	}
+
+	tracks := map[webrtc.RTPCodecType]*webrtc.TrackRemote{}
+	videoTrack := client.track(t, webrtc.RTPCodecTypeVideo, tracks)
+	if mimeType := videoTrack.Codec().MimeType; mimeType != webrtc.MimeTypeH264 {
+		t.Errorf("video codec = %s", mimeType)
+	}
+	keyTimestamp, keyframe := readFrame(t, videoTrack)
+	if expected := annexB(testSPS, testPPS, idr); !bytes.Equal(keyframe, expected) {
+		t.Errorf("keyframe = %d bytes, expected the parameter sets and the IDR slice", len(keyframe))
+	}
+	timestamp, frame := readFrame(t, videoTrack)
+	if !bytes.Equal(frame, annexB(slice)) || timestamp-keyTimestamp != 40*90 {
+		t.Errorf("frame %x at +%d, expected %x 40 ms later", frame, timestamp-keyTimestamp, annexB(slice))
+	}
+
+	audioTrack := client.track(t, webrtc.RTPCodecTypeAudio, tracks)
+	audioTrack.SetReadDeadline(time.Now().Add(10 * time.Second))
+	packet, _, err := audioTrack.ReadRTP()
+	if err != nil {
+		t.Fatalf("audio ReadRTP() error = %v", err)
+	}
+	if audioTrack.Codec().MimeType != webrtc.MimeTypeOpus || !bytes.Equal(packet.Payload, opus.Payload) || packet.Timestamp != opus.Timestamp {
+		t.Errorf("audio packet = %+v, expected the Opus packet", packet)
+	}
+
+	// DELETE on the session URL
+	if err := m.Close(session.ID); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := m.Close(session.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("second Close() error = %v, expected ErrSessionNotFound", err)
+	}
+	if !video.isClosed() || !audio.isClosed() || m.Count() != 0 {
+		t.Error("closing the session did not release its sources")
+	}
+}
+
+func TestWHEPSessionEndsWithStream(t *testing.T) {
+	m, err := NewManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := newFakeSource(sequenceHeader(), videoTag(0, true, 0, []byte{0x65, 0x88}))
+	client, offer := newWHEPClient(t)
+	_, answer, err := m.Offer(t.Context(), offer, video, nil)
+	if err != nil {
+		t.Fatalf("Offer() error = %v", err)
+	}
+	client.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer})
+	client.track(t, webrtc.RTPCodecTypeVideo, map[webrtc.RTPCodecType]*webrtc.TrackRemote{})
+
+	video.Close() // the stream ended
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session outlived its stream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWHEPInvalidOffer(t *testing.T) {
+	m, err := NewManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := newFakeSource[flv.Tag]()
+	audio := newFakeSource[[]byte]()
+	if _, _, err := m.Offer(t.Context(), "v=0\r\n", video, audio); !errors.Is(err, ErrInvalidOffer) {
+		t.Errorf("Offer() error = %v, expected ErrInvalidOffer", err)
+	}
+	if !video.isClosed() || !audio.isClosed() || m.Count() != 0 {
+		t.Error("a failed offer did not release its sources")
+	}
+}
@@ -0,0 +1,27 @@
+package whip
+
+// trackClock converts the RTP timestamps of a track to FLV milliseconds on
+// the session timeline. Each track's clock starts at its own random value,
+// so the first sample is placed by arrival time relative to the session's
+// first sample and later ones by their RTP timestamp deltas.
+type trackClock struct {
+	rate     int64
+	started  bool
+	previous uint32
+	elapsed  int64 // in clock ticks since the first sample
+	offset   int64 // milliseconds from the session start to the first sample
+}
+
+// timestamp returns the FLV timestamp of a sample, with since the time since
+// the session start in milliseconds
+func (c *trackClock) timestamp(rtpTimestamp uint32, since func() int64) uint32 {
+	if !c.started {
+		c.started = true
+		c.previous = rtpTimestamp
+		c.offset = since()
+	}
+	// The signed difference survives the 32 bit wraparound
+	c.elapsed += int64(int32(rtpTimestamp - c.previous))
+	c.previous = rtpTimestamp
+	return uint32(max(c.offset+c.elapsed*1000/c.rate, 0))
+}
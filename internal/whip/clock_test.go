@@ -0,0 +1,31 @@
+package whip
+
+import (
+	"testing"
+)
+
+func TestTrackClock(t *testing.T) {
+	arrivals := []int64{500}
+	since := func() int64 {
+		elapsed := arrivals[0]
+		arrivals = arrivals[1:] // only the first sample is placed by arrival
+		return elapsed
+	}
+
+	clock := trackClock{rate: 90000}
+	tests := []struct {
+		name         string
+		rtpTimestamp uint32
+		expected     uint32
+	}{
+		{"First sample at its arrival", 0xfffff000, 500},
+		{"40 ms later", 0xfffff000 + 3600, 540},
+		{"Across the wraparound", 0x14f90, 1500},
+		{"Slightly out of order", 0x14f90 - 900, 1490},
+	}
+	for _, tt := range tests {
+		if got := clock.timestamp(tt.rtpTimestamp, since); got != tt.expected {
+			t.Errorf("%s: timestamp() = %d, expected %d", tt.name, got, tt.expected)
+		}
+	}
+}
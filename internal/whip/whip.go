@@ -0,0 +1,376 @@
+// Package whip ingests live streams from WebRTC encoders over WHIP, the
+// WebRTC-HTTP Ingestion Protocol: an encoder posts an SDP offer and gets back
+// an answer, then sends H.264 video and Opus audio, which sessions turn into
+// FLV tags for the same pipeline as RTMP publishers.
+package whip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+
+	"rtmp-server-poc/internal/flv"
+	"rtmp-server-poc/internal/remux"
+)
+
+var (
+	// ErrInvalidOffer is returned for offers that cannot be answered, such
+	// as offers without H.264 video
+	ErrInvalidOffer = errors.New("whip: invalid SDP offer")
+	// ErrSessionNotFound is returned when closing an unknown session
+	ErrSessionNotFound = errors.New("whip: session not found")
+)
+
+const (
+	// connectTimeout bounds how long a session waits for the encoder to
+	// connect after the answer
+	connectTimeout = 15 * time.Second
+
+	// keyframeInterval is how often sessions ask for a keyframe. Browsers
+	// send few of them, while HLS segments need one each.
+	keyframeInterval = 2 * time.Second
+
+	// videoClockRate and audioClockRate are the RTP clock rates, in Hz
+	videoClockRate = 90000
+	audioClockRate = 48000
+
+	// videoMaxLate and audioMaxLate are how many packets a track waits for
+	// a missing one before giving up on its frame
+	videoMaxLate = 256
+	audioMaxLate = 32
+)
+
+// h264Profiles are the profile-level-id values the sessions accept, the ones
+// browsers and encoders offer. Any level is accepted.
+var h264Profiles = []string{"42e01f", "42001f", "4d001f", "640c1f", "64001f"}
+
+// videoFeedback is the RTCP feedback offered for video: retransmissions and
+// keyframe requests
+var videoFeedback = []webrtc.RTCPFeedback{
+	{Type: webrtc.TypeRTCPFBNACK},
+	{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"},
+	{Type: webrtc.TypeRTCPFBCCM, Parameter: "fir"},
+	{Type: webrtc.TypeRTCPFBGoogREMB},
+}
+
+// Sink receives a session's FLV tag payloads, as a stream.Publisher does.
+// Video and audio are written from their own goroutines.
+type Sink interface {
+	WriteVideo(timestamp uint32, data []byte) error
+	WriteAudio(timestamp uint32, data []byte) error
+	// Close is called once the session has ended
+	Close()
+}
+
+// Manager answers WHIP offers and keeps the sessions until they end
+type Manager struct {
+	api           *webrtc.API
+	configuration webrtc.Configuration
+
+	mutex    sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewManager creates a manager whose peer connections gather candidates
+// with the given STUN and TURN servers
+func NewManager(iceServers []string) (*Manager, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	for i, profile := range h264Profiles {
+		err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeH264,
+				ClockRate:    videoClockRate,
+				SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile,
+				RTCPFeedback: videoFeedback,
+			},
+			PayloadType: webrtc.PayloadType(102 + i),
+		}, webrtc.RTPCodecTypeVideo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   audioClockRate,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return nil, err
+	}
+	// NACKs, RTCP reports and the like
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		api:      webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry)),
+		sessions: make(map[string]*Session),
+	}
+	if len(iceServers) > 0 {
+		m.configuration.ICEServers = []webrtc.ICEServer{{URLs: iceServers}}
+	}
+	return m, nil
+}
+
+// Session receives a live stream from one WebRTC encoder
+type Session struct {
+	// ID identifies the session in its WHIP resource URL
+	ID string
+
+	manager *Manager
+	pc      *webrtc.PeerConnection
+	sink    Sink
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	connected chan struct{} // closed once the encoder is connected
+	closeOnce sync.Once
+
+	// start is the arrival of the first sample, the zero of the timestamps
+	startOnce sync.Once
+	start     time.Time
+}
+
+// newSessionID returns a random session ID
+func newSessionID() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// Offer answers an encoder's SDP offer with a session writing the stream to
+// sink. The session owns the sink and closes it once it ends, or right away
+// when the offer fails. The answer carries every ICE candidate, so the
+// encoder does not need to trickle them.
+func (m *Manager) Offer(ctx context.Context, offer string, sink Sink) (*Session, string, error) {
+	s, err := m.newSession(sink)
+	if err != nil {
+		sink.Close()
+		return nil, "", err
+	}
+	answer, err := s.negotiate(ctx, offer)
+	if err != nil {
+		s.Close()
+		return nil, "", err
+	}
+
+	m.mutex.Lock()
+	m.sessions[s.ID] = s
+	m.mutex.Unlock()
+	go s.run()
+	return s, answer, nil
+}
+
+// newSession creates a peer connection receiving the session's tracks
+func (m *Manager) newSession(sink Sink) (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := m.api.NewPeerConnection(m.configuration)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		ID:        id,
+		manager:   m,
+		pc:        pc,
+		sink:      sink,
+		ctx:       ctx,
+		cancel:    cancel,
+		connected: make(chan struct{}),
+	}
+
+	var connectedOnce sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			connectedOnce.Do(func() { close(s.connected) })
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			s.Close()
+		}
+	})
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		switch track.Kind() {
+		case webrtc.RTPCodecTypeVideo:
+			go s.requestKeyframes(track)
+			s.receiveVideo(track)
+		case webrtc.RTPCodecTypeAudio:
+			s.receiveAudio(track)
+		}
+	})
+	return s, nil
+}
+
+// negotiate applies the offer and returns the answer once every candidate
+// has been gathered. The offer must send H.264 video: the media engine
+// rejects other codecs, so an offer without it has no video to receive.
+func (s *Session) negotiate(ctx context.Context, offer string) (string, error) {
+	err := s.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidOffer, err)
+	}
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidOffer, err)
+	}
+	if !strings.Contains(answer.SDP, "H264/90000") {
+		return "", fmt.Errorf("%w: no H.264 video", ErrInvalidOffer)
+	}
+	gathered := webrtc.GatheringCompletePromise(s.pc)
+	if err := s.pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	return s.pc.LocalDescription().SDP, nil
+}
+
+// run ends the session when the encoder does not connect in time
+func (s *Session) run() {
+	select {
+	case <-s.connected:
+		log.Printf("WHIP session %s connected", s.ID)
+	case <-time.After(connectTimeout):
+		log.Printf("WHIP session %s: encoder did not connect within %v", s.ID, connectTimeout)
+		s.Close()
+	case <-s.ctx.Done():
+	}
+}
+
+// sinceStart returns the milliseconds since the first sample of the session
+func (s *Session) sinceStart() int64 {
+	s.startOnce.Do(func() { s.start = time.Now() })
+	return time.Since(s.start).Milliseconds()
+}
+
+// requestKeyframes asks the encoder for a keyframe right away, as the
+// stream cannot start without one, then every keyframeInterval
+func (s *Session) requestKeyframes(track *webrtc.TrackRemote) {
+	ticker := time.NewTicker(keyframeInterval)
+	defer ticker.Stop()
+	for {
+		pli := &rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}
+		if err := s.pc.WriteRTCP([]rtcp.Packet{pli}); err != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// receiveVideo writes the H.264 access units of a track until it ends
+func (s *Session) receiveVideo(track *webrtc.TrackRemote) {
+	builder := samplebuilder.New(videoMaxLate, &codecs.H264Packet{}, videoClockRate)
+	clock := trackClock{rate: videoClockRate}
+	avc := &remux.AVC{}
+	s.receive(track, builder, func(data []byte, rtpTimestamp uint32) error {
+		// WebRTC H.264 has no B-frames, so no composition time
+		return s.write(avc.Tags(clock.timestamp(rtpTimestamp, s.sinceStart), 0, data))
+	})
+}
+
+// receiveAudio writes the Opus packets of a track until it ends
+func (s *Session) receiveAudio(track *webrtc.TrackRemote) {
+	builder := samplebuilder.New(audioMaxLate, &codecs.OpusPacket{}, audioClockRate)
+	clock := trackClock{rate: audioClockRate}
+	opus := &remux.Opus{Channels: 2}
+	s.receive(track, builder, func(data []byte, rtpTimestamp uint32) error {
+		return s.write(opus.Tags(clock.timestamp(rtpTimestamp, s.sinceStart), data))
+	})
+}
+
+// write hands tags to the sink
+func (s *Session) write(tags []remux.Tag) error {
+	for _, tag := range tags {
+		write := s.sink.WriteAudio
+		if tag.Type == flv.TagTypeVideo {
+			write = s.sink.WriteVideo
+		}
+		if err := write(tag.Timestamp, tag.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receive reads the RTP packets of a track and hands each complete sample to
+// write, ending the session when the track ends or a write fails, as when
+// the stream refuses the publisher or another one takes over
+func (s *Session) receive(track *webrtc.TrackRemote, builder *samplebuilder.SampleBuilder, write func(data []byte, rtpTimestamp uint32) error) {
+	defer s.Close()
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		builder.Push(packet)
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			if err := write(sample.Data, sample.PacketTimestamp); err != nil {
+				log.Printf("WHIP session %s: %v", s.ID, err)
+				return
+			}
+		}
+	}
+}
+
+// Close ends the session and its stream
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.manager.mutex.Lock()
+		if s.manager.sessions[s.ID] == s {
+			delete(s.manager.sessions, s.ID)
+		}
+		s.manager.mutex.Unlock()
+
+		s.pc.Close()
+		s.sink.Close()
+		log.Printf("WHIP session %s closed", s.ID)
+	})
+}
+
+// Close ends a session by ID
+func (m *Manager) Close(id string) error {
+	m.mutex.Lock()
+	s, ok := m.sessions[id]
+	m.mutex.Unlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+	s.Close()
+	return nil
+}
+
+// Count returns the number of sessions
+func (m *Manager) Count() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.sessions)
+}
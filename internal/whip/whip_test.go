@@ -0,0 +1,262 @@
+package whip
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+
+	"rtmp-server-poc/internal/flv"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// annexB joins NAL units with start codes
+func annexB(nalus ...[]byte) []byte {
+	var frame []byte
+	for _, nalu := range nalus {
+		frame = append(append(frame, 0x00, 0x00, 0x00, 0x01), nalu...)
+	}
+	return frame
+}
+
+// fakeSink records the tags of a session, failing writes once fail is set
+type fakeSink struct {
+	mutex  sync.Mutex
+	tags   []flv.Tag
+	fail   error
+	closed chan struct{}
+}
+
+func newFakeSink() *fakeSink {
+	return &fakeSink{closed: make(chan struct{})}
+}
+
+func (f *fakeSink) write(tagType byte, timestamp uint32, data []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.fail != nil {
+		return f.fail
+	}
+	tag, err := flv.ParseTag(tagType, timestamp, data)
+	if err != nil {
+		return err
+	}
+	f.tags = append(f.tags, tag)
+	return nil
+}
+
+func (f *fakeSink) WriteVideo(timestamp uint32, data []byte) error {
+	return f.write(flv.TagTypeVideo, timestamp, data)
+}
+
+func (f *fakeSink) WriteAudio(timestamp uint32, data []byte) error {
+	return f.write(flv.TagTypeAudio, timestamp, data)
+}
+
+func (f *fakeSink) Close() {
+	close(f.closed)
+}
+
+func (f *fakeSink) isClosed() bool {
+	select {
+	case <-f.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// snapshot returns the tags received so far
+func (f *fakeSink) snapshot() []flv.Tag {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]flv.Tag(nil), f.tags...)
+}
+
+// whipClient is a send-only peer connection, as a WHIP encoder creates it
+type whipClient struct {
+	pc    *webrtc.PeerConnection
+	video *webrtc.TrackLocalStaticSample
+	audio *webrtc.TrackLocalStaticSample
+}
+
+// newWHIPClient creates a client and its offer, with every candidate.
+// Without H.264 it only sends audio.
+func newWHIPClient(t *testing.T, h264 bool) (*whipClient, string) {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	c := &whipClient{pc: pc}
+
+	c.audio, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "whip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks := []*webrtc.TrackLocalStaticSample{c.audio}
+	if h264 {
+		c.video, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "whip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracks = append(tracks, c.video)
+	}
+	for _, track := range tracks {
+		init := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}
+		if _, err := pc.AddTransceiverFromTrack(track, init); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return c, pc.LocalDescription().SDP
+}
+
+// send writes 25 fps video with a keyframe every 10 frames and 20 ms Opus
+// packets until done is closed
+func (c *whipClient) send(done <-chan struct{}) {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		c.audio.WriteSample(media.Sample{Data: []byte{0xfc, 0xff, 0xfe}, Duration: 20 * time.Millisecond})
+		if i%2 != 0 {
+			continue
+		}
+		frame := annexB([]byte{0x41, 0x9a, 0x02})
+		if i%20 == 0 {
+			frame = annexB(testSPS, testPPS, append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 3000)...))
+		}
+		c.video.WriteSample(media.Sample{Data: frame, Duration: 40 * time.Millisecond})
+	}
+}
+
+// publish connects a client to a new session and keeps it sending
+func publish(t *testing.T, m *Manager, sink *fakeSink) *Session {
+	t.Helper()
+	client, offer := newWHIPClient(t, true)
+	session, answer, err := m.Offer(t.Context(), offer, sink)
+	if err != nil {
+		t.Fatalf("Offer() error = %v", err)
+	}
+	if err := client.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatalf("SetRemoteDescription() error = %v", err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go client.send(done)
+	return session
+}
+
+// waitFor polls condition for up to 10 seconds
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWHIPSession(t *testing.T) {
+	m, err := NewManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := newFakeSink()
+	session := publish(t, m, sink)
+
+	var video, audio []flv.Tag
+	waitFor(t, "video and audio tags", func() bool {
+		video, audio = nil, nil
+		for _, tag := range sink.snapshot() {
+			if tag.Video != nil {
+				video = append(video, tag)
+			} else if tag.Audio != nil {
+				audio = append(audio, tag)
+			}
+		}
+		return len(video) >= 12 && len(audio) >= 10
+	})
+
+	// A sequence header, then the keyframe it belongs to
+	if !video[0].Video.IsSequenceHeader() || !video[1].IsKeyframe() {
+		t.Errorf("video starts with %+v, %+v, expected a sequence header and a keyframe", video[0].Video, video[1].Video)
+	}
+	for i := 2; i < len(video); i++ {
+		if delta := video[i].Timestamp - video[i-1].Timestamp; !video[i].Video.IsSequenceHeader() && (delta < 20 || delta > 60) {
+			t.Errorf("video tag %d is %d ms after the previous one, expected about 40", i, delta)
+		}
+	}
+	if !audio[0].Audio.IsSequenceHeader() || audio[0].Audio.Codec() != "opus" || audio[1].Audio.IsSequenceHeader() {
+		t.Errorf("audio starts with %+v, %+v, expected an Opus sequence start and a frame", audio[0].Audio, audio[1].Audio)
+	}
+
+	// DELETE on the session URL
+	if err := m.Close(session.ID); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := m.Close(session.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("second Close() error = %v, expected ErrSessionNotFound", err)
+	}
+	if !sink.isClosed() || m.Count() != 0 {
+		t.Error("closing the session did not close its sink")
+	}
+}
+
+func TestWHIPSessionEndsOnWriteError(t *testing.T) {
+	m, err := NewManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := newFakeSink()
+	publish(t, m, sink)
+	waitFor(t, "the first tags", func() bool { return len(sink.snapshot()) > 0 })
+
+	// Another publisher took over the stream
+	sink.mutex.Lock()
+	sink.fail = errors.New("publisher was replaced")
+	sink.mutex.Unlock()
+	waitFor(t, "the session to end", func() bool { return sink.isClosed() && m.Count() == 0 })
+}
+
+func TestWHIPInvalidOffer(t *testing.T) {
+	m, err := NewManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, audioOnly := newWHIPClient(t, false)
+	for name, offer := range map[string]string{"Malformed": "v=0\r\n", "Without video": audioOnly} {
+		sink := newFakeSink()
+		if _, _, err := m.Offer(t.Context(), offer, sink); !errors.Is(err, ErrInvalidOffer) {
+			t.Errorf("%s: Offer() error = %v, expected ErrInvalidOffer", name, err)
+		}
+		if !sink.isClosed() || m.Count() != 0 {
+			t.Errorf("%s: a failed offer did not close its sink", name)
+		}
+	}
+}